@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The account pages let LFS users manage their own account: change their
+// password, create and revoke access tokens, release their locks and see the
+// storage charged to them. Every handler only touches the data of the user
+// logged in.
+
+// roleUser is the role of every stored user in the account area.
+const roleUser = "user"
+
+// minPasswordLength is the shortest password users may choose for themselves.
+const minPasswordLength = 8
+
+// newAccountArea returns the account pages, used by LFS users with their
+// password. Access tokens can't be used to log in.
+func newAccountArea(a *App) *sessionArea {
+	return &sessionArea{
+		app:     a,
+		name:    "account",
+		cookie:  "lfs_account_session",
+		enabled: func() bool { return true },
+		authenticate: func(user, pass string) (string, error) {
+			if user == "" || !a.metaStore.CheckPassword(user, pass) {
+				return "", nil
+			}
+			return roleUser, nil
+		},
+		role: func(user string) (string, error) {
+			exists, err := a.metaStore.UserExists(user)
+			if err != nil || !exists {
+				return "", err
+			}
+			return roleUser, nil
+		},
+	}
+}
+
+func (a *App) addAccount(r *mux.Router) {
+	r.HandleFunc("/account/login", a.account.loginForm).Methods("GET")
+	r.HandleFunc("/account/login", a.auditMgmt("account.login", a.account.login)).Methods("POST")
+	r.HandleFunc("/account/logout", a.account.require("", a.auditMgmt("account.logout", a.account.logout))).Methods("POST")
+	r.HandleFunc("/account", a.account.require("", a.accountHandler)).Methods("GET")
+	r.HandleFunc("/account/password", a.account.require("", a.auditMgmt("user.password", a.changePasswordHandler))).Methods("POST")
+	r.HandleFunc("/account/tokens", a.account.require("", a.auditMgmt("token.create", a.createTokenHandler))).Methods("POST")
+	r.HandleFunc("/account/tokens/revoke", a.account.require("", a.auditMgmt("token.revoke", a.revokeTokenHandler))).Methods("POST")
+	r.HandleFunc("/account/unlock", a.account.require("", a.auditMgmt("lock.unlock", a.accountUnlockHandler))).Methods("POST")
+}
+
+// renderAccount shows the account page of the user logged in, along with
+// what data already holds.
+func (a *App) renderAccount(w http.ResponseWriter, r *http.Request, data pageData) {
+	user := requestUser(r)
+	data.Name, data.Area = "account", "account"
+
+	var err error
+	if data.Usage, err = a.metaStore.Usage(quotaUser, user); err != nil {
+		fmt.Fprintf(w, "Error retrieving usage: %s", err)
+		return
+	}
+	if data.Locks, err = a.metaStore.SelectLocks(LockSelection{Owner: user}); err != nil {
+		fmt.Fprintf(w, "Error retrieving locks: %s", err)
+		return
+	}
+	if data.Tokens, err = a.metaStore.Tokens(user); err != nil {
+		fmt.Fprintf(w, "Error retrieving tokens: %s", err)
+		return
+	}
+
+	if err := render(w, r, "account.tmpl", data); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) accountHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderAccount(w, r, pageData{})
+}
+
+// changePasswordHandler sets the password of the user logged in, who must
+// confirm their current one, and ends their other sessions.
+func (a *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	pass := r.PostFormValue("password")
+	auditEntry(r).Target = user
+
+	if !a.metaStore.CheckPassword(user, r.PostFormValue("current")) {
+		mgmtError(w, r, "The current password is wrong")
+		return
+	}
+	if len(pass) < minPasswordLength {
+		mgmtError(w, r, "The new password must be at least %d characters long", minPasswordLength)
+		return
+	}
+	if pass != r.PostFormValue("confirm") {
+		mgmtError(w, r, "The new passwords don't match")
+		return
+	}
+
+	if err := a.metaStore.AddUser(user, pass); err != nil {
+		mgmtError(w, r, "Error setting password: %s", err)
+		return
+	}
+
+	now := time.Now()
+	for _, area := range []*sessionArea{a.account, a.mgmt} {
+		if err := a.metaStore.EndSessions(area.name, user, now); err != nil {
+			mgmtError(w, r, "Error ending sessions: %s", err)
+			return
+		}
+	}
+	if err := a.account.set(w, newSession(a.account.name, user)); err != nil {
+		mgmtError(w, r, "Error starting session: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/account", 302)
+}
+
+// createTokenHandler creates an access token for the user logged in and shows
+// it, the only time it can be seen.
+func (a *App) createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	name := r.PostFormValue("name")
+	e := auditEntry(r)
+	e.Target = user
+	if name == "" {
+		mgmtError(w, r, "Invalid token name")
+		return
+	}
+
+	t, token, err := a.metaStore.CreateToken(user, name)
+	if err != nil {
+		mgmtError(w, r, "Error creating token: %s", err)
+		return
+	}
+	e.Target = user + " " + t.Id
+
+	// The page is shown rather than redirected to, so the token doesn't
+	// end up in the browser's history.
+	e.Outcome = auditSuccess
+	a.renderAccount(w, r, pageData{NewToken: token})
+}
+
+func (a *App) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	id := r.PostFormValue("id")
+	auditEntry(r).Target = user + " " + id
+
+	if err := a.metaStore.RevokeToken(user, id); err != nil {
+		mgmtError(w, r, "Error revoking token: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/account", 302)
+}
+
+// accountUnlockHandler releases a lock of the user logged in.
+func (a *App) accountUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	repo, id := r.PostFormValue("repo"), r.PostFormValue("id")
+	e := auditEntry(r)
+	e.Repo, e.LockId = repo, id
+
+	l, err := a.metaStore.DeleteLock(repo, user, id, false)
+	if err != nil {
+		mgmtError(w, r, "Error releasing lock: %s", err)
+		return
+	}
+	if l == nil {
+		mgmtError(w, r, "%s", errLockNotFound)
+		return
+	}
+	e.Path = l.Path
+
+	a.publish(&Event{Type: eventLockReleased, Repo: repo, User: user, Lock: l})
+
+	http.Redirect(w, r, "/account", 302)
+}
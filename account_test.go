@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccount(t *testing.T) {
+	const user, pass = "pippin", "second-breakfast"
+	if err := testMetaStore.AddUser(user, pass); err != nil {
+		t.Fatal(err)
+	}
+	defer testMetaStore.DeleteUser(user)
+
+	get := func(cookie *http.Cookie) (int, string) {
+		res := mgmtDo(t, "GET", "/account", nil, cookie)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	post := func(path string, form url.Values, cookie *http.Cookie) (int, string) {
+		res := mgmtDo(t, "POST", path, form, cookie)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	res := mgmtDo(t, "GET", "/account", nil)
+	res.Body.Close()
+	if loc := res.Header.Get("Location"); res.StatusCode != 302 || loc != "/account/login?next=%2Faccount" {
+		t.Fatalf("expected a redirect to the login form, got %d %q", res.StatusCode, loc)
+	}
+
+	cookie, token := sessionLogin(t, lfsApp.account, user, pass)
+
+	mgmtSession := newSession("mgmt", user)
+	rec := httptest.NewRecorder()
+	if err := lfsApp.mgmt.set(rec, mgmtSession); err != nil {
+		t.Fatal(err)
+	}
+	replayed := &http.Cookie{Name: lfsApp.account.cookie, Value: rec.Result().Cookies()[0].Value}
+	if status, _ := get(replayed); status != 302 {
+		t.Errorf("expected a session of another area to be refused, got %d", status)
+	}
+
+	now := time.Now()
+	mine := Lock{Id: "account-mine", Path: "account/mine.psd", Owner: User{Name: user}, LockedAt: now}
+	theirs := Lock{Id: "account-theirs", Path: "account/theirs.psd", Owner: User{Name: testUser}, LockedAt: now}
+	if err := testMetaStore.AddLocks(testRepo, mine, theirs); err != nil {
+		t.Fatal(err)
+	}
+	defer testMetaStore.DeleteLock(testRepo, testUser, theirs.Id, true)
+
+	status, body := get(cookie)
+	if status != 200 || !strings.Contains(body, mine.Path) || strings.Contains(body, theirs.Path) {
+		t.Fatalf("expected the page to only show the user's locks, got %d", status)
+	}
+
+	if status, _ := post("/account/unlock", url.Values{csrfField: {token}, "repo": {testRepo}, "id": {theirs.Id}}, cookie); status == 302 {
+		t.Errorf("expected another user's lock not to be released")
+	}
+	if status, body := post("/account/unlock", url.Values{csrfField: {token}, "repo": {testRepo}, "id": {mine.Id}}, cookie); status != 302 {
+		t.Fatalf("expected the lock to be released, got %d: %s", status, body)
+	}
+	locks, _ := testMetaStore.SelectLocks(LockSelection{Repo: testRepo, Path: "account/"})
+	if len(locks) != 1 || locks[0].Lock.Id != theirs.Id {
+		t.Fatalf("expected only the other user's lock to be left, got %v", locks)
+	}
+
+	status, body = post("/account/tokens", url.Values{csrfField: {token}, "name": {"laptop"}}, cookie)
+	secret := tokenInPage.FindString(body)
+	if status != 200 || secret == "" {
+		t.Fatalf("expected the new token to be shown, got %d", status)
+	}
+	if _, ok := testMetaStore.Authenticate(user, secret); !ok {
+		t.Errorf("expected the token to authenticate the user")
+	}
+	if _, ok := testMetaStore.Authenticate(testUser, secret); ok {
+		t.Errorf("expected the token to only authenticate its user")
+	}
+	res = mgmtDo(t, "POST", "/account/login", url.Values{"user": {user}, "password": {secret}})
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected tokens not to log in to the account pages, got %d", res.StatusCode)
+	}
+
+	tokens, _ := testMetaStore.Tokens(user)
+	if len(tokens) != 1 || tokens[0].Name != "laptop" || tokens[0].LastUsed.IsZero() {
+		t.Fatalf("expected the token to be listed with its last use, got %v", tokens)
+	}
+	if status, _ := post("/account/tokens/revoke", url.Values{csrfField: {token}, "id": {tokens[0].Id}}, cookie); status != 302 {
+		t.Fatalf("expected the token to be revoked, got %d", status)
+	}
+	if _, ok := testMetaStore.Authenticate(user, secret); ok {
+		t.Errorf("expected a revoked token not to authenticate")
+	}
+
+	for _, form := range []url.Values{
+		{"current": {"wrong"}, "password": {"elevenses!"}, "confirm": {"elevenses!"}},
+		{"current": {pass}, "password": {"short"}, "confirm": {"short"}},
+		{"current": {pass}, "password": {"elevenses!"}, "confirm": {"elevensies"}},
+	} {
+		form.Set(csrfField, token)
+		if status, _ := post("/account/password", form, cookie); status == 302 {
+			t.Errorf("expected the password not to change with %v", form)
+		}
+	}
+
+	res = mgmtDo(t, "POST", "/account/password", url.Values{csrfField: {token}, "current": {pass}, "password": {"elevenses!"}, "confirm": {"elevenses!"}}, cookie)
+	res.Body.Close()
+	if res.StatusCode != 302 || len(res.Cookies()) != 1 {
+		t.Fatalf("expected the password to change, got %d", res.StatusCode)
+	}
+	if !testMetaStore.CheckPassword(user, "elevenses!") {
+		t.Errorf("expected the new password to be set")
+	}
+	if status, _ := get(cookie); status != 302 {
+		t.Errorf("expected other sessions to end when the password changes, got %d", status)
+	}
+	if status, _ := get(res.Cookies()[0]); status != 200 {
+		t.Errorf("expected the session changing the password to go on, got %d", status)
+	}
+}
+
+var tokenInPage = regexp.MustCompile(tokenPrefix + `[0-9a-f]+`)
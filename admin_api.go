@@ -0,0 +1,836 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The admin API is a JSON mirror of the mgmt interface for automation. It is
+// authenticated with basic auth as an administrator, each route requiring a
+// role like in mgmt, and described by the OpenAPI document served at
+// adminAPIPrefix + "/openapi.json".
+const adminAPIPrefix = "/api/admin/v1"
+
+const (
+	// adminPageSize is the default number of items in a page of a listing.
+	adminPageSize = 100
+	// adminMaxPageSize is the largest page a listing returns.
+	adminMaxPageSize = 1000
+)
+
+// AdminRepo summarizes a repository: its settings, the storage accounted to
+// it and its locks.
+type AdminRepo struct {
+	*Repository
+	Objects    int64       `json:"objects"`
+	Bytes      int64       `json:"bytes"`
+	Quota      int64       `json:"quota"`
+	Locks      int         `json:"locks"`
+	LockPolicy *LockPolicy `json:"lock_policy,omitempty"`
+}
+
+// AdminObject is an object with its storage and retention state.
+type AdminObject struct {
+	*MetaObject
+	Stored bool `json:"stored"`
+	Pin    *Pin `json:"pin,omitempty"`
+}
+
+// AdminUserRequest creates a user or sets the password of an existing one.
+type AdminUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// AdminRoleRequest sets the role of a user. An empty role takes it away.
+type AdminRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// AdminRepoRequest creates a repository or sets its visibility and transfer
+// adapters. The name and owner are only read when creating.
+type AdminRepoRequest struct {
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Visibility string   `json:"visibility"`
+	Transfers  []string `json:"transfers"`
+}
+
+// AdminRenameRequest renames a repository.
+type AdminRenameRequest struct {
+	Name string `json:"name"`
+}
+
+// AdminArchiveRequest archives or restores a repository.
+type AdminArchiveRequest struct {
+	Archived bool `json:"archived"`
+}
+
+// AdminGrantRequest grants a user access to a private repository.
+type AdminGrantRequest struct {
+	Access string `json:"access"`
+}
+
+// AdminQuotaRequest overrides a quota. A null quota removes the override.
+type AdminQuotaRequest struct {
+	Quota *int64 `json:"quota"`
+}
+
+func (a *App) addAdminAPI(r *mux.Router) {
+	s := r.PathPrefix(adminAPIPrefix).Subrouter()
+
+	s.HandleFunc("/openapi.json", a.adminAuth(roleAuditor, openAPIHandler)).Methods("GET")
+	s.HandleFunc("/config", a.adminAuth(roleAuditor, adminConfigHandler)).Methods("GET")
+	s.HandleFunc("/stats", a.adminAuth(roleAuditor, a.adminStatsHandler)).Methods("GET")
+
+	s.HandleFunc("/users", a.adminAuth(roleAuditor, a.adminUsersHandler)).Methods("GET")
+	s.HandleFunc("/users", a.adminAuth(roleUserManager, a.auditAPI("user.add", a.adminCreateUserHandler))).Methods("POST")
+	s.HandleFunc("/users/{name}", a.adminAuth(roleAuditor, a.adminUserHandler)).Methods("GET")
+	s.HandleFunc("/users/{name}", a.adminAuth(roleUserManager, a.auditAPI("user.password", a.adminSetPasswordHandler))).Methods("PUT")
+	s.HandleFunc("/users/{name}", a.adminAuth(roleUserManager, a.auditAPI("user.delete", a.adminDeleteUserHandler))).Methods("DELETE")
+	s.HandleFunc("/users/{name}/role", a.adminAuth(roleAdmin, a.auditAPI("user.role", a.adminSetRoleHandler))).Methods("PUT")
+
+	s.HandleFunc("/repos", a.adminAuth(roleAuditor, a.adminReposHandler)).Methods("GET")
+	s.HandleFunc("/repos", a.adminAuth(roleAdmin, a.auditAPI("repo.create", a.adminCreateRepoHandler))).Methods("POST")
+	s.HandleFunc("/repos/{repo}", a.adminAuth(roleAuditor, a.adminRepoHandler)).Methods("GET")
+	s.HandleFunc("/repos/{repo}", a.adminAuth(roleAdmin, a.auditAPI("repo.update", a.adminUpdateRepoHandler))).Methods("PUT")
+	s.HandleFunc("/repos/{repo}", a.adminAuth(roleAdmin, a.auditAPI("repo.delete", a.adminDeleteRepoHandler))).Methods("DELETE")
+	s.HandleFunc("/repos/{repo}/rename", a.adminAuth(roleAdmin, a.auditAPI("repo.rename", a.adminRenameRepoHandler))).Methods("POST")
+	s.HandleFunc("/repos/{repo}/archived", a.adminAuth(roleAdmin, a.auditAPI("repo.archive", a.adminArchiveRepoHandler))).Methods("PUT")
+	s.HandleFunc("/repos/{repo}/grants/{name}", a.adminAuth(roleAdmin, a.auditAPI("repo.grant", a.adminGrantHandler))).Methods("PUT")
+	s.HandleFunc("/repos/{repo}/grants/{name}", a.adminAuth(roleAdmin, a.auditAPI("repo.revoke", a.adminRevokeHandler))).Methods("DELETE")
+	s.HandleFunc("/repos/{repo}/quota", a.adminAuth(roleAdmin, a.auditAPI("quota.set", a.adminSetRepoQuotaHandler))).Methods("PUT")
+	s.HandleFunc("/repos/{repo}/lockpolicy", a.adminAuth(roleAdmin, a.auditAPI("lockpolicy.set", a.adminSetLockPolicyHandler))).Methods("PUT")
+	s.HandleFunc("/repos/{repo}/lockpolicy", a.adminAuth(roleAdmin, a.auditAPI("lockpolicy.delete", a.adminDeleteLockPolicyHandler))).Methods("DELETE")
+	s.HandleFunc("/repos/{repo}/locks", a.adminAuth(roleAuditor, a.adminRepoLocksHandler)).Methods("GET")
+	s.HandleFunc("/repos/{repo}/locks/{id}", a.adminAuth(roleAdmin, a.auditAPI("lock.force_unlock", a.adminUnlockHandler))).Methods("DELETE")
+
+	s.HandleFunc("/objects", a.adminAuth(roleAuditor, a.adminObjectsHandler)).Methods("GET")
+	s.HandleFunc("/objects/{oid}", a.adminAuth(roleAuditor, a.adminObjectHandler)).Methods("GET")
+	s.HandleFunc("/objects/{oid}", a.adminAuth(roleAdmin, a.auditAPI("object.delete", a.adminDeleteObjectHandler))).Methods("DELETE")
+
+	s.HandleFunc("/locks", a.adminAuth(roleAuditor, a.adminLocksHandler)).Methods("GET")
+	s.HandleFunc("/locks", a.adminAuth(roleAdmin, a.auditAPI("lock.bulk_release", a.adminReleaseLocksHandler))).Methods("DELETE")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError answers with message, which is also kept as the detail of
+// the request's audit entry.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	auditEntry(r).Detail = message
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+// pageLimit returns the limit query parameter of a listing.
+func pageLimit(r *http.Request) (int, error) {
+	l := r.FormValue("limit")
+	if l == "" {
+		return adminPageSize, nil
+	}
+
+	n, err := strconv.Atoi(l)
+	if err != nil || n < 1 || n > adminMaxPageSize {
+		return 0, fmt.Errorf("Invalid limit %q: must be between 1 and %d", l, adminMaxPageSize)
+	}
+	return n, nil
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := embedded.ReadFile("mgmt/openapi.json")
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+// adminStatsHandler returns the dashboard, with the traffic of the window in
+// the query.
+func (a *App) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := a.dashboard(r.FormValue("window"))
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, d)
+}
+
+// adminConfigHandler returns the server's version and settings, keyed by
+// their environment variables. The admin password is left out.
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	settings := make(map[string]string)
+
+	te := reflect.TypeOf(Config).Elem()
+	ve := reflect.ValueOf(Config).Elem()
+	for i := 0; i < te.NumField(); i++ {
+		name := te.Field(i).Name
+		if name == "AdminPass" {
+			continue
+		}
+		settings[strings.ToUpper(keyPrefix+"_"+name)] = ve.Field(i).String()
+	}
+
+	writeJSON(w, 200, map[string]interface{}{"version": version, "settings": settings})
+}
+
+func (a *App) adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if users == nil {
+		users = []*MetaUser{}
+	}
+
+	writeJSON(w, 200, users)
+}
+
+func (a *App) adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	exists, err := a.metaStore.UserExists(name)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if !exists {
+		writeJSONError(w, r, 404, errUserNotFound.Error())
+		return
+	}
+
+	role, err := a.metaStore.Role(name)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, &MetaUser{Name: name, Role: role})
+}
+
+func (a *App) adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	auditEntry(r).Target = req.Name
+	if req.Name == "" || req.Password == "" {
+		writeJSONError(w, r, 422, "Invalid username or password")
+		return
+	}
+
+	exists, err := a.metaStore.UserExists(req.Name)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if exists {
+		writeJSONError(w, r, 409, errUserExists.Error())
+		return
+	}
+
+	if err := a.metaStore.AddUser(req.Name, req.Password); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 201, &MetaUser{Name: req.Name})
+}
+
+func (a *App) adminSetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	auditEntry(r).Target = name
+
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	if req.Password == "" {
+		writeJSONError(w, r, 422, "Invalid password")
+		return
+	}
+	exists, err := a.metaStore.UserExists(name)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if !exists {
+		writeJSONError(w, r, 404, errUserNotFound.Error())
+		return
+	}
+	if err := a.canChangeUser(r, name); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	if err := a.metaStore.AddUser(name, req.Password); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	// Whoever knew the old password may have started sessions or created
+	// tokens with it.
+	if err := a.metaStore.RevokeTokens(name); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	now := time.Now()
+	for _, area := range []*sessionArea{a.account, a.mgmt} {
+		if err := a.metaStore.EndSessions(area.name, name, now); err != nil {
+			writeJSONError(w, r, 500, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, 200, &MetaUser{Name: name})
+}
+
+func (a *App) adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	auditEntry(r).Target = name
+
+	exists, err := a.metaStore.UserExists(name)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if !exists {
+		writeJSONError(w, r, 404, errUserNotFound.Error())
+		return
+	}
+	if err := a.canChangeUser(r, name); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	if err := a.metaStore.DeleteUser(name); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (a *App) adminSetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	auditEntry(r).Target = name
+
+	var req AdminRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	if err := a.metaStore.SetRole(name, req.Role); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	writeJSON(w, 200, &MetaUser{Name: name, Role: req.Role})
+}
+
+// writeUserError responds with the status matching an error changing a user.
+func writeUserError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errUserNotFound:
+		writeJSONError(w, r, 404, err.Error())
+	case errInvalidRole:
+		writeJSONError(w, r, 422, err.Error())
+	case errAdminTarget:
+		writeJSONError(w, r, 403, err.Error())
+	case errLastAdmin, errNoAdmins:
+		writeJSONError(w, r, 409, err.Error())
+	default:
+		writeJSONError(w, r, 500, err.Error())
+	}
+}
+
+// adminRepos returns every registered repository, sorted by name.
+func (a *App) adminRepos() ([]*AdminRepo, error) {
+	registered, err := a.metaStore.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	usages, err := a.metaStore.Usages(quotaRepo)
+	if err != nil {
+		return nil, err
+	}
+	usageOf := make(map[string]*Usage, len(usages))
+	for _, u := range usages {
+		usageOf[u.Name] = u
+	}
+
+	locks, err := a.metaStore.AllLocks()
+	if err != nil {
+		return nil, err
+	}
+	lockCounts := make(map[string]int)
+	for _, l := range locks {
+		lockCounts[l.Repo]++
+	}
+
+	policies, err := a.metaStore.LockPolicies()
+	if err != nil {
+		return nil, err
+	}
+	policyOf := make(map[string]*LockPolicy, len(policies))
+	for _, p := range policies {
+		policyOf[p.Repo] = p
+	}
+
+	repos := make([]*AdminRepo, 0, len(registered))
+	for _, r := range registered {
+		repo := &AdminRepo{Repository: r, Quota: defaultQuota(quotaRepo), Locks: lockCounts[r.Name], LockPolicy: policyOf[r.Name]}
+		if u := usageOf[r.Name]; u != nil {
+			repo.Objects, repo.Bytes, repo.Quota = u.Objects, u.Bytes, u.Quota
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// adminRepo returns the summary of the repository name, or errRepoNotFound.
+func (a *App) adminRepo(name string) (*AdminRepo, error) {
+	r, err := a.metaStore.Repository(name)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &AdminRepo{Repository: r}
+	usage, err := a.metaStore.Usage(quotaRepo, name)
+	if err != nil {
+		return nil, err
+	}
+	repo.Objects, repo.Bytes, repo.Quota = usage.Objects, usage.Bytes, usage.Quota
+
+	locks, err := a.metaStore.SelectLocks(LockSelection{Repo: name})
+	if err != nil {
+		return nil, err
+	}
+	repo.Locks = len(locks)
+
+	if repo.LockPolicy, err = a.metaStore.LockPolicy(name); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// writeRepoError responds with the status matching an error changing a
+// repository.
+func writeRepoError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errRepoNotFound:
+		writeJSONError(w, r, 404, err.Error())
+	case errRepoExists, errRepoNotEmpty:
+		writeJSONError(w, r, 409, err.Error())
+	case errUserNotFound:
+		writeJSONError(w, r, 422, err.Error())
+	default:
+		writeJSONError(w, r, 500, err.Error())
+	}
+}
+
+// writeAdminRepo responds with the summary of the repository name.
+func (a *App) writeAdminRepo(w http.ResponseWriter, r *http.Request, status int, name string) {
+	repo, err := a.adminRepo(name)
+	if err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	writeJSON(w, status, repo)
+}
+
+func (a *App) adminReposHandler(w http.ResponseWriter, r *http.Request) {
+	repos, err := a.adminRepos()
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, repos)
+}
+
+func (a *App) adminRepoHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeAdminRepo(w, r, 200, mux.Vars(r)["repo"])
+}
+
+func (a *App) adminCreateRepoHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminRepoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	auditEntry(r).Repo = req.Name
+
+	repo := &Repository{Name: req.Name, Owner: req.Owner, Visibility: req.Visibility, Transfers: req.Transfers, CreatedBy: requestUser(r)}
+	if repo.Visibility == "" {
+		repo.Visibility = defaultVisibility()
+	}
+	if err := repo.validate(); err != nil {
+		writeJSONError(w, r, 422, err.Error())
+		return
+	}
+
+	if err := a.metaStore.CreateRepository(repo); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 201, repo.Name)
+}
+
+func (a *App) adminUpdateRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["repo"]
+	auditEntry(r).Repo = name
+
+	var req AdminRepoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	settings := &Repository{Name: name, Visibility: req.Visibility, Transfers: req.Transfers}
+	if err := settings.validate(); err != nil {
+		writeJSONError(w, r, 422, err.Error())
+		return
+	}
+
+	if _, err := a.metaStore.UpdateRepository(name, req.Visibility, req.Transfers); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, name)
+}
+
+func (a *App) adminRenameRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["repo"]
+	audit := auditEntry(r)
+	audit.Repo = name
+
+	var req AdminRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	audit.Target = req.Name
+	if err := validRepoName(req.Name); err != nil {
+		writeJSONError(w, r, 422, err.Error())
+		return
+	}
+
+	if _, err := a.metaStore.RenameRepository(name, req.Name); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, req.Name)
+}
+
+func (a *App) adminArchiveRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["repo"]
+	auditEntry(r).Repo = name
+
+	var req AdminArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	if _, err := a.metaStore.ArchiveRepository(name, req.Archived); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, name)
+}
+
+func (a *App) adminDeleteRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["repo"]
+	auditEntry(r).Repo = name
+
+	if err := a.metaStore.DeleteRepository(name); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (a *App) adminGrantHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = vars["repo"], vars["name"]
+
+	var req AdminGrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	if !contains(grantAccesses, req.Access) {
+		writeJSONError(w, r, 422, fmt.Sprintf("Invalid access: %q", req.Access))
+		return
+	}
+
+	if _, err := a.metaStore.GrantRepository(vars["repo"], vars["name"], req.Access); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, vars["repo"])
+}
+
+func (a *App) adminRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = vars["repo"], vars["name"]
+
+	if _, err := a.metaStore.GrantRepository(vars["repo"], vars["name"], ""); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, vars["repo"])
+}
+
+func (a *App) adminSetRepoQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	repo := mux.Vars(r)["repo"]
+	auditEntry(r).Target = quotaRepo + " " + repo
+
+	var req AdminQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	limit := int64(-1)
+	if req.Quota != nil {
+		if *req.Quota < 0 {
+			writeJSONError(w, r, 422, "Invalid quota")
+			return
+		}
+		limit = *req.Quota
+	}
+
+	if _, err := a.metaStore.Repository(repo); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+	if err := a.metaStore.SetQuota(quotaRepo, repo, limit); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, repo)
+}
+
+func (a *App) adminSetLockPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	repo := mux.Vars(r)["repo"]
+	auditEntry(r).Repo = repo
+
+	var policy LockPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	policy.Repo = repo
+	if err := policy.validate(); err != nil {
+		writeJSONError(w, r, 422, err.Error())
+		return
+	}
+
+	if _, err := a.metaStore.Repository(repo); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+	if err := a.metaStore.SetLockPolicy(&policy); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, repo)
+}
+
+func (a *App) adminDeleteLockPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	repo := mux.Vars(r)["repo"]
+	auditEntry(r).Repo = repo
+
+	if _, err := a.metaStore.Repository(repo); err != nil {
+		writeRepoError(w, r, err)
+		return
+	}
+	if err := a.metaStore.DeleteLockPolicy(repo); err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	a.writeAdminRepo(w, r, 200, repo)
+}
+
+func (a *App) adminRepoLocksHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	locks, next, err := a.metaStore.ListLocks(mux.Vars(r)["repo"], LockFilter{
+		Id:     r.FormValue("id"),
+		Path:   r.FormValue("path"),
+		Owner:  r.FormValue("owner"),
+		Ref:    r.FormValue("refspec"),
+		Cursor: r.FormValue("cursor"),
+		Limit:  limit,
+	})
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	if locks == nil {
+		locks = []Lock{}
+	}
+
+	writeJSON(w, 200, &LockList{Locks: locks, NextCursor: next})
+}
+
+func (a *App) adminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user, _, _ := r.BasicAuth()
+
+	l, err := a.adminUnlock(vars["repo"], user, vars["id"])
+	if err == errLockNotFound {
+		writeJSONError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	audit := auditEntry(r)
+	audit.Path, audit.Target = l.Path, l.Owner.Name
+
+	writeJSON(w, 200, &UnlockResponse{Lock: l})
+}
+
+func (a *App) adminLocksHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := lockSelection(r)
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	locks, err := a.metaStore.SelectLocks(f)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, locks)
+}
+
+// adminReleaseLocksHandler force unlocks every lock matching the query, which
+// must select some.
+func (a *App) adminReleaseLocksHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := lockSelection(r)
+	if err == nil && f.Empty() {
+		err = errEmptyLockSelection
+	}
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	audit := auditEntry(r)
+	audit.Repo, audit.Path, audit.Target = f.Repo, f.Path, f.Owner
+
+	user, _, _ := r.BasicAuth()
+	released, err := a.releaseLocks(r, user, f)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, map[string][]RepoLock{"locks": released})
+}
+
+func (a *App) adminObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	f, err := objectFilter(r)
+	if err != nil {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+
+	objects, next, err := a.metaStore.ObjectPage(f, r.FormValue("cursor"), limit)
+	if err == errInvalidCursor {
+		writeJSONError(w, r, 400, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+	if objects == nil {
+		objects = []*MetaObject{}
+	}
+
+	writeJSON(w, 200, map[string]interface{}{"objects": objects, "next_cursor": next})
+}
+
+func (a *App) adminObjectHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: mux.Vars(r)["oid"]})
+	if err == errObjectNotFound {
+		writeJSONError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	pin, err := a.metaStore.PinOf(meta.Oid)
+	if err != nil {
+		writeJSONError(w, r, 500, err.Error())
+		return
+	}
+
+	writeJSON(w, 200, &AdminObject{MetaObject: meta, Stored: a.contentStore.Exists(meta), Pin: pin})
+}
+
+func (a *App) adminDeleteObjectHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := a.deleteObject(mux.Vars(r)["oid"])
+	switch err {
+	case nil:
+		w.WriteHeader(204)
+	case errObjectNotFound:
+		writeJSONError(w, r, 404, err.Error())
+	case errLegalHold:
+		writeJSONError(w, r, 409, err.Error())
+	default:
+		writeJSONError(w, r, 500, err.Error())
+	}
+}
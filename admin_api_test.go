@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+const (
+	testAdminUser = "admin"
+	testAdminPass = "admin"
+)
+
+// adminAPI calls the admin API with the admin credentials enabled.
+func adminAPI(t *testing.T, method, path, body string, v interface{}) int {
+	t.Helper()
+
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	res, err := api(method, adminAPIPrefix+path, "application/json", testAdminUser, testAdminPass, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	defer res.Body.Close()
+
+	if v != nil && res.StatusCode < 300 {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("expected a JSON response to %s %s, got: %s", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	res, err := api("GET", adminAPIPrefix+"/users", "application/json", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Errorf("expected status 404 without admin credentials configured, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminAPIUsers(t *testing.T) {
+	var user MetaUser
+	if status := adminAPI(t, "POST", "/users", `{"name":"frodo","password":"ring"}`, &user); status != 201 || user.Name != "frodo" {
+		t.Fatalf("expected frodo to be created, got status %d and %+v", status, user)
+	}
+	if status := adminAPI(t, "POST", "/users", `{"name":"frodo","password":"ring"}`, nil); status != 409 {
+		t.Errorf("expected status 409 for an existing user, got %d", status)
+	}
+	if status := adminAPI(t, "POST", "/users", `{"name":"sam"}`, nil); status != 422 {
+		t.Errorf("expected status 422 without a password, got %d", status)
+	}
+
+	var users []MetaUser
+	adminAPI(t, "GET", "/users", "", &users)
+	found := false
+	for _, u := range users {
+		found = found || u.Name == "frodo"
+	}
+	if !found {
+		t.Errorf("expected frodo in the user list, got %+v", users)
+	}
+
+	_, token, err := testMetaStore.CreateToken("frodo", "laptop")
+	if err != nil {
+		t.Fatalf("expected CreateToken to succeed, got: %s", err)
+	}
+	if status := adminAPI(t, "PUT", "/users/frodo", `{"password":"mithril"}`, nil); status != 200 {
+		t.Fatalf("expected the password to be set, got %d", status)
+	}
+	if _, ok := testMetaStore.Authenticate("frodo", token); ok {
+		t.Error("expected the password change to revoke frodo's tokens")
+	}
+	if _, ok := testMetaStore.Authenticate("frodo", "mithril"); !ok {
+		t.Error("expected frodo to log in with the new password")
+	}
+	if status := adminAPI(t, "PUT", "/users/gollum", `{"password":"precious"}`, nil); status != 404 {
+		t.Errorf("expected status 404 for an unknown user, got %d", status)
+	}
+	if exists, _ := testMetaStore.UserExists("gollum"); exists {
+		t.Error("expected setting a password not to create a user")
+	}
+
+	if status := adminAPI(t, "DELETE", "/users/frodo", "", nil); status != 204 {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if status := adminAPI(t, "GET", "/users/frodo", "", nil); status != 404 {
+		t.Errorf("expected status 404 for a deleted user, got %d", status)
+	}
+}
+
+func TestAdminAPIObjects(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		if _, err := testMetaStore.Put(&RequestVars{Oid: fmt.Sprintf("adminpage%d", i), Size: 1}); err != nil {
+			t.Fatalf("expected Put to succeed, got: %s", err)
+		}
+	}
+
+	var page struct {
+		Objects    []*MetaObject `json:"objects"`
+		NextCursor string        `json:"next_cursor"`
+	}
+	if status := adminAPI(t, "GET", "/objects?prefix=adminpage&limit=2", "", &page); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if len(page.Objects) != 2 || page.Objects[0].Oid != "adminpage0" || page.NextCursor == "" {
+		t.Fatalf("expected the first two objects and a cursor, got %d objects and cursor %q", len(page.Objects), page.NextCursor)
+	}
+
+	adminAPI(t, "GET", "/objects?prefix=adminpage&limit=2&cursor="+page.NextCursor, "", &page)
+	if len(page.Objects) != 1 || page.Objects[0].Oid != "adminpage2" || page.NextCursor != "" {
+		t.Errorf("expected the last object and no cursor, got %d objects and cursor %q", len(page.Objects), page.NextCursor)
+	}
+
+	if status := adminAPI(t, "GET", "/objects?limit=0", "", nil); status != 400 {
+		t.Errorf("expected status 400 for an invalid limit, got %d", status)
+	}
+}
+
+func TestAdminAPIObjectDelete(t *testing.T) {
+	data := "admin api content"
+	sum := sha256.Sum256([]byte(data))
+	meta := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if _, err := testMetaStore.Put(&RequestVars{Oid: meta.Oid, Size: meta.Size}); err != nil {
+		t.Fatalf("expected Put to succeed, got: %s", err)
+	}
+	if err := testContentStore.Put(meta, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected content Put to succeed, got: %s", err)
+	}
+
+	var stat AdminObject
+	if status := adminAPI(t, "GET", "/objects/"+meta.Oid, "", &stat); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if stat.Size != meta.Size || !stat.Stored || stat.Pin != nil {
+		t.Errorf("expected a stored, unpinned object, got %+v", stat)
+	}
+
+	if status := adminAPI(t, "DELETE", "/objects/"+meta.Oid, "", nil); status != 204 {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if status := adminAPI(t, "GET", "/objects/"+meta.Oid, "", nil); status != 404 {
+		t.Errorf("expected status 404 for a deleted object, got %d", status)
+	}
+	if testContentStore.Exists(meta) {
+		t.Error("expected the content to be deleted")
+	}
+}
+
+func TestAdminAPIForceUnlock(t *testing.T) {
+	lock, err := createRefLock("/bilbo/adminrepo/locks", "admin.psd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list LockList
+	adminAPI(t, "GET", "/repos/adminrepo/locks", "", &list)
+	if len(list.Locks) != 1 || list.Locks[0].Id != lock.Id {
+		t.Fatalf("expected the lock to be listed, got %+v", list.Locks)
+	}
+
+	var unlocked UnlockResponse
+	if status := adminAPI(t, "DELETE", "/repos/adminrepo/locks/"+lock.Id, "", &unlocked); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if unlocked.Lock == nil || unlocked.Lock.Id != lock.Id {
+		t.Errorf("expected the released lock, got %+v", unlocked.Lock)
+	}
+	if status := adminAPI(t, "DELETE", "/repos/adminrepo/locks/"+lock.Id, "", nil); status != 404 {
+		t.Errorf("expected status 404 for a released lock, got %d", status)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Repo: "adminrepo", Action: "lock.force_unlock"}, auditPageSize)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 2 || entries[1].Actor != testAdminUser || entries[1].Outcome != auditSuccess || entries[1].Target != testUser {
+		t.Errorf("expected a successful and a failed force unlock in the audit log, got %d entries", len(entries))
+	}
+}
+
+func TestAdminAPIConfig(t *testing.T) {
+	var cfg struct {
+		Version  string            `json:"version"`
+		Settings map[string]string `json:"settings"`
+	}
+	if status := adminAPI(t, "GET", "/config", "", &cfg); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if cfg.Version != version || cfg.Settings["LFS_METADB"] == "" {
+		t.Errorf("expected the version and settings, got %+v", cfg)
+	}
+	if _, ok := cfg.Settings["LFS_ADMINPASS"]; ok {
+		t.Error("expected the admin password to be left out")
+	}
+}
+
+func TestAdminAPIOpenAPI(t *testing.T) {
+	var doc struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if status := adminAPI(t, "GET", "/openapi.json", "", &doc); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if doc.OpenAPI == "" || doc.Paths["/objects/{oid}"] == nil {
+		t.Errorf("expected the OpenAPI document, got %+v", doc)
+	}
+}
+
+func TestAdminAPIReleaseLocks(t *testing.T) {
+	for _, path := range []string{"a.psd", "b.psd"} {
+		if _, err := createRefLock("/bilbo/releaserepo/locks", path, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if status := adminAPI(t, "DELETE", "/locks", "", nil); status != 400 {
+		t.Errorf("expected releasing every lock to be refused with 400, got %d", status)
+	}
+	if status := adminAPI(t, "DELETE", "/locks?repo=releaserepo&older_than=x", "", nil); status != 400 {
+		t.Errorf("expected an invalid age to be refused with 400, got %d", status)
+	}
+	if status := adminAPI(t, "DELETE", "/locks?repo=releaserepo&older_than=1", "", nil); status != 200 {
+		t.Errorf("expected releasing no lock to succeed, got %d", status)
+	}
+
+	var released struct {
+		Locks []RepoLock `json:"locks"`
+	}
+	if status := adminAPI(t, "DELETE", "/locks?repo=releaserepo&owner="+testUser, "", &released); status != 200 || len(released.Locks) != 2 {
+		t.Fatalf("expected both locks to be released, got %d: %v", status, released.Locks)
+	}
+
+	var locks []RepoLock
+	if adminAPI(t, "GET", "/locks?repo=releaserepo", "", &locks); len(locks) != 0 {
+		t.Errorf("expected no locks left, got %d", len(locks))
+	}
+}
+
+func TestAdminAPIStats(t *testing.T) {
+	var d Dashboard
+	if status := adminAPI(t, "GET", "/stats?window=30d", "", &d); status != 200 {
+		t.Fatalf("expected the statistics, got %d", status)
+	}
+	if d.Window != "30d" || d.Stored.Objects == 0 || d.Stored.Bytes == 0 || d.Traffic == nil {
+		t.Errorf("expected the stored objects and traffic of 30 days, got %+v", d)
+	}
+	if d.Disk == nil || d.Disk.Total == 0 {
+		t.Error("expected the content store's disk usage")
+	}
+
+	if status := adminAPI(t, "GET", "/stats?window=1y", "", nil); status != 400 {
+		t.Errorf("expected an unknown window to be refused with 400, got %d", status)
+	}
+}
+
+func TestAdminAPIRoles(t *testing.T) {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	for name, role := range map[string]string{"auditor": roleAuditor, "manager": roleUserManager} {
+		if err := testMetaStore.AddUser(name, "pass"); err != nil {
+			t.Fatal(err)
+		}
+		defer testMetaStore.DeleteUser(name)
+		if status := adminAPI(t, "PUT", "/users/"+name+"/role", `{"role":"`+role+`"}`, nil); status != 200 {
+			t.Fatalf("expected the role to be set, got %d", status)
+		}
+	}
+	if status := adminAPI(t, "PUT", "/users/"+testUser+"/role", `{"role":"root"}`, nil); status != 422 {
+		t.Errorf("expected status 422 for an invalid role, got %d", status)
+	}
+
+	as := func(user, method, path, body string) int {
+		res, err := api(method, adminAPIPrefix+path, "application/json", user, "pass", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := as("auditor", "GET", "/users", ""); status != 200 {
+		t.Errorf("expected an auditor to list users, got %d", status)
+	}
+	if status := as("auditor", "POST", "/users", `{"name":"eve","password":"x"}`); status != 403 {
+		t.Errorf("expected an auditor not to add users, got %d", status)
+	}
+	if status := as("manager", "POST", "/users", `{"name":"eve","password":"x"}`); status != 201 {
+		t.Errorf("expected a user manager to add users, got %d", status)
+	}
+	if status := as("manager", "DELETE", "/users/eve", ""); status != 204 {
+		t.Errorf("expected a user manager to delete users, got %d", status)
+	}
+	if status := as("manager", "PUT", "/users/auditor", `{"password":"x"}`); status != 403 {
+		t.Errorf("expected a user manager not to change an administrator, got %d", status)
+	}
+	if status := as("manager", "PUT", "/users/manager/role", `{"role":"admin"}`); status != 403 {
+		t.Errorf("expected a user manager not to give roles, got %d", status)
+	}
+	if status := as("manager", "DELETE", "/locks?repo="+testRepo, ""); status != 403 {
+		t.Errorf("expected a user manager not to release locks, got %d", status)
+	}
+
+	var u MetaUser
+	if status := adminAPI(t, "GET", "/users/auditor", "", &u); status != 200 || u.Role != roleAuditor {
+		t.Errorf("expected the user's role, got %d %+v", status, u)
+	}
+
+	if _, ok := testMetaStore.Authenticate(testAdminUser, testAdminPass); ok {
+		t.Errorf("expected the bootstrap account not to be an LFS user")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Administrators are stored users given a role in rolesBucket, keyed by user
+// name. Each role grants what the ones after it do:
+const (
+	// roleAdmin can do everything, including giving roles.
+	roleAdmin = "admin"
+	// roleUserManager can add, change and remove users without a role.
+	roleUserManager = "user-manager"
+	// roleAuditor can only look.
+	roleAuditor = "auditor"
+)
+
+var roles = []string{roleAdmin, roleUserManager, roleAuditor}
+
+var roleRanks = map[string]int{roleAuditor: 1, roleUserManager: 2, roleAdmin: 3}
+
+// The bootstrap account, LFS_ADMINUSER and LFS_ADMINPASS, is an admin until it
+// is disabled by setting bootstrapDisabledKey in settingsBucket.
+var bootstrapDisabledKey = []byte("bootstrap_disabled")
+
+var (
+	errInvalidRole = errors.New("Invalid role")
+	errLastAdmin   = errors.New("At least one user must keep the admin role while the bootstrap account is disabled")
+	errNoAdmins    = errors.New("Give a user the admin role before disabling the bootstrap account")
+	errAdminTarget = errors.New("Only admins can change users with a role")
+)
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// roleAllows reports whether role grants everything required does.
+func roleAllows(role, required string) bool {
+	return validRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// Role returns the role of user, or an empty string if they have none.
+func (s *MetaStore) Role(user string) (string, error) {
+	var role string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rolesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		role = string(bucket.Get([]byte(user)))
+		return nil
+	})
+	return role, err
+}
+
+// Roles returns the role of every user that has one.
+func (s *MetaStore) Roles() (map[string]string, error) {
+	roles := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rolesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			roles[string(k)] = string(v)
+			return nil
+		})
+	})
+	return roles, err
+}
+
+// SetRole gives user role, or takes their role away if role is empty.
+func (s *MetaStore) SetRole(user, role string) error {
+	if role != "" && !validRole(role) {
+		return errInvalidRole
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rolesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if tx.Bucket(usersBucket).Get([]byte(user)) == nil {
+			return errUserNotFound
+		}
+
+		if role != roleAdmin {
+			if err := checkLastAdmin(tx, user); err != nil {
+				return err
+			}
+		}
+		if role == "" {
+			return bucket.Delete([]byte(user))
+		}
+		return bucket.Put([]byte(user), []byte(role))
+	})
+}
+
+// checkLastAdmin returns errLastAdmin if user is the only admin and the
+// bootstrap account is disabled, so that taking their role away would leave
+// nobody able to give roles.
+func checkLastAdmin(tx *bolt.Tx, user string) error {
+	if tx.Bucket(settingsBucket).Get(bootstrapDisabledKey) == nil {
+		return nil
+	}
+
+	admins := 0
+	isAdmin := false
+	tx.Bucket(rolesBucket).ForEach(func(k, v []byte) error {
+		if string(v) == roleAdmin {
+			admins++
+			isAdmin = isAdmin || string(k) == user
+		}
+		return nil
+	})
+	if isAdmin && admins == 1 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// BootstrapDisabled reports whether the bootstrap account was disabled.
+func (s *MetaStore) BootstrapDisabled() (bool, error) {
+	disabled := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(settingsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		disabled = bucket.Get(bootstrapDisabledKey) != nil
+		return nil
+	})
+	return disabled, err
+}
+
+// SetBootstrapDisabled disables or enables the bootstrap account. It can only
+// be disabled once a stored user is an admin.
+func (s *MetaStore) SetBootstrapDisabled(disabled bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(settingsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if !disabled {
+			return bucket.Delete(bootstrapDisabledKey)
+		}
+
+		admins := 0
+		tx.Bucket(rolesBucket).ForEach(func(k, v []byte) error {
+			if string(v) == roleAdmin {
+				admins++
+			}
+			return nil
+		})
+		if admins == 0 {
+			return errNoAdmins
+		}
+		return bucket.Put(bootstrapDisabledKey, []byte("1"))
+	})
+}
+
+// bootstrapEnabled reports whether the LFS_ADMINUSER and LFS_ADMINPASS account
+// can be used.
+func (a *App) bootstrapEnabled() bool {
+	if Config.AdminUser == "" || Config.AdminPass == "" {
+		return false
+	}
+
+	disabled, err := a.metaStore.BootstrapDisabled()
+	if err != nil {
+		logger.Log(kv{"fn": "bootstrapEnabled", "err": err.Error()})
+		return false
+	}
+	return !disabled
+}
+
+// adminEnabled reports whether anyone can use the mgmt interface and the admin
+// API: the bootstrap account, or a stored user with a role.
+func (a *App) adminEnabled() bool {
+	if a.bootstrapEnabled() {
+		return true
+	}
+
+	roles, err := a.metaStore.Roles()
+	if err != nil {
+		logger.Log(kv{"fn": "adminEnabled", "err": err.Error()})
+		return false
+	}
+	return len(roles) > 0
+}
+
+// adminRole returns the role of user, or an empty string if they are not an
+// administrator. While the bootstrap account is enabled its name always
+// refers to it, never to a stored user of the same name.
+func (a *App) adminRole(user string) (string, error) {
+	if user == "" {
+		return "", nil
+	}
+	if user == Config.AdminUser && a.bootstrapEnabled() {
+		return roleAdmin, nil
+	}
+	return a.metaStore.Role(user)
+}
+
+// authenticateAdmin checks the credentials of an administrator and returns
+// their role, or an empty string if they are not valid.
+func (a *App) authenticateAdmin(user, pass string) (string, error) {
+	if user == "" || pass == "" {
+		return "", nil
+	}
+	if user == Config.AdminUser && a.bootstrapEnabled() {
+		if pass != Config.AdminPass {
+			return "", nil
+		}
+		return roleAdmin, nil
+	}
+
+	if !a.metaStore.CheckPassword(user, pass) {
+		return "", nil
+	}
+	return a.metaStore.Role(user)
+}
+
+// requestRole returns the role of the administrator making r.
+func requestRole(r *http.Request) string {
+	role, _ := r.Context().Value(roleKey{}).(string)
+	return role
+}
+
+type roleKey struct{}
+
+// withRole returns a copy of r made by an administrator with role.
+func withRole(r *http.Request, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), roleKey{}, role))
+}
+
+// canChangeUser returns errAdminTarget if the administrator making r may not
+// add, change or remove user: only admins may touch users with a role.
+func (a *App) canChangeUser(r *http.Request, user string) error {
+	if requestRole(r) == roleAdmin {
+		return nil
+	}
+
+	role, err := a.metaStore.Role(user)
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		return errAdminTarget
+	}
+	return nil
+}
+
+// adminAuth guards the admin API with basic auth: the administrator must have
+// a role granting what role does.
+func (a *App) adminAuth(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.adminEnabled() {
+			writeStatus(w, r, 404)
+			return
+		}
+
+		user, pass, _ := r.BasicAuth()
+		granted, err := a.authenticateAdmin(user, pass)
+		if err != nil {
+			logger.Log(kv{"fn": "adminAuth", "err": err.Error()})
+			writeStatus(w, r, 500)
+			return
+		}
+		if granted == "" {
+			w.Header().Set("WWW-Authenticate", "Basic realm=mgmt")
+			writeStatus(w, r, 401)
+			return
+		}
+		if !roleAllows(granted, role) {
+			writeStatus(w, r, 403)
+			return
+		}
+
+		r = withRole(withUser(r, user), granted)
+		h(w, r)
+		logRequest(r, 200)
+	}
+}
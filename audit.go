@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// The audit log is kept in auditBucket as seq (uint64 BE) -> JSON AuditEntry.
+// Entries are only ever appended, and dropped from the front by
+// PruneAudit once they are older than LFS_AUDITRETENTION or beyond
+// LFS_AUDITMAXENTRIES.
+const (
+	// auditPruneInterval is how often old audit entries are dropped.
+	auditPruneInterval = time.Hour
+	// auditPageSize is the number of entries shown on the audit page.
+	auditPageSize = 100
+)
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// auditSystem is the actor of operations the server does on its own, such as
+// releasing expired locks.
+const auditSystem = "system"
+
+// AuditEntry records a mutating operation.
+type AuditEntry struct {
+	Id     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Repo   string    `json:"repo,omitempty"`
+	Oid    string    `json:"oid,omitempty"`
+	LockId string    `json:"lock_id,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	// Target names what the action applied to when it is not an object or a
+	// lock, such as a user or a webhook.
+	Target    string `json:"target,omitempty"`
+	SourceIP  string `json:"source_ip"`
+	RequestId string `json:"request_id,omitempty"`
+	Outcome   string `json:"outcome"`
+	Status    int    `json:"status"`
+	// Detail says why an operation failed: the error it failed with, or the
+	// text of its response status.
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match every entry, and
+// Action also matches the actions it prefixes: "lock" matches "lock.create".
+// Before, if set, only selects entries with a lower id.
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Repo    string
+	Oid     string
+	Outcome string
+	Before  uint64
+}
+
+func (f *AuditFilter) matches(e *AuditEntry) bool {
+	if f.Actor != "" && f.Actor != e.Actor {
+		return false
+	}
+	if f.Action != "" && f.Action != e.Action && !strings.HasPrefix(e.Action, f.Action+".") {
+		return false
+	}
+	if f.Repo != "" && f.Repo != e.Repo {
+		return false
+	}
+	if f.Oid != "" && f.Oid != e.Oid {
+		return false
+	}
+	return f.Outcome == "" || f.Outcome == e.Outcome
+}
+
+// AppendAudit adds e to the audit log and assigns its id.
+func (s *MetaStore) AppendAudit(e *AuditEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return appendAudit(tx, e)
+	})
+}
+
+// appendAudit adds e to the audit log within tx and assigns its id.
+func appendAudit(tx *bolt.Tx, e *AuditEntry) error {
+	bucket := tx.Bucket(auditBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Id = seq
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(seqKey(seq), data)
+}
+
+// AuditLog returns up to limit entries matching f, newest first, and the
+// cursor to pass as f.Before for the next page. The cursor is zero on the
+// last page.
+func (s *MetaStore) AuditLog(f AuditFilter, limit int) ([]*AuditEntry, uint64, error) {
+	var entries []*AuditEntry
+	var next uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+
+		k, v := c.Last()
+		if f.Before > 0 {
+			if k, _ = c.Seek(seqKey(f.Before)); k != nil {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Last()
+			}
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !f.matches(&e) {
+				continue
+			}
+			if len(entries) == limit {
+				next = entries[len(entries)-1].Id
+				return nil
+			}
+			entries = append(entries, &e)
+		}
+		return nil
+	})
+	return entries, next, err
+}
+
+// ExportAudit calls fn with every entry matching f, oldest first.
+func (s *MetaStore) ExportAudit(f AuditFilter, fn func(*AuditEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if f.Before > 0 && e.Id >= f.Before {
+				return nil
+			}
+			if !f.matches(&e) {
+				continue
+			}
+			if err := fn(&e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PruneAudit drops the entries recorded before cutoff, and the oldest entries
+// beyond the newest max. A zero cutoff or max disables that limit. It
+// returns the number of entries dropped.
+func (s *MetaStore) PruneAudit(cutoff time.Time, max int) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+
+		var limit []byte
+		if seq := bucket.Sequence(); max > 0 && seq > uint64(max) {
+			limit = seqKey(seq - uint64(max))
+		}
+
+		var old [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if limit == nil || bytes.Compare(k, limit) > 0 {
+				if cutoff.IsZero() {
+					break
+				}
+				var e AuditEntry
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				if !e.Time.Before(cutoff) {
+					break
+				}
+			}
+			old = append(old, k)
+		}
+
+		for _, k := range old {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+// auditRecorder captures the status of a response.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// auditAPI records action in the audit log for every request to the LFS API
+// handler h. Requests answered with a 4xx or 5xx status are failures.
+func (a *App) auditAPI(action string, h http.HandlerFunc) http.HandlerFunc {
+	return a.audited(action, h, func(status int) bool { return status < 400 })
+}
+
+// auditMgmt records action in the audit log for every request to the mgmt
+// form handler h. Mgmt handlers redirect on success and answer with an error
+// message otherwise.
+func (a *App) auditMgmt(action string, h http.HandlerFunc) http.HandlerFunc {
+	return a.audited(action, h, func(status int) bool { return status == http.StatusFound })
+}
+
+func (a *App) audited(action string, h http.HandlerFunc, ok func(int) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		e := &AuditEntry{
+			Time:      time.Now().UTC(),
+			Action:    action,
+			Repo:      vars["repo"],
+			Oid:       vars["oid"],
+			LockId:    vars["id"],
+			SourceIP:  sourceIP(r),
+			RequestId: requestID(r),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, e))
+
+		rec := &auditRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		if e.Actor == "" {
+			e.Actor = requestUser(r)
+		}
+		if e.Actor == "" {
+			e.Actor, _, _ = r.BasicAuth()
+		}
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = 200
+		}
+		if e.Outcome == "" {
+			e.Outcome = auditSuccess
+			if !ok(e.Status) {
+				e.Outcome = auditFailure
+			}
+		}
+		if e.Outcome == auditFailure && e.Detail == "" {
+			e.Detail = http.StatusText(e.Status)
+		}
+
+		if err := a.metaStore.AppendAudit(e); err != nil {
+			logger.Log(kv{"fn": "audit", "action": action, "err": err.Error()})
+		}
+	}
+}
+
+// auditOperation records e as one of several operations done while handling
+// the audited request r, such as each lock of a bulk release. Its outcome is
+// derived from err.
+func (a *App) auditOperation(r *http.Request, e *AuditEntry, err error) {
+	e.Time = time.Now().UTC()
+	e.Actor = requestUser(r)
+	if e.Actor == "" {
+		e.Actor, _, _ = r.BasicAuth()
+	}
+	e.SourceIP = sourceIP(r)
+	e.RequestId = requestID(r)
+	e.Outcome, e.Status = auditSuccess, http.StatusOK
+	if err != nil {
+		e.Outcome, e.Status, e.Detail = auditFailure, http.StatusInternalServerError, err.Error()
+	}
+
+	if err := a.metaStore.AppendAudit(e); err != nil {
+		logger.Log(kv{"fn": "audit", "action": e.Action, "err": err.Error()})
+	}
+}
+
+// auditEntry returns the audit entry of r, for handlers to add details to,
+// or a throwaway entry if r is not audited. A handler that sets the Outcome
+// overrides the one derived from the response status.
+func auditEntry(r *http.Request) *AuditEntry {
+	if e, ok := r.Context().Value(auditKey{}).(*AuditEntry); ok {
+		return e
+	}
+	return &AuditEntry{}
+}
+
+type auditKey struct{}
+
+// sourceIP returns the address a request came from.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pruneAudit applies the configured audit retention.
+func (a *App) pruneAudit() error {
+	var cutoff time.Time
+	if d := Config.AuditRetentionDuration(); d > 0 {
+		cutoff = time.Now().Add(-d)
+	}
+
+	n, err := a.metaStore.PruneAudit(cutoff, Config.AuditMaxEntriesCount())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logger.Log(kv{"fn": "audit", "msg": "pruned audit log", "entries": n})
+	}
+	return nil
+}
+
+func (a *App) auditPruneLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.pruneAudit(); err != nil {
+			logger.Log(kv{"fn": "audit", "err": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for i := 0; i < 5; i++ {
+		e := &AuditEntry{Time: time.Now(), Actor: fmt.Sprintf("user-%d", i%2), Action: "lock.create", Outcome: auditSuccess}
+		if err := metaStoreTest.AppendAudit(e); err != nil {
+			t.Fatalf("expected AppendAudit to succeed, got: %s", err)
+		}
+	}
+	if err := metaStoreTest.AppendAudit(&AuditEntry{Time: time.Now(), Actor: "user-0", Action: "user.add", Outcome: auditFailure}); err != nil {
+		t.Fatalf("expected AppendAudit to succeed, got: %s", err)
+	}
+
+	entries, next, err := metaStoreTest.AuditLog(AuditFilter{Actor: "user-0", Action: "lock"}, 2)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Id != 5 || entries[1].Id != 3 || next != 3 {
+		t.Fatalf("expected entries 5 and 3 and a cursor, got %d entries and cursor %d", len(entries), next)
+	}
+
+	entries, next, err = metaStoreTest.AuditLog(AuditFilter{Actor: "user-0", Action: "lock", Before: next}, 2)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Id != 1 || next != 0 {
+		t.Fatalf("expected entry 1 on the last page, got %d entries and cursor %d", len(entries), next)
+	}
+
+	entries, _, err = metaStoreTest.AuditLog(AuditFilter{Outcome: auditFailure}, auditPageSize)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "user.add" {
+		t.Fatalf("expected the failed user.add entry, got %d entries", len(entries))
+	}
+
+	var ids []uint64
+	err = metaStoreTest.ExportAudit(AuditFilter{Action: "lock.create"}, func(e *AuditEntry) error {
+		ids = append(ids, e.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected ExportAudit to succeed, got: %s", err)
+	}
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+		t.Errorf("expected entries 1 to 5 oldest first, got %v", ids)
+	}
+}
+
+func TestPruneAudit(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	now := time.Now()
+	for i := 5; i > 0; i-- {
+		if err := metaStoreTest.AppendAudit(&AuditEntry{Time: now.Add(-time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatalf("expected AppendAudit to succeed, got: %s", err)
+		}
+	}
+
+	n, err := metaStoreTest.PruneAudit(now.Add(-150*time.Minute), 0)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 entries older than the cutoff to be pruned, got %d: %v", n, err)
+	}
+
+	n, err = metaStoreTest.PruneAudit(time.Time{}, 1)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 entry beyond the maximum to be pruned, got %d: %v", n, err)
+	}
+
+	entries, _, err := metaStoreTest.AuditLog(AuditFilter{}, auditPageSize)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Id != 5 {
+		t.Errorf("expected only the newest entry to be kept, got %d entries", len(entries))
+	}
+}
+
+func TestAuditLockHandlers(t *testing.T) {
+	lock, err := createRefLock("/bilbo/auditrepo/locks", "audit.psd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createRefLock("/bilbo/auditrepo/locks", "audit.psd", ""); err == nil {
+		t.Fatal("expected the second lock to conflict")
+	}
+
+	res, err := api("POST", "/bilbo/auditrepo/locks/"+lock.Id+"/unlock", metaMediaType, testUser, testPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Repo: "auditrepo"}, auditPageSize)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %d", len(entries))
+	}
+
+	unlock, conflict, create := entries[0], entries[1], entries[2]
+	if create.Action != "lock.create" || create.Outcome != auditSuccess || create.LockId != lock.Id || create.Path != "audit.psd" {
+		t.Errorf("unexpected lock creation entry: %+v", create)
+	}
+	if create.Actor != testUser || create.SourceIP != "127.0.0.1" || create.RequestId == "" {
+		t.Errorf("expected actor, source and request id in %+v", create)
+	}
+	if conflict.Outcome != auditFailure || conflict.Status != 409 || conflict.Detail != http.StatusText(409) {
+		t.Errorf("expected a failed lock creation with its status as detail, got %+v", conflict)
+	}
+	if unlock.Action != "lock.unlock" || unlock.Outcome != auditSuccess || unlock.LockId != lock.Id {
+		t.Errorf("unexpected unlock entry: %+v", unlock)
+	}
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The admin commands manage the server's data from the command line, e.g.
+// over SSH. By default they open LFS_METADB and LFS_CONTENTPATH directly,
+// which only works while the server is stopped. With -server they go through
+// the admin API of a running server instead, authenticated with
+// LFS_ADMINUSER and LFS_ADMINPASS; commands that need the files themselves
+// are not available then.
+
+// Exit codes of the admin commands.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	// exitProblems is returned by fsck when it finds problems.
+	exitProblems = 4
+)
+
+var (
+	errLocalOnly = errors.New("Command needs direct access to the data and can't be used with -server")
+	errUsage     = errors.New("usage")
+)
+
+const cliUsage = `Usage: lfs-test-server [-json] [-server URL] <command> [arguments]
+
+Commands:
+  user list                      List users
+  user add NAME [PASSWORD]       Add a user; the password is read from stdin if omitted
+  user passwd NAME [PASSWORD]    Set a user's password
+  user del NAME                  Delete a user
+  user role NAME ROLE|none       Give a user the admin, user-manager or auditor role, or take it away
+  object ls [-repo R] [-uploader U] [-prefix P] [-min-size N] [-max-size N]
+            [-sort size|-size|date|-date] [-limit N]
+                                 List objects
+  object stat OID                Show an object
+  object cat OID                 Write an object's content to stdout
+  object rm OID                  Delete an object
+  lock ls [-repo R] [-owner U]   List locks
+  lock unlock REPO ID            Force unlock a lock
+  stats                          Show users, objects, storage and locks per repository
+  fsck                           Check that every object's content is present and intact
+  gc [-dry-run]                  Delete content without an object and compact packs
+  export [FILE]                  Write the meta store as JSON lines to FILE or stdout
+  import FILE                    Load an export into a new meta store
+
+Options:
+  -json        Print JSON instead of tables
+  -server URL  Use the admin API of the server at URL instead of the local files
+
+Exit status is 0 on success, 1 on error, 2 on bad usage, 3 if the user,
+object or lock is not found, and 4 if fsck found problems.
+`
+
+// cli runs one admin command.
+type cli struct {
+	in      io.Reader
+	out     io.Writer
+	errOut  io.Writer
+	json    bool
+	server  string
+	backend adminBackend
+}
+
+// isCLICommand reports whether arg starts an admin command line.
+func isCLICommand(arg string) bool {
+	switch arg {
+	case "user", "object", "lock", "stats", "fsck", "gc", "export", "import", "help", "-json", "-server":
+		return true
+	}
+	return false
+}
+
+// runCLI runs the admin command in args and returns its exit code.
+func runCLI(args []string, in io.Reader, out, errOut io.Writer) int {
+	c := &cli{in: in, out: out, errOut: errOut}
+
+	flags := flag.NewFlagSet("lfs-test-server", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	flags.Usage = func() { fmt.Fprint(errOut, cliUsage) }
+	flags.BoolVar(&c.json, "json", false, "")
+	flags.StringVar(&c.server, "server", "", "")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	args = flags.Args()
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Fprint(errOut, cliUsage)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	code, err := c.run(args[0], args[1:])
+	if c.backend != nil {
+		c.backend.Close()
+	}
+	switch {
+	case err == errUsage:
+		fmt.Fprint(errOut, cliUsage)
+		return exitUsage
+	case err == flag.ErrHelp:
+		return exitUsage
+	case err == errObjectNotFound || err == errUserNotFound || err == errLockNotFound:
+		fmt.Fprintln(errOut, err)
+		return exitNotFound
+	case err != nil:
+		fmt.Fprintln(errOut, err)
+		return exitError
+	}
+	return code
+}
+
+func (c *cli) run(cmd string, args []string) (int, error) {
+	sub := ""
+	if cmd == "user" || cmd == "object" || cmd == "lock" {
+		if len(args) == 0 {
+			return 0, errUsage
+		}
+		sub, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "fsck", "gc", "export", "import":
+		if c.server != "" {
+			return 0, errLocalOnly
+		}
+	}
+
+	readOnly := false
+	switch cmd + " " + sub {
+	case "user list", "object ls", "object stat", "object cat", "lock ls", "stats ", "fsck ", "export ":
+		readOnly = true
+	case "gc ":
+		// Deleting content takes the write lock, which can't be had while
+		// a server uses the meta store and keeps one from starting.
+		readOnly = dryRun(args)
+	}
+	if err := c.open(readOnly); err != nil {
+		return 0, err
+	}
+
+	switch cmd + " " + sub {
+	case "user list":
+		return exitOK, c.userList(args)
+	case "user add":
+		return exitOK, c.userAdd(args)
+	case "user passwd":
+		return exitOK, c.userPasswd(args)
+	case "user del":
+		return exitOK, c.userDel(args)
+	case "user role":
+		return exitOK, c.userRole(args)
+	case "object ls":
+		return exitOK, c.objectLs(args)
+	case "object stat":
+		return exitOK, c.objectStat(args)
+	case "object cat":
+		return exitOK, c.objectCat(args)
+	case "object rm":
+		return exitOK, c.objectRm(args)
+	case "lock ls":
+		return exitOK, c.lockLs(args)
+	case "lock unlock":
+		return exitOK, c.lockUnlock(args)
+	case "stats ":
+		return exitOK, c.stats(args)
+	case "fsck ":
+		return c.fsck(args)
+	case "gc ":
+		return exitOK, c.gc(args)
+	case "export ":
+		return exitOK, c.export(args)
+	case "import ":
+		return exitOK, c.importDump(args)
+	}
+	return 0, errUsage
+}
+
+// open opens the backend of the command. Commands that only read the meta
+// store are marked readOnly, so they neither migrate nor write to it.
+// dryRun reports whether args ask for a dry run.
+func dryRun(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-dry-run", "--dry-run", "-dry-run=true", "--dry-run=true":
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cli) open(readOnly bool) error {
+	if c.server != "" {
+		c.backend = newRemoteBackend(c.server)
+		return nil
+	}
+
+	b, err := openLocalBackend(readOnly)
+	if err != nil {
+		return err
+	}
+	c.backend = b
+	return nil
+}
+
+// local returns the local backend; the local-only commands are rejected with
+// -server before it is needed.
+func (c *cli) local() *localBackend {
+	return c.backend.(*localBackend)
+}
+
+// print writes v as JSON with -json, and as a table written by table
+// otherwise.
+func (c *cli) print(v interface{}, table func(w io.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// parse parses the flags of a command and checks it has between min and max
+// arguments.
+func parse(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+
+	args = flags.Args()
+	if len(args) < min || len(args) > max {
+		return nil, errUsage
+	}
+	return args, nil
+}
+
+// password returns the password argument, or reads it from the first line
+// of stdin.
+func (c *cli) password(args []string) (string, error) {
+	if len(args) > 1 {
+		return args[1], nil
+	}
+
+	line, err := bufio.NewReader(c.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("No password given")
+	}
+	return password, nil
+}
+
+func (c *cli) userList(args []string) error {
+	if _, err := parse(flag.NewFlagSet("user list", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+
+	users, err := c.backend.Users()
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		users = []*MetaUser{}
+	}
+
+	return c.print(users, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tROLE")
+		for _, u := range users {
+			fmt.Fprintf(w, "%s\t%s\n", u.Name, u.Role)
+		}
+	})
+}
+
+func (c *cli) userAdd(args []string) error {
+	args, err := parse(flag.NewFlagSet("user add", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return errUsage
+	}
+
+	password, err := c.password(args)
+	if err != nil {
+		return err
+	}
+	if err := c.backend.AddUser(args[0], password); err != nil {
+		return err
+	}
+
+	return c.print(&MetaUser{Name: args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Added user %s\n", args[0])
+	})
+}
+
+func (c *cli) userPasswd(args []string) error {
+	args, err := parse(flag.NewFlagSet("user passwd", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return errUsage
+	}
+
+	password, err := c.password(args)
+	if err != nil {
+		return err
+	}
+	if err := c.backend.SetPassword(args[0], password); err != nil {
+		return err
+	}
+
+	return c.print(&MetaUser{Name: args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Set the password of %s\n", args[0])
+	})
+}
+
+func (c *cli) userDel(args []string) error {
+	args, err := parse(flag.NewFlagSet("user del", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := c.backend.DeleteUser(args[0]); err != nil {
+		return err
+	}
+
+	return c.print(&MetaUser{Name: args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Deleted user %s\n", args[0])
+	})
+}
+
+func (c *cli) userRole(args []string) error {
+	args, err := parse(flag.NewFlagSet("user role", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	role := args[1]
+	if role == "none" {
+		role = ""
+	}
+	if err := c.backend.SetRole(args[0], role); err != nil {
+		return err
+	}
+
+	return c.print(&MetaUser{Name: args[0], Role: role}, func(w io.Writer) {
+		if role == "" {
+			fmt.Fprintf(w, "Took the role of %s away\n", args[0])
+		} else {
+			fmt.Fprintf(w, "Gave %s the %s role\n", args[0], role)
+		}
+	})
+}
+
+func (c *cli) objectLs(args []string) error {
+	var f ObjectFilter
+	var limit int
+	var minSize, maxSize string
+	flags := flag.NewFlagSet("object ls", flag.ContinueOnError)
+	flags.StringVar(&f.Repo, "repo", "", "")
+	flags.StringVar(&f.Uploader, "uploader", "", "")
+	flags.StringVar(&f.Prefix, "prefix", "", "")
+	flags.StringVar(&minSize, "min-size", "", "")
+	flags.StringVar(&maxSize, "max-size", "", "")
+	flags.StringVar(&f.Order, "sort", "", "")
+	flags.IntVar(&limit, "limit", 0, "")
+	if _, err := parse(flags, args, 0, 0); err != nil || limit < 0 || !validObjectOrder(f.Order) {
+		return errUsage
+	}
+
+	var err error
+	if f.MinSize, err = parseByteSize(minSize); err != nil {
+		return err
+	}
+	if f.MaxSize, err = parseByteSize(maxSize); err != nil {
+		return err
+	}
+
+	objects := []*MetaObject{}
+	cursor := ""
+	for {
+		size := adminMaxPageSize
+		if limit > 0 && limit-len(objects) < size {
+			size = limit - len(objects)
+		}
+
+		page, next, err := c.backend.Objects(f, cursor, size)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, page...)
+
+		if next == "" || (limit > 0 && len(objects) >= limit) {
+			break
+		}
+		cursor = next
+	}
+
+	return c.print(objects, func(w io.Writer) {
+		fmt.Fprintln(w, "OID\tSIZE\tREPO\tUPLOADER\tUPLOADED\tDOWNLOADS")
+		for _, o := range objects {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\n", o.Oid, o.Size, o.Repo, o.Uploader, formatTime(o.UploadedAt), o.Downloads)
+		}
+	})
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (c *cli) objectStat(args []string) error {
+	args, err := parse(flag.NewFlagSet("object stat", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	obj, err := c.backend.Object(args[0])
+	if err != nil {
+		return err
+	}
+
+	return c.print(obj, func(w io.Writer) {
+		fmt.Fprintf(w, "Oid:\t%s\n", obj.Oid)
+		fmt.Fprintf(w, "Size:\t%d (%s)\n", obj.Size, formatBytes(obj.Size))
+		fmt.Fprintf(w, "Stored:\t%v\n", obj.Stored)
+		fmt.Fprintf(w, "Created:\t%s\n", formatTime(obj.CreatedAt))
+		fmt.Fprintf(w, "Repository:\t%s\n", obj.Repo)
+		fmt.Fprintf(w, "Uploader:\t%s\n", obj.Uploader)
+		fmt.Fprintf(w, "Uploaded:\t%s\n", formatTime(obj.UploadedAt))
+		fmt.Fprintf(w, "Downloads:\t%d\n", obj.Downloads)
+		fmt.Fprintf(w, "Last download:\t%s\n", formatTime(obj.LastDownload))
+		if obj.Pin != nil {
+			fmt.Fprintf(w, "Pinned:\t%s (legal hold: %v) %s\n", formatTime(obj.Pin.CreatedAt), obj.Pin.LegalHold, obj.Pin.Note)
+		}
+	})
+}
+
+func (c *cli) objectCat(args []string) error {
+	args, err := parse(flag.NewFlagSet("object cat", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.backend.Content(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(c.out, r)
+	return err
+}
+
+func (c *cli) objectRm(args []string) error {
+	args, err := parse(flag.NewFlagSet("object rm", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := c.backend.DeleteObject(args[0]); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"oid": args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "Deleted object %s\n", args[0])
+	})
+}
+
+func (c *cli) lockLs(args []string) error {
+	var repo, owner string
+	flags := flag.NewFlagSet("lock ls", flag.ContinueOnError)
+	flags.StringVar(&repo, "repo", "", "")
+	flags.StringVar(&owner, "owner", "", "")
+	if _, err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	locks, err := c.backend.Locks(repo, owner)
+	if err != nil {
+		return err
+	}
+
+	return c.print(locks, func(w io.Writer) {
+		fmt.Fprintln(w, "REPO\tID\tPATH\tOWNER\tREF\tLOCKED\tEXPIRES")
+		for _, rl := range locks {
+			l := rl.Lock
+			ref, expires := "-", "-"
+			if l.Ref != nil {
+				ref = l.Ref.Name
+			}
+			if l.ExpiresAt != nil {
+				expires = formatTime(*l.ExpiresAt)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rl.Repo, l.Id, l.Path, l.Owner.Name, ref, formatTime(l.LockedAt), expires)
+		}
+	})
+}
+
+func (c *cli) lockUnlock(args []string) error {
+	args, err := parse(flag.NewFlagSet("lock unlock", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	l, err := c.backend.Unlock(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	return c.print(&UnlockResponse{Lock: l}, func(w io.Writer) {
+		fmt.Fprintf(w, "Unlocked %s (%s, owned by %s)\n", l.Path, l.Id, l.Owner.Name)
+	})
+}
+
+// cliStats summarizes a server.
+type cliStats struct {
+	Users   int          `json:"users"`
+	Objects int          `json:"objects"`
+	Bytes   int64        `json:"bytes"`
+	Locks   int          `json:"locks"`
+	Repos   []*AdminRepo `json:"repos"`
+}
+
+func (c *cli) stats(args []string) error {
+	if _, err := parse(flag.NewFlagSet("stats", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+
+	var s cliStats
+	users, err := c.backend.Users()
+	if err != nil {
+		return err
+	}
+	s.Users = len(users)
+
+	cursor := ""
+	for {
+		page, next, err := c.backend.Objects(ObjectFilter{}, cursor, adminMaxPageSize)
+		if err != nil {
+			return err
+		}
+		for _, o := range page {
+			s.Objects++
+			s.Bytes += o.Size
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if s.Repos, err = c.backend.Repos(); err != nil {
+		return err
+	}
+	for _, r := range s.Repos {
+		s.Locks += r.Locks
+	}
+
+	return c.print(&s, func(w io.Writer) {
+		fmt.Fprintf(w, "Users:\t%d\n", s.Users)
+		fmt.Fprintf(w, "Objects:\t%d (%s)\n", s.Objects, formatBytes(s.Bytes))
+		fmt.Fprintf(w, "Locks:\t%d\n\n", s.Locks)
+		fmt.Fprintln(w, "REPO\tSTORED\tQUOTA\tLOCKS")
+		for _, r := range s.Repos {
+			quota := "unlimited"
+			if r.Quota > 0 {
+				quota = formatBytes(r.Quota)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", r.Name, formatBytes(r.Bytes), quota, r.Locks)
+		}
+	})
+}
+
+// Problems found by fsck.
+const (
+	fsckMissing = "missing"
+	fsckCorrupt = "corrupt"
+	fsckOrphan  = "orphan"
+)
+
+// fsckProblem is an object whose content is missing or corrupt, or content
+// that no object refers to.
+type fsckProblem struct {
+	Oid     string `json:"oid"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// checkContent verifies the stored content of every object, and finds
+// content no object refers to.
+func checkContent(meta *MetaStore, content *ContentStore) (int, []fsckProblem, error) {
+	objects, err := meta.Objects()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	problems := []fsckProblem{}
+	known := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		known[o.Oid] = true
+		if !content.Exists(o) {
+			problems = append(problems, fsckProblem{Oid: o.Oid, Problem: fsckMissing})
+			continue
+		}
+		if err := verifyContent(content, o); err != nil {
+			problems = append(problems, fsckProblem{Oid: o.Oid, Problem: fsckCorrupt, Detail: err.Error()})
+		}
+	}
+
+	err = content.Walk(func(oid string, size int64) error {
+		if !known[oid] {
+			problems = append(problems, fsckProblem{Oid: oid, Problem: fsckOrphan, Detail: fmt.Sprintf("%d bytes", size)})
+		}
+		return nil
+	})
+	return len(objects), problems, err
+}
+
+// verifyContent checks that the stored content of meta has its size and
+// hash.
+func verifyContent(content *ContentStore, meta *MetaObject) error {
+	r, err := content.Get(meta, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if n != meta.Size {
+		return fmt.Errorf("%s: %d bytes stored", errSizeMismatch, n)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+	return nil
+}
+
+func (c *cli) fsck(args []string) (int, error) {
+	if _, err := parse(flag.NewFlagSet("fsck", flag.ContinueOnError), args, 0, 0); err != nil {
+		return 0, err
+	}
+
+	b := c.local()
+	checked, problems, err := checkContent(b.app.metaStore, b.app.contentStore)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.print(problems, func(w io.Writer) {
+		if len(problems) > 0 {
+			fmt.Fprintln(w, "OID\tPROBLEM\tDETAIL")
+		}
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Oid, p.Problem, p.Detail)
+		}
+		fmt.Fprintf(w, "Checked %d objects, found %d problems\n", checked, len(problems))
+	})
+	if err != nil || len(problems) > 0 {
+		return exitProblems, err
+	}
+	return exitOK, nil
+}
+
+// gcReport lists the orphaned content gc deleted, or would delete.
+type gcReport struct {
+	DryRun    bool     `json:"dry_run"`
+	Deleted   []string `json:"deleted"`
+	Reclaimed int64    `json:"reclaimed"`
+}
+
+func (c *cli) gc(args []string) error {
+	report := gcReport{Deleted: []string{}}
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.BoolVar(&report.DryRun, "dry-run", false, "")
+	if _, err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	// Orphans are found from the object keys alone; checking the content
+	// itself is left to fsck.
+	b := c.local()
+	known, err := b.app.metaStore.ObjectOids()
+	if err != nil {
+		return err
+	}
+	err = b.app.contentStore.Walk(func(oid string, size int64) error {
+		if !known[oid] {
+			report.Deleted = append(report.Deleted, oid)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !report.DryRun {
+		for _, oid := range report.Deleted {
+			if err := b.app.contentStore.Delete(&MetaObject{Oid: oid}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !report.DryRun {
+		if report.Reclaimed, err = b.app.contentStore.Compact(); err != nil {
+			return err
+		}
+	}
+
+	return c.print(&report, func(w io.Writer) {
+		verb := "Deleted"
+		if report.DryRun {
+			verb = "Would delete"
+		}
+		for _, oid := range report.Deleted {
+			fmt.Fprintf(w, "%s %s\n", verb, oid)
+		}
+		fmt.Fprintf(w, "%s %d orphaned objects, reclaimed %s from packs\n", verb, len(report.Deleted), formatBytes(report.Reclaimed))
+	})
+}
+
+func (c *cli) export(args []string) error {
+	args, err := parse(flag.NewFlagSet("export", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return errUsage
+	}
+
+	w := c.out
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := c.local().app.metaStore.Export(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (c *cli) importDump(args []string) error {
+	args, err := parse(flag.NewFlagSet("import", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store := c.local().app.metaStore
+	n, err := store.Import(f)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Migrate(); err != nil {
+		return err
+	}
+
+	return c.print(map[string]int{"imported": n}, func(w io.Writer) {
+		fmt.Fprintf(w, "Imported %d keys\n", n)
+	})
+}
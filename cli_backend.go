@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// adminBackend is what the admin commands operate on: the local files or a
+// running server.
+type adminBackend interface {
+	Users() ([]*MetaUser, error)
+	AddUser(name, password string) error
+	SetPassword(name, password string) error
+	DeleteUser(name string) error
+	SetRole(name, role string) error
+	Objects(f ObjectFilter, cursor string, limit int) ([]*MetaObject, string, error)
+	Object(oid string) (*AdminObject, error)
+	Content(oid string) (io.ReadCloser, error)
+	DeleteObject(oid string) error
+	Locks(repo, owner string) ([]RepoLock, error)
+	Unlock(repo, id string) (*Lock, error)
+	Repos() ([]*AdminRepo, error)
+	Close()
+}
+
+// localBackend operates on LFS_METADB and LFS_CONTENTPATH. Changes are
+// recorded in the audit log with the local user as the actor.
+type localBackend struct {
+	app   *App
+	actor string
+}
+
+// openLocalBackend opens the local files. With readOnly set, the meta store
+// is opened for reading only and must already be at the latest schema
+// version; otherwise pending migrations are applied.
+func openLocalBackend(readOnly bool) (*localBackend, error) {
+	open := NewMetaStore
+	if readOnly {
+		open = openMetaStoreReadOnly
+	}
+	metaStore, err := open(Config.MetaDB)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the meta store %s (if the server is running, use -server): %s", Config.MetaDB, err)
+	}
+	if readOnly {
+		if err := checkSchemaVersion(metaStore); err != nil {
+			metaStore.Close()
+			return nil, err
+		}
+	}
+
+	contentStore, err := openContentStore()
+	if err != nil {
+		metaStore.Close()
+		return nil, fmt.Errorf("Could not open the content store: %s", err)
+	}
+
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor = "cli:" + u.Username
+	}
+
+	return &localBackend{app: &App{metaStore: metaStore, contentStore: contentStore}, actor: actor}, nil
+}
+
+// checkSchemaVersion fails if the meta store has pending migrations, which
+// read-only commands can't apply.
+func checkSchemaVersion(s *MetaStore) error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("The meta store %s is at schema version %d, run lfs-test-server migrate to upgrade it to %d", s.path, version, latestSchemaVersion())
+}
+
+func (b *localBackend) audit(e *AuditEntry, err error) {
+	e.Time = time.Now().UTC()
+	e.Actor = b.actor
+	e.Outcome = auditSuccess
+	if err != nil {
+		e.Outcome = auditFailure
+		e.Detail = err.Error()
+	}
+	if err := b.app.metaStore.AppendAudit(e); err != nil {
+		logger.Log(kv{"fn": "audit", "action": e.Action, "err": err.Error()})
+	}
+}
+
+func (b *localBackend) Users() ([]*MetaUser, error) {
+	return b.app.metaStore.Users()
+}
+
+func (b *localBackend) AddUser(name, password string) (err error) {
+	defer func() { b.audit(&AuditEntry{Action: "user.add", Target: name}, err) }()
+
+	exists, err := b.app.metaStore.UserExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errUserExists
+	}
+	return b.app.metaStore.AddUser(name, password)
+}
+
+func (b *localBackend) SetPassword(name, password string) (err error) {
+	defer func() { b.audit(&AuditEntry{Action: "user.password", Target: name}, err) }()
+	return b.app.metaStore.AddUser(name, password)
+}
+
+func (b *localBackend) DeleteUser(name string) (err error) {
+	defer func() { b.audit(&AuditEntry{Action: "user.delete", Target: name}, err) }()
+
+	exists, err := b.app.metaStore.UserExists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUserNotFound
+	}
+	return b.app.metaStore.DeleteUser(name)
+}
+
+func (b *localBackend) SetRole(name, role string) (err error) {
+	defer func() { b.audit(&AuditEntry{Action: "user.role", Target: name}, err) }()
+	return b.app.metaStore.SetRole(name, role)
+}
+
+func (b *localBackend) Objects(f ObjectFilter, cursor string, limit int) ([]*MetaObject, string, error) {
+	return b.app.metaStore.ObjectPage(f, cursor, limit)
+}
+
+func (b *localBackend) Object(oid string) (*AdminObject, error) {
+	meta, err := b.app.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
+		return nil, err
+	}
+
+	pin, err := b.app.metaStore.PinOf(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdminObject{MetaObject: meta, Stored: b.app.contentStore.Exists(meta), Pin: pin}, nil
+}
+
+func (b *localBackend) Content(oid string) (io.ReadCloser, error) {
+	meta, err := b.app.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
+		return nil, err
+	}
+	return b.app.contentStore.Get(meta, 0)
+}
+
+func (b *localBackend) DeleteObject(oid string) (err error) {
+	defer func() { b.audit(&AuditEntry{Action: "object.delete", Oid: oid}, err) }()
+	_, err = b.app.deleteObject(oid)
+	return err
+}
+
+func (b *localBackend) Locks(repo, owner string) ([]RepoLock, error) {
+	locks, err := b.app.metaStore.AllLocks()
+	if err != nil {
+		return nil, err
+	}
+	return LockSelection{Repo: repo, Owner: owner}.Filter(locks), nil
+}
+
+func (b *localBackend) Unlock(repo, id string) (l *Lock, err error) {
+	e := &AuditEntry{Action: "lock.force_unlock", Repo: repo, LockId: id}
+	defer func() { b.audit(e, err) }()
+
+	l, err = b.app.metaStore.AdminDeleteLock(repo, b.actor, id)
+	if err == nil && l == nil {
+		err = errLockNotFound
+	}
+	if l != nil {
+		e.Path, e.Target = l.Path, l.Owner.Name
+	}
+	return l, err
+}
+
+func (b *localBackend) Repos() ([]*AdminRepo, error) {
+	return b.app.adminRepos()
+}
+
+func (b *localBackend) Close() {
+	b.app.contentStore.Close()
+	b.app.metaStore.Close()
+}
+
+// remoteBackend operates on a running server through its admin API.
+type remoteBackend struct {
+	url    string
+	client *http.Client
+}
+
+func newRemoteBackend(server string) *remoteBackend {
+	return &remoteBackend{url: strings.TrimSuffix(server, "/"), client: &http.Client{Timeout: time.Minute}}
+}
+
+func (b *remoteBackend) request(method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, b.url+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(Config.AdminUser, Config.AdminPass)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, remoteError(res)
+	}
+	return res, nil
+}
+
+// do calls the admin API and decodes the response into v, if v is not nil.
+func (b *remoteBackend) do(method, path string, body, v interface{}) error {
+	res, err := b.request(method, adminAPIPrefix+path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// remoteError turns an admin API error into the error the local backend
+// would have returned, so both lead to the same exit code.
+func remoteError(res *http.Response) error {
+	var e struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(res.Body).Decode(&e)
+
+	for _, known := range []error{errObjectNotFound, errUserNotFound, errUserExists, errLockNotFound, errLegalHold, errInvalidRole, errLastAdmin} {
+		if e.Message == known.Error() {
+			return known
+		}
+	}
+
+	switch {
+	case res.StatusCode == 401:
+		return errors.New("Authentication failed: check LFS_ADMINUSER and LFS_ADMINPASS")
+	case e.Message != "":
+		return errors.New(e.Message)
+	case res.StatusCode == 404:
+		return errors.New("Not found: is the admin API enabled on the server?")
+	}
+	return fmt.Errorf("Server responded with %s", res.Status)
+}
+
+func (b *remoteBackend) Users() ([]*MetaUser, error) {
+	var users []*MetaUser
+	return users, b.do("GET", "/users", nil, &users)
+}
+
+func (b *remoteBackend) AddUser(name, password string) error {
+	return b.do("POST", "/users", &AdminUserRequest{Name: name, Password: password}, nil)
+}
+
+func (b *remoteBackend) SetPassword(name, password string) error {
+	return b.do("PUT", "/users/"+url.PathEscape(name), &AdminUserRequest{Password: password}, nil)
+}
+
+func (b *remoteBackend) DeleteUser(name string) error {
+	return b.do("DELETE", "/users/"+url.PathEscape(name), nil, nil)
+}
+
+func (b *remoteBackend) SetRole(name, role string) error {
+	return b.do("PUT", "/users/"+url.PathEscape(name)+"/role", &AdminRoleRequest{Role: role}, nil)
+}
+
+func (b *remoteBackend) Objects(f ObjectFilter, cursor string, limit int) ([]*MetaObject, string, error) {
+	q := url.Values{}
+	q.Set("repo", f.Repo)
+	q.Set("uploader", f.Uploader)
+	q.Set("prefix", f.Prefix)
+	q.Set("min_size", fmt.Sprint(f.MinSize))
+	q.Set("max_size", fmt.Sprint(f.MaxSize))
+	q.Set("sort", f.Order)
+	q.Set("cursor", cursor)
+	q.Set("limit", fmt.Sprint(limit))
+
+	var page struct {
+		Objects    []*MetaObject `json:"objects"`
+		NextCursor string        `json:"next_cursor"`
+	}
+	err := b.do("GET", "/objects?"+q.Encode(), nil, &page)
+	return page.Objects, page.NextCursor, err
+}
+
+func (b *remoteBackend) Object(oid string) (*AdminObject, error) {
+	var obj AdminObject
+	if err := b.do("GET", "/objects/"+url.PathEscape(oid), nil, &obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (b *remoteBackend) Content(oid string) (io.ReadCloser, error) {
+	if _, err := b.Object(oid); err != nil {
+		return nil, err
+	}
+
+	res, err := b.request("GET", "/mgmt/raw/"+url.PathEscape(oid), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (b *remoteBackend) DeleteObject(oid string) error {
+	return b.do("DELETE", "/objects/"+url.PathEscape(oid), nil, nil)
+}
+
+func (b *remoteBackend) Locks(repo, owner string) ([]RepoLock, error) {
+	var locks []RepoLock
+	if err := b.do("GET", "/locks?owner="+url.QueryEscape(owner), nil, &locks); err != nil {
+		return nil, err
+	}
+	return LockSelection{Repo: repo, Owner: owner}.Filter(locks), nil
+}
+
+func (b *remoteBackend) Unlock(repo, id string) (*Lock, error) {
+	var res UnlockResponse
+	if err := b.do("DELETE", "/repos/"+url.PathEscape(repo)+"/locks/"+url.PathEscape(id), nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Lock, nil
+}
+
+func (b *remoteBackend) Repos() ([]*AdminRepo, error) {
+	var repos []*AdminRepo
+	return repos, b.do("GET", "/repos", nil, &repos)
+}
+
+func (b *remoteBackend) Close() {}
+
+// openContentStore opens the content store at LFS_CONTENTPATH, packing small
+// objects if LFS_PACKTHRESHOLD is set.
+func openContentStore() (*ContentStore, error) {
+	if threshold := Config.PackThresholdSize(); threshold > 0 {
+		return NewPackedContentStore(Config.ContentPath, threshold)
+	}
+	return NewContentStore(Config.ContentPath)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// runTestCLI runs an admin command and returns its exit code and output.
+func runTestCLI(stdin string, args ...string) (int, string) {
+	var out, errOut bytes.Buffer
+	code := runCLI(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String() + errOut.String()
+}
+
+// useTestData points the admin commands at a fresh meta store and content
+// store in a temporary directory.
+func useTestData(t *testing.T) string {
+	dir := t.TempDir()
+	metaDB, contentPath := Config.MetaDB, Config.ContentPath
+	Config.MetaDB, Config.ContentPath = filepath.Join(dir, "lfs.db"), filepath.Join(dir, "content")
+	t.Cleanup(func() { Config.MetaDB, Config.ContentPath = metaDB, contentPath })
+	return dir
+}
+
+func TestCLIUsers(t *testing.T) {
+	useTestData(t)
+
+	if code, out := runTestCLI("", "user", "add", "alice", "secret"); code != exitOK {
+		t.Fatalf("expected user add to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "user", "add", "alice", "secret"); code != exitError {
+		t.Errorf("expected adding an existing user to fail with %d, got %d", exitError, code)
+	}
+	if code, out := runTestCLI("changed\n", "user", "passwd", "alice"); code != exitOK {
+		t.Fatalf("expected user passwd to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "user", "del", "bob"); code != exitNotFound {
+		t.Errorf("expected deleting a missing user to exit with %d, got %d", exitNotFound, code)
+	}
+	if code, _ := runTestCLI("", "user", "frob"); code != exitUsage {
+		t.Errorf("expected an unknown command to exit with %d, got %d", exitUsage, code)
+	}
+
+	code, out := runTestCLI("", "-json", "user", "list")
+	var users []MetaUser
+	if code != exitOK || json.Unmarshal([]byte(out), &users) != nil || len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("expected alice in the JSON user list, got %d: %s", code, out)
+	}
+
+	store, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if user, ok := store.Authenticate("alice", "changed"); !ok || user != "alice" {
+		t.Error("expected the password read from stdin to be set")
+	}
+	entries, _, err := store.AuditLog(AuditFilter{Action: "user"}, auditPageSize)
+	if err != nil || len(entries) != 4 || !strings.HasPrefix(entries[0].Actor, "cli") {
+		t.Errorf("expected the user changes to be audited, got %d entries: %v", len(entries), err)
+	}
+}
+
+func TestCLIObjects(t *testing.T) {
+	useTestData(t)
+
+	data := "cli content"
+	sum := sha256.Sum256([]byte(data))
+	meta := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+	store, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Put(&RequestVars{Oid: meta.Oid, Size: meta.Size})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := openContentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := content.Put(meta, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, out := runTestCLI("", "object", "ls"); code != exitOK || !strings.Contains(out, meta.Oid) {
+		t.Errorf("expected the object to be listed, got %d: %s", code, out)
+	}
+	if code, out := runTestCLI("", "object", "cat", meta.Oid); code != exitOK || out != data {
+		t.Errorf("expected the object's content, got %d: %q", code, out)
+	}
+	if code, out := runTestCLI("", "fsck"); code != exitOK {
+		t.Errorf("expected fsck to find no problems, got %d: %s", code, out)
+	}
+
+	orphan := strings.Repeat("ab", 32)
+	path := filepath.Join(Config.ContentPath, transformKey(orphan))
+	os.MkdirAll(filepath.Dir(path), 0750)
+	if err := os.WriteFile(path, []byte("orphan"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if code, out := runTestCLI("", "fsck"); code != exitProblems || !strings.Contains(out, orphan) {
+		t.Errorf("expected fsck to report the orphan, got %d: %s", code, out)
+	}
+	if code, out := runTestCLI("", "gc", "-dry-run"); code != exitOK || !strings.Contains(out, "Would delete "+orphan) {
+		t.Errorf("expected gc -dry-run to list the orphan, got %d: %s", code, out)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("expected gc -dry-run to keep the orphan")
+	}
+	server, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := runTestCLI("", "gc"); code != exitError {
+		t.Errorf("expected gc to fail while a server has the meta store open, got %d", code)
+	}
+	server.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Error("expected gc to keep the orphan while a server runs")
+	}
+	if code, out := runTestCLI("", "gc"); code != exitOK {
+		t.Errorf("expected gc to succeed, got %d: %s", code, out)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected gc to delete the orphan")
+	}
+	if !content.Exists(meta) {
+		t.Error("expected gc to keep the object's content")
+	}
+
+	if code, out := runTestCLI("", "object", "rm", meta.Oid); code != exitOK {
+		t.Errorf("expected object rm to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "object", "stat", meta.Oid); code != exitNotFound {
+		t.Errorf("expected a deleted object to exit with %d, got %d", exitNotFound, code)
+	}
+	if content.Exists(meta) {
+		t.Error("expected the content to be deleted")
+	}
+}
+
+func TestCLIReadOnly(t *testing.T) {
+	useTestData(t)
+
+	// Leave the meta store one migration behind.
+	store, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, latestSchemaVersion()-1)
+	})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"object", "ls"}, {"stats"}} {
+		if code, out := runTestCLI("", args...); code != exitError || !strings.Contains(out, "migrate") {
+			t.Errorf("expected %s to refuse an outdated meta store, got %d: %s", args[0], code, out)
+		}
+	}
+	if backups, _ := filepath.Glob(Config.MetaDB + ".*.bak"); len(backups) != 0 {
+		t.Errorf("expected read-only commands not to back up the meta store, got: %v", backups)
+	}
+
+	if code, out := runTestCLI("", "user", "add", "alice", "secret"); code != exitOK {
+		t.Fatalf("expected user add to migrate the meta store, got %d: %s", code, out)
+	}
+	if code, out := runTestCLI("", "stats"); code != exitOK {
+		t.Errorf("expected stats to succeed once migrated, got %d: %s", code, out)
+	}
+}
+
+func TestCLIExportImport(t *testing.T) {
+	dir := useTestData(t)
+	export := filepath.Join(dir, "export.jsonl")
+
+	if code, out := runTestCLI("", "user", "add", "alice", "secret"); code != exitOK {
+		t.Fatalf("expected user add to succeed, got %d: %s", code, out)
+	}
+	if code, out := runTestCLI("", "export", export); code != exitOK {
+		t.Fatalf("expected export to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "import", export); code != exitError {
+		t.Errorf("expected import into a used meta store to fail, got %d", code)
+	}
+
+	Config.MetaDB = filepath.Join(dir, "imported.db")
+	if code, out := runTestCLI("", "import", export); code != exitOK {
+		t.Fatalf("expected import to succeed, got %d: %s", code, out)
+	}
+
+	store, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, ok := store.Authenticate("alice", "secret"); !ok {
+		t.Error("expected the imported user to authenticate")
+	}
+	entries, _, err := store.AuditLog(AuditFilter{}, auditPageSize)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the audit log to be imported, got %d entries: %v", len(entries), err)
+	}
+	if err := store.AppendAudit(&AuditEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, _ = store.AuditLog(AuditFilter{}, auditPageSize); entries[0].Id != 2 {
+		t.Errorf("expected the bucket sequence to be imported, got id %d", entries[0].Id)
+	}
+}
+
+func TestCLIRemote(t *testing.T) {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	if code, out := runTestCLI("", "-server", lfsServer.URL, "user", "add", "gandalf", "grey"); code != exitOK {
+		t.Fatalf("expected user add to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "-server", lfsServer.URL, "user", "add", "gandalf", "grey"); code != exitError {
+		t.Errorf("expected adding an existing user to fail with %d, got %d", exitError, code)
+	}
+	if code, out := runTestCLI("", "-server", lfsServer.URL, "user", "del", "gandalf"); code != exitOK {
+		t.Errorf("expected user del to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "-server", lfsServer.URL, "object", "stat", nonExistingOid); code != exitNotFound {
+		t.Errorf("expected a missing object to exit with %d, got %d", exitNotFound, code)
+	}
+	if code, out := runTestCLI("", "-server", lfsServer.URL, "object", "cat", contentOid); code != exitOK || out != content {
+		t.Errorf("expected the object's content, got %d: %q", code, out)
+	}
+	if code, _ := runTestCLI("", "-server", lfsServer.URL, "fsck"); code != exitError {
+		t.Errorf("expected fsck with -server to fail with %d, got %d", exitError, code)
+	}
+
+	lock, err := createRefLock("/bilbo/clirepo/locks", "cli.psd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, out := runTestCLI("", "-json", "-server", lfsServer.URL, "lock", "ls", "-repo", "clirepo")
+	var locks []RepoLock
+	if code != exitOK || json.Unmarshal([]byte(out), &locks) != nil || len(locks) != 1 || locks[0].Lock.Id != lock.Id {
+		t.Fatalf("expected the lock to be listed, got %d: %s", code, out)
+	}
+	if code, out := runTestCLI("", "-server", lfsServer.URL, "lock", "unlock", "clirepo", lock.Id); code != exitOK {
+		t.Errorf("expected lock unlock to succeed, got %d: %s", code, out)
+	}
+	if code, _ := runTestCLI("", "-server", lfsServer.URL, "lock", "unlock", "clirepo", lock.Id); code != exitNotFound {
+		t.Errorf("expected unlocking a released lock to exit with %d, got %d", exitNotFound, code)
+	}
+}
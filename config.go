@@ -4,34 +4,47 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Configuration holds application configuration. Values will be pulled from
 // environment variables, prefixed by keyPrefix. Default values can be added
 // via tags.
 type Configuration struct {
-	Listen      string `config:"tcp://:8080"`
-	Host        string `config:"localhost:8080"`
-	ExtOrigin   string `config:""` // consider lfs-test-server may behind a reverse proxy
-	MetaDB      string `config:"lfs.db"`
-	ContentPath string `config:"lfs-content"`
-	AdminUser   string `config:""`
-	AdminPass   string `config:""`
-	Cert        string `config:""`
-	Key         string `config:""`
-	Scheme      string `config:"http"`
-	Public      string `config:"public"`
-	UseTus      string `config:"false"`
-	TusHost     string `config:"localhost:1080"`
+	Listen             string `config:"tcp://:8080"`
+	Host               string `config:"localhost:8080"`
+	ExtOrigin          string `config:""` // consider lfs-test-server may behind a reverse proxy
+	MetaDB             string `config:"lfs.db"`
+	ContentPath        string `config:"lfs-content"`
+	AdminUser          string `config:""`
+	AdminPass          string `config:""`
+	Cert               string `config:""`
+	Key                string `config:""`
+	Scheme             string `config:"http"`
+	Public             string `config:"public"`
+	UseTus             string `config:"false"`
+	TusHost            string `config:"localhost:1080"`
+	PackThreshold      string `config:"0"`
+	RepoQuota          string `config:"0"`
+	UserQuota          string `config:"0"`
+	MaxObjectSize      string `config:"0"`
+	RetentionInterval  string `config:""`
+	LockTTL            string `config:""`
+	AuditRetention     string `config:"2160h"`
+	AuditMaxEntries    string `config:"1000000"`
+	SessionTimeout     string `config:"30m"`
+	AutoCreateRepos    string `config:"true"`
+	ReservationTimeout string `config:"24h"`
 }
 
 func (c *Configuration) IsHTTPS() bool {
-	return strings.Contains(Config.Scheme, "https")
+	return strings.Contains(c.Scheme, "https")
 }
 
 func (c *Configuration) IsPublic() bool {
-	switch Config.Public {
+	switch c.Public {
 	case "1", "true", "TRUE":
 		return true
 	}
@@ -39,13 +52,171 @@ func (c *Configuration) IsPublic() bool {
 }
 
 func (c *Configuration) IsUsingTus() bool {
-	switch Config.UseTus {
+	switch c.UseTus {
 	case "1", "true", "TRUE":
 		return true
 	}
 	return false
 }
 
+// IsAutoCreatingRepos reports whether repositories are registered the first
+// time something is uploaded to or locked in them.
+func (c *Configuration) IsAutoCreatingRepos() bool {
+	switch c.AutoCreateRepos {
+	case "1", "true", "TRUE":
+		return true
+	}
+	return false
+}
+
+// PackThresholdSize returns the size below which objects are stored in pack
+// files. Zero disables packing.
+func (c *Configuration) PackThresholdSize() int64 {
+	return sizeOrZero(c.PackThreshold)
+}
+
+// RepoQuotaSize returns the default number of bytes a repository may store.
+// Zero means unlimited.
+func (c *Configuration) RepoQuotaSize() int64 {
+	return sizeOrZero(c.RepoQuota)
+}
+
+// UserQuotaSize returns the default number of bytes a user may store. Zero
+// means unlimited.
+func (c *Configuration) UserQuotaSize() int64 {
+	return sizeOrZero(c.UserQuota)
+}
+
+// MaxObjectSizeBytes returns the largest object that may be uploaded. Zero
+// means unlimited.
+func (c *Configuration) MaxObjectSizeBytes() int64 {
+	return sizeOrZero(c.MaxObjectSize)
+}
+
+// RetentionIntervalDuration returns how often retention rules are applied.
+// Zero disables scheduled retention.
+func (c *Configuration) RetentionIntervalDuration() time.Duration {
+	d, err := time.ParseDuration(c.RetentionInterval)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// LockTTLDuration returns how long locks last without being renewed, unless a
+// repository's lock policy says otherwise. Zero means locks never expire.
+func (c *Configuration) LockTTLDuration() time.Duration {
+	d, err := time.ParseDuration(c.LockTTL)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// AuditRetentionDuration returns how long audit log entries are kept. Zero
+// keeps them forever.
+func (c *Configuration) AuditRetentionDuration() time.Duration {
+	d, err := time.ParseDuration(c.AuditRetention)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// defaultSessionTimeout is how long mgmt sessions last without activity when
+// LFS_SESSIONTIMEOUT is not a valid duration.
+const defaultSessionTimeout = 30 * time.Minute
+
+// SessionTimeoutDuration returns how long a mgmt session lasts without
+// activity.
+func (c *Configuration) SessionTimeoutDuration() time.Duration {
+	d, err := time.ParseDuration(c.SessionTimeout)
+	if err != nil || d <= 0 {
+		return defaultSessionTimeout
+	}
+	return d
+}
+
+// defaultReservationTimeout is how long storage reservations last without
+// being confirmed when LFS_RESERVATIONTIMEOUT is not a valid duration.
+const defaultReservationTimeout = 24 * time.Hour
+
+// ReservationTimeoutDuration returns how long storage reserved for an upload
+// is kept if the upload doesn't finish.
+func (c *Configuration) ReservationTimeoutDuration() time.Duration {
+	d, err := time.ParseDuration(c.ReservationTimeout)
+	if err != nil || d <= 0 {
+		return defaultReservationTimeout
+	}
+	return d
+}
+
+// AuditMaxEntriesCount returns how many audit log entries are kept. Zero
+// means unlimited.
+func (c *Configuration) AuditMaxEntriesCount() int {
+	n, err := strconv.Atoi(c.AuditMaxEntries)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// sizeOrZero parses a size setting that Validate has already checked.
+func sizeOrZero(s string) int64 {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Validate checks the size settings, so that a typo is reported at startup
+// instead of silently disabling packing or a quota.
+func (c *Configuration) Validate() error {
+	sizes := []struct{ name, value string }{
+		{"PackThreshold", c.PackThreshold},
+		{"RepoQuota", c.RepoQuota},
+		{"UserQuota", c.UserQuota},
+		{"MaxObjectSize", c.MaxObjectSize},
+	}
+	for _, s := range sizes {
+		if _, err := parseByteSize(s.value); err != nil {
+			return fmt.Errorf("%s_%s: %s", keyPrefix, strings.ToUpper(s.name), err)
+		}
+	}
+	return nil
+}
+
+// parseByteSize parses a byte count with an optional K, M, G or T suffix,
+// e.g. "512", "64K" or "10G".
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	case 'T':
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
 // Config is the global app configuration
 var Config = &Configuration{}
 
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -14,23 +16,62 @@ var (
 	errSizeMismatch = errors.New("Content size does not match")
 )
 
-// ContentStore provides a simple file system based storage.
+// ContentStore provides a simple file system based storage. Objects are stored
+// as loose files, unless packing is enabled, in which case objects below the
+// pack threshold are appended to shared pack files.
 type ContentStore struct {
 	basePath string
+	packs    *packStore
 }
 
-// NewContentStore creates a ContentStore at the base directory.
+// NewContentStore creates a ContentStore at the base directory. Objects packed
+// while packing was enabled are still served, but new objects are stored as
+// loose files.
 func NewContentStore(base string) (*ContentStore, error) {
 	if err := os.MkdirAll(base, 0750); err != nil {
 		return nil, err
 	}
 
-	return &ContentStore{base}, nil
+	s := &ContentStore{basePath: base}
+	dir := filepath.Join(base, packDir)
+	if _, err := os.Stat(dir); err == nil {
+		if s.packs, err = openPackStore(dir, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// NewPackedContentStore creates a ContentStore at the base directory that packs
+// objects smaller than threshold bytes into pack files.
+func NewPackedContentStore(base string, threshold int64) (*ContentStore, error) {
+	s, err := NewContentStore(base)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.packs != nil {
+		s.packs.threshold = threshold
+		return s, nil
+	}
+	if s.packs, err = openPackStore(filepath.Join(base, packDir), threshold); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 // Get takes a Meta object and retreives the content from the store, returning
 // it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
 func (s *ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	if s.packs != nil {
+		r, err := s.packs.get(meta.Oid, fromByte)
+		if err != errPackEntryNotFound {
+			return r, err
+		}
+	}
+
 	path := filepath.Join(s.basePath, transformKey(meta.Oid))
 
 	f, err := os.Open(path)
@@ -45,6 +86,10 @@ func (s *ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, err
 
 // Put takes a Meta object and an io.Reader and writes the content to the store.
 func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
+	if s.packs != nil && meta.Size < s.packs.threshold {
+		return s.putPacked(meta, r)
+	}
+
 	path := filepath.Join(s.basePath, transformKey(meta.Oid))
 	tmpPath := path + ".tmp"
 
@@ -84,8 +129,35 @@ func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
 	return nil
 }
 
+// putPacked verifies the content in memory and appends it to a pack file.
+func (s *ContentStore) putPacked(meta *MetaObject, r io.Reader) error {
+	var buf bytes.Buffer
+	hash := sha256.New()
+	hw := io.MultiWriter(hash, &buf)
+
+	written, err := io.Copy(hw, io.LimitReader(r, meta.Size+1))
+	if err != nil {
+		return err
+	}
+
+	if written != meta.Size {
+		return errSizeMismatch
+	}
+
+	shaStr := hex.EncodeToString(hash.Sum(nil))
+	if shaStr != meta.Oid {
+		return errHashMismatch
+	}
+
+	return s.packs.put(meta.Oid, buf.Bytes())
+}
+
 // Exists returns true if the object exists in the content store.
 func (s *ContentStore) Exists(meta *MetaObject) bool {
+	if s.packs != nil && s.packs.exists(meta.Oid) {
+		return true
+	}
+
 	path := filepath.Join(s.basePath, transformKey(meta.Oid))
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
@@ -93,6 +165,107 @@ func (s *ContentStore) Exists(meta *MetaObject) bool {
 	return true
 }
 
+// ContentLocation describes where an object's content is stored.
+type ContentLocation struct {
+	// Path is the loose file, or the pack file holding the object.
+	Path   string
+	Packed bool
+	Offset int64
+	// Size is the number of bytes stored.
+	Size int64
+}
+
+// Locate returns where the content of meta is stored, or nil if it is not
+// in the store.
+func (s *ContentStore) Locate(meta *MetaObject) (*ContentLocation, error) {
+	if s.packs != nil {
+		entry, err := s.packs.lookup(meta.Oid)
+		if err == nil {
+			return &ContentLocation{Path: s.packs.packPath(entry.Pack), Packed: true, Offset: entry.Offset, Size: entry.Length}, nil
+		}
+		if err != errPackEntryNotFound {
+			return nil, err
+		}
+	}
+
+	path := filepath.Join(s.basePath, transformKey(meta.Oid))
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ContentLocation{Path: path, Size: info.Size()}, nil
+}
+
+// Delete removes the object's content from the store. Deleting content that
+// does not exist is not an error.
+func (s *ContentStore) Delete(meta *MetaObject) error {
+	if s.packs != nil {
+		found, err := s.packs.delete(meta.Oid)
+		if err != nil || found {
+			return err
+		}
+	}
+
+	path := filepath.Join(s.basePath, transformKey(meta.Oid))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Walk calls fn with the oid and size of every object in the store, packed
+// objects first. Files that don't hold an object, such as the packs and
+// unfinished uploads, are skipped.
+func (s *ContentStore) Walk(fn func(oid string, size int64) error) error {
+	if s.packs != nil {
+		if err := s.packs.walk(fn); err != nil {
+			return err
+		}
+	}
+
+	return filepath.Walk(s.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(s.basePath, packDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.basePath, path)
+		if err != nil {
+			return err
+		}
+		oid := strings.Replace(filepath.ToSlash(rel), "/", "", -1)
+		if len(oid) != 64 {
+			return nil
+		}
+		return fn(oid, info.Size())
+	})
+}
+
+// Compact reclaims space held by deleted objects in pack files and returns the
+// number of bytes reclaimed. It is a no-op when packing is disabled.
+func (s *ContentStore) Compact() (int64, error) {
+	if s.packs == nil {
+		return 0, nil
+	}
+	return s.packs.compact()
+}
+
+// Close releases the resources held by the store.
+func (s *ContentStore) Close() error {
+	if s.packs == nil {
+		return nil
+	}
+	return s.packs.close()
+}
+
 func transformKey(key string) string {
 	if len(key) < 5 {
 		return key
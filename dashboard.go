@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// dashboardTopSize is the number of repositories and users ranked on the
+// dashboard.
+const dashboardTopSize = 10
+
+// trafficWindow is a period the dashboard reports traffic for, made of the
+// current hour and the ones before it.
+type trafficWindow struct {
+	Name  string
+	Hours int
+}
+
+var trafficWindows = []trafficWindow{
+	{"24h", 24},
+	{"7d", 7 * 24},
+	{"30d", 30 * 24},
+}
+
+// DiskUsage is the size of a file system and the space available on it.
+type DiskUsage struct {
+	Total int64 `json:"total"`
+	Free  int64 `json:"free"`
+}
+
+// Percent returns the share of the file system in use.
+func (d *DiskUsage) Percent() int {
+	if d.Total <= 0 {
+		return 0
+	}
+	return int((d.Total - d.Free) * 100 / d.Total)
+}
+
+// Dashboard summarizes the storage and traffic of the server. Everything in
+// it is kept up to date as the server runs, so it is cheap to compute on any
+// size of store.
+type Dashboard struct {
+	Stored StoreStats `json:"stored"`
+	// Disk is nil if the space on the content store's file system is not
+	// known.
+	Disk  *DiskUsage `json:"disk,omitempty"`
+	Locks int        `json:"locks"`
+	// Repos and Users are those storing the most bytes.
+	Repos   []*Usage       `json:"repos"`
+	Users   []*Usage       `json:"users"`
+	Window  string         `json:"window"`
+	Traffic *TrafficReport `json:"traffic"`
+	Errors  []LoggedError  `json:"errors"`
+}
+
+// dashboard returns the dashboard with the traffic of the named window, or of
+// the first one if window is empty.
+func (a *App) dashboard(window string) (*Dashboard, error) {
+	w := trafficWindows[0]
+	if window != "" {
+		found := false
+		for _, tw := range trafficWindows {
+			if tw.Name == window {
+				w, found = tw, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Invalid window: %q", window)
+		}
+	}
+
+	d := &Dashboard{Window: w.Name, Errors: logger.RecentErrors()}
+
+	stored, err := a.metaStore.StoreStats()
+	if err != nil {
+		return nil, err
+	}
+	d.Stored = *stored
+
+	if disk, err := diskUsage(a.contentStore.basePath); err == nil {
+		d.Disk = disk
+	}
+
+	if d.Locks, err = a.metaStore.LockCount(); err != nil {
+		return nil, err
+	}
+
+	if d.Repos, err = topUsages(a.metaStore, quotaRepo); err != nil {
+		return nil, err
+	}
+	if d.Users, err = topUsages(a.metaStore, quotaUser); err != nil {
+		return nil, err
+	}
+
+	if d.Traffic, err = a.metaStore.Traffic(time.Now().Add(-time.Duration(w.Hours-1) * time.Hour)); err != nil {
+		return nil, err
+	}
+	d.Traffic.Repos = topTraffic(d.Traffic.Repos)
+	d.Traffic.Users = topTraffic(d.Traffic.Users)
+	return d, nil
+}
+
+// topUsages returns the repositories or users storing the most bytes.
+func topUsages(s *MetaStore, kind string) ([]*Usage, error) {
+	usages, err := s.Usages(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := usages[:0]
+	for _, u := range usages {
+		if u.Bytes > 0 {
+			stored = append(stored, u)
+		}
+	}
+	sort.SliceStable(stored, func(i, j int) bool { return stored[i].Bytes > stored[j].Bytes })
+	if len(stored) > dashboardTopSize {
+		stored = stored[:dashboardTopSize]
+	}
+	return stored, nil
+}
+
+func topTraffic(counts []*TrafficCounts) []*TrafficCounts {
+	if len(counts) > dashboardTopSize {
+		return counts[:dashboardTopSize]
+	}
+	return counts
+}
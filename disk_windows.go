@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// diskUsage is not supported on Windows.
+func diskUsage(path string) (*DiskUsage, error) {
+	return nil, errors.New("Disk usage is not supported on Windows")
+}
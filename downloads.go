@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// downloadFlushInterval is how often buffered download statistics are written
+// to the meta store.
+const downloadFlushInterval = 5 * time.Second
+
+// downloadRecorder buffers object download statistics in memory and writes
+// them to the meta store periodically, so a download doesn't cost a bolt
+// write transaction.
+type downloadRecorder struct {
+	store *MetaStore
+
+	mu      sync.Mutex
+	pending map[string]*downloadStat
+}
+
+// newDownloadRecorder creates a downloadRecorder that flushes to store every
+// interval.
+func newDownloadRecorder(store *MetaStore, interval time.Duration) *downloadRecorder {
+	r := &downloadRecorder{store: store, pending: make(map[string]*downloadStat)}
+	go r.loop(interval)
+	return r
+}
+
+// Record notes a download of oid at the given time.
+func (r *downloadRecorder) Record(oid string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.merge(oid, 1, at)
+}
+
+// Flush writes the buffered statistics to the meta store.
+func (r *downloadRecorder) Flush() error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*downloadStat)
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	err := r.store.RecordDownloads(pending)
+	if err != nil {
+		// Keep the statistics for the next flush.
+		r.mu.Lock()
+		for oid, stat := range pending {
+			r.merge(oid, stat.Count, stat.Last)
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// merge adds count downloads of oid, the last at last, to the pending
+// statistics. The caller holds r.mu.
+func (r *downloadRecorder) merge(oid string, count int64, last time.Time) {
+	stat, ok := r.pending[oid]
+	if !ok {
+		stat = &downloadStat{}
+		r.pending[oid] = stat
+	}
+	stat.Count += count
+	if last.After(stat.Last) {
+		stat.Last = last
+	}
+}
+
+func (r *downloadRecorder) loop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := r.Flush(); err != nil {
+			logger.Log(kv{"fn": "downloadRecorder", "err": err.Error()})
+		}
+	}
+}
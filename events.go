@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published by the server.
+const (
+	eventObjectUploaded   = "object.uploaded"
+	eventLockCreated      = "lock.created"
+	eventLockReleased     = "lock.released"
+	eventBatch            = "batch"
+	eventTransferStarted  = "transfer.started"
+	eventTransferFinished = "transfer.finished"
+	eventAuthFailed       = "auth.failed"
+)
+
+// webhookEvents are the event types delivered to webhooks. The others are
+// only streamed to live subscribers.
+var webhookEvents = map[string]bool{
+	eventObjectUploaded: true,
+	eventLockCreated:    true,
+	eventLockReleased:   true,
+}
+
+const (
+	// eventBufferSize is the number of events a slow live subscriber may
+	// fall behind by before events are dropped for it.
+	eventBufferSize = 256
+	// eventKeepAlive is how often an idle event stream sends a comment to
+	// keep proxies from closing it.
+	eventKeepAlive = 15 * time.Second
+)
+
+// Event describes something that happened on the server. It is the payload
+// of webhook deliveries and of the live event stream.
+type Event struct {
+	Id     string       `json:"id"`
+	Type   string       `json:"type"`
+	Repo   string       `json:"repo,omitempty"`
+	User   string       `json:"user,omitempty"`
+	Time   time.Time    `json:"time"`
+	Object *EventObject `json:"object,omitempty"`
+	Lock   *Lock        `json:"lock,omitempty"`
+	Force  bool         `json:"force,omitempty"`
+
+	// Operation is "upload" or "download" for batch and transfer events.
+	Operation string `json:"operation,omitempty"`
+	// Count is the number of objects in a batch request.
+	Count int `json:"count,omitempty"`
+	// Bytes is the size of a transfer, or the bytes sent once it finished.
+	Bytes int64 `json:"bytes,omitempty"`
+	// DurationMs is how long a finished transfer took.
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	// Status is the HTTP status a request finished with.
+	Status     int    `json:"status,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// EventObject identifies the object of an event.
+type EventObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// publish stamps e with an id and the current time, streams it to live
+// subscribers and hands it to the webhooks.
+func (a *App) publish(e *Event) {
+	e.Id = randomEventId()
+	e.Time = time.Now().UTC()
+
+	a.events.Broadcast(e)
+	a.traffic.Record(e)
+
+	if webhookEvents[e.Type] {
+		a.webhooks.Publish(e)
+	}
+}
+
+func randomEventId() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return fmt.Sprintf("%x", id[:])
+}
+
+// eventSubscription receives the events of a repository and of event types.
+// An empty repo or list of types matches all of them.
+type eventSubscription struct {
+	repo  string
+	types []string
+	C     chan *Event
+}
+
+// matches reports whether the subscription wants e. A type matches events of
+// that type, and also those of its subtypes: "lock" matches "lock.created".
+func (s *eventSubscription) matches(e *Event) bool {
+	if s.repo != "" && s.repo != e.Repo {
+		return false
+	}
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == e.Type || strings.HasPrefix(e.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// eventHub fans events out to live subscribers. Publishing never blocks: a
+// subscriber that falls more than eventBufferSize events behind misses the
+// events that don't fit.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*eventSubscription]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*eventSubscription]struct{})}
+}
+
+// Subscribe returns a subscription to the events of repo and types.
+func (h *eventHub) Subscribe(repo string, types []string) *eventSubscription {
+	s := &eventSubscription{repo: repo, types: types, C: make(chan *Event, eventBufferSize)}
+
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Unsubscribe stops sending events to s.
+func (h *eventHub) Unsubscribe(s *eventSubscription) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// Broadcast sends e to every subscription that matches it.
+func (h *eventHub) Broadcast(e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		if !s.matches(e) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+		}
+	}
+}
+
+// eventStreamHandler streams events as Server-Sent Events until the client
+// disconnects. The repo and type query parameters filter the events; type
+// takes a comma separated list.
+func (a *App) eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, r, 500)
+		return
+	}
+
+	sub := a.events.Subscribe(r.FormValue("repo"), splitList(r.FormValue("type")))
+	defer a.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-sub.C:
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.Log(kv{"fn": "eventStreamHandler", "err": err.Error()})
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
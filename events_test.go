@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventSubscriptionMatches(t *testing.T) {
+	e := &Event{Type: eventTransferFinished, Repo: "repo"}
+
+	cases := []struct {
+		sub  eventSubscription
+		want bool
+	}{
+		{eventSubscription{}, true},
+		{eventSubscription{repo: "repo"}, true},
+		{eventSubscription{repo: "other"}, false},
+		{eventSubscription{types: []string{"transfer"}}, true},
+		{eventSubscription{types: []string{eventBatch, eventTransferFinished}}, true},
+		{eventSubscription{types: []string{"trans"}}, false},
+		{eventSubscription{repo: "repo", types: []string{"lock"}}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.sub.matches(e); got != c.want {
+			t.Errorf("expected subscription to %q %v to match to be %v", c.sub.repo, c.sub.types, c.want)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	stream := httptest.NewServer(http.HandlerFunc(lfsApp.eventStreamHandler))
+	defer stream.Close()
+
+	res, err := http.Get(stream.URL + "?repo=streamrepo&type=lock,auth")
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", ct)
+	}
+
+	// Not in the stream: another repository, and a type that isn't wanted.
+	if _, err := createRefLock("/bilbo/otherrepo/locks", "stream.psd", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batchUpload("/bilbo/streamrepo/objects/batch", contentOid, contentSize); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := createRefLock("/bilbo/streamrepo/locks", "stream.psd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The challenge of a request without credentials is not a failure.
+	if _, err := api("POST", "/bilbo/streamrepo/locks", metaMediaType, "", "", bytes.NewBufferString(`{"path":"x"}`)); err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if _, err := api("GET", "/bilbo/streamrepo/locks", metaMediaType, testUser, "wrong", nil); err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	events := make(chan *Event)
+	go func() {
+		var typ string
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var e Event
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil || e.Type != typ {
+					close(events)
+					return
+				}
+				events <- &e
+			}
+		}
+	}()
+
+	for _, want := range []string{eventLockCreated, eventAuthFailed} {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("expected a valid event in the stream")
+			}
+			if e.Type != want || e.Repo != "streamrepo" {
+				t.Fatalf("expected %s event for streamrepo, got %s for %s", want, e.Type, e.Repo)
+			}
+			if e.Type == eventLockCreated && (e.Lock == nil || e.Lock.Id != lock.Id) {
+				t.Errorf("expected lock %s in the event, got %+v", lock.Id, e.Lock)
+			}
+			if e.Type == eventAuthFailed && (e.User != testUser || e.Status != 401) {
+				t.Errorf("expected failed authentication of %s, got %+v", testUser, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a %s event", want)
+		}
+	}
+}
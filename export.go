@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// An export is the whole meta store as JSON lines. Each bucket, nested
+// buckets included, is written as a record with its path and sequence before
+// the records of its keys, so the dump can be replayed in order by Import.
+// Keys and values are opaque bytes and are base64 encoded.
+
+var errImportNotEmpty = errors.New("The meta store already holds users or objects; import into a new database")
+
+// exportRecord is a line of an export: a bucket when Key is nil, otherwise a
+// key of the bucket at Bucket.
+type exportRecord struct {
+	Bucket   []string `json:"bucket"`
+	Sequence uint64   `json:"sequence,omitempty"`
+	Key      []byte   `json:"key,omitempty"`
+	Value    []byte   `json:"value,omitempty"`
+}
+
+// Export writes every bucket of the meta store to w.
+func (s *MetaStore) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	var export func(path []string, b *bolt.Bucket) error
+	export = func(path []string, b *bolt.Bucket) error {
+		if err := enc.Encode(&exportRecord{Bucket: path, Sequence: b.Sequence()}); err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return export(append(path[:len(path):len(path)], string(k)), b.Bucket(k))
+			}
+			return enc.Encode(&exportRecord{Bucket: path, Key: k, Value: v})
+		})
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return export([]string{string(name)}, b)
+		})
+	})
+}
+
+// Import loads an export written by Export, in a single transaction. It
+// refuses to import into a meta store that already has users or objects.
+// The schema version is imported with the data, so the caller should migrate
+// the store afterwards.
+func (s *MetaStore) Import(r io.Reader) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, objectsBucket} {
+			if k, _ := tx.Bucket(name).Cursor().First(); k != nil {
+				return errImportNotEmpty
+			}
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var rec exportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return fmt.Errorf("Line %d: %s", line, err)
+			}
+			if len(rec.Bucket) == 0 {
+				return fmt.Errorf("Line %d: missing bucket", line)
+			}
+
+			b, err := tx.CreateBucketIfNotExists([]byte(rec.Bucket[0]))
+			for _, name := range rec.Bucket[1:] {
+				if err != nil {
+					break
+				}
+				b, err = b.CreateBucketIfNotExists([]byte(name))
+			}
+			if err != nil {
+				return fmt.Errorf("Line %d: %s", line, err)
+			}
+
+			if rec.Key == nil {
+				if err := b.SetSequence(rec.Sequence); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := b.Put(rec.Key, rec.Value); err != nil {
+				return fmt.Errorf("Line %d: %s", line, err)
+			}
+			n++
+		}
+		return scanner.Err()
+	})
+	return n, err
+}
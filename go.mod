@@ -2,7 +2,6 @@ module github.com/git-lfs/lfs-test-server
 
 require (
 	github.com/boltdb/bolt v1.3.1
-	github.com/gorilla/context v1.1.2
 	github.com/gorilla/mux v1.8.1
 	golang.org/x/sys v0.15.0 // indirect
 )
@@ -28,10 +28,25 @@ func init() {
 
 type kv map[string]interface{}
 
+// recentErrorsSize is the number of errors a KVLogger keeps for the
+// dashboard.
+const recentErrorsSize = 20
+
+// LoggedError is a logged message about an error: one with an "err" key or a
+// 5xx status.
+type LoggedError struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
 // KVLogger provides a logger that logs data in key/value pairs.
 type KVLogger struct {
 	w  io.Writer
 	mu sync.Mutex
+
+	// errors holds the most recent errors, oldest first.
+	errors []LoggedError
 }
 
 // NewKVLogger creates a KVLogger that writes to `out`.
@@ -53,19 +68,47 @@ func (l *KVLogger) Log(data kv) {
 		line = 0
 	}
 
-	out := fmt.Sprintf("%s %s lfs[%d] [%s:%d]: ", time.Now().UTC().Format(time.RFC3339), hostname, pid, file, line)
+	now := time.Now().UTC()
+	out := fmt.Sprintf("%s %s lfs[%d] [%s:%d]: ", now.Format(time.RFC3339), hostname, pid, file, line)
 	var vals []string
 
 	for k, v := range data {
 		vals = append(vals, fmt.Sprintf("%s=%v", k, v))
 	}
-	out += strings.Join(vals, " ")
+	message := strings.Join(vals, " ")
+	out += message
 
 	l.mu.Lock()
 	fmt.Fprint(l.w, out+"\n")
+	if isError(data) {
+		if len(l.errors) == recentErrorsSize {
+			l.errors = l.errors[1:]
+		}
+		l.errors = append(l.errors, LoggedError{Time: now, Source: fmt.Sprintf("%s:%d", file, line), Message: message})
+	}
 	l.mu.Unlock()
 }
 
+// RecentErrors returns the most recently logged errors, newest first.
+func (l *KVLogger) RecentErrors() []LoggedError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errors := make([]LoggedError, len(l.errors))
+	for i, e := range l.errors {
+		errors[len(errors)-1-i] = e
+	}
+	return errors
+}
+
+func isError(data kv) bool {
+	if _, ok := data["err"]; ok {
+		return true
+	}
+	status, ok := data["status"].(int)
+	return ok && status >= 500
+}
+
 // Fatal is equivalent to Log() follwed by a call to os.Exit(1)
 func (l *KVLogger) Fatal(data kv) {
 	l.Log(data)
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Lock history is kept in a bucket per repository inside lockHistoryBucket:
+//
+//	events: seq (uint64 BE)               -> JSON LockEvent
+//	paths:  path key 0x00 seq (uint64 BE) -> nil
+//
+// Events are recorded in the same transaction as the change they describe.
+var (
+	lockEventsBucket     = []byte("events")
+	lockEventPathsBucket = []byte("paths")
+)
+
+// lockHistoryPageSize is the number of events shown on the lock history page.
+const lockHistoryPageSize = 200
+
+// Lock history actions.
+const (
+	lockCreated       = "created"
+	lockReleased      = "released"
+	lockForceReleased = "force-released"
+	lockExpired       = "expired"
+	lockTransferred   = "transferred"
+)
+
+// LockEvent records a change to a lock.
+type LockEvent struct {
+	Action string `json:"action"`
+	LockId string `json:"lock_id"`
+	Path   string `json:"path"`
+	// Owner is the owner of the lock before the event.
+	Owner string `json:"owner"`
+	// NewOwner is the owner a lock was transferred to.
+	NewOwner string `json:"new_owner,omitempty"`
+	// User made the change. It is empty for expired locks.
+	User string    `json:"user,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// newLockEvent returns an event for l by user at the current time.
+func newLockEvent(action string, l *Lock, user string) *LockEvent {
+	return &LockEvent{
+		Action: action,
+		LockId: l.Id,
+		Path:   l.Path,
+		Owner:  l.Owner.Name,
+		User:   user,
+		At:     time.Now().UTC(),
+	}
+}
+
+// recordLockEvent appends e to the history of repo.
+func recordLockEvent(tx *bolt.Tx, repo string, e *LockEvent) error {
+	history, err := tx.Bucket(lockHistoryBucket).CreateBucketIfNotExists([]byte(repo))
+	if err != nil {
+		return err
+	}
+	events, err := history.CreateBucketIfNotExists(lockEventsBucket)
+	if err != nil {
+		return err
+	}
+	paths, err := history.CreateBucketIfNotExists(lockEventPathsBucket)
+	if err != nil {
+		return err
+	}
+
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := events.Put(seqKey(seq), data); err != nil {
+		return err
+	}
+	return paths.Put(append([]byte(lockPathKey(e.Path)+"\x00"), seqKey(seq)...), nil)
+}
+
+// LockHistory returns the most recent events of repo, newest first. If path
+// is set only the events of locks on that path are returned. A limit of zero
+// returns all events.
+func (s *MetaStore) LockHistory(repo, path string, limit int) ([]*LockEvent, error) {
+	var events []*LockEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(lockHistoryBucket).Bucket([]byte(repo))
+		if history == nil {
+			return nil
+		}
+		bucket := history.Bucket(lockEventsBucket)
+
+		add := func(data []byte) (bool, error) {
+			var e LockEvent
+			if err := json.Unmarshal(data, &e); err != nil {
+				return false, err
+			}
+			events = append(events, &e)
+			return limit == 0 || len(events) < limit, nil
+		}
+
+		if path == "" {
+			c := bucket.Cursor()
+			for k, v := c.Last(); k != nil; k, v = c.Prev() {
+				if more, err := add(v); err != nil || !more {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var seqs [][]byte
+		err := scanIndex(history.Bucket(lockEventPathsBucket), lockPathKey(path), func(seq string) error {
+			seqs = append(seqs, []byte(seq))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := len(seqs) - 1; i >= 0; i-- {
+			data := bucket.Get(seqs[i])
+			if data == nil {
+				continue
+			}
+			if more, err := add(data); err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+	return events, err
+}
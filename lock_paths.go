@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var errInvalidLockPath = errors.New("Invalid lock path")
+
+// Lock paths come in three kinds: a file path such as "art/hero.psd", a
+// directory path with a trailing slash such as "art/", which covers every
+// path beneath it, and a glob asked for with the "glob:" prefix such as
+// "glob:art/*.psd", matched with path.Match so that "*" does not cross
+// directories. Without the prefix, "*", "?" and "[" are ordinary characters.
+const (
+	lockFile = iota
+	lockDir
+	lockGlob
+)
+
+// globPrefix marks a lock path as a glob.
+const globPrefix = "glob:"
+
+// normalizeLockPath cleans a lock path: backslashes become slashes, duplicate
+// slashes and "." segments are removed, ".." segments are resolved and
+// leading slashes are dropped. A trailing slash is kept to mark a directory,
+// and case is kept. Paths that are empty, escape the repository or are
+// malformed globs are rejected with errInvalidLockPath.
+func normalizeLockPath(p string) (string, error) {
+	glob := strings.HasPrefix(p, globPrefix)
+	p = strings.ReplaceAll(strings.TrimPrefix(p, globPrefix), "\\", "/")
+	dir := strings.HasSuffix(p, "/")
+
+	p = path.Clean(strings.TrimLeft(p, "/"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", errInvalidLockPath
+	}
+	if dir {
+		p += "/"
+	}
+
+	if glob {
+		if _, err := path.Match(p, ""); err != nil {
+			return "", errInvalidLockPath
+		}
+		p = globPrefix + p
+	}
+	return p, nil
+}
+
+// lockPathKey returns the key locks on p are compared and indexed by: the
+// normalized path.
+func lockPathKey(p string) string {
+	if n, err := normalizeLockPath(p); err == nil {
+		p = n
+	}
+	return p
+}
+
+// lockKind returns the kind of the lock path key.
+func lockKind(key string) int {
+	switch {
+	case strings.HasPrefix(key, globPrefix):
+		return lockGlob
+	case strings.HasSuffix(key, "/"):
+		return lockDir
+	}
+	return lockFile
+}
+
+// globPattern returns the pattern of the glob key.
+func globPattern(key string) string {
+	return strings.TrimPrefix(key, globPrefix)
+}
+
+// literalPrefix returns the directories of the glob key before its first
+// wildcard. Every path the glob matches starts with it.
+func literalPrefix(key string) string {
+	key = globPattern(key)
+	i := strings.IndexAny(key, "*?[")
+	if i < 0 {
+		return key
+	}
+	return key[:strings.LastIndex(key[:i], "/")+1]
+}
+
+// globCoversDir reports whether the glob key can match a path beneath the
+// directory key.
+func globCoversDir(glob, dir string) bool {
+	gs := strings.Split(globPattern(glob), "/")
+	ds := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	if len(gs) <= len(ds) {
+		return false
+	}
+	for i, d := range ds {
+		if ok, _ := path.Match(gs[i], d); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lockKeysConflict reports whether locks on the path keys a and b cover a
+// common path. For two globs this is approximate: they conflict when they are
+// equal or one matches the other as a literal path.
+func lockKeysConflict(a, b string) bool {
+	ka, kb := lockKind(a), lockKind(b)
+	if ka > kb {
+		a, b, ka, kb = b, a, kb, ka
+	}
+
+	switch {
+	case ka == lockFile && kb == lockFile:
+		return a == b
+	case ka == lockFile && kb == lockDir:
+		return strings.HasPrefix(a, b)
+	case ka == lockFile && kb == lockGlob:
+		ok, _ := path.Match(globPattern(b), a)
+		return ok
+	case ka == lockDir && kb == lockDir:
+		return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+	case ka == lockDir && kb == lockGlob:
+		return strings.HasPrefix(globPattern(b), a) || globCoversDir(b, a)
+	}
+
+	if a == b {
+		return true
+	}
+	a, b = globPattern(a), globPattern(b)
+	ab, _ := path.Match(a, b)
+	ba, _ := path.Match(b, a)
+	return ab || ba
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestNormalizeLockPath(t *testing.T) {
+	cases := map[string]string{
+		"art/hero.psd":       "art/hero.psd",
+		"./art/hero.psd":     "art/hero.psd",
+		"/art//hero.psd":     "art/hero.psd",
+		"art\\hero.psd":      "art/hero.psd",
+		"art/./sub/../x.psd": "art/x.psd",
+		"art/":               "art/",
+		"art//":              "art/",
+		"Art/Hero.PSD":       "Art/Hero.PSD",
+		"art/*.psd":          "art/*.psd",
+		"art/[.psd":          "art/[.psd",
+		"glob:art//*.psd":    "glob:art/*.psd",
+	}
+	for in, expected := range cases {
+		out, err := normalizeLockPath(in)
+		if err != nil {
+			t.Errorf("normalizeLockPath(%q): unexpected error: %s", in, err)
+		} else if out != expected {
+			t.Errorf("normalizeLockPath(%q): expected %q, got %q", in, expected, out)
+		}
+	}
+
+	for _, in := range []string{"", ".", "/", "..", "../x", "a/../../x", "glob:art/[.psd", "glob:../x"} {
+		if _, err := normalizeLockPath(in); err != errInvalidLockPath {
+			t.Errorf("normalizeLockPath(%q): expected errInvalidLockPath, got %v", in, err)
+		}
+	}
+}
+
+func TestLockKeysConflict(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		conflict bool
+	}{
+		{"art/hero.psd", "art/hero.psd", true},
+		{"art/hero.psd", "art/other.psd", false},
+		{"art/hero.psd", "art/", true},
+		{"art/sub/hero.psd", "art/", true},
+		{"artwork/hero.psd", "art/", false},
+		{"art", "art/", false},
+		{"art/", "art/sub/", true},
+		{"art/", "audio/", false},
+		{"art/hero.psd", "glob:art/*.psd", true},
+		{"art/sub/hero.psd", "glob:art/*.psd", false},
+		{"art/hero.png", "glob:art/*.psd", false},
+		{"art/", "glob:art/*.psd", true},
+		{"art/sub/", "glob:art/*/hero.psd", true},
+		{"art/sub/", "glob:art/*.psd", false},
+		{"audio/", "glob:*/x.wav", true},
+		{"audio/", "glob:*.wav", false},
+		{"glob:art/*", "glob:art/*.psd", true},
+		{"glob:art/*.psd", "glob:art/*.png", false},
+		{"art/hero.psd", "art/*.psd", false},
+		{"art/*.psd", "art/*.psd", true},
+		{"Art/hero.psd", "art/hero.psd", false},
+		{"Art/hero.psd", "art/", false},
+	}
+	for _, c := range cases {
+		if got := lockKeysConflict(c.a, c.b); got != c.conflict {
+			t.Errorf("lockKeysConflict(%q, %q): expected %v, got %v", c.a, c.b, c.conflict, got)
+		}
+		if got := lockKeysConflict(c.b, c.a); got != c.conflict {
+			t.Errorf("lockKeysConflict(%q, %q): expected %v, got %v", c.b, c.a, c.conflict, got)
+		}
+	}
+}
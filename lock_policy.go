@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockReapInterval is how often expired locks are released.
+const lockReapInterval = time.Minute
+
+var (
+	errLockPathNotAllowed = errors.New("Path is not lockable")
+	errTooManyLocks       = errors.New("Too many locks")
+	errForceNotAllowed    = errors.New("Not allowed to force unlock")
+)
+
+// LockPolicy holds the lock settings of a repository. Empty fields fall back
+// to the server defaults, which don't restrict locking.
+type LockPolicy struct {
+	Repo string `json:"repo"`
+	// TTL is how long a lock lasts without being renewed, as a Go duration.
+	// "0" means locks never expire.
+	TTL string `json:"ttl,omitempty"`
+	// AllowedPaths are the globs of lockable paths, like the lockable
+	// patterns in .gitattributes: a glob without a slash matches the file
+	// name in any directory, other globs match the whole path. Directory and
+	// glob locks must match an allowed glob as written, without the "glob:"
+	// prefix, e.g. "assets/*/".
+	AllowedPaths []string `json:"allowed_paths,omitempty"`
+	// MaxLocksPerUser limits how many locks a user may hold in the
+	// repository. Zero means unlimited.
+	MaxLocksPerUser int `json:"max_locks_per_user,omitempty"`
+	// ForceUnlockers are the users allowed to force unlock other users'
+	// locks. If empty, any user may.
+	ForceUnlockers []string `json:"force_unlockers,omitempty"`
+}
+
+// TTLDuration returns the lock lifetime set by the policy, and whether the
+// policy sets one.
+func (p *LockPolicy) TTLDuration() (time.Duration, bool) {
+	if p == nil || p.TTL == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(p.TTL)
+	if err != nil || d < 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// Lockable reports whether the policy allows locking p.
+func (p *LockPolicy) Lockable(lockPath string) bool {
+	if p == nil || len(p.AllowedPaths) == 0 {
+		return true
+	}
+
+	key := strings.ToLower(globPattern(lockPathKey(lockPath)))
+	base := path.Base(key)
+	if strings.HasSuffix(key, "/") {
+		base += "/"
+	}
+
+	for _, pattern := range p.AllowedPaths {
+		pattern = strings.ToLower(pattern)
+		target := key
+		if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+			target = base
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CanForceUnlock reports whether the policy allows user to force unlock other
+// users' locks.
+func (p *LockPolicy) CanForceUnlock(user string) bool {
+	if p == nil || len(p.ForceUnlockers) == 0 {
+		return true
+	}
+	for _, u := range p.ForceUnlockers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *LockPolicy) validate() error {
+	if p.Repo == "" {
+		return fmt.Errorf("Invalid repository: %q", p.Repo)
+	}
+	if p.TTL != "" {
+		if d, err := time.ParseDuration(p.TTL); err != nil || d < 0 {
+			return fmt.Errorf("Invalid lock TTL: %q", p.TTL)
+		}
+	}
+	for _, pattern := range p.AllowedPaths {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("Invalid lockable path: %q", pattern)
+		}
+	}
+	if p.MaxLocksPerUser < 0 {
+		return fmt.Errorf("Invalid maximum locks per user: %d", p.MaxLocksPerUser)
+	}
+	return nil
+}
+
+// RepoLock is a lock together with the repository it belongs to.
+type RepoLock struct {
+	Repo string `json:"repo"`
+	Lock Lock   `json:"lock"`
+}
+
+// LockPolicies returns the lock policies of all repositories that have one.
+func (s *MetaStore) LockPolicies() ([]*LockPolicy, error) {
+	var policies []*LockPolicy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(lockPoliciesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var p LockPolicy
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			policies = append(policies, &p)
+			return nil
+		})
+	})
+	return policies, err
+}
+
+// LockPolicy returns the lock policy for repo, or nil if it has none.
+func (s *MetaStore) LockPolicy(repo string) (*LockPolicy, error) {
+	var policy *LockPolicy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		policy, err = lockPolicy(tx, repo)
+		return err
+	})
+	return policy, err
+}
+
+func lockPolicy(tx *bolt.Tx, repo string) (*LockPolicy, error) {
+	bucket := tx.Bucket(lockPoliciesBucket)
+	if bucket == nil {
+		return nil, errNoBucket
+	}
+
+	data := bucket.Get([]byte(repo))
+	if data == nil {
+		return nil, nil
+	}
+	policy := &LockPolicy{}
+	return policy, json.Unmarshal(data, policy)
+}
+
+// SetLockPolicy adds or replaces the lock policy for p.Repo.
+func (s *MetaStore) SetLockPolicy(p *LockPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(lockPoliciesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put([]byte(p.Repo), data)
+	})
+}
+
+// DeleteLockPolicy removes the lock policy for repo.
+func (s *MetaStore) DeleteLockPolicy(repo string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(lockPoliciesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Delete([]byte(repo))
+	})
+}
+
+// lockPolicyError returns the HTTP status and a message explaining err if it
+// is a lock policy violation by user on lockPath in repo.
+func (a *App) lockPolicyError(repo, user, lockPath string, err error) (int, string, bool) {
+	var status int
+	switch err {
+	case errLockPathNotAllowed:
+		status = 422
+	case errTooManyLocks, errForceNotAllowed:
+		status = 403
+	default:
+		return 0, "", false
+	}
+
+	policy, perr := a.metaStore.LockPolicy(repo)
+	if perr != nil || policy == nil {
+		return status, err.Error(), true
+	}
+
+	switch err {
+	case errLockPathNotAllowed:
+		return status, fmt.Sprintf("%s is not lockable in %s; lockable paths are %s", lockPath, repo, strings.Join(policy.AllowedPaths, ", ")), true
+	case errTooManyLocks:
+		return status, fmt.Sprintf("%s already holds the maximum of %d locks in %s", user, policy.MaxLocksPerUser, repo), true
+	}
+	return status, fmt.Sprintf("%s is not allowed to force unlock other users' locks in %s", user, repo), true
+}
+
+// lockTTL returns how long new locks in repo last. Zero means forever.
+func (a *App) lockTTL(repo string) (time.Duration, error) {
+	policy, err := a.metaStore.LockPolicy(repo)
+	if err != nil {
+		return 0, err
+	}
+	if ttl, ok := policy.TTLDuration(); ok {
+		return ttl, nil
+	}
+	return Config.LockTTLDuration(), nil
+}
+
+// lockExpiry returns the expiry time of a lock in repo created or renewed at
+// now, or nil if it doesn't expire.
+func (a *App) lockExpiry(repo string, now time.Time) (*time.Time, error) {
+	ttl, err := a.lockTTL(repo)
+	if err != nil || ttl == 0 {
+		return nil, err
+	}
+	expires := now.Add(ttl)
+	return &expires, nil
+}
+
+// reapLocks releases locks that have expired, logs each of them and notifies
+// subscribers that they were released.
+func (a *App) reapLocks() error {
+	reaped, err := a.metaStore.ReapLocks(time.Now())
+	for _, rl := range reaped {
+		logger.Log(kv{"fn": "reapLocks", "msg": "released expired lock", "repo": rl.Repo, "id": rl.Lock.Id, "path": rl.Lock.Path, "owner": rl.Lock.Owner.Name, "expired_at": rl.Lock.ExpiresAt.UTC().Format(time.RFC3339)})
+		lock := rl.Lock
+		a.publish(&Event{Type: eventLockReleased, Repo: rl.Repo, User: auditSystem, Lock: &lock})
+	}
+	return err
+}
+
+// lockReaperLoop releases expired locks every interval.
+func (a *App) lockReaperLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.reapLocks(); err != nil {
+			logger.Log(kv{"fn": "reapLocks", "err": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockPolicyLockable(t *testing.T) {
+	policy := &LockPolicy{Repo: testRepo, AllowedPaths: []string{"*.psd", "levels/*.map", "assets/*/"}}
+
+	for _, path := range []string{"hero.psd", "art/chars/Hero.PSD", "levels/one.map", "assets/textures/"} {
+		if !policy.Lockable(path) {
+			t.Errorf("expected %q to be lockable", path)
+		}
+	}
+	for _, path := range []string{"README.md", "art/hero.png", "other/levels/one.map", "levels/", "assets/"} {
+		if policy.Lockable(path) {
+			t.Errorf("expected %q not to be lockable", path)
+		}
+	}
+
+	var none *LockPolicy
+	if !none.Lockable("README.md") {
+		t.Errorf("expected every path to be lockable without a policy")
+	}
+}
+
+func TestLockPolicyValidate(t *testing.T) {
+	invalid := []*LockPolicy{
+		{},
+		{Repo: testRepo, TTL: "soon"},
+		{Repo: testRepo, AllowedPaths: []string{"[.psd"}},
+		{Repo: testRepo, MaxLocksPerUser: -1},
+	}
+	for _, p := range invalid {
+		if err := p.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", p)
+		}
+	}
+
+	valid := &LockPolicy{Repo: testRepo, TTL: "72h", AllowedPaths: []string{"*.psd"}, MaxLocksPerUser: 5, ForceUnlockers: []string{testUser}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("expected policy to be valid, got: %s", err)
+	}
+}
+
+func TestReapLocks(t *testing.T) {
+	sub := lfsApp.events.Subscribe("reaplocks", []string{eventLockReleased})
+	defer lfsApp.events.Unsubscribe(sub)
+
+	expired := time.Now().Add(-time.Minute)
+	lock := NewTestLock(randomLockId(), "reaped.psd", testUser)
+	lock.ExpiresAt = &expired
+	if _, err := testMetaStore.CreateLock("reaplocks", lock); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got: %s", err)
+	}
+
+	if err := lfsApp.reapLocks(); err != nil {
+		t.Fatalf("expected reapLocks to succeed, got: %s", err)
+	}
+	if n := len(sub.C); n != 1 {
+		t.Fatalf("expected a lock release event, got %d", n)
+	}
+	if e := <-sub.C; e.Lock == nil || e.Lock.Id != lock.Id || e.User != auditSystem {
+		t.Errorf("expected the release of %s by the system, got: %+v", lock.Id, e)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Action: "lock.expire", Repo: "reaplocks"}, auditPageSize)
+	if err != nil || len(entries) != 1 || entries[0].Actor != auditSystem || entries[0].LockId != lock.Id || entries[0].Path != "reaped.psd" {
+		t.Errorf("expected an expiry audit entry by the system, got %d: %v", len(entries), err)
+	}
+}
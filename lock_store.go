@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Locks are stored in a bucket per repository inside locksBucket. Each lock
+// is a single record in lockIdsBucket, with secondary indexes that hold no
+// values:
+//
+//	ids:      id                 -> JSON lockRecord
+//	paths:    path key 0x00 id   -> nil
+//	patterns: path key 0x00 id   -> nil
+//	owners:   owner 0x00 id      -> nil
+//	order:    seq (uint64 BE)    -> id
+//	expiry:   expires_at (unix nanoseconds BE) 0x00 id -> nil
+//
+// Path keys are normalized, see lockPathKey. Directory and glob
+// locks are also in the patterns index, so a new lock can be checked against
+// all of them. seq comes from the repository bucket's sequence and orders
+// locks by creation, which is also the order used for pagination. Only locks
+// with an expiry time are in the expiry index.
+var (
+	lockIdsBucket      = []byte("ids")
+	lockPathsBucket    = []byte("paths")
+	lockOwnersBucket   = []byte("owners")
+	lockOrderBucket    = []byte("order")
+	lockExpiryBucket   = []byte("expiry")
+	lockPatternsBucket = []byte("patterns")
+
+	lockBuckets = [][]byte{lockIdsBucket, lockPathsBucket, lockOwnersBucket, lockOrderBucket, lockExpiryBucket, lockPatternsBucket}
+
+	errLockExists       = errors.New("Lock already exists")
+	errLockNotFound     = errors.New("Lock not found")
+	errRenewNotOwner    = errors.New("Attempt to renew other user's lock")
+	errTransferNotOwner = errors.New("Attempt to transfer other user's lock")
+	errNoNewOwner       = errors.New("No new lock owner")
+
+	errEmptyLockSelection = errors.New("Select the locks by repository, owner, path or age")
+)
+
+// lockRecord is a Lock as stored in the meta store.
+type lockRecord struct {
+	Lock
+	Seq uint64 `json:"seq"`
+}
+
+// LockFilter selects locks to list. Zero values match everything; a Limit of
+// zero means no limit. Cursor is the id of the first lock to return. Ref
+// matches locks bound to that ref as well as locks that apply to every ref.
+type LockFilter struct {
+	Id     string
+	Path   string
+	Owner  string
+	Ref    string
+	Cursor string
+	Limit  int
+}
+
+func (f *LockFilter) matches(rec *lockRecord, now time.Time) bool {
+	return !rec.Expired(now) &&
+		(f.Id == "" || rec.Id == f.Id) &&
+		(f.Path == "" || lockPathKey(rec.Path) == lockPathKey(f.Path)) &&
+		(f.Owner == "" || rec.Owner.Name == f.Owner) &&
+		refsOverlap(f.Ref, rec.RefName())
+}
+
+// refsOverlap reports whether locks on refs a and b apply to a common ref. A
+// lock without a ref applies to every ref.
+func refsOverlap(a, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+// repoLocks provides access to the lock buckets of a single repository.
+type repoLocks struct {
+	repo     *bolt.Bucket
+	ids      *bolt.Bucket
+	paths    *bolt.Bucket
+	owners   *bolt.Bucket
+	order    *bolt.Bucket
+	expiry   *bolt.Bucket
+	patterns *bolt.Bucket
+}
+
+// openRepoLocks returns the lock buckets for repo. If create is false and the
+// repository has no locks, it returns nil.
+func openRepoLocks(tx *bolt.Tx, repo string, create bool) (*repoLocks, error) {
+	locks := tx.Bucket(locksBucket)
+	if locks == nil {
+		return nil, errNoBucket
+	}
+
+	b := locks.Bucket([]byte(repo))
+	if b == nil {
+		if !create {
+			return nil, nil
+		}
+
+		var err error
+		if b, err = locks.CreateBucket([]byte(repo)); err != nil {
+			return nil, err
+		}
+		for _, name := range lockBuckets {
+			if _, err := b.CreateBucket(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &repoLocks{
+		repo:     b,
+		ids:      b.Bucket(lockIdsBucket),
+		paths:    b.Bucket(lockPathsBucket),
+		owners:   b.Bucket(lockOwnersBucket),
+		order:    b.Bucket(lockOrderBucket),
+		expiry:   b.Bucket(lockExpiryBucket),
+		patterns: b.Bucket(lockPatternsBucket),
+	}, nil
+}
+
+func indexKey(value, id string) []byte {
+	return []byte(value + "\x00" + id)
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// expiryKey returns the expiry index key of l, or nil if it doesn't expire.
+func expiryKey(l *Lock) []byte {
+	if l.ExpiresAt == nil {
+		return nil
+	}
+	return append(seqKey(uint64(l.ExpiresAt.UnixNano())), append([]byte{0}, l.Id...)...)
+}
+
+func (rl *repoLocks) get(id string) (*lockRecord, error) {
+	data := rl.ids.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var rec lockRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// scanIndex calls fn with the id of every entry in index whose value is
+// exactly value.
+func scanIndex(index *bolt.Bucket, value string, fn func(id string) error) error {
+	prefix := []byte(value + "\x00")
+	c := index.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if err := fn(string(k[len(prefix):])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanPrefix calls fn with the id of every entry in index whose value starts
+// with prefix.
+func scanPrefix(index *bolt.Bucket, prefix string, fn func(id string) error) error {
+	c := index.Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+		if err := fn(string(k[bytes.LastIndexByte(k, 0)+1:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conflicting returns an unexpired lock that covers a path in common with
+// path and applies to ref, if any. Only the locks the indexes can't rule out
+// are loaded: every directory and glob lock, and the locks on paths the new
+// lock could cover.
+func (rl *repoLocks) conflicting(path, ref string) (*lockRecord, error) {
+	now := time.Now()
+	key := lockPathKey(path)
+
+	var found *lockRecord
+	check := func(id string) error {
+		if found != nil {
+			return nil
+		}
+		rec, err := rl.get(id)
+		if err == nil && rec != nil && !rec.Expired(now) && refsOverlap(ref, rec.RefName()) && lockKeysConflict(key, lockPathKey(rec.Path)) {
+			found = rec
+		}
+		return err
+	}
+
+	var err error
+	switch lockKind(key) {
+	case lockFile:
+		err = scanIndex(rl.paths, key, check)
+	case lockDir:
+		err = scanPrefix(rl.paths, key, check)
+	case lockGlob:
+		err = scanPrefix(rl.paths, literalPrefix(key), check)
+	}
+	if err != nil || found != nil {
+		return found, err
+	}
+
+	return found, scanPrefix(rl.patterns, "", check)
+}
+
+// LockConflict is a path that is locked by another user.
+type LockConflict struct {
+	Path string `json:"path"`
+	Lock Lock   `json:"lock"`
+}
+
+// CheckLocks returns the paths that a push to ref by user would change while
+// another user holds a lock covering them. The directory and glob locks of
+// the repo are loaded once, so a push with many paths costs one index lookup
+// per path.
+func (s *MetaStore) CheckLocks(repo, ref, user string, paths []string) ([]LockConflict, error) {
+	conflicts := make([]LockConflict, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, false)
+		if err != nil || rl == nil {
+			return err
+		}
+
+		now := time.Now()
+		blocks := func(rec *lockRecord) bool {
+			return rec != nil && !rec.Expired(now) && rec.Owner.Name != user && refsOverlap(ref, rec.RefName())
+		}
+
+		var patterns []*lockRecord
+		err = scanPrefix(rl.patterns, "", func(id string) error {
+			rec, err := rl.get(id)
+			if err == nil && blocks(rec) {
+				patterns = append(patterns, rec)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, p := range paths {
+			key := lockPathKey(p)
+
+			var found *lockRecord
+			err := scanIndex(rl.paths, key, func(id string) error {
+				rec, err := rl.get(id)
+				if err == nil && found == nil && blocks(rec) {
+					found = rec
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, rec := range patterns {
+				if found != nil {
+					break
+				}
+				if lockKeysConflict(key, lockPathKey(rec.Path)) {
+					found = rec
+				}
+			}
+
+			if found != nil {
+				conflicts = append(conflicts, LockConflict{Path: p, Lock: found.Lock})
+			}
+		}
+		return nil
+	})
+	return conflicts, err
+}
+
+// countOwned returns the number of unexpired locks held by owner.
+func (rl *repoLocks) countOwned(owner string) (int, error) {
+	now := time.Now()
+
+	n := 0
+	err := scanIndex(rl.owners, owner, func(id string) error {
+		rec, err := rl.get(id)
+		if err == nil && rec != nil && !rec.Expired(now) {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// insert adds l to the repository, failing with errLockExists if its path is
+// already locked on an overlapping ref. The conflicting lock is returned along
+// with the error.
+func (rl *repoLocks) insert(l Lock) (*Lock, error) {
+	existing, err := rl.conflicting(l.Path, l.RefName())
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return &existing.Lock, errLockExists
+	}
+
+	return nil, rl.put(l)
+}
+
+// put stores l and its index entries without checking for conflicts.
+func (rl *repoLocks) put(l Lock) error {
+	seq, err := rl.repo.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	rec := &lockRecord{Lock: l, Seq: seq}
+	if err := rl.update(rec); err != nil {
+		return err
+	}
+	if err := rl.putPath(&l); err != nil {
+		return err
+	}
+	if err := rl.owners.Put(indexKey(l.Owner.Name, l.Id), nil); err != nil {
+		return err
+	}
+	return rl.order.Put(seqKey(seq), []byte(l.Id))
+}
+
+// putPath adds l to the path indexes.
+func (rl *repoLocks) putPath(l *Lock) error {
+	key := lockPathKey(l.Path)
+	if err := rl.paths.Put(indexKey(key, l.Id), nil); err != nil {
+		return err
+	}
+	if lockKind(key) != lockFile {
+		return rl.patterns.Put(indexKey(key, l.Id), nil)
+	}
+	return nil
+}
+
+// update writes rec and its expiry index entry. The caller removes any
+// previous expiry entry.
+func (rl *repoLocks) update(rec *lockRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if err := rl.ids.Put([]byte(rec.Id), data); err != nil {
+		return err
+	}
+	if key := expiryKey(&rec.Lock); key != nil {
+		return rl.expiry.Put(key, nil)
+	}
+	return nil
+}
+
+// remove deletes the lock and its index entries.
+func (rl *repoLocks) remove(rec *lockRecord) error {
+	if err := rl.ids.Delete([]byte(rec.Id)); err != nil {
+		return err
+	}
+	if key := expiryKey(&rec.Lock); key != nil {
+		if err := rl.expiry.Delete(key); err != nil {
+			return err
+		}
+	}
+	key := lockPathKey(rec.Path)
+	if err := rl.paths.Delete(indexKey(key, rec.Id)); err != nil {
+		return err
+	}
+	if err := rl.patterns.Delete(indexKey(key, rec.Id)); err != nil {
+		return err
+	}
+	if err := rl.owners.Delete(indexKey(rec.Owner.Name, rec.Id)); err != nil {
+		return err
+	}
+	return rl.order.Delete(seqKey(rec.Seq))
+}
+
+// list returns the locks matching f in creation order, and the id of the
+// next lock if there are more.
+func (rl *repoLocks) list(f LockFilter) ([]Lock, string, error) {
+	var start uint64
+	if f.Cursor != "" {
+		rec, err := rl.get(f.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if rec == nil {
+			return nil, "", fmt.Errorf("cursor (%s) not found", f.Cursor)
+		}
+		start = rec.Seq
+	}
+
+	now := time.Now()
+
+	var locks []Lock
+	next := ""
+	add := func(rec *lockRecord) bool {
+		if rec.Seq < start || !f.matches(rec, now) {
+			return true
+		}
+		if f.Limit > 0 && len(locks) == f.Limit {
+			next = rec.Id
+			return false
+		}
+		locks = append(locks, rec.Lock)
+		return true
+	}
+
+	if f.Id != "" {
+		rec, err := rl.get(f.Id)
+		if err != nil {
+			return nil, "", err
+		}
+		if rec != nil {
+			add(rec)
+		}
+		return locks, next, nil
+	}
+
+	// Narrow the scan with an index when filtering by path or owner.
+	if f.Path != "" || f.Owner != "" {
+		index, value := rl.paths, lockPathKey(f.Path)
+		if f.Path == "" {
+			index, value = rl.owners, f.Owner
+		}
+
+		// The index isn't in creation order, so keep the earliest matches
+		// as they are found: one more than the limit tells if there are
+		// more.
+		var recs []*lockRecord
+		err := scanIndex(index, value, func(id string) error {
+			rec, err := rl.get(id)
+			if err != nil || rec == nil || rec.Seq < start || !f.matches(rec, now) {
+				return err
+			}
+
+			i := sort.Search(len(recs), func(i int) bool { return recs[i].Seq > rec.Seq })
+			if f.Limit > 0 && i > f.Limit {
+				return nil
+			}
+			recs = append(recs, nil)
+			copy(recs[i+1:], recs[i:])
+			recs[i] = rec
+			if f.Limit > 0 && len(recs) > f.Limit+1 {
+				recs = recs[:f.Limit+1]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, rec := range recs {
+			if !add(rec) {
+				break
+			}
+		}
+		return locks, next, nil
+	}
+
+	c := rl.order.Cursor()
+	for k, v := c.Seek(seqKey(start)); k != nil; k, v = c.Next() {
+		rec, err := rl.get(string(v))
+		if err != nil {
+			return nil, "", err
+		}
+		if rec != nil && !add(rec) {
+			break
+		}
+	}
+	return locks, next, nil
+}
+
+// CreateLock adds a lock for the repo unless its path is already locked, in
+// which case the existing lock is returned with errLockExists. The repo's
+// lock policy is enforced with errLockPathNotAllowed and errTooManyLocks. The
+// checks and the insert happen in one transaction.
+func (s *MetaStore) CreateLock(repo string, l Lock) (*Lock, error) {
+	var existing *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		policy, err := lockPolicy(tx, repo)
+		if err != nil {
+			return err
+		}
+		if !policy.Lockable(l.Path) {
+			return errLockPathNotAllowed
+		}
+
+		rl, err := openRepoLocks(tx, repo, true)
+		if err != nil {
+			return err
+		}
+
+		if policy != nil && policy.MaxLocksPerUser > 0 {
+			held, err := rl.countOwned(l.Owner.Name)
+			if err != nil {
+				return err
+			}
+			if held >= policy.MaxLocksPerUser {
+				return errTooManyLocks
+			}
+		}
+
+		if existing, err = rl.insert(l); err != nil {
+			return err
+		}
+		return recordLockEvent(tx, repo, newLockEvent(lockCreated, &l, l.Owner.Name))
+	})
+	return existing, err
+}
+
+// AddLocks write locks to the store for the repo.
+func (s *MetaStore) AddLocks(repo string, l ...Lock) error {
+	locks := append([]Lock(nil), l...)
+	sort.Sort(LocksByCreatedAt(locks))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, true)
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range locks {
+			if _, err := rl.insert(lock); err != nil {
+				return err
+			}
+			if err := recordLockEvent(tx, repo, newLockEvent(lockCreated, &lock, lock.Owner.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Locks retrieves locks for the repo from the store
+func (s *MetaStore) Locks(repo string) ([]Lock, error) {
+	locks, _, err := s.ListLocks(repo, LockFilter{})
+	return locks, err
+}
+
+// ListLocks returns the locks of the repo selected by f, and the cursor of
+// the next page if there is one.
+func (s *MetaStore) ListLocks(repo string, f LockFilter) (locks []Lock, next string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, false)
+		if err != nil || rl == nil {
+			if err == nil && f.Cursor != "" {
+				err = fmt.Errorf("cursor (%s) not found", f.Cursor)
+			}
+			return err
+		}
+
+		locks, next, err = rl.list(f)
+		return err
+	})
+	return locks, next, err
+}
+
+// FilteredLocks return filtered locks for the repo, with the limit given as
+// a request parameter
+func (s *MetaStore) FilteredLocks(repo string, f LockFilter, limit string) (locks []Lock, next string, err error) {
+	if limit != "" {
+		f.Limit, err = strconv.Atoi(limit)
+		if err != nil || f.Limit < 0 {
+			return make([]Lock, 0), "", fmt.Errorf("Invalid limit amount: %s", limit)
+		}
+		if f.Limit == 0 {
+			return make([]Lock, 0), "", nil
+		}
+	}
+
+	return s.ListLocks(repo, f)
+}
+
+// forceAllowed returns errForceNotAllowed unless the repo's lock policy
+// allows user to force changes to other users' locks.
+func forceAllowed(tx *bolt.Tx, repo, user string) error {
+	policy, err := lockPolicy(tx, repo)
+	if err != nil {
+		return err
+	}
+	if !policy.CanForceUnlock(user) {
+		return errForceNotAllowed
+	}
+	return nil
+}
+
+// DeleteLock removes lock for the repo by id from the store. Forcing the
+// removal of another user's lock fails with errForceNotAllowed unless the
+// repo's lock policy allows user to.
+func (s *MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
+	return s.releaseLock(repo, id, user, func(tx *bolt.Tx, rec *lockRecord) error {
+		if rec.Owner.Name == user {
+			return nil
+		}
+		if !force {
+			return errNotOwner
+		}
+		return forceAllowed(tx, repo, user)
+	})
+}
+
+// AdminDeleteLock removes any lock for the repo by id on behalf of the
+// administrator user, bypassing ownership and lock policy.
+func (s *MetaStore) AdminDeleteLock(repo, user, id string) (*Lock, error) {
+	return s.releaseLock(repo, id, user, nil)
+}
+
+// releaseLock removes the lock with id if allowed, which may be nil, accepts
+// the removal by user, and records it in the lock history.
+func (s *MetaStore) releaseLock(repo, id, user string, allowed func(*bolt.Tx, *lockRecord) error) (*Lock, error) {
+	var deleted *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, false)
+		if err != nil || rl == nil {
+			return err
+		}
+
+		rec, err := rl.get(id)
+		if err != nil || rec == nil {
+			return err
+		}
+		if allowed != nil {
+			if err := allowed(tx, rec); err != nil {
+				return err
+			}
+		}
+
+		if err := rl.remove(rec); err != nil {
+			return err
+		}
+
+		action := lockReleased
+		if rec.Owner.Name != user {
+			action = lockForceReleased
+		}
+		deleted = &rec.Lock
+		return recordLockEvent(tx, repo, newLockEvent(action, deleted, user))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// TransferLock makes to the owner of the lock with id. Only the owner may
+// transfer a lock, unless user forces the transfer and the repo's lock policy
+// allows user to force unlock. The repo's limit of locks per user applies to
+// the new owner.
+func (s *MetaStore) TransferLock(repo, user, id, to string, force bool) (*Lock, error) {
+	return s.transferLock(repo, id, user, to, func(tx *bolt.Tx, rec *lockRecord) error {
+		if rec.Owner.Name == user {
+			return nil
+		}
+		if !force {
+			return errTransferNotOwner
+		}
+		return forceAllowed(tx, repo, user)
+	})
+}
+
+// AdminTransferLock makes to the owner of the lock with id on behalf of the
+// administrator user, bypassing ownership and lock policy.
+func (s *MetaStore) AdminTransferLock(repo, user, id, to string) (*Lock, error) {
+	return s.transferLock(repo, id, user, to, nil)
+}
+
+func (s *MetaStore) transferLock(repo, id, user, to string, allowed func(*bolt.Tx, *lockRecord) error) (*Lock, error) {
+	if to == "" {
+		return nil, errNoNewOwner
+	}
+
+	var transferred *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, false)
+		if err != nil || rl == nil {
+			return err
+		}
+
+		rec, err := rl.get(id)
+		if err != nil || rec == nil || rec.Expired(time.Now()) {
+			return err
+		}
+		if allowed != nil {
+			if err := allowed(tx, rec); err != nil {
+				return err
+			}
+		}
+		if rec.Owner.Name == to {
+			transferred = &rec.Lock
+			return nil
+		}
+
+		policy, err := lockPolicy(tx, repo)
+		if err != nil {
+			return err
+		}
+		if policy != nil && policy.MaxLocksPerUser > 0 && allowed != nil {
+			held, err := rl.countOwned(to)
+			if err != nil {
+				return err
+			}
+			if held >= policy.MaxLocksPerUser {
+				return errTooManyLocks
+			}
+		}
+
+		event := newLockEvent(lockTransferred, &rec.Lock, user)
+		event.NewOwner = to
+
+		if err := rl.owners.Delete(indexKey(rec.Owner.Name, rec.Id)); err != nil {
+			return err
+		}
+		if err := rl.owners.Put(indexKey(to, rec.Id), nil); err != nil {
+			return err
+		}
+		rec.Owner = User{Name: to}
+		if err := rl.update(rec); err != nil {
+			return err
+		}
+
+		transferred = &rec.Lock
+		return recordLockEvent(tx, repo, event)
+	})
+	return transferred, err
+}
+
+// RenewLock moves the expiry of the user's lock to expires, or clears it if
+// expires is nil. It returns nil if the lock doesn't exist or has expired.
+func (s *MetaStore) RenewLock(repo, user, id string, expires *time.Time) (*Lock, error) {
+	var renewed *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, repo, false)
+		if err != nil || rl == nil {
+			return err
+		}
+
+		rec, err := rl.get(id)
+		if err != nil || rec == nil || rec.Expired(time.Now()) {
+			return err
+		}
+		if rec.Owner.Name != user {
+			return errRenewNotOwner
+		}
+
+		if key := expiryKey(&rec.Lock); key != nil {
+			if err := rl.expiry.Delete(key); err != nil {
+				return err
+			}
+		}
+		rec.ExpiresAt = expires
+		if err := rl.update(rec); err != nil {
+			return err
+		}
+
+		renewed = &rec.Lock
+		return nil
+	})
+	return renewed, err
+}
+
+// ReapLocks removes every lock that has expired at now and returns them. Each
+// release is recorded in the audit log as done by the system.
+func (s *MetaStore) ReapLocks(now time.Time) ([]RepoLock, error) {
+	var reaped []RepoLock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var repos []string
+		tx.Bucket(locksBucket).ForEach(func(k, v []byte) error {
+			repos = append(repos, string(k))
+			return nil
+		})
+
+		limit := seqKey(uint64(now.UnixNano()))
+		for _, repo := range repos {
+			rl, err := openRepoLocks(tx, repo, false)
+			if err != nil || rl == nil {
+				return err
+			}
+
+			var ids []string
+			c := rl.expiry.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, _ = c.Next() {
+				ids = append(ids, string(k[9:]))
+			}
+
+			for _, id := range ids {
+				rec, err := rl.get(id)
+				if err != nil {
+					return err
+				}
+				if rec == nil {
+					continue
+				}
+				if err := rl.remove(rec); err != nil {
+					return err
+				}
+				if err := recordLockEvent(tx, repo, newLockEvent(lockExpired, &rec.Lock, "")); err != nil {
+					return err
+				}
+				e := &AuditEntry{
+					Time:    now.UTC(),
+					Actor:   auditSystem,
+					Action:  "lock.expire",
+					Repo:    repo,
+					LockId:  rec.Id,
+					Path:    rec.Path,
+					Outcome: auditSuccess,
+				}
+				if err := appendAudit(tx, e); err != nil {
+					return err
+				}
+				reaped = append(reaped, RepoLock{Repo: repo, Lock: rec.Lock})
+			}
+		}
+		return nil
+	})
+	return reaped, err
+}
+
+// AllLocks return all locks in the store with their repos
+func (s *MetaStore) AllLocks() ([]RepoLock, error) {
+	var locks []RepoLock
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			rl, err := openRepoLocks(tx, string(k), false)
+			if err != nil || rl == nil {
+				return err
+			}
+
+			l, _, err := rl.list(LockFilter{})
+			if err != nil {
+				return err
+			}
+			for _, lv := range l {
+				locks = append(locks, RepoLock{Repo: string(k), Lock: lv})
+			}
+			return nil
+		})
+	})
+	return locks, err
+}
+
+// LockCount returns the number of unexpired locks in every repository.
+func (s *MetaStore) LockCount() (int, error) {
+	now := time.Now()
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			rl, err := openRepoLocks(tx, string(k), false)
+			if err != nil || rl == nil {
+				return err
+			}
+			return rl.ids.ForEach(func(id, data []byte) error {
+				var rec lockRecord
+				if err := json.Unmarshal(data, &rec); err != nil {
+					return err
+				}
+				if !rec.Expired(now) {
+					n++
+				}
+				return nil
+			})
+		})
+	})
+	return n, err
+}
+
+// LockSelection selects locks across repositories for administration. Empty
+// fields match every lock. Path matches the locks whose path contains it,
+// ignoring case, and OlderThan those locked longer ago than it.
+type LockSelection struct {
+	Repo      string
+	Owner     string
+	Path      string
+	OlderThan time.Duration
+}
+
+// Empty reports whether f selects every lock.
+func (f LockSelection) Empty() bool {
+	return f == LockSelection{}
+}
+
+// Filter returns the locks matching f, sorted by repository and path.
+func (f LockSelection) Filter(locks []RepoLock) []RepoLock {
+	path := strings.ToLower(f.Path)
+	cutoff := time.Now().Add(-f.OlderThan)
+
+	filtered := make([]RepoLock, 0, len(locks))
+	for _, l := range locks {
+		if f.Repo != "" && l.Repo != f.Repo {
+			continue
+		}
+		if f.Owner != "" && l.Lock.Owner.Name != f.Owner {
+			continue
+		}
+		if path != "" && !strings.Contains(strings.ToLower(l.Lock.Path), path) {
+			continue
+		}
+		if f.OlderThan > 0 && !l.Lock.LockedAt.Before(cutoff) {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		if filtered[i].Repo != filtered[j].Repo {
+			return filtered[i].Repo < filtered[j].Repo
+		}
+		return filtered[i].Lock.Path < filtered[j].Lock.Path
+	})
+	return filtered
+}
+
+// SelectLocks returns the locks of every repository matching f, sorted by
+// repository and path.
+func (s *MetaStore) SelectLocks(f LockSelection) ([]RepoLock, error) {
+	locks, err := s.AllLocks()
+	if err != nil {
+		return nil, err
+	}
+	return f.Filter(locks), nil
+}
+
+type LocksByCreatedAt []Lock
+
+func (c LocksByCreatedAt) Len() int           { return len(c) }
+func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j].LockedAt) }
+func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// migrateLockPathKeys rebuilds the path index with normalized keys and adds
+// the patterns index to existing repositories.
+func migrateLockPathKeys(tx *bolt.Tx) error {
+	bucket := tx.Bucket(locksBucket)
+
+	var repos [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		repos = append(repos, k)
+		return nil
+	})
+
+	for _, repo := range repos {
+		b := bucket.Bucket(repo)
+		if err := b.DeleteBucket(lockPathsBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(lockPathsBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists(lockPatternsBucket); err != nil {
+			return err
+		}
+
+		rl, err := openRepoLocks(tx, string(repo), false)
+		if err != nil {
+			return err
+		}
+		err = rl.ids.ForEach(func(k, v []byte) error {
+			var rec lockRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return rl.putPath(&rec.Lock)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyLockPath returns the path of a lock taken when every path with a
+// wildcard was a glob.
+func legacyLockPath(p string) string {
+	if strings.ContainsAny(p, "*?[") && !strings.HasPrefix(p, globPrefix) {
+		return globPrefix + p
+	}
+	return p
+}
+
+// migrateGlobLockPaths adds globPrefix to the locks that were taken as globs,
+// and rebuilds the path indexes of locks and lock history, whose keys were
+// lower case.
+func migrateGlobLockPaths(tx *bolt.Tx) error {
+	bucket := tx.Bucket(locksBucket)
+
+	var repos [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		repos = append(repos, k)
+		return nil
+	})
+
+	for _, repo := range repos {
+		b := bucket.Bucket(repo)
+		for _, name := range [][]byte{lockPathsBucket, lockPatternsBucket} {
+			if err := b.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := b.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		rl, err := openRepoLocks(tx, string(repo), false)
+		if err != nil {
+			return err
+		}
+		var recs []*lockRecord
+		err = rl.ids.ForEach(func(k, v []byte) error {
+			var rec lockRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			recs = append(recs, &rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, rec := range recs {
+			if p := legacyLockPath(rec.Path); p != rec.Path {
+				rec.Path = p
+				if err := rl.update(rec); err != nil {
+					return err
+				}
+			}
+			if err := rl.putPath(&rec.Lock); err != nil {
+				return err
+			}
+		}
+	}
+
+	history := tx.Bucket(lockHistoryBucket)
+	if history == nil {
+		return nil
+	}
+	repos = nil
+	history.ForEach(func(k, v []byte) error {
+		repos = append(repos, k)
+		return nil
+	})
+
+	for _, repo := range repos {
+		b := history.Bucket(repo)
+		events := b.Bucket(lockEventsBucket)
+		if events == nil {
+			continue
+		}
+		if err := b.DeleteBucket(lockEventPathsBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		paths, err := b.CreateBucket(lockEventPathsBucket)
+		if err != nil {
+			return err
+		}
+
+		err = events.ForEach(func(k, v []byte) error {
+			var e LockEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			return paths.Put(append([]byte(lockPathKey(legacyLockPath(e.Path))+"\x00"), k...), nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLockExpiry adds the expiry index to existing repositories.
+func migrateLockExpiry(tx *bolt.Tx) error {
+	bucket := tx.Bucket(locksBucket)
+
+	var repos [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		repos = append(repos, k)
+		return nil
+	})
+
+	for _, repo := range repos {
+		if _, err := bucket.Bucket(repo).CreateBucketIfNotExists(lockExpiryBucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLocksToRecords converts the JSON array of locks stored per
+// repository into one record per lock with indexes.
+func migrateLocksToRecords(tx *bolt.Tx) error {
+	bucket := tx.Bucket(locksBucket)
+
+	arrays := make(map[string][]Lock)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		var locks []Lock
+		if err := json.Unmarshal(v, &locks); err != nil {
+			return fmt.Errorf("locks for %s: %s", k, err)
+		}
+		arrays[string(k)] = locks
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for repo, locks := range arrays {
+		if err := bucket.Delete([]byte(repo)); err != nil {
+			return err
+		}
+
+		rl, err := openRepoLocks(tx, repo, true)
+		if err != nil {
+			return err
+		}
+
+		// Keep every lock, even duplicates left behind by the old
+		// non-atomic create, so nobody silently loses a lock.
+		sort.Sort(LocksByCreatedAt(locks))
+		for _, l := range locks {
+			if l.Id == "" {
+				continue
+			}
+			if err := rl.put(l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -15,6 +15,8 @@ const (
 	contentMediaType = "application/vnd.git-lfs"
 	metaMediaType    = contentMediaType + "+json"
 	version          = "0.4.0"
+
+	packCompactInterval = time.Hour
 )
 
 var (
@@ -78,15 +80,79 @@ func maincmd() {
 	fmt.Printf("%+v\n", meta)
 }
 
+// compactPacks periodically reclaims space held by deleted packed objects.
+func compactPacks(store *ContentStore) {
+	for range time.Tick(packCompactInterval) {
+		reclaimed, err := store.Compact()
+		if err != nil {
+			logger.Log(kv{"fn": "compactPacks", "err": err.Error()})
+			continue
+		}
+		logger.Log(kv{"fn": "compactPacks", "msg": "compacted packs", "reclaimed": reclaimed})
+	}
+}
+
+// migratecmd applies pending meta store migrations, or with --dry-run only
+// lists them without writing to the database.
+func migratecmd() {
+	dryRun := len(os.Args) > 2 && os.Args[2] == "--dry-run"
+
+	open := openMetaStore
+	if dryRun {
+		open = openMetaStoreReadOnly
+	}
+	metaStore, err := open(Config.MetaDB)
+	if err != nil {
+		logger.Fatal(kv{"fn": "migratecmd", "err": "Could not open the meta store: " + err.Error()})
+	}
+	defer metaStore.Close()
+
+	current, err := metaStore.SchemaVersion()
+	if err != nil {
+		logger.Fatal(kv{"fn": "migratecmd", "err": "Could not read the schema version: " + err.Error()})
+	}
+
+	pending, err := metaStore.PendingMigrations()
+	if err != nil {
+		logger.Fatal(kv{"fn": "migratecmd", "err": err.Error()})
+	}
+
+	fmt.Printf("Schema version %d, latest %d\n", current, latestSchemaVersion())
+	for _, m := range pending {
+		fmt.Printf("  pending %d: %s\n", m.Version, m.Name)
+	}
+	if dryRun || len(pending) == 0 {
+		return
+	}
+
+	if _, err := metaStore.Migrate(); err != nil {
+		logger.Fatal(kv{"fn": "migratecmd", "err": err.Error()})
+	}
+	fmt.Printf("Migrated to schema version %d\n", latestSchemaVersion())
+}
+
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "-v" {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+	if err := Config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
 	if len(os.Args) > 2 && os.Args[1] == "cmd" {
 		maincmd()
 		os.Exit(0)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migratecmd()
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && isCLICommand(os.Args[1]) {
+		// Keep stdout for the command's output.
+		logger = NewKVLogger(os.Stderr)
+		os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
 
 	var listener net.Listener
 
@@ -110,11 +176,15 @@ func main() {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
 	}
 
-	contentStore, err := NewContentStore(Config.ContentPath)
+	contentStore, err := openContentStore()
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
 	}
 
+	if contentStore.packs != nil {
+		go compactPacks(contentStore)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func(c chan os.Signal, listener net.Listener) {
@@ -130,11 +200,20 @@ func main() {
 	logger.Log(kv{"fn": "main", "msg": "listening", "pid": os.Getpid(), "addr": Config.Listen, "version": version})
 
 	app := NewApp(contentStore, metaStore)
+	if interval := Config.RetentionIntervalDuration(); interval > 0 {
+		go app.retentionLoop(interval)
+	}
+	go app.lockReaperLoop(lockReapInterval)
+	go app.auditPruneLoop(auditPruneInterval)
+	go app.releaseReservationsLoop(reservationReleaseInterval)
 	if Config.IsUsingTus() {
 		tusServer.Start()
 	}
 	app.Serve(listener)
 	tl.WaitForChildren()
+	if err := app.downloads.Flush(); err != nil {
+		logger.Log(kv{"fn": "main", "err": "Could not flush download statistics: " + err.Error()})
+	}
 	if Config.IsUsingTus() {
 		tusServer.Stop()
 	}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
-	"sort"
-	"strconv"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,45 +17,143 @@ import (
 // MetaStore implements a metadata storage. It stores user credentials and Meta information
 // for objects. The storage is handled by boltdb.
 type MetaStore struct {
-	db *bolt.DB
+	db   *bolt.DB
+	path string
 }
 
 var (
 	errNoBucket       = errors.New("Bucket not found")
 	errObjectNotFound = errors.New("Object not found")
 	errNotOwner       = errors.New("Attempt to delete other user's lock")
+	errUserNotFound   = errors.New("User not found")
+	errUserExists     = errors.New("User already exists")
+	errInvalidCursor  = errors.New("Invalid cursor")
 )
 
 var (
-	usersBucket   = []byte("users")
-	objectsBucket = []byte("objects")
-	locksBucket   = []byte("locks")
+	usersBucket     = []byte("users")
+	objectsBucket   = []byte("objects")
+	locksBucket     = []byte("locks")
+	usageBucket     = []byte("usage")
+	chargesBucket   = []byte("charges")
+	quotasBucket    = []byte("quotas")
+	retentionBucket = []byte("retention")
+	pinsBucket      = []byte("pins")
+	schemaBucket    = []byte("schema")
+
+	lockPoliciesBucket = []byte("lockpolicies")
+	lockHistoryBucket  = []byte("lockhistory")
+
+	webhooksBucket          = []byte("webhooks")
+	deliveriesBucket        = []byte("deliveries")
+	pendingDeliveriesBucket = []byte("pendingdeliveries")
+	auditBucket             = []byte("audit")
+
+	objectSizeBucket = []byte("objectsizes")
+	objectDateBucket = []byte("objectdates")
+
+	statsBucket   = []byte("stats")
+	trafficBucket = []byte("traffic")
+
+	sessionsBucket = []byte("sessions")
+	rolesBucket    = []byte("roles")
+	settingsBucket = []byte("settings")
+	tokensBucket   = []byte("tokens")
+	reposBucket    = []byte("repos")
+
+	// buckets lists every top level bucket created by NewMetaStore.
+	buckets = [][]byte{
+		usersBucket,
+		objectsBucket,
+		locksBucket,
+		usageBucket,
+		chargesBucket,
+		quotasBucket,
+		retentionBucket,
+		pinsBucket,
+		schemaBucket,
+		lockPoliciesBucket,
+		lockHistoryBucket,
+		webhooksBucket,
+		deliveriesBucket,
+		pendingDeliveriesBucket,
+		auditBucket,
+		objectSizeBucket,
+		objectDateBucket,
+		statsBucket,
+		trafficBucket,
+		sessionsBucket,
+		rolesBucket,
+		settingsBucket,
+		tokensBucket,
+		reposBucket,
+	}
 )
 
 // NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
+// Pending schema migrations are applied, after backing up the database.
 func NewMetaStore(dbFile string) (*MetaStore, error) {
+	s, err := openMetaStore(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openMetaStore opens the boltdb database at dbFile without migrating it. A
+// new database is stamped with the current schema version.
+func openMetaStore(dbFile string) (*MetaStore, error) {
 	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
-			return err
-		}
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh := true
+		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			fresh = false
+			return nil
+		})
 
-		if _, err := tx.CreateBucketIfNotExists(objectsBucket); err != nil {
-			return err
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
 
-		if _, err := tx.CreateBucketIfNotExists(locksBucket); err != nil {
-			return err
+		if fresh {
+			return setSchemaVersion(tx, latestSchemaVersion())
 		}
-
 		return nil
 	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	return &MetaStore{db: db}, nil
+	return &MetaStore{db: db, path: dbFile}, nil
+}
+
+// openMetaStoreReadOnly opens the existing boltdb database at dbFile for
+// reading only. Nothing is created or migrated, so buckets added by later
+// versions may be missing.
+func openMetaStoreReadOnly(dbFile string) (*MetaStore, error) {
+	// bolt creates missing files even when opening them read-only.
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &MetaStore{db: db, path: dbFile}, nil
 }
 
 // Get retrieves the Meta information for an object given information in
@@ -65,11 +163,11 @@ func (s *MetaStore) Get(v *RequestVars) (*MetaObject, error) {
 	return meta, error
 }
 
-// Get retrieves the Meta information for an object given information in
+// UnsafeGet retrieves the Meta information for an object given information in
 // RequestVars
 // DO NOT CHECK authentication, as it is supposed to have been done before
 func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
-	var meta MetaObject
+	var meta *MetaObject
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(objectsBucket)
@@ -82,15 +180,16 @@ func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 			return errObjectNotFound
 		}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(value))
-		return dec.Decode(&meta)
+		var err error
+		meta, err = decodeObject(value)
+		return err
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &meta, nil
+	return meta, nil
 }
 
 // Put writes meta information from RequestVars to the store.
@@ -101,10 +200,8 @@ func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
 		return meta, nil
 	}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	meta := MetaObject{Oid: v.Oid, Size: v.Size}
-	err := enc.Encode(meta)
+	meta := MetaObject{Oid: v.Oid, Size: v.Size, CreatedAt: time.Now().UTC()}
+	data, err := encodeObject(&meta)
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +212,15 @@ func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
 			return errNoBucket
 		}
 
-		err = bucket.Put([]byte(v.Oid), buf.Bytes())
+		err = bucket.Put([]byte(v.Oid), data)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if err := countObject(tx, meta.Size, 1); err != nil {
+			return err
+		}
+		return indexObject(tx, &meta)
 	})
 
 	if err != nil {
@@ -130,178 +230,150 @@ func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
 	return &meta, nil
 }
 
-// Delete removes the meta information from RequestVars to the store.
-func (s *MetaStore) Delete(v *RequestVars) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// RecordUpload stamps the object with the repository and user that uploaded
+// its content, and confirms the repository's charge for it. Only the first
+// upload is stamped.
+func (s *MetaStore) RecordUpload(oid, repo, user string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(v.Oid))
-		if err != nil {
+		if err := confirmCharge(tx, oid, repo); err != nil {
 			return err
 		}
-
-		return nil
+		return updateObject(bucket, oid, func(meta *MetaObject) bool {
+			if !meta.UploadedAt.IsZero() {
+				return false
+			}
+			meta.Repo = repo
+			meta.Uploader = user
+			meta.UploadedAt = at.UTC()
+			return true
+		})
 	})
-
-	return err
 }
 
-// AddLocks write locks to the store for the repo.
-func (s *MetaStore) AddLocks(repo string, l ...Lock) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
-		if bucket == nil {
-			return errNoBucket
-		}
-
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
-		}
-		locks = append(locks, l...)
-		sort.Sort(LocksByCreatedAt(locks))
-		data, err := json.Marshal(&locks)
-		if err != nil {
-			return err
-		}
-
-		return bucket.Put([]byte(repo), data)
-	})
-	return err
+// downloadStat accumulates downloads of an object between flushes.
+type downloadStat struct {
+	Count int64
+	Last  time.Time
 }
 
-// Locks retrieves locks for the repo from the store
-func (s *MetaStore) Locks(repo string) ([]Lock, error) {
-	var locks []Lock
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+// RecordDownloads adds the download counts and times in stats to their
+// objects in a single transaction. Objects that no longer exist are skipped.
+func (s *MetaStore) RecordDownloads(stats map[string]*downloadStat) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
+		for oid, stat := range stats {
+			err := updateObject(bucket, oid, func(meta *MetaObject) bool {
+				meta.Downloads += stat.Count
+				if stat.Last.After(meta.LastDownload) {
+					meta.LastDownload = stat.Last.UTC()
+				}
+				return true
+			})
+			if err != nil && err != errObjectNotFound {
 				return err
 			}
 		}
 		return nil
 	})
-	return locks, err
 }
 
-// FilteredLocks return filtered locks for the repo
-func (s *MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []Lock, next string, err error) {
-	locks, err = s.Locks(repo)
-	if err != nil {
-		return
+// updateObject decodes the object stored under oid, applies fn and writes it
+// back if fn returns true.
+func updateObject(bucket *bolt.Bucket, oid string, fn func(*MetaObject) bool) error {
+	value := bucket.Get([]byte(oid))
+	if len(value) == 0 {
+		return errObjectNotFound
 	}
 
-	if cursor != "" {
-		lastSeen := -1
-		for i, l := range locks {
-			if l.Id == cursor {
-				lastSeen = i
-				break
-			}
-		}
-
-		if lastSeen > -1 {
-			locks = locks[lastSeen:]
-		} else {
-			err = fmt.Errorf("cursor (%s) not found", cursor)
-			return
-		}
+	meta, err := decodeObject(value)
+	if err != nil {
+		return err
 	}
-
-	if path != "" {
-		var filtered []Lock
-		for _, l := range locks {
-			if l.Path == path {
-				filtered = append(filtered, l)
-			}
-		}
-
-		locks = filtered
+	if !fn(meta) {
+		return nil
 	}
 
-	if limit != "" {
-		var size int
-		size, err = strconv.Atoi(limit)
-		if err != nil || size < 0 {
-			locks = make([]Lock, 0)
-			err = fmt.Errorf("Invalid limit amount: %s", limit)
-			return
-		}
-
-		size = int(math.Min(float64(size), float64(len(locks))))
-		if size+1 < len(locks) {
-			next = locks[size].Id
-		}
-		locks = locks[:size]
+	data, err := encodeObject(meta)
+	if err != nil {
+		return err
 	}
+	return bucket.Put([]byte(oid), data)
+}
 
-	return locks, next, nil
+// Delete removes the meta information from RequestVars to the store and
+// releases any storage charged for it.
+func (s *MetaStore) Delete(v *RequestVars) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeObject(tx, v.Oid)
+	})
 }
 
-// DeleteLock removes lock for the repo by id from the store
-func (s *MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
-	var deleted *Lock
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
-		if bucket == nil {
-			return errNoBucket
-		}
+// removeObject removes the metadata of oid within tx and refunds its charges.
+func removeObject(tx *bolt.Tx, oid string) error {
+	bucket := tx.Bucket(objectsBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
 
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
+	if value := bucket.Get([]byte(oid)); len(value) > 0 {
+		meta, err := decodeObject(value)
+		if err != nil {
+			return err
 		}
-		newLocks := make([]Lock, 0, len(locks))
-
-		var lock Lock
-		for _, l := range locks {
-			if l.Id == id {
-				if l.Owner.Name != user && !force {
-					return errNotOwner
-				}
-				lock = l
-			} else if len(l.Id) > 0 {
-				newLocks = append(newLocks, l)
-			}
+		if err := unindexObject(tx, meta); err != nil {
+			return err
 		}
-		if lock.Id == "" {
-			return nil
+		if err := countObject(tx, meta.Size, -1); err != nil {
+			return err
 		}
-		deleted = &lock
+	}
 
-		if len(newLocks) == 0 {
-			return bucket.Delete([]byte(repo))
-		}
+	if err := bucket.Delete([]byte(oid)); err != nil {
+		return err
+	}
+	return refund(tx, oid)
+}
 
-		data, err := json.Marshal(&newLocks)
-		if err != nil {
-			return err
-		}
-		return bucket.Put([]byte(repo), data)
-	})
-	return deleted, err
+// objectRecordVersion is the version of the encoding used to store objects.
+//
+// Version 1 stores each object as a JSON document keyed by OID, holding the
+// record version in "v" alongside the fields of MetaObject:
+//
+//	{"v":1,"oid":"…","size":123,"created_at":"…","repo":"…","uploader":"…",
+//	 "uploaded_at":"…","last_download":"…","downloads":0}
+//
+// Databases created before schema versioning stored gob encoded MetaObjects;
+// these are converted by the first migration.
+const objectRecordVersion = 1
+
+type objectRecord struct {
+	V int `json:"v"`
+	*MetaObject
 }
 
-type LocksByCreatedAt []Lock
+func encodeObject(meta *MetaObject) ([]byte, error) {
+	return json.Marshal(&objectRecord{V: objectRecordVersion, MetaObject: meta})
+}
 
-func (c LocksByCreatedAt) Len() int           { return len(c) }
-func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j].LockedAt) }
-func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func decodeObject(data []byte) (*MetaObject, error) {
+	rec := objectRecord{MetaObject: &MetaObject{}}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.V != objectRecordVersion {
+		return nil, fmt.Errorf("Unsupported object record version: %d", rec.V)
+	}
+	return rec.MetaObject, nil
+}
 
 // Close closes the underlying boltdb.
 func (s *MetaStore) Close() {
@@ -326,7 +398,8 @@ func (s *MetaStore) AddUser(user, pass string) error {
 	return err
 }
 
-// DeleteUser removes user credentials from the meta store.
+// DeleteUser removes user credentials, their role, their access tokens and
+// the access they were granted to repositories from the meta store.
 func (s *MetaStore) DeleteUser(user string) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
@@ -334,6 +407,19 @@ func (s *MetaStore) DeleteUser(user string) error {
 			return errNoBucket
 		}
 
+		if err := checkLastAdmin(tx, user); err != nil {
+			return err
+		}
+		if err := tx.Bucket(rolesBucket).Delete([]byte(user)); err != nil {
+			return err
+		}
+		if err := deleteTokens(tx, user); err != nil {
+			return err
+		}
+		if err := deleteGrants(tx, user); err != nil {
+			return err
+		}
+
 		err := bucket.Delete([]byte(user))
 		return err
 	})
@@ -343,7 +429,9 @@ func (s *MetaStore) DeleteUser(user string) error {
 
 // MetaUser encapsulates information about a meta store user
 type MetaUser struct {
-	Name string
+	Name string `json:"name"`
+	// Role is the user's administrator role, if any.
+	Role string `json:"role,omitempty"`
 }
 
 // Users returns all MetaUsers in the meta store
@@ -356,8 +444,9 @@ func (s *MetaStore) Users() ([]*MetaUser, error) {
 			return errNoBucket
 		}
 
+		roles := tx.Bucket(rolesBucket)
 		bucket.ForEach(func(k, v []byte) error {
-			users = append(users, &MetaUser{string(k)})
+			users = append(users, &MetaUser{Name: string(k), Role: string(roles.Get(k))})
 			return nil
 		})
 		return nil
@@ -376,57 +465,249 @@ func (s *MetaStore) Objects() ([]*MetaObject, error) {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			var meta MetaObject
-			dec := gob.NewDecoder(bytes.NewBuffer(v))
-			err := dec.Decode(&meta)
+		return bucket.ForEach(func(k, v []byte) error {
+			meta, err := decodeObject(v)
 			if err != nil {
 				return err
 			}
-			objects = append(objects, &meta)
+			objects = append(objects, meta)
 			return nil
 		})
-		return nil
 	})
 
 	return objects, err
 }
 
-// AllLocks return all locks in the store, lock path is prepended with repo
-func (s *MetaStore) AllLocks() ([]Lock, error) {
-	var locks []Lock
+// ObjectOids returns the oids of every object, without decoding them.
+func (s *MetaStore) ObjectOids() (map[string]bool, error) {
+	oids := make(map[string]bool)
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			var l []Lock
-			if err := json.Unmarshal(v, &l); err != nil {
-				return err
-			}
-			for _, lv := range l {
-				lv.Path = fmt.Sprintf("%s:%s", k, lv.Path)
-				locks = append(locks, lv)
-			}
+		return bucket.ForEach(func(k, v []byte) error {
+			oids[string(k)] = true
 			return nil
 		})
+	})
+	return oids, err
+}
+
+// Orders of an object listing. Objects are kept in oid order, and indexed by
+// size and by creation time in objectSizeBucket and objectDateBucket, keyed
+// by the value (int64 BE) followed by the oid.
+const (
+	objectOrderOid      = ""
+	objectOrderSize     = "size"
+	objectOrderSizeDesc = "-size"
+	objectOrderDate     = "date"
+	objectOrderDateDesc = "-date"
+)
+
+// ObjectFilter selects objects. Empty fields match every object.
+type ObjectFilter struct {
+	Repo     string
+	Uploader string
+	// Prefix matches objects whose oid starts with it.
+	Prefix string
+	// MinSize and MaxSize, if not zero, bound the object size in bytes.
+	MinSize int64
+	MaxSize int64
+	// Order is one of the objectOrder constants.
+	Order string
+}
+
+func (f *ObjectFilter) matches(meta *MetaObject) bool {
+	return (f.Repo == "" || f.Repo == meta.Repo) &&
+		(f.Uploader == "" || f.Uploader == meta.Uploader) &&
+		strings.HasPrefix(meta.Oid, f.Prefix) &&
+		(f.MinSize == 0 || meta.Size >= f.MinSize) &&
+		(f.MaxSize == 0 || meta.Size <= f.MaxSize)
+}
+
+// validObjectOrder reports whether order is one of the objectOrder constants.
+func validObjectOrder(order string) bool {
+	switch order {
+	case objectOrderOid, objectOrderSize, objectOrderSizeDesc, objectOrderDate, objectOrderDateDesc:
+		return true
+	}
+	return false
+}
+
+func objectIndexKey(n int64, oid string) []byte {
+	key := make([]byte, 8+len(oid))
+	binary.BigEndian.PutUint64(key, uint64(n))
+	copy(key[8:], oid)
+	return key
+}
+
+func objectDateKey(meta *MetaObject) []byte {
+	var n int64
+	if !meta.CreatedAt.IsZero() {
+		n = meta.CreatedAt.UnixNano()
+	}
+	return objectIndexKey(n, meta.Oid)
+}
+
+// indexObject adds meta to the size and date indexes.
+func indexObject(tx *bolt.Tx, meta *MetaObject) error {
+	if err := tx.Bucket(objectSizeBucket).Put(objectIndexKey(meta.Size, meta.Oid), []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket(objectDateBucket).Put(objectDateKey(meta), []byte{})
+}
+
+// unindexObject removes meta from the size and date indexes.
+func unindexObject(tx *bolt.Tx, meta *MetaObject) error {
+	if err := tx.Bucket(objectSizeBucket).Delete(objectIndexKey(meta.Size, meta.Oid)); err != nil {
+		return err
+	}
+	return tx.Bucket(objectDateBucket).Delete(objectDateKey(meta))
+}
 
+// ObjectPage returns up to limit objects matching f, in f.Order, starting
+// after cursor. It also returns the cursor of the next page, which is empty on
+// the last page. In oid order the cursor is an oid; in the other orders it is
+// an index key, hex encoded.
+func (s *MetaStore) ObjectPage(f ObjectFilter, cursor string, limit int) ([]*MetaObject, string, error) {
+	var objects []*MetaObject
+	var next string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var c *bolt.Cursor
+		var start, after []byte
+		desc := false
+		switch f.Order {
+		case objectOrderOid:
+			c = bucket.Cursor()
+			start, after = []byte(f.Prefix), []byte(cursor)
+			if cursor > f.Prefix {
+				start = after
+			}
+		case objectOrderSize, objectOrderSizeDesc, objectOrderDate, objectOrderDateDesc:
+			if f.Order == objectOrderSize || f.Order == objectOrderSizeDesc {
+				c = tx.Bucket(objectSizeBucket).Cursor()
+			} else {
+				c = tx.Bucket(objectDateBucket).Cursor()
+			}
+			desc = strings.HasPrefix(f.Order, "-")
+
+			var err error
+			if start, err = hex.DecodeString(cursor); err != nil {
+				return errInvalidCursor
+			}
+			after = start
+		default:
+			return fmt.Errorf("Invalid order %q", f.Order)
+		}
+
+		var k, v []byte
+		switch {
+		case desc && len(start) == 0:
+			k, v = c.Last()
+		case desc:
+			if k, v = c.Seek(start); k == nil {
+				k, v = c.Last()
+			}
+		default:
+			k, v = c.Seek(start)
+		}
+
+		var last []byte
+		for ; k != nil; k, v = step(c, desc) {
+			if len(after) > 0 && (bytes.Equal(k, after) || (desc && bytes.Compare(k, after) > 0)) {
+				continue
+			}
+
+			var meta *MetaObject
+			if f.Order == objectOrderOid {
+				if !strings.HasPrefix(string(k), f.Prefix) {
+					return nil
+				}
+				var err error
+				if meta, err = decodeObject(v); err != nil {
+					return err
+				}
+			} else {
+				value := bucket.Get(k[8:])
+				if len(value) == 0 {
+					continue
+				}
+				var err error
+				if meta, err = decodeObject(value); err != nil {
+					return err
+				}
+			}
+
+			if !f.matches(meta) {
+				continue
+			}
+			if len(objects) == limit {
+				next = string(last)
+				if f.Order != objectOrderOid {
+					next = hex.EncodeToString(last)
+				}
+				return nil
+			}
+			objects = append(objects, meta)
+			last = append(last[:0], k...)
+		}
 		return nil
 	})
-	return locks, err
+
+	return objects, next, err
 }
 
-// Authenticate authorizes user with password and returns the user name
-func (s *MetaStore) Authenticate(user, password string) (string, bool) {
-	// check admin
-	if len(user) > 0 && len(password) > 0 {
-		if ok := checkBasicAuth(user, password, true); ok {
-			return user, true
-		}
+// step moves c to the next key, or the previous one if desc is set.
+func step(c *bolt.Cursor, desc bool) ([]byte, []byte) {
+	if desc {
+		return c.Prev()
 	}
+	return c.Next()
+}
+
+// migrateObjectIndexes indexes existing objects by size and creation time.
+func migrateObjectIndexes(tx *bolt.Tx) error {
+	return tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+		meta, err := decodeObject(v)
+		if err != nil {
+			return err
+		}
+		return indexObject(tx, meta)
+	})
+}
+
+// UserExists reports whether user has credentials in the meta store.
+func (s *MetaStore) UserExists(user string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		exists = bucket.Get([]byte(user)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// Authenticate authorizes user with their password or one of their access
+// tokens, and returns the user name. Only stored users can use LFS: the
+// bootstrap admin account can't.
+func (s *MetaStore) Authenticate(user, password string) (string, bool) {
+	return user, s.CheckPassword(user, password) || s.checkToken(user, password)
+}
 
+// CheckPassword reports whether password is the password of user.
+func (s *MetaStore) CheckPassword(user, password string) bool {
 	value := ""
 
 	s.db.View(func(tx *bolt.Tx) error {
@@ -439,5 +720,5 @@ func (s *MetaStore) Authenticate(user, password string) (string, bool) {
 		return nil
 	})
 
-	return user, value != "" && value == password
+	return value != "" && value == password
 }
@@ -5,6 +5,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var (
@@ -65,6 +67,273 @@ func TestPutMeta(t *testing.T) {
 	}
 }
 
+func TestRecordUpload(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.RecordUpload(contentOid, testRepo, testUser, time.Now()); err != nil {
+		t.Fatalf("expected RecordUpload to succeed, got: %s", err)
+	}
+
+	// Only the first upload is recorded.
+	if err := metaStoreTest.RecordUpload(contentOid, "other", testUser1, time.Now()); err != nil {
+		t.Fatalf("expected RecordUpload to succeed, got: %s", err)
+	}
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("Error retreiving meta: %s", err)
+	}
+	if meta.Uploader != testUser || meta.Repo != testRepo {
+		t.Errorf("expected first uploader to be recorded, got: %s in %s", meta.Uploader, meta.Repo)
+	}
+	if meta.UploadedAt.IsZero() {
+		t.Errorf("expected upload time to be recorded")
+	}
+}
+
+func TestRecordDownloads(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	last := time.Now()
+	stats := map[string]*downloadStat{
+		contentOid:     {Count: 3, Last: last},
+		nonExistingOid: {Count: 1, Last: last},
+	}
+	if err := metaStoreTest.RecordDownloads(stats); err != nil {
+		t.Fatalf("expected RecordDownloads to succeed, got: %s", err)
+	}
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("Error retreiving meta: %s", err)
+	}
+	if meta.Downloads != 3 {
+		t.Errorf("expected 3 downloads, got: %d", meta.Downloads)
+	}
+	if !meta.LastDownload.Equal(last.UTC()) {
+		t.Errorf("expected last download to be recorded, got: %s", meta.LastDownload)
+	}
+}
+
+func TestDownloadRecorderKeepsFailedFlush(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	r := &downloadRecorder{store: metaStoreTest, pending: make(map[string]*downloadStat)}
+	first := time.Now()
+	r.Record(contentOid, first)
+
+	metaStoreTest.db.Close()
+	if err := r.Flush(); err == nil {
+		t.Fatal("expected Flush to fail with the meta store closed")
+	}
+	r.Record(contentOid, first.Add(time.Second))
+
+	stat := r.pending[contentOid]
+	if stat == nil || stat.Count != 2 || !stat.Last.Equal(first.Add(time.Second)) {
+		t.Errorf("expected the failed flush to be kept with the new download, got %+v", stat)
+	}
+}
+
+func TestObjectsReturnsDecodeError(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	err := metaStoreTest.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).Put([]byte("broken"), []byte("not an object"))
+	})
+	if err != nil {
+		t.Fatalf("expected the broken object to be written, got: %s", err)
+	}
+
+	if _, err := metaStoreTest.Objects(); err == nil {
+		t.Error("expected Objects to fail on an undecodable object")
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// The seeded object has contentSize (18) bytes.
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: "stats", Size: 100}); err != nil {
+		t.Fatalf("expected Put to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: "stats", Size: 100}); err != nil {
+		t.Fatalf("expected Put of an existing object to succeed, got: %s", err)
+	}
+	if err := metaStoreTest.Reserve("stats", testRepo, testUser, 100); err != nil {
+		t.Fatalf("expected Reserve to succeed, got: %s", err)
+	}
+
+	stats, err := metaStoreTest.StoreStats()
+	if err != nil || stats.Objects != 2 || stats.Bytes != contentSize+100 {
+		t.Errorf("expected 2 objects of %d bytes, got %v: %v", contentSize+100, stats, err)
+	}
+	if u, _ := metaStoreTest.Usage(quotaRepo, testRepo); u.Objects != 1 || u.Bytes != 100 {
+		t.Errorf("expected the object to be counted for the repository, got %d objects of %d bytes", u.Objects, u.Bytes)
+	}
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: "stats"}); err != nil {
+		t.Fatalf("expected Delete to succeed, got: %s", err)
+	}
+	stats, err = metaStoreTest.StoreStats()
+	if err != nil || stats.Objects != 1 || stats.Bytes != contentSize {
+		t.Errorf("expected the seeded object to be left, got %v: %v", stats, err)
+	}
+	if u, _ := metaStoreTest.Usage(quotaUser, testUser); u.Objects != 0 {
+		t.Errorf("expected the deleted object to be uncounted for the user, got %d", u.Objects)
+	}
+}
+
+func TestObjectPageOrder(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// The seeded object has contentSize (18) bytes.
+	for i, size := range []int64{300, 5, 40} {
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: fmt.Sprintf("order%d", i), Size: size}); err != nil {
+			t.Fatalf("expected Put to succeed, got: %s", err)
+		}
+	}
+
+	oids := func(f ObjectFilter, limit int) []string {
+		var all []string
+		cursor := ""
+		for {
+			objects, next, err := metaStoreTest.ObjectPage(f, cursor, limit)
+			if err != nil {
+				t.Fatalf("expected ObjectPage to succeed, got: %s", err)
+			}
+			for _, o := range objects {
+				all = append(all, o.Oid[:6])
+			}
+			if next == "" {
+				return all
+			}
+			cursor = next
+		}
+	}
+
+	cases := []struct {
+		f    ObjectFilter
+		want string
+	}{
+		{ObjectFilter{Order: objectOrderSize}, "[order1 f97e1b order2 order0]"},
+		{ObjectFilter{Order: objectOrderSizeDesc}, "[order0 order2 f97e1b order1]"},
+		{ObjectFilter{Order: objectOrderDate}, "[f97e1b order0 order1 order2]"},
+		{ObjectFilter{Order: objectOrderDateDesc}, "[order2 order1 order0 f97e1b]"},
+		{ObjectFilter{Order: objectOrderSizeDesc, MinSize: 10, MaxSize: 100}, "[order2 f97e1b]"},
+		{ObjectFilter{Order: objectOrderSize, Prefix: "order"}, "[order1 order2 order0]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(oids(c.f, 1)); got != c.want {
+			t.Errorf("expected %+v to list %s, got %s", c.f, c.want, got)
+		}
+	}
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: "order0"}); err != nil {
+		t.Fatalf("expected Delete to succeed, got: %s", err)
+	}
+	if got := fmt.Sprint(oids(ObjectFilter{Order: objectOrderSizeDesc}, 10)); got != "[order2 f97e1b order1]" {
+		t.Errorf("expected the deleted object to leave the index, got %s", got)
+	}
+
+	if _, _, err := metaStoreTest.ObjectPage(ObjectFilter{Order: objectOrderSize}, "zz", 10); err != errInvalidCursor {
+		t.Errorf("expected an invalid cursor error, got %v", err)
+	}
+}
+
+func TestReserveAndRefund(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.SetQuota(quotaUser, testUser, 50); err != nil {
+		t.Fatalf("expected SetQuota to succeed, got: %s", err)
+	}
+
+	if err := metaStoreTest.Reserve(nonExistingOid, testRepo, testUser, 40); err != nil {
+		t.Fatalf("expected Reserve to succeed, got: %s", err)
+	}
+
+	// Reserving an already charged object is a no-op.
+	if err := metaStoreTest.Reserve(nonExistingOid, testRepo, testUser, 40); err != nil {
+		t.Fatalf("expected repeated Reserve to succeed, got: %s", err)
+	}
+
+	if err := metaStoreTest.Reserve(contentOid, testRepo, testUser, 40); err != errUserQuotaExceeded {
+		t.Fatalf("expected user quota to be exceeded, got: %v", err)
+	}
+
+	usage, _ := metaStoreTest.Usage(quotaRepo, testRepo)
+	if usage.Bytes != 40 {
+		t.Errorf("expected repo usage of 40, got: %d", usage.Bytes)
+	}
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: nonExistingOid}); err != nil {
+		t.Fatalf("expected Delete to succeed, got: %s", err)
+	}
+
+	usage, _ = metaStoreTest.Usage(quotaUser, testUser)
+	if usage.Bytes != 0 {
+		t.Errorf("expected user usage to be refunded, got: %d", usage.Bytes)
+	}
+}
+
+func TestChargesPerRepository(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, repo := range []string{"one", "two"} {
+		if err := metaStoreTest.Reserve(nonExistingOid, repo, testUser, 40); err != nil {
+			t.Fatalf("expected Reserve to succeed, got: %s", err)
+		}
+	}
+	for _, repo := range []string{"one", "two"} {
+		if usage, _ := metaStoreTest.Usage(quotaRepo, repo); usage.Objects != 1 || usage.Bytes != 40 {
+			t.Errorf("expected %s to be charged, got %+v", repo, usage)
+		}
+	}
+	if usage, _ := metaStoreTest.Usage(quotaUser, testUser); usage.Bytes != 80 {
+		t.Errorf("expected the user to be charged for both repositories, got %d", usage.Bytes)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.RecordUpload(nonExistingOid, "one", testUser, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	released, err := metaStoreTest.ReleaseReservations(time.Now().Add(time.Minute))
+	if err != nil || len(released) != 1 || released[0].Repo != "two" {
+		t.Fatalf("expected the unconfirmed reservation to be released, got %+v, %v", released, err)
+	}
+	if usage, _ := metaStoreTest.Usage(quotaRepo, "two"); usage.Objects != 0 || usage.Bytes != 0 {
+		t.Errorf("expected the released reservation to be refunded, got %+v", usage)
+	}
+	charges, _ := metaStoreTest.ChargesOf(nonExistingOid)
+	if len(charges) != 1 || charges[0].Repo != "one" || !charges[0].Confirmed {
+		t.Errorf("expected the confirmed charge to be kept, got %+v", charges)
+	}
+
+	// Charges used to be keyed by object alone.
+	err = metaStoreTest.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chargesBucket).Put([]byte(contentOid), []byte(`{"repo":"old","user":"bilbo","size":18}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.db.Update(migrateChargeKeys); err != nil {
+		t.Fatalf("expected migrateChargeKeys to succeed, got: %s", err)
+	}
+	charges, _ = metaStoreTest.ChargesOf(contentOid)
+	if len(charges) != 1 || charges[0].Oid != contentOid || charges[0].Repo != "old" || !charges[0].Confirmed {
+		t.Errorf("expected the charge to be rekeyed, got %+v", charges)
+	}
+}
+
 func TestLocks(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
@@ -98,7 +367,7 @@ func TestFilteredLocks(t *testing.T) {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	locks, next, err := metaStoreTest.FilteredLocks(testRepo, "", "", "3")
+	locks, next, err := metaStoreTest.FilteredLocks(testRepo, LockFilter{}, "3")
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
@@ -109,7 +378,7 @@ func TestFilteredLocks(t *testing.T) {
 		t.Errorf("expected next to exist")
 	}
 
-	locks, next, err = metaStoreTest.FilteredLocks(testRepo, "", next, "2")
+	locks, next, err = metaStoreTest.FilteredLocks(testRepo, LockFilter{Cursor: next}, "2")
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
@@ -130,7 +399,7 @@ func TestAddLocks(t *testing.T) {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	locks, _, err := metaStoreTest.FilteredLocks(testRepo, lock.Path, "", "1")
+	locks, _, err := metaStoreTest.FilteredLocks(testRepo, LockFilter{Path: lock.Path}, "1")
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
@@ -138,7 +407,340 @@ func TestAddLocks(t *testing.T) {
 		t.Errorf("expected lock to be existed")
 	}
 	if locks[0].Id != lockId {
-		t.Errorf("expected lockId to match, got: %s", locks[0])
+		t.Errorf("expected lockId to match, got: %v", locks[0])
+	}
+}
+
+func TestCreateLockConflict(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+
+	existing, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), lockPath, testUser1))
+	if err != errLockExists {
+		t.Fatalf("expected errLockExists, got : %v", err)
+	}
+	if existing == nil || existing.Id != lockId {
+		t.Errorf("expected existing lock to be returned, got : %v", existing)
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Errorf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 {
+		t.Errorf("expected only the first lock to be stored, got: %d", len(locks))
+	}
+}
+
+func TestListLocksByOwner(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for i := 0; i < 6; i++ {
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i%2))
+		if _, err := metaStoreTest.CreateLock(testRepo, lock); err != nil {
+			t.Fatalf("expected CreateLock to succeed, got : %s", err)
+		}
+	}
+
+	locks, next, err := metaStoreTest.ListLocks(testRepo, LockFilter{Owner: "user-1", Limit: 2})
+	if err != nil {
+		t.Fatalf("expected ListLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 2 || locks[0].Path != "path-1" || locks[1].Path != "path-3" {
+		t.Errorf("expected the first two locks of user-1, got: %v", locks)
+	}
+	if next == "" {
+		t.Fatalf("expected next to exist")
+	}
+
+	locks, next, err = metaStoreTest.ListLocks(testRepo, LockFilter{Owner: "user-1", Cursor: next, Limit: 2})
+	if err != nil {
+		t.Fatalf("expected ListLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 || locks[0].Path != "path-5" {
+		t.Errorf("expected the last lock of user-1, got: %v", locks)
+	}
+	if next != "" {
+		t.Errorf("expected next to not exist, got: %s", next)
+	}
+}
+
+func TestLockCountSkipsExpired(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	expired := NewTestLock(randomLockId(), "expired.psd", testUser)
+	past := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &past
+	for _, lock := range []Lock{NewTestLock(lockId, lockPath, testUser), expired} {
+		if _, err := metaStoreTest.CreateLock(testRepo, lock); err != nil {
+			t.Fatalf("expected CreateLock to succeed, got : %s", err)
+		}
+	}
+
+	if n, err := metaStoreTest.LockCount(); err != nil || n != 1 {
+		t.Errorf("expected 1 unexpired lock, got %d: %v", n, err)
+	}
+}
+
+func TestDeleteLockRemovesIndexes(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, lockId, false); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), lockPath, testUser1)); err != nil {
+		t.Errorf("expected path to be lockable again, got : %s", err)
+	}
+
+	locks, _, err := metaStoreTest.ListLocks(testRepo, LockFilter{Owner: testUser})
+	if err != nil {
+		t.Errorf("expected ListLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("expected no locks for the previous owner, got: %d", len(locks))
+	}
+}
+
+func TestCreateLockPatternConflicts(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, path := range []string{"art/hero.psd", "audio/", "glob:docs/*.pdf"} {
+		if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), path, testUser)); err != nil {
+			t.Fatalf("expected CreateLock(%q) to succeed, got : %s", path, err)
+		}
+	}
+
+	for _, path := range []string{"./art//hero.psd", "art/", "audio/music/theme.wav", "docs/manual.pdf", "docs/"} {
+		if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), path, testUser1)); err != errLockExists {
+			t.Errorf("expected CreateLock(%q) to conflict, got : %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"art/other.psd", "Art/Hero.psd", "art/sub/", "docs/manual.txt", "docs/old/manual.pdf", "docs/[1].txt"} {
+		if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), path, testUser1)); err != nil {
+			t.Errorf("expected CreateLock(%q) to succeed, got : %v", path, err)
+		}
+	}
+
+	locks, _, err := metaStoreTest.ListLocks(testRepo, LockFilter{Path: "./art//hero.psd"})
+	if err != nil {
+		t.Fatalf("expected ListLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 || locks[0].Path != "art/hero.psd" {
+		t.Errorf("expected path filter to match the normalized path, got: %v", locks)
+	}
+}
+
+func TestCreateLockPolicy(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	policy := &LockPolicy{Repo: testRepo, AllowedPaths: []string{"*.psd"}, MaxLocksPerUser: 2, ForceUnlockers: []string{testUser1}}
+	if err := metaStoreTest.SetLockPolicy(policy); err != nil {
+		t.Fatalf("expected SetLockPolicy to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), "README.md", testUser)); err != errLockPathNotAllowed {
+		t.Errorf("expected errLockPathNotAllowed, got : %v", err)
+	}
+
+	lock := NewTestLock(lockId, "a.psd", testUser)
+	for _, l := range []Lock{lock, NewTestLock(randomLockId(), "b.psd", testUser)} {
+		if _, err := metaStoreTest.CreateLock(testRepo, l); err != nil {
+			t.Fatalf("expected CreateLock to succeed, got : %s", err)
+		}
+	}
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), "c.psd", testUser)); err != errTooManyLocks {
+		t.Errorf("expected errTooManyLocks, got : %v", err)
+	}
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), "c.psd", testUser1)); err != nil {
+		t.Errorf("expected another user to be able to lock, got : %s", err)
+	}
+
+	if err := metaStoreTest.SetLockPolicy(&LockPolicy{Repo: testRepo, ForceUnlockers: []string{testUser1}}); err != nil {
+		t.Fatalf("expected SetLockPolicy to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.DeleteLock(testRepo, "someone", lock.Id, true); err != errForceNotAllowed {
+		t.Errorf("expected errForceNotAllowed, got : %v", err)
+	}
+	if deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, true); err != nil || deleted == nil {
+		t.Errorf("expected force unlocker to be able to force unlock, got : %v, %v", deleted, err)
+	}
+}
+
+func TestTransferLock(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.TransferLock(testRepo, testUser1, lockId, testUser1, false); err != errTransferNotOwner {
+		t.Errorf("expected errTransferNotOwner, got : %v", err)
+	}
+
+	l, err := metaStoreTest.TransferLock(testRepo, testUser, lockId, testUser1, false)
+	if err != nil {
+		t.Fatalf("expected TransferLock to succeed, got : %s", err)
+	}
+	if l == nil || l.Owner.Name != testUser1 {
+		t.Errorf("expected lock to be owned by the new owner, got : %v", l)
+	}
+
+	locks, _, err := metaStoreTest.ListLocks(testRepo, LockFilter{Owner: testUser1})
+	if err != nil {
+		t.Fatalf("expected ListLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 {
+		t.Errorf("expected owner index to follow the transfer, got: %d", len(locks))
+	}
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser1, lockId, false); err != nil {
+		t.Errorf("expected new owner to be able to unlock, got : %s", err)
+	}
+}
+
+func TestLockHistory(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.TransferLock(testRepo, testUser, lockId, testUser1, false); err != nil {
+		t.Fatalf("expected TransferLock to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, lockId, true); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), "other", testUser)); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+
+	events, err := metaStoreTest.LockHistory(testRepo, lockPath, 0)
+	if err != nil {
+		t.Fatalf("expected LockHistory to succeed, got : %s", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events for the path, got: %d", len(events))
+	}
+
+	expected := []struct{ action, owner, user string }{
+		{lockForceReleased, testUser1, testUser},
+		{lockTransferred, testUser, testUser},
+		{lockCreated, testUser, testUser},
+	}
+	for i, e := range expected {
+		if events[i].Action != e.action || events[i].Owner != e.owner || events[i].User != e.user {
+			t.Errorf("expected event %d to be %v, got: %+v", i, e, events[i])
+		}
+	}
+	if events[1].NewOwner != testUser1 {
+		t.Errorf("expected transfer to record the new owner, got: %q", events[1].NewOwner)
+	}
+
+	events, err = metaStoreTest.LockHistory(testRepo, "", 2)
+	if err != nil {
+		t.Fatalf("expected LockHistory to succeed, got : %s", err)
+	}
+	if len(events) != 2 || events[0].Path != "other" {
+		t.Errorf("expected the 2 newest events of the repo, got: %v", events)
+	}
+}
+
+func TestExpiredLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	past := time.Now().Add(-time.Minute)
+	expired := NewTestLock(lockId, lockPath, testUser)
+	expired.ExpiresAt = &past
+	if _, err := metaStoreTest.CreateLock(testRepo, expired); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Errorf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("expected expired lock to be hidden, got: %d", len(locks))
+	}
+
+	if _, err := metaStoreTest.CreateLock(testRepo, NewTestLock(randomLockId(), lockPath, testUser1)); err != nil {
+		t.Errorf("expected expired lock not to conflict, got : %s", err)
+	}
+	if l, err := metaStoreTest.RenewLock(testRepo, testUser, lockId, nil); err != nil || l != nil {
+		t.Errorf("expected expired lock not to be renewable, got : %v, %v", l, err)
+	}
+
+	reaped, err := metaStoreTest.ReapLocks(time.Now())
+	if err != nil {
+		t.Fatalf("expected ReapLocks to succeed, got : %s", err)
+	}
+	if len(reaped) != 1 || reaped[0].Lock.Id != lockId || reaped[0].Repo != testRepo {
+		t.Errorf("expected the expired lock to be reaped, got: %v", reaped)
+	}
+
+	locks, err = metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Errorf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 || locks[0].Owner.Name != testUser1 {
+		t.Errorf("expected the unexpired lock to remain, got: %v", locks)
+	}
+}
+
+func TestRenewLock(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	soon := time.Now().Add(time.Minute)
+	lock := NewTestLock(lockId, lockPath, testUser)
+	lock.ExpiresAt = &soon
+	if _, err := metaStoreTest.CreateLock(testRepo, lock); err != nil {
+		t.Fatalf("expected CreateLock to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.RenewLock(testRepo, testUser1, lockId, nil); err != errRenewNotOwner {
+		t.Errorf("expected errRenewNotOwner, got : %v", err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	renewed, err := metaStoreTest.RenewLock(testRepo, testUser, lockId, &later)
+	if err != nil {
+		t.Fatalf("expected RenewLock to succeed, got : %s", err)
+	}
+	if renewed == nil || renewed.ExpiresAt == nil || !renewed.ExpiresAt.Equal(later) {
+		t.Errorf("expected expiry to be extended, got : %v", renewed)
+	}
+
+	reaped, err := metaStoreTest.ReapLocks(soon.Add(time.Second))
+	if err != nil {
+		t.Fatalf("expected ReapLocks to succeed, got : %s", err)
+	}
+	if len(reaped) != 0 {
+		t.Errorf("expected renewed lock not to be reaped at its old expiry, got: %v", reaped)
+	}
+
+	reaped, err = metaStoreTest.ReapLocks(later)
+	if err != nil {
+		t.Fatalf("expected ReapLocks to succeed, got : %s", err)
+	}
+	if len(reaped) != 1 {
+		t.Errorf("expected renewed lock to be reaped at its new expiry, got: %v", reaped)
 	}
 }
 
@@ -156,7 +758,7 @@ func TestDeleteLock(t *testing.T) {
 		t.Errorf("expected DeleteLock to succeed, got : %s", err)
 	}
 	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
 	}
 }
 
@@ -193,7 +795,7 @@ func TestDeleteLockNotOwnerForce(t *testing.T) {
 		t.Errorf("expected DeleteLock(force) to succeed, got : %s", err)
 	}
 	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
 	}
 }
 
@@ -211,7 +813,7 @@ func TestDeleteLockNonExisting(t *testing.T) {
 		t.Errorf("expected DeleteLock to succeed, got : %s", err)
 	}
 	if deleted != nil {
-		t.Errorf("expected nil returned, got : %s", deleted)
+		t.Errorf("expected nil returned, got : %v", deleted)
 	}
 }
 
@@ -252,3 +854,56 @@ func teardownMeta() {
 	metaStoreTest.Close()
 	os.RemoveAll("test-meta-store.db")
 }
+
+func TestRoles(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.SetRole("nobody", roleAdmin); err != errUserNotFound {
+		t.Errorf("expected errUserNotFound, got %v", err)
+	}
+	if err := metaStoreTest.SetRole(testUser, "root"); err != errInvalidRole {
+		t.Errorf("expected errInvalidRole, got %v", err)
+	}
+	if err := metaStoreTest.SetBootstrapDisabled(true); err != errNoAdmins {
+		t.Errorf("expected the bootstrap account to stay enabled without an admin, got %v", err)
+	}
+
+	if err := metaStoreTest.SetRole(testUser, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.AddUser("carol", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.SetRole("carol", roleAuditor); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := metaStoreTest.Users()
+	if len(users) != 2 || users[0].Role != roleAdmin || users[1].Role != roleAuditor {
+		t.Fatalf("expected the users to have their roles, got %+v %+v", users[0], users[1])
+	}
+
+	if err := metaStoreTest.SetBootstrapDisabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.SetRole(testUser, roleAuditor); err != errLastAdmin {
+		t.Errorf("expected the last admin to keep their role, got %v", err)
+	}
+	if err := metaStoreTest.DeleteUser(testUser); err != errLastAdmin {
+		t.Errorf("expected the last admin not to be deleted, got %v", err)
+	}
+
+	if err := metaStoreTest.DeleteUser("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := metaStoreTest.Role("carol"); role != "" {
+		t.Errorf("expected the role to be deleted with the user, got %q", role)
+	}
+
+	if err := metaStoreTest.SetBootstrapDisabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.SetRole(testUser, ""); err != nil {
+		t.Errorf("expected the role to be taken away, got %v", err)
+	}
+}
@@ -1,33 +1,146 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gorilla/mux"
 )
 
 type pageData struct {
-	Name    string
-	Config  *Configuration
-	Users   []*MetaUser
-	Objects []*MetaObject
-	Locks   []Lock
-	Oid     string
+	Name       string
+	Config     *Configuration
+	Users      []*MetaUser
+	Objects    []*MetaObject
+	Locks      []RepoLock
+	Oid        string
+	RepoUsages []*Usage
+	UserUsages []*Usage
+	Rules      []*RetentionRule
+	Pins       []*Pin
+	Retention  *RetentionReport
+
+	LockPolicies  []*LockPolicy
+	LockEvents    []*LockEvent
+	Repo          string
+	Path          string
+	LockSelection LockSelection
+	LockQuery     string
+	OlderThan     string
+
+	Webhooks   []*Webhook
+	Deliveries []*Delivery
+	EventTypes string
+
+	AuditEntries []*AuditEntry
+	AuditFilter  AuditFilter
+	NextCursor   uint64
+
+	Object       *AdminObject
+	Location     *ContentLocation
+	Charges      []*objectCharge
+	ObjectFilter ObjectFilter
+	ObjectQuery  string
+	ObjectCursor string
+	MinSize      string
+	MaxSize      string
+
+	Dashboard      *Dashboard
+	TrafficWindows []trafficWindow
+
+	Repos            []*AdminRepo
+	Repository       *AdminRepo
+	Visibilities     []string
+	TransferAdapters []string
+	GrantAccesses    []string
+
+	Roles            []string
+	BootstrapUser    string
+	BootstrapEnabled bool
+
+	Usage    *Usage
+	Tokens   []*AccessToken
+	NewToken string
+
+	// Area is the session area the page is part of, "mgmt" unless set.
+	Area string
+	// SessionUser is who is logged in, if the page is viewed in a session,
+	// and SessionRole the role of whoever views it. Both are set by render.
+	SessionUser string
+	SessionRole string
+	Error       string
+}
+
+// Allowed reports whether the administrator viewing the page has a role
+// granting what role does, to only show the forms they can use.
+func (p pageData) Allowed(role string) bool {
+	return roleAllows(p.SessionRole, role)
 }
 
 func (a *App) addMgmt(r *mux.Router) {
-	r.HandleFunc("/mgmt", basicAuth(a.indexHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/objects", basicAuth(a.objectsHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/raw/{oid}", basicAuth(a.objectsRawHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/locks", basicAuth(a.locksHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/users", basicAuth(a.usersHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/add", basicAuth(a.addUserHandler)).Methods("POST")
-	r.HandleFunc("/mgmt/del", basicAuth(a.delUserHandler)).Methods("POST")
+	r.HandleFunc("/mgmt/login", a.mgmt.loginForm).Methods("GET")
+	r.HandleFunc("/mgmt/login", a.auditMgmt("session.login", a.mgmt.login)).Methods("POST")
+	r.HandleFunc("/mgmt/logout", a.requireSession(roleAuditor, a.auditMgmt("session.logout", a.mgmt.logout))).Methods("POST")
+	r.HandleFunc("/mgmt", a.requireSession(roleAuditor, a.indexHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/objects", a.requireSession(roleAuditor, a.objectsHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/objects/del", a.requireSession(roleAdmin, a.auditMgmt("object.delete", a.delObjectHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/objects/{oid}", a.requireSession(roleAuditor, a.objectHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/raw/{oid}", a.requireSession(roleAuditor, a.objectsRawHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/locks", a.requireSession(roleAuditor, a.locksHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/locks/history", a.requireSession(roleAuditor, a.lockHistoryHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/locks/unlock", a.requireSession(roleAdmin, a.auditMgmt("lock.force_unlock", a.unlockHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/locks/release", a.requireSession(roleAdmin, a.auditMgmt("lock.bulk_release", a.releaseLocksHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/locks/transfer", a.requireSession(roleAdmin, a.auditMgmt("lock.transfer", a.transferLockHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/locks/policies", a.requireSession(roleAdmin, a.auditMgmt("lockpolicy.set", a.setLockPolicyHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/locks/policies/del", a.requireSession(roleAdmin, a.auditMgmt("lockpolicy.delete", a.delLockPolicyHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/users", a.requireSession(roleAuditor, a.usersHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/add", a.requireSession(roleUserManager, a.auditMgmt("user.add", a.addUserHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/del", a.requireSession(roleUserManager, a.auditMgmt("user.delete", a.delUserHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/users/role", a.requireSession(roleAdmin, a.auditMgmt("user.role", a.setRoleHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/users/bootstrap", a.requireSession(roleAdmin, a.auditMgmt("admin.bootstrap", a.bootstrapHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos", a.requireSession(roleAuditor, a.reposHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/repos", a.requireSession(roleAdmin, a.auditMgmt("repo.create", a.createRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/update", a.requireSession(roleAdmin, a.auditMgmt("repo.update", a.updateRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/rename", a.requireSession(roleAdmin, a.auditMgmt("repo.rename", a.renameRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/archive", a.requireSession(roleAdmin, a.auditMgmt("repo.archive", a.archiveRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/grant", a.requireSession(roleAdmin, a.auditMgmt("repo.grant", a.grantRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/revoke", a.requireSession(roleAdmin, a.auditMgmt("repo.revoke", a.revokeRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/del", a.requireSession(roleAdmin, a.auditMgmt("repo.delete", a.delRepoHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/repos/{repo}", a.requireSession(roleAuditor, a.repoHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/quotas", a.requireSession(roleAuditor, a.quotasHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/quotas", a.requireSession(roleAdmin, a.auditMgmt("quota.set", a.setQuotaHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/retention", a.requireSession(roleAuditor, a.retentionHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/retention/rules", a.requireSession(roleAdmin, a.auditMgmt("retention.rule.set", a.setRetentionRuleHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/retention/rules/del", a.requireSession(roleAdmin, a.auditMgmt("retention.rule.delete", a.delRetentionRuleHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/retention/pins", a.requireSession(roleAdmin, a.auditMgmt("object.pin", a.pinHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/retention/pins/del", a.requireSession(roleAdmin, a.auditMgmt("object.unpin", a.unpinHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/retention/run", a.requireSession(roleAdmin, a.auditMgmt("retention.run", a.runRetentionHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/audit", a.requireSession(roleAuditor, a.auditHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/audit/export", a.requireSession(roleAuditor, a.auditExportHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/activity", a.requireSession(roleAuditor, a.activityHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/events", a.requireSession(roleAuditor, a.eventStreamHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/webhooks", a.requireSession(roleAuditor, a.webhooksHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/webhooks", a.requireSession(roleAdmin, a.auditMgmt("webhook.add", a.addWebhookHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/webhooks/del", a.requireSession(roleAdmin, a.auditMgmt("webhook.delete", a.delWebhookHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/webhooks/redeliver", a.requireSession(roleAdmin, a.auditMgmt("webhook.redeliver", a.redeliverHandler))).Methods("POST")
+
+	r.HandleFunc("/mgmt/css/{file}", cssHandler)
+}
 
-	r.HandleFunc("/mgmt/css/{file}", basicAuth(cssHandler))
+// mgmtError answers a mgmt form with an error message, which is also kept as
+// the detail of the request's audit entry.
+func mgmtError(w http.ResponseWriter, r *http.Request, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	auditEntry(r).Detail = msg
+	fmt.Fprint(w, msg)
 }
 
 func cssHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,56 +157,139 @@ func cssHandler(w http.ResponseWriter, r *http.Request) {
 	f.Close()
 }
 
-func checkBasicAuth(user string, pass string, ok bool) bool {
-	if !ok {
-		return false
+// indexHandler shows the dashboard, with the traffic of the window in the
+// query, and the server's configuration.
+func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := a.dashboard(r.FormValue("window"))
+	if err != nil {
+		fmt.Fprintf(w, "Error computing dashboard: %s", err)
+		return
 	}
 
-	if user != Config.AdminUser || pass != Config.AdminPass {
-		return false
+	data := pageData{Name: "index", Config: Config, Dashboard: d, TrafficWindows: trafficWindows}
+	if err := render(w, r, "config.tmpl", data); err != nil {
+		writeStatus(w, r, 404)
 	}
-	return true
 }
 
-func basicAuth(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if Config.AdminUser == "" || Config.AdminPass == "" {
-			writeStatus(w, r, 404)
-			return
-		}
+// objectFilter returns the object filter and order given by the repo,
+// uploader, prefix, min_size, max_size and sort parameters of r.
+func objectFilter(r *http.Request) (ObjectFilter, error) {
+	f := ObjectFilter{
+		Repo:     r.FormValue("repo"),
+		Uploader: r.FormValue("uploader"),
+		Prefix:   strings.ToLower(strings.TrimSpace(r.FormValue("prefix"))),
+		Order:    r.FormValue("sort"),
+	}
+
+	var err error
+	if f.MinSize, err = parseByteSize(r.FormValue("min_size")); err != nil {
+		return f, err
+	}
+	if f.MaxSize, err = parseByteSize(r.FormValue("max_size")); err != nil {
+		return f, err
+	}
+	if !validObjectOrder(f.Order) {
+		return f, fmt.Errorf("Invalid sort: %q", f.Order)
+	}
+	return f, nil
+}
 
-		user, pass, ok := r.BasicAuth()
+// objectsHandler shows a page of objects, filtered and sorted by the query.
+func (a *App) objectsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := objectFilter(r)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving objects: %s", err)
+		return
+	}
 
-		ret := checkBasicAuth(user, pass, ok)
-		if !ret {
-			w.Header().Set("WWW-Authenticate", "Basic realm=mgmt")
-			writeStatus(w, r, 401)
-			return
-		}
+	objects, next, err := a.metaStore.ObjectPage(f, r.FormValue("cursor"), adminPageSize)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving objects: %s", err)
+		return
+	}
 
-		h(w, r)
-		logRequest(r, 200)
+	query := r.URL.Query()
+	query.Del("cursor")
+
+	data := pageData{
+		Name:         "objects",
+		Objects:      objects,
+		ObjectFilter: f,
+		ObjectQuery:  query.Encode(),
+		ObjectCursor: next,
+		MinSize:      r.FormValue("min_size"),
+		MaxSize:      r.FormValue("max_size"),
+	}
+	if err := render(w, r, "objects.tmpl", data); err != nil {
+		writeStatus(w, r, 404)
 	}
 }
 
-func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if err := render(w, "config.tmpl", pageData{Name: "index", Config: Config}); err != nil {
+// objectHandler shows an object: its metadata, where its content is stored,
+// who its storage is charged to, its pin and its audit history.
+func (a *App) objectHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
 		writeStatus(w, r, 404)
+		return
 	}
-}
 
-func (a *App) objectsHandler(w http.ResponseWriter, r *http.Request) {
-	objects, err := a.metaStore.Objects()
+	location, err := a.contentStore.Locate(meta)
 	if err != nil {
-		fmt.Fprintf(w, "Error retrieving objects: %s", err)
+		fmt.Fprintf(w, "Error locating content: %s", err)
 		return
 	}
 
-	if err := render(w, "objects.tmpl", pageData{Name: "objects", Objects: objects}); err != nil {
+	pin, err := a.metaStore.PinOf(oid)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving pin: %s", err)
+		return
+	}
+
+	charges, err := a.metaStore.ChargesOf(oid)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving charges: %s", err)
+		return
+	}
+
+	entries, _, err := a.metaStore.AuditLog(AuditFilter{Oid: oid}, auditPageSize)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving audit log: %s", err)
+		return
+	}
+
+	data := pageData{
+		Name:         "objects",
+		Object:       &AdminObject{MetaObject: meta, Stored: location != nil, Pin: pin},
+		Location:     location,
+		Charges:      charges,
+		AuditEntries: entries,
+	}
+	if err := render(w, r, "object.tmpl", data); err != nil {
 		writeStatus(w, r, 404)
 	}
 }
 
+// delObjectHandler deletes an object's metadata and content. The form must
+// confirm the deletion by repeating the oid.
+func (a *App) delObjectHandler(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	auditEntry(r).Oid = oid
+	if r.FormValue("confirm") != oid {
+		mgmtError(w, r, "Deletion of %s not confirmed", oid)
+		return
+	}
+
+	if _, err := a.deleteObject(oid); err != nil {
+		mgmtError(w, r, "Error deleting object: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/objects", 302)
+}
+
 func (a *App) objectsRawHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	rv := &RequestVars{Oid: vars["oid"]}
@@ -118,18 +314,186 @@ func (a *App) objectsRawHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, content)
 }
 
+// lockSelection parses the repo, owner, path and older_than (days) lock
+// filters of r.
+func lockSelection(r *http.Request) (LockSelection, error) {
+	f := LockSelection{
+		Repo:  r.FormValue("repo"),
+		Owner: r.FormValue("owner"),
+		Path:  strings.TrimSpace(r.FormValue("path")),
+	}
+
+	if d := r.FormValue("older_than"); d != "" {
+		days, err := strconv.Atoi(d)
+		if err != nil || days < 0 {
+			return f, fmt.Errorf("Invalid age in days: %q", d)
+		}
+		f.OlderThan = time.Duration(days) * 24 * time.Hour
+	}
+	return f, nil
+}
+
+// locksHandler shows the locks matching the query's filters.
 func (a *App) locksHandler(w http.ResponseWriter, r *http.Request) {
-	locks, err := a.metaStore.AllLocks()
+	f, err := lockSelection(r)
 	if err != nil {
 		fmt.Fprintf(w, "Error retrieving locks: %s", err)
 		return
 	}
 
-	if err := render(w, "locks.tmpl", pageData{Name: "locks", Locks: locks}); err != nil {
+	locks, err := a.metaStore.SelectLocks(f)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving locks: %s", err)
+		return
+	}
+
+	policies, err := a.metaStore.LockPolicies()
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving lock policies: %s", err)
+		return
+	}
+
+	data := pageData{
+		Name:          "locks",
+		Config:        Config,
+		Locks:         locks,
+		LockPolicies:  policies,
+		LockSelection: f,
+		LockQuery:     r.URL.RawQuery,
+		OlderThan:     r.FormValue("older_than"),
+	}
+	if err := render(w, r, "locks.tmpl", data); err != nil {
 		writeStatus(w, r, 404)
 	}
 }
 
+// unlockHandler force unlocks a single lock, then returns to the locks page
+// with the filters of its query.
+func (a *App) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	repo, id := r.PostFormValue("repo"), r.PostFormValue("id")
+	user := requestUser(r)
+
+	audit := auditEntry(r)
+	audit.Repo, audit.LockId = repo, id
+
+	l, err := a.adminUnlock(repo, user, id)
+	if err == errLockNotFound {
+		mgmtError(w, r, "Lock not found")
+		return
+	}
+	if err != nil {
+		mgmtError(w, r, "Error releasing lock: %s", err)
+		return
+	}
+	audit.Path, audit.Target = l.Path, l.Owner.Name
+
+	http.Redirect(w, r, "/mgmt/locks?"+r.URL.RawQuery, 302)
+}
+
+// releaseLocksHandler force unlocks every lock matching the posted filters,
+// which must select some, once confirmed.
+func (a *App) releaseLocksHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := lockSelection(r)
+	if err == nil && f.Empty() {
+		err = errEmptyLockSelection
+	}
+	if err != nil {
+		mgmtError(w, r, "Error releasing locks: %s", err)
+		return
+	}
+
+	audit := auditEntry(r)
+	audit.Repo, audit.Path, audit.Target = f.Repo, f.Path, f.Owner
+	if r.FormValue("confirm") != "yes" {
+		mgmtError(w, r, "Release of the locks not confirmed")
+		return
+	}
+
+	user := requestUser(r)
+	if _, err := a.releaseLocks(r, user, f); err != nil {
+		mgmtError(w, r, "Error releasing locks: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/locks?"+r.URL.RawQuery, 302)
+}
+
+func (a *App) lockHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	repo := r.FormValue("repo")
+	path := r.FormValue("path")
+
+	var events []*LockEvent
+	if repo != "" {
+		var err error
+		events, err = a.metaStore.LockHistory(repo, path, lockHistoryPageSize)
+		if err != nil {
+			fmt.Fprintf(w, "Error retrieving lock history: %s", err)
+			return
+		}
+	}
+
+	if err := render(w, r, "lockhistory.tmpl", pageData{Name: "locks", Repo: repo, Path: path, LockEvents: events}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) transferLockHandler(w http.ResponseWriter, r *http.Request) {
+	repo := r.FormValue("repo")
+	user := requestUser(r)
+
+	audit := auditEntry(r)
+	audit.Repo, audit.LockId, audit.Target = repo, r.FormValue("id"), r.FormValue("owner")
+
+	l, err := a.metaStore.AdminTransferLock(repo, user, r.FormValue("id"), r.FormValue("owner"))
+	if err != nil {
+		mgmtError(w, r, "Error transferring lock: %s", err)
+		return
+	}
+	if l == nil {
+		mgmtError(w, r, "Lock not found")
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/locks", 302)
+}
+
+func (a *App) setLockPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	maxLocks := 0
+	if m := r.FormValue("max_locks_per_user"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			mgmtError(w, r, "Invalid maximum locks per user: %s", m)
+			return
+		}
+		maxLocks = n
+	}
+
+	policy := &LockPolicy{
+		Repo:            r.FormValue("repo"),
+		TTL:             r.FormValue("ttl"),
+		AllowedPaths:    splitList(r.FormValue("allowed_paths")),
+		MaxLocksPerUser: maxLocks,
+		ForceUnlockers:  splitList(r.FormValue("force_unlockers")),
+	}
+	auditEntry(r).Repo = policy.Repo
+	if err := a.metaStore.SetLockPolicy(policy); err != nil {
+		mgmtError(w, r, "Error saving lock policy: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/locks", 302)
+}
+
+func (a *App) delLockPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Repo = r.FormValue("repo")
+	if err := a.metaStore.DeleteLockPolicy(r.FormValue("repo")); err != nil {
+		mgmtError(w, r, "Error deleting lock policy: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/locks", 302)
+}
+
 func (a *App) usersHandler(w http.ResponseWriter, r *http.Request) {
 	users, err := a.metaStore.Users()
 	if err != nil {
@@ -137,43 +501,541 @@ func (a *App) usersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := render(w, "users.tmpl", pageData{Name: "users", Users: users}); err != nil {
+	data := pageData{
+		Name:             "users",
+		Users:            users,
+		Roles:            roles,
+		BootstrapUser:    Config.AdminUser,
+		BootstrapEnabled: a.bootstrapEnabled(),
+	}
+	if err := render(w, r, "users.tmpl", data); err != nil {
 		writeStatus(w, r, 404)
 	}
 }
 
+// addUserHandler adds a user or sets their password, and gives them a role if
+// one is chosen.
 func (a *App) addUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.FormValue("name")
 	pass := r.FormValue("password")
+	role := r.FormValue("role")
+	auditEntry(r).Target = user
 	if user == "" || pass == "" {
-		fmt.Fprint(w, "Invalid username or password")
+		mgmtError(w, r, "Invalid username or password")
+		return
+	}
+	if role != "" && !validRole(role) {
+		mgmtError(w, r, "%s", errInvalidRole)
+		return
+	}
+	if role != "" && requestRole(r) != roleAdmin {
+		mgmtError(w, r, "%s", errAdminTarget)
+		return
+	}
+	if err := a.canChangeUser(r, user); err != nil {
+		mgmtError(w, r, "Error adding user: %s", err)
 		return
 	}
 
 	if err := a.metaStore.AddUser(user, pass); err != nil {
-		fmt.Fprintf(w, "Error adding user: %s", err)
+		mgmtError(w, r, "Error adding user: %s", err)
 		return
 	}
+	if role != "" {
+		if err := a.metaStore.SetRole(user, role); err != nil {
+			mgmtError(w, r, "Error setting role: %s", err)
+			return
+		}
+	}
 
 	http.Redirect(w, r, "/mgmt/users", 302)
 }
 
 func (a *App) delUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.FormValue("name")
+	auditEntry(r).Target = user
 	if user == "" {
-		fmt.Fprint(w, "Invalid username")
+		mgmtError(w, r, "Invalid username")
+		return
+	}
+	if err := a.canChangeUser(r, user); err != nil {
+		mgmtError(w, r, "Error deleting user: %s", err)
 		return
 	}
 
 	if err := a.metaStore.DeleteUser(user); err != nil {
-		fmt.Fprintf(w, "Error deleting user: %s", err)
+		mgmtError(w, r, "Error deleting user: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/users", 302)
+}
+
+// setRoleHandler gives a user a role, or takes it away if none is chosen.
+func (a *App) setRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PostFormValue("name")
+	auditEntry(r).Target = user
+
+	if err := a.metaStore.SetRole(user, r.PostFormValue("role")); err != nil {
+		mgmtError(w, r, "Error setting role: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/users", 302)
+}
+
+// bootstrapHandler disables or enables the LFS_ADMINUSER account.
+func (a *App) bootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Target = Config.AdminUser
+
+	if err := a.metaStore.SetBootstrapDisabled(r.PostFormValue("disabled") == "yes"); err != nil {
+		mgmtError(w, r, "Error changing the bootstrap account: %s", err)
 		return
 	}
 
 	http.Redirect(w, r, "/mgmt/users", 302)
 }
 
-func render(w http.ResponseWriter, tmpl string, data pageData) error {
+func (a *App) reposHandler(w http.ResponseWriter, r *http.Request) {
+	repos, err := a.adminRepos()
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving repositories: %s", err)
+		return
+	}
+
+	data := pageData{Name: "repos", Config: Config, Repos: repos, Visibilities: visibilities}
+	if err := render(w, r, "repos.tmpl", data); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+// repoHandler shows a repository with its settings, storage and locks.
+func (a *App) repoHandler(w http.ResponseWriter, r *http.Request) {
+	repo, err := a.adminRepo(mux.Vars(r)["repo"])
+	if err == errRepoNotFound {
+		writeStatus(w, r, 404)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving repository: %s", err)
+		return
+	}
+
+	data := pageData{
+		Name:             "repos",
+		Config:           Config,
+		Repository:       repo,
+		Visibilities:     visibilities,
+		TransferAdapters: transferAdapters,
+		GrantAccesses:    grantAccesses,
+	}
+	if err := render(w, r, "repo.tmpl", data); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func repoPath(name string) string {
+	return "/mgmt/repos/" + url.PathEscape(name)
+}
+
+func (a *App) createRepoHandler(w http.ResponseWriter, r *http.Request) {
+	repo := &Repository{
+		Name:       strings.TrimSpace(r.FormValue("name")),
+		Owner:      strings.TrimSpace(r.FormValue("owner")),
+		Visibility: r.FormValue("visibility"),
+		CreatedBy:  requestUser(r),
+	}
+	auditEntry(r).Repo = repo.Name
+
+	if err := a.metaStore.CreateRepository(repo); err != nil {
+		mgmtError(w, r, "Error creating repository: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(repo.Name), 302)
+}
+
+// updateRepoHandler sets the visibility, transfer adapters and quota of a
+// repository. An empty quota restores the default.
+func (a *App) updateRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("repo")
+	auditEntry(r).Repo = name
+
+	limit := int64(-1)
+	if q := r.FormValue("quota"); q != "" {
+		n, err := parseByteSize(q)
+		if err != nil {
+			mgmtError(w, r, "Invalid quota: %s", err)
+			return
+		}
+		limit = n
+	}
+
+	if _, err := a.metaStore.UpdateRepository(name, r.FormValue("visibility"), r.Form["transfers"]); err != nil {
+		mgmtError(w, r, "Error updating repository: %s", err)
+		return
+	}
+	if err := a.metaStore.SetQuota(quotaRepo, name, limit); err != nil {
+		mgmtError(w, r, "Error setting quota: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(name), 302)
+}
+
+func (a *App) renameRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name, newName := r.FormValue("repo"), strings.TrimSpace(r.FormValue("name"))
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = name, newName
+
+	if _, err := a.metaStore.RenameRepository(name, newName); err != nil {
+		mgmtError(w, r, "Error renaming repository: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(newName), 302)
+}
+
+func (a *App) archiveRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("repo")
+	auditEntry(r).Repo = name
+
+	if _, err := a.metaStore.ArchiveRepository(name, r.FormValue("archived") == "true"); err != nil {
+		mgmtError(w, r, "Error archiving repository: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(name), 302)
+}
+
+// grantRepoHandler grants a user read or write access to a private
+// repository.
+func (a *App) grantRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name, user, access := r.FormValue("repo"), strings.TrimSpace(r.FormValue("user")), r.FormValue("access")
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = name, user
+	if user == "" || !contains(grantAccesses, access) {
+		mgmtError(w, r, "Missing user or access")
+		return
+	}
+
+	if _, err := a.metaStore.GrantRepository(name, user, access); err != nil {
+		mgmtError(w, r, "Error granting access: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(name), 302)
+}
+
+func (a *App) revokeRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name, user := r.FormValue("repo"), r.FormValue("user")
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = name, user
+
+	if _, err := a.metaStore.GrantRepository(name, user, ""); err != nil {
+		mgmtError(w, r, "Error revoking access: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, repoPath(name), 302)
+}
+
+// delRepoHandler deletes a repository. The form must confirm the deletion by
+// repeating its name.
+func (a *App) delRepoHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("repo")
+	auditEntry(r).Repo = name
+	if r.FormValue("confirm") != name {
+		mgmtError(w, r, "Deletion of the repository not confirmed")
+		return
+	}
+
+	if err := a.metaStore.DeleteRepository(name); err != nil {
+		mgmtError(w, r, "Error deleting repository: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/repos", 302)
+}
+
+func (a *App) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	repos, err := a.metaStore.Usages(quotaRepo)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving repository usage: %s", err)
+		return
+	}
+
+	users, err := a.metaStore.Usages(quotaUser)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving user usage: %s", err)
+		return
+	}
+
+	if err := render(w, r, "quotas.tmpl", pageData{Name: "quotas", Config: Config, RepoUsages: repos, UserUsages: users}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) setQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	name := r.FormValue("name")
+	auditEntry(r).Target = kind + " " + name
+	if name == "" {
+		mgmtError(w, r, "Invalid name")
+		return
+	}
+
+	limit := int64(-1)
+	if q := r.FormValue("quota"); q != "" {
+		n, err := parseByteSize(q)
+		if err != nil {
+			mgmtError(w, r, "Invalid quota: %s", err)
+			return
+		}
+		limit = n
+	}
+
+	if err := a.metaStore.SetQuota(kind, name, limit); err != nil {
+		mgmtError(w, r, "Error setting quota: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/quotas", 302)
+}
+
+func (a *App) retentionHandler(w http.ResponseWriter, r *http.Request) {
+	report := a.LastRetention()
+	if r.FormValue("dryrun") != "" {
+		var err error
+		report, err = a.RunRetention(true)
+		if err != nil {
+			fmt.Fprintf(w, "Error computing retention: %s", err)
+			return
+		}
+	}
+
+	a.renderRetention(w, r, report)
+}
+
+func (a *App) runRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := a.RunRetention(false)
+	if err != nil {
+		mgmtError(w, r, "Error running retention: %s", err)
+		return
+	}
+
+	// The report is shown instead of redirecting back to the page.
+	auditEntry(r).Outcome = auditSuccess
+	a.renderRetention(w, r, report)
+}
+
+func (a *App) renderRetention(w http.ResponseWriter, r *http.Request, report *RetentionReport) {
+	rules, err := a.metaStore.RetentionRules()
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving retention rules: %s", err)
+		return
+	}
+
+	pins, err := a.metaStore.Pins()
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving pins: %s", err)
+		return
+	}
+
+	if err := render(w, r, "retention.tmpl", pageData{Name: "retention", Rules: rules, Pins: pins, Retention: report}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) setRetentionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	unused, _ := strconv.Atoi(r.FormValue("unused_days"))
+	maxAge, _ := strconv.Atoi(r.FormValue("max_age_days"))
+	rule := &RetentionRule{
+		Pattern:    r.FormValue("pattern"),
+		UnusedDays: unused,
+		MaxAgeDays: maxAge,
+		ExpireAll:  r.FormValue("expire_all") != "",
+	}
+	auditEntry(r).Target = rule.Pattern
+
+	if err := a.metaStore.SetRetentionRule(rule); err != nil {
+		mgmtError(w, r, "Error saving retention rule: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/retention", 302)
+}
+
+func (a *App) delRetentionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Target = r.FormValue("pattern")
+	if err := a.metaStore.DeleteRetentionRule(r.FormValue("pattern")); err != nil {
+		mgmtError(w, r, "Error deleting retention rule: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/retention", 302)
+}
+
+func (a *App) pinHandler(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	auditEntry(r).Oid = oid
+	if oid == "" {
+		mgmtError(w, r, "Invalid oid")
+		return
+	}
+
+	pin := &Pin{Oid: oid, LegalHold: r.FormValue("legal_hold") != "", Note: r.FormValue("note")}
+	if err := a.metaStore.Pin(pin); err != nil {
+		mgmtError(w, r, "Error pinning object: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/retention", 302)
+}
+
+func (a *App) unpinHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Oid = r.FormValue("oid")
+	if err := a.metaStore.Unpin(r.FormValue("oid")); err != nil {
+		mgmtError(w, r, "Error unpinning object: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/retention", 302)
+}
+
+func (a *App) auditHandler(w http.ResponseWriter, r *http.Request) {
+	f := auditFilter(r)
+	entries, next, err := a.metaStore.AuditLog(f, auditPageSize)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving audit log: %s", err)
+		return
+	}
+
+	if err := render(w, r, "audit.tmpl", pageData{Name: "audit", AuditEntries: entries, AuditFilter: f, NextCursor: next}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+// auditExportHandler writes the audit entries matching the filter as JSON
+// lines, oldest first.
+func (a *App) auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	err := a.metaStore.ExportAudit(auditFilter(r), func(e *AuditEntry) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		logger.Log(kv{"fn": "auditExportHandler", "err": err.Error()})
+	}
+}
+
+func auditFilter(r *http.Request) AuditFilter {
+	before, _ := strconv.ParseUint(r.FormValue("before"), 10, 64)
+	return AuditFilter{
+		Actor:   r.FormValue("actor"),
+		Action:  r.FormValue("action"),
+		Repo:    r.FormValue("repo"),
+		Oid:     r.FormValue("oid"),
+		Outcome: r.FormValue("outcome"),
+		Before:  before,
+	}
+}
+
+func (a *App) activityHandler(w http.ResponseWriter, r *http.Request) {
+	if err := render(w, r, "activity.tmpl", pageData{Name: "activity", Repo: r.FormValue("repo"), EventTypes: r.FormValue("type")}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := a.metaStore.Webhooks()
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving webhooks: %s", err)
+		return
+	}
+
+	deliveries, err := a.metaStore.Deliveries(webhookDeliveryPageSize)
+	if err != nil {
+		fmt.Fprintf(w, "Error retrieving deliveries: %s", err)
+		return
+	}
+
+	if err := render(w, r, "webhooks.tmpl", pageData{Name: "webhooks", Webhooks: hooks, Deliveries: deliveries}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+func (a *App) addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook := &Webhook{
+		Repo:   r.FormValue("repo"),
+		URL:    r.FormValue("url"),
+		Secret: r.FormValue("secret"),
+		Events: splitList(r.FormValue("events")),
+	}
+	audit := auditEntry(r)
+	audit.Repo, audit.Target = hook.Repo, hook.URL
+	if err := a.metaStore.AddWebhook(hook); err != nil {
+		mgmtError(w, r, "Error adding webhook: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/webhooks", 302)
+}
+
+func (a *App) delWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Target = r.FormValue("id")
+	if err := a.metaStore.DeleteWebhook(r.FormValue("id")); err != nil {
+		mgmtError(w, r, "Error deleting webhook: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/webhooks", 302)
+}
+
+func (a *App) redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	auditEntry(r).Target = r.FormValue("id")
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		mgmtError(w, r, "Invalid delivery: %s", r.FormValue("id"))
+		return
+	}
+
+	if err := a.webhooks.Redeliver(id); err != nil {
+		mgmtError(w, r, "Error redelivering: %s", err)
+		return
+	}
+
+	http.Redirect(w, r, "/mgmt/webhooks", 302)
+}
+
+// splitList splits a comma or space separated form value.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// formatBytes renders a byte count in human readable form.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+}
+
+// render shows the mgmt page tmpl. Its forms add the CSRF token of the
+// request's session with {{csrf}}.
+func render(w http.ResponseWriter, r *http.Request, tmpl string, data pageData) error {
 	body, err := embedded.ReadFile("mgmt/templates/body.tmpl")
 	if err != nil {
 		return err
@@ -186,7 +1048,19 @@ func render(w http.ResponseWriter, tmpl string, data pageData) error {
 	}
 	contentString := string(content)
 
-	t := template.Must(template.New("main").Parse(bodyString))
+	if data.Area == "" {
+		data.Area = "mgmt"
+	}
+	var token string
+	data.SessionRole = requestRole(r)
+	if s := requestSession(r); s != nil {
+		data.SessionUser, token = s.User, s.CSRF
+	}
+	csrf := func() template.HTML {
+		return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `"/>`)
+	}
+
+	t := template.Must(template.New("main").Funcs(templateFuncs).Funcs(template.FuncMap{"csrf": csrf}).Parse(bodyString))
 	t.New("content").Parse(contentString)
 
 	return t.Execute(w, data)
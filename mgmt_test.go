@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mgmtRequest calls the mgmt interface in a session of the admin user, with
+// the session's CSRF token added to the form, and returns the status and
+// body. Redirects are not followed.
+func mgmtRequest(t *testing.T, method, path string, form url.Values) (int, string) {
+	t.Helper()
+
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	cookie, token := sessionLogin(t, lfsApp.mgmt, testAdminUser, testAdminPass)
+	if method == "POST" {
+		posted := url.Values{csrfField: {token}}
+		for k, v := range form {
+			posted[k] = v
+		}
+		form = posted
+	}
+
+	res := mgmtDo(t, method, path, form, cookie)
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+// sessionLogin signs in to the session area and returns the session cookie
+// and its CSRF token.
+func sessionLogin(t *testing.T, area *sessionArea, user, pass string) (*http.Cookie, string) {
+	t.Helper()
+
+	res := mgmtDo(t, "POST", area.path()+"/login", url.Values{"user": {user}, "password": {pass}})
+	res.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == area.cookie {
+			cookie = c
+		}
+	}
+	if res.StatusCode != 302 || cookie == nil {
+		t.Fatalf("expected to sign in, got %d", res.StatusCode)
+	}
+
+	res = mgmtDo(t, "GET", area.path(), nil, cookie)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	m := csrfInput.FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("expected a CSRF token in the first page, got %d", res.StatusCode)
+	}
+	return cookie, string(m[1])
+}
+
+var csrfInput = regexp.MustCompile(`name="` + csrfField + `" value="([0-9a-f]+)"`)
+
+// mgmtDo sends a form to the mgmt interface or the account pages with the
+// cookies, without following redirects.
+func mgmtDo(t *testing.T, method, path string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, lfsServer.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	return res
+}
+
+func TestMgmtObjectBrowser(t *testing.T) {
+	data := "mgmt browser content"
+	sum := sha256.Sum256([]byte(data))
+	meta := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if _, err := testMetaStore.Put(&RequestVars{Oid: meta.Oid, Size: meta.Size}); err != nil {
+		t.Fatalf("expected Put to succeed, got: %s", err)
+	}
+	if err := testContentStore.Put(meta, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected content Put to succeed, got: %s", err)
+	}
+
+	status, body := mgmtRequest(t, "GET", "/mgmt/objects?prefix="+meta.Oid[:10]+"&sort=-size", nil)
+	if status != 200 || !strings.Contains(body, "/mgmt/objects/"+meta.Oid) {
+		t.Fatalf("expected the object in the listing, got %d", status)
+	}
+
+	status, body = mgmtRequest(t, "GET", "/mgmt/objects/"+meta.Oid, nil)
+	if status != 200 || !strings.Contains(body, "20 bytes") || strings.Contains(body, "content is missing") {
+		t.Fatalf("expected the object's details, got %d: %s", status, body)
+	}
+
+	status, _ = mgmtRequest(t, "POST", "/mgmt/objects/del", url.Values{"oid": {meta.Oid}, "confirm": {"yes"}})
+	if status != 200 || !testContentStore.Exists(meta) {
+		t.Fatalf("expected an unconfirmed deletion to be refused, got %d", status)
+	}
+
+	status, _ = mgmtRequest(t, "POST", "/mgmt/objects/del", url.Values{"oid": {meta.Oid}, "confirm": {meta.Oid}})
+	if status != 302 {
+		t.Fatalf("expected a redirect after deleting, got %d", status)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: meta.Oid}); err != errObjectNotFound {
+		t.Errorf("expected the metadata to be deleted, got %v", err)
+	}
+	if testContentStore.Exists(meta) {
+		t.Error("expected the content to be deleted")
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Oid: meta.Oid}, auditPageSize)
+	if err != nil || len(entries) != 2 || entries[0].Outcome != auditSuccess || entries[1].Outcome != auditFailure {
+		t.Fatalf("expected a failed and a successful deletion in the audit log, got %d entries: %v", len(entries), err)
+	}
+	if want := "Deletion of " + meta.Oid + " not confirmed"; entries[1].Detail != want {
+		t.Errorf("expected the failure's message as detail, got %q", entries[1].Detail)
+	}
+}
+
+func TestMgmtLockAdministration(t *testing.T) {
+	sub := lfsApp.events.Subscribe("mgmtlocks", []string{eventLockReleased})
+	defer lfsApp.events.Unsubscribe(sub)
+
+	var locks []*Lock
+	for _, path := range []string{"art/hero.psd", "art/villain.psd", "docs/spec.docx"} {
+		lock, err := createRefLock("/bilbo/mgmtlocks/locks", path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		locks = append(locks, lock)
+	}
+
+	status, body := mgmtRequest(t, "GET", "/mgmt/locks?repo=mgmtlocks&path=ART/", nil)
+	if status != 200 || !strings.Contains(body, "art/hero.psd") || strings.Contains(body, "docs/spec.docx") {
+		t.Fatalf("expected only the art locks to be listed, got %d", status)
+	}
+
+	status, _ = mgmtRequest(t, "POST", "/mgmt/locks/unlock?repo=mgmtlocks", url.Values{"repo": {"mgmtlocks"}, "id": {locks[2].Id}})
+	if status != 302 {
+		t.Fatalf("expected a redirect after force unlocking, got %d", status)
+	}
+
+	selection := url.Values{"repo": {"mgmtlocks"}, "owner": {testUser}, "path": {""}, "older_than": {""}}
+	if status, _ = mgmtRequest(t, "POST", "/mgmt/locks/release", selection); status != 200 {
+		t.Fatalf("expected an unconfirmed release to be refused, got %d", status)
+	}
+	if status, _ = mgmtRequest(t, "POST", "/mgmt/locks/release", url.Values{"confirm": {"yes"}}); status != 200 {
+		t.Fatalf("expected releasing every lock to be refused, got %d", status)
+	}
+	selection.Set("confirm", "yes")
+	if status, _ = mgmtRequest(t, "POST", "/mgmt/locks/release", selection); status != 302 {
+		t.Fatalf("expected a redirect after releasing, got %d", status)
+	}
+
+	remaining, err := testMetaStore.SelectLocks(LockSelection{Repo: "mgmtlocks"})
+	if err != nil || len(remaining) != 0 {
+		t.Errorf("expected every lock to be released, got %d: %v", len(remaining), err)
+	}
+	if n := len(sub.C); n != len(locks) {
+		t.Errorf("expected %d lock release events, got %d", len(locks), n)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Action: "lock.force_unlock", Repo: "mgmtlocks"}, auditPageSize)
+	if err != nil || len(entries) != len(locks) || entries[0].Actor != testAdminUser || entries[0].Target != testUser {
+		t.Errorf("expected a force unlock audit entry per lock, got %d: %v", len(entries), err)
+	}
+}
+
+func TestMgmtDashboard(t *testing.T) {
+	status, body := mgmtRequest(t, "GET", "/mgmt?window=7d", nil)
+	if status != 200 || !strings.Contains(body, "<strong>7d</strong>") || !strings.Contains(body, "Recent errors") {
+		t.Errorf("expected the dashboard for 7 days, got %d", status)
+	}
+
+	if status, body = mgmtRequest(t, "GET", "/mgmt?window=1y", nil); !strings.Contains(body, "Invalid window") {
+		t.Errorf("expected an unknown window to be refused, got %d: %s", status, body)
+	}
+}
+
+func TestMgmtSessions(t *testing.T) {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	res := mgmtDo(t, "POST", "/mgmt/login", url.Values{"user": {testAdminUser}, "password": {"wrong"}})
+	res.Body.Close()
+	if res.StatusCode != 401 || len(res.Cookies()) != 0 {
+		t.Fatalf("expected a bad login to be refused, got %d", res.StatusCode)
+	}
+
+	res = mgmtDo(t, "GET", "/mgmt/users", nil)
+	res.Body.Close()
+	if loc := res.Header.Get("Location"); res.StatusCode != 302 || loc != "/mgmt/login?next=%2Fmgmt%2Fusers" {
+		t.Fatalf("expected a redirect to the login form, got %d %q", res.StatusCode, loc)
+	}
+
+	cookie, token := sessionLogin(t, lfsApp.mgmt, testAdminUser, testAdminPass)
+
+	for _, form := range []url.Values{
+		{"name": {"mallory"}, "password": {"x"}},
+		{"name": {"mallory"}, "password": {"x"}, csrfField: {"0123"}},
+	} {
+		res = mgmtDo(t, "POST", "/mgmt/add", form, cookie)
+		res.Body.Close()
+		if res.StatusCode != 403 {
+			t.Fatalf("expected a form without the CSRF token to be refused, got %d", res.StatusCode)
+		}
+	}
+	users, _ := testMetaStore.Users()
+	for _, u := range users {
+		if u.Name == "mallory" {
+			t.Fatalf("expected the user not to be added")
+		}
+	}
+
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/mgmt/users", nil)
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 200 {
+		t.Fatalf("expected basic auth to read the users page, got %v", err)
+	}
+	req, _ = http.NewRequest("POST", lfsServer.URL+"/mgmt/add", strings.NewReader(url.Values{"name": {"mallory"}, "password": {"x"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 403 {
+		t.Fatalf("expected basic auth not to post forms, got %v", err)
+	}
+
+	idle := newSession("mgmt", testAdminUser)
+	idle.Seen = idle.Seen.Add(-Config.SessionTimeoutDuration() - time.Minute)
+	old := newSession("mgmt", testAdminUser)
+	old.Created = old.Created.Add(-sessionMaxAge - time.Minute)
+	for _, s := range []*session{idle, old} {
+		rec := httptest.NewRecorder()
+		if err := lfsApp.mgmt.set(rec, s); err != nil {
+			t.Fatal(err)
+		}
+		res = mgmtDo(t, "GET", "/mgmt/users", nil, rec.Result().Cookies()...)
+		res.Body.Close()
+		if res.StatusCode != 302 {
+			t.Fatalf("expected an expired session to be refused, got %d", res.StatusCode)
+		}
+	}
+
+	res = mgmtDo(t, "POST", "/mgmt/logout", url.Values{csrfField: {token}}, cookie)
+	res.Body.Close()
+	if res.StatusCode != 302 || res.Header.Get("Location") != "/mgmt/login" {
+		t.Fatalf("expected to log out, got %d", res.StatusCode)
+	}
+	res = mgmtDo(t, "GET", "/mgmt/users", nil, cookie)
+	res.Body.Close()
+	if res.StatusCode != 302 {
+		t.Fatalf("expected the session to end on logout, got %d", res.StatusCode)
+	}
+}
+
+func TestMgmtRoles(t *testing.T) {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	defer func() { Config.AdminUser, Config.AdminPass = user, pass }()
+
+	for name, role := range map[string]string{"dora": roleAuditor, "ada": roleAdmin} {
+		if err := testMetaStore.AddUser(name, "pass"); err != nil {
+			t.Fatal(err)
+		}
+		defer testMetaStore.DeleteUser(name)
+		if err := testMetaStore.SetRole(name, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cookie, token := sessionLogin(t, lfsApp.mgmt, "dora", "pass")
+	res := mgmtDo(t, "GET", "/mgmt/users", nil, cookie)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || strings.Contains(string(body), `action="/mgmt/add"`) {
+		t.Fatalf("expected an auditor to see the users without the forms, got %d", res.StatusCode)
+	}
+	res = mgmtDo(t, "POST", "/mgmt/quotas", url.Values{csrfField: {token}, "kind": {quotaRepo}, "name": {testRepo}, "quota": {"1"}}, cookie)
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Fatalf("expected an auditor not to set quotas, got %d", res.StatusCode)
+	}
+
+	defer testMetaStore.SetBootstrapDisabled(false)
+	if status, body := mgmtRequest(t, "POST", "/mgmt/users/bootstrap", url.Values{"disabled": {"yes"}}); status != 302 {
+		t.Fatalf("expected the bootstrap account to be disabled, got %d: %s", status, body)
+	}
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/mgmt/users", nil)
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 401 {
+		t.Fatalf("expected the bootstrap account to be refused, got %v", err)
+	}
+
+	cookie, token = sessionLogin(t, lfsApp.mgmt, "ada", "pass")
+	res = mgmtDo(t, "POST", "/mgmt/users/role", url.Values{csrfField: {token}, "name": {"ada"}, "role": {roleAuditor}}, cookie)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), errLastAdmin.Error()) {
+		t.Fatalf("expected the last admin to keep their role, got %d: %s", res.StatusCode, body)
+	}
+	res = mgmtDo(t, "POST", "/mgmt/users/bootstrap", url.Values{csrfField: {token}}, cookie)
+	res.Body.Close()
+	if disabled, _ := testMetaStore.BootstrapDisabled(); res.StatusCode != 302 || disabled {
+		t.Fatalf("expected the bootstrap account to be enabled, got %d", res.StatusCode)
+	}
+}
+
+func TestMgmtRunRetention(t *testing.T) {
+	if status, body := mgmtRequest(t, "POST", "/mgmt/retention/run", nil); status != 200 {
+		t.Fatalf("expected the retention report, got %d: %s", status, body)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Action: "retention.run"}, 1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the run in the audit log, got %d entries: %v", len(entries), err)
+	}
+	if entries[0].Outcome != auditSuccess || entries[0].Actor != testAdminUser {
+		t.Errorf("expected a successful run by the admin, got %+v", entries[0])
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var schemaVersionKey = []byte("version")
+
+// migration upgrades the meta store schema to Version. Each migration runs in
+// its own transaction together with the update of the schema version, so a
+// failed migration leaves the database at the previous version.
+type migration struct {
+	Version int
+	Name    string
+	Migrate func(tx *bolt.Tx) error
+}
+
+// migrations lists all schema migrations in the order they are applied.
+// Append new migrations to the end; never reorder or remove them.
+var migrations = []migration{
+	{1, "Encode objects as versioned JSON records", migrateObjectsToJSON},
+	{2, "Store locks as indexed records", migrateLocksToRecords},
+	{3, "Index locks by expiry", migrateLockExpiry},
+	{4, "Index locks by normalized path", migrateLockPathKeys},
+	{5, "Index objects by size and creation time", migrateObjectIndexes},
+	{6, "Count stored objects and bytes", migrateObjectCounts},
+	{7, "Register repositories", migrateRepositories},
+	{8, "Key storage charges by object and repository", migrateChargeKeys},
+	{9, "Charge uploaded objects to their repository", migrateUploadCharges},
+	{10, "Mark glob locks and index lock paths by case", migrateGlobLockPaths},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	bucket := tx.Bucket(schemaBucket)
+	if bucket == nil {
+		return 0
+	}
+	value := bucket.Get(schemaVersionKey)
+	if len(value) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(value))
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	return tx.Bucket(schemaBucket).Put(schemaVersionKey, b)
+}
+
+// SchemaVersion returns the schema version of the database.
+func (s *MetaStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// PendingMigrations returns the migrations that have not been applied yet.
+func (s *MetaStore) PendingMigrations() ([]migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > latestSchemaVersion() {
+		return nil, fmt.Errorf("Database schema version %d is newer than the supported version %d", version, latestSchemaVersion())
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations and returns them. The database is
+// copied to a backup file next to it before the first migration runs.
+func (s *MetaStore) Migrate() ([]migration, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	backup, err := s.Backup()
+	if err != nil {
+		return nil, fmt.Errorf("Could not back up database before migrating: %s", err)
+	}
+	logger.Log(kv{"fn": "Migrate", "msg": "backed up database", "path": backup})
+
+	for _, m := range pending {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.Version)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+		logger.Log(kv{"fn": "Migrate", "msg": "applied migration", "version": m.Version, "name": m.Name})
+	}
+
+	return pending, nil
+}
+
+// Backup writes a consistent copy of the database next to it and returns the
+// path of the copy.
+func (s *MetaStore) Backup() (string, error) {
+	var path string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		path = fmt.Sprintf("%s.v%d-%s.bak", s.path, schemaVersion(tx), time.Now().UTC().Format("20060102T150405Z"))
+		return tx.CopyFile(path, 0600)
+	})
+	return path, err
+}
+
+// migrateObjectsToJSON converts gob encoded objects to objectRecordVersion
+// JSON records.
+func migrateObjectsToJSON(tx *bolt.Tx) error {
+	bucket := tx.Bucket(objectsBucket)
+
+	converted := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var meta MetaObject
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&meta); err != nil {
+			return fmt.Errorf("object %s: %s", k, err)
+		}
+
+		data, err := encodeObject(&meta)
+		if err != nil {
+			return err
+		}
+		converted[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for oid, data := range converted {
+		if err := bucket.Put([]byte(oid), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const migrationTestDB = "migration-test.db"
+
+func TestNewMetaStoreStampsSchemaVersion(t *testing.T) {
+	defer cleanupMigrationTest()
+
+	store, err := NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to succeed, got: %s", err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion()
+	if err != nil {
+		t.Fatalf("expected SchemaVersion to succeed, got: %s", err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("expected new database at version %d, got: %d", latestSchemaVersion(), version)
+	}
+
+	if backups, _ := filepath.Glob(migrationTestDB + ".*.bak"); len(backups) != 0 {
+		t.Errorf("expected no backup for a new database, got: %v", backups)
+	}
+}
+
+func TestMigrateGobObjects(t *testing.T) {
+	defer cleanupMigrationTest()
+
+	// Create a database in the format used before schema versioning.
+	db, err := bolt.Open(migrationTestDB, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(objectsBucket)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(MetaObject{Oid: contentOid, Size: contentSize}); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(contentOid), buf.Bytes())
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("error seeding database: %s", err)
+	}
+
+	store, err := openMetaStoreReadOnly(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected openMetaStoreReadOnly to succeed, got: %s", err)
+	}
+
+	pending, err := store.PendingMigrations()
+	if err != nil {
+		t.Fatalf("expected PendingMigrations to succeed, got: %s", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("expected all migrations to be pending, got: %d", len(pending))
+	}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(schemaBucket) != nil {
+			t.Errorf("expected a read-only open not to create buckets")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error reading database: %s", err)
+	}
+	store.Close()
+
+	if _, err := openMetaStoreReadOnly(migrationTestDB + ".missing"); err == nil {
+		t.Errorf("expected a missing database not to be opened read-only")
+	}
+	if _, err := os.Stat(migrationTestDB + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing database not to be created, got: %v", err)
+	}
+
+	store, err = NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to migrate, got: %s", err)
+	}
+	defer store.Close()
+
+	meta, err := store.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("expected migrated object to be readable, got: %s", err)
+	}
+	if meta.Size != contentSize {
+		t.Errorf("expected size to survive migration, got: %d", meta.Size)
+	}
+
+	objects, _, err := store.ObjectPage(ObjectFilter{Order: objectOrderSize}, "", 10)
+	if err != nil || len(objects) != 1 {
+		t.Errorf("expected the migrated object to be indexed by size, got %d objects: %v", len(objects), err)
+	}
+	if stats, err := store.StoreStats(); err != nil || stats.Objects != 1 || stats.Bytes != contentSize {
+		t.Errorf("expected the migrated object to be counted, got %v: %v", stats, err)
+	}
+
+	if backups, _ := filepath.Glob(migrationTestDB + ".v0-*.bak"); len(backups) != 1 {
+		t.Errorf("expected a pre-migration backup, got: %v", backups)
+	}
+
+	// Objects stored before repositories were tracked stay downloadable.
+	app := &App{metaStore: store}
+	r := httptest.NewRequest("GET", "/bilbo/repo/objects/"+contentOid, nil)
+	r = withUser(r, testUser)
+	if !app.canDownload(r, meta) {
+		t.Errorf("expected the migrated object to be downloadable")
+	}
+	r = httptest.NewRequest("GET", "/bilbo/repo/objects/"+contentOid, nil)
+	if app.canDownload(r, meta) {
+		t.Errorf("expected the migrated object to follow the default visibility")
+	}
+}
+
+func TestMigrateLockArrays(t *testing.T) {
+	defer cleanupMigrationTest()
+
+	store, err := NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to succeed, got: %s", err)
+	}
+
+	// Store locks the way they were stored before schema version 2,
+	// including a duplicate left behind by a racing create.
+	older := NewTestLock("lock-1", "a.bin", testUser)
+	older.LockedAt = time.Now().Add(-time.Hour)
+	newer := NewTestLock("lock-2", "b.bin", testUser1)
+	dup := NewTestLock("lock-3", "a.bin", testUser1)
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal([]Lock{newer, older, dup})
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(locksBucket).Put([]byte(testRepo), data); err != nil {
+			return err
+		}
+		return setSchemaVersion(tx, 1)
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("error seeding database: %s", err)
+	}
+
+	store, err = NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to migrate, got: %s", err)
+	}
+	defer store.Close()
+
+	locks, err := store.Locks(testRepo)
+	if err != nil {
+		t.Fatalf("expected Locks to succeed, got: %s", err)
+	}
+	if len(locks) != 3 {
+		t.Fatalf("expected all locks to survive migration, got: %d", len(locks))
+	}
+	if locks[0].Id != older.Id {
+		t.Errorf("expected locks in creation order, got: %v", locks)
+	}
+
+	locks, _, err = store.ListLocks(testRepo, LockFilter{Owner: testUser1})
+	if err != nil {
+		t.Fatalf("expected ListLocks to succeed, got: %s", err)
+	}
+	if len(locks) != 2 {
+		t.Errorf("expected owner index to be built, got: %d", len(locks))
+	}
+}
+
+func TestMigrateGlobLockPaths(t *testing.T) {
+	defer cleanupMigrationTest()
+
+	store, err := NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to succeed, got: %s", err)
+	}
+	for _, l := range []Lock{NewTestLock("lock-1", "Art/Hero.psd", testUser), NewTestLock("lock-2", "docs/x.pdf", testUser)} {
+		if _, err := store.CreateLock(testRepo, l); err != nil {
+			t.Fatalf("expected CreateLock to succeed, got: %s", err)
+		}
+	}
+
+	// Before schema version 10 path keys were lower case, and a path with a
+	// wildcard was a glob.
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		rl, err := openRepoLocks(tx, testRepo, false)
+		if err != nil {
+			return err
+		}
+		rec, err := rl.get("lock-2")
+		if err != nil {
+			return err
+		}
+		rec.Path = "docs/*.pdf"
+		if err := rl.update(rec); err != nil {
+			return err
+		}
+
+		repo := tx.Bucket(locksBucket).Bucket([]byte(testRepo))
+		for _, name := range [][]byte{lockPathsBucket, lockPatternsBucket} {
+			if err := repo.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := repo.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		rl, _ = openRepoLocks(tx, testRepo, false)
+		rl.paths.Put(indexKey("art/hero.psd", "lock-1"), nil)
+		rl.paths.Put(indexKey("docs/*.pdf", "lock-2"), nil)
+		rl.patterns.Put(indexKey("docs/*.pdf", "lock-2"), nil)
+
+		if err := tx.Bucket(lockHistoryBucket).Bucket([]byte(testRepo)).DeleteBucket(lockEventPathsBucket); err != nil {
+			return err
+		}
+		return setSchemaVersion(tx, 9)
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("error seeding database: %s", err)
+	}
+
+	store, err = NewMetaStore(migrationTestDB)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to migrate, got: %s", err)
+	}
+	defer store.Close()
+
+	locks, _, err := store.ListLocks(testRepo, LockFilter{Path: "Art/Hero.psd"})
+	if err != nil || len(locks) != 1 {
+		t.Errorf("expected the path index to keep case, got %v: %v", locks, err)
+	}
+	locks, _, err = store.ListLocks(testRepo, LockFilter{Id: "lock-2"})
+	if err != nil || len(locks) != 1 || locks[0].Path != "glob:docs/*.pdf" {
+		t.Fatalf("expected the glob lock to be marked, got %v: %v", locks, err)
+	}
+	if _, err := store.CreateLock(testRepo, NewTestLock("lock-3", "docs/manual.pdf", testUser1)); err != errLockExists {
+		t.Errorf("expected the glob lock to still cover its files, got: %v", err)
+	}
+	if events, err := store.LockHistory(testRepo, "Art/Hero.psd", 0); err != nil || len(events) != 1 {
+		t.Errorf("expected the lock history to be indexed by path, got %d events: %v", len(events), err)
+	}
+}
+
+func cleanupMigrationTest() {
+	os.Remove(migrationTestDB)
+	backups, _ := filepath.Glob(migrationTestDB + ".*.bak")
+	for _, b := range backups {
+		os.Remove(b)
+	}
+}
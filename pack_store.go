@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	packDir       = "packs"
+	packIndexFile = "index.db"
+	packPrefix    = "pack-"
+	packSuffix    = ".pack"
+
+	// maxPackSize is the size at which a new pack file is started.
+	maxPackSize = 64 * 1024 * 1024
+
+	// packCompactRatio is the fraction of live bytes below which a pack is
+	// rewritten during compaction.
+	packCompactRatio = 0.5
+)
+
+var (
+	errPackEntryNotFound = errors.New("Pack entry not found")
+
+	packEntriesBucket = []byte("entries")
+)
+
+// packEntry locates an object inside a pack file.
+type packEntry struct {
+	Pack   uint32
+	Offset int64
+	Length int64
+}
+
+func (e packEntry) encode() []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[0:4], e.Pack)
+	binary.BigEndian.PutUint64(b[4:12], uint64(e.Offset))
+	binary.BigEndian.PutUint64(b[12:20], uint64(e.Length))
+	return b
+}
+
+func decodePackEntry(b []byte) (packEntry, error) {
+	if len(b) != 20 {
+		return packEntry{}, fmt.Errorf("Invalid pack entry length: %d", len(b))
+	}
+	return packEntry{
+		Pack:   binary.BigEndian.Uint32(b[0:4]),
+		Offset: int64(binary.BigEndian.Uint64(b[4:12])),
+		Length: int64(binary.BigEndian.Uint64(b[12:20])),
+	}, nil
+}
+
+// packStore appends small objects to shared pack files instead of giving each
+// object its own file. An index maps each OID to its pack, offset and length.
+// Deleted objects only drop out of the index; their bytes are reclaimed by
+// compact.
+type packStore struct {
+	dir       string
+	threshold int64
+	index     *bolt.DB
+
+	mu          sync.RWMutex
+	current     *os.File
+	currentId   uint32
+	currentSize int64
+}
+
+// openPackStore opens or creates the pack store in dir. Objects smaller than
+// threshold bytes are eligible for packing.
+func openPackStore(dir string, threshold int64) (*packStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, packIndexFile), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(packEntriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	p := &packStore{dir: dir, threshold: threshold, index: db}
+
+	ids, err := p.packIds()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var id uint32 = 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1]
+	}
+	if err := p.openPack(id); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if p.currentSize >= maxPackSize {
+		if err := p.roll(); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *packStore) packPath(id uint32) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s%06d%s", packPrefix, id, packSuffix))
+}
+
+// packIds returns the ids of all pack files on disk in ascending order.
+func (p *packStore) packIds() ([]uint32, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, packPrefix) || !strings.HasSuffix(name, packSuffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, packPrefix), packSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(n))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openPack makes the pack with id the append target. Callers must hold mu.
+func (p *packStore) openPack(id uint32) error {
+	f, err := os.OpenFile(p.packPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if p.current != nil {
+		p.current.Close()
+	}
+	p.current = f
+	p.currentId = id
+	p.currentSize = st.Size()
+	return nil
+}
+
+// roll starts a new pack file. Callers must hold mu.
+func (p *packStore) roll() error {
+	return p.openPack(p.currentId + 1)
+}
+
+// append writes data to the current pack and returns its location. Callers
+// must hold mu.
+func (p *packStore) append(data []byte) (packEntry, error) {
+	if p.currentSize > 0 && p.currentSize+int64(len(data)) > maxPackSize {
+		if err := p.roll(); err != nil {
+			return packEntry{}, err
+		}
+	}
+
+	entry := packEntry{Pack: p.currentId, Offset: p.currentSize, Length: int64(len(data))}
+	n, err := p.current.Write(data)
+	p.currentSize += int64(n)
+	if err != nil {
+		return packEntry{}, err
+	}
+	if err := p.current.Sync(); err != nil {
+		return packEntry{}, err
+	}
+
+	return entry, nil
+}
+
+func (p *packStore) lookup(oid string) (packEntry, error) {
+	var entry packEntry
+	err := p.index.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(packEntriesBucket).Get([]byte(oid))
+		if value == nil {
+			return errPackEntryNotFound
+		}
+
+		var err error
+		entry, err = decodePackEntry(value)
+		return err
+	})
+	return entry, err
+}
+
+// put appends data for oid to the current pack. Content that is already
+// packed is not written again.
+func (p *packStore) put(oid string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.lookup(oid); err == nil {
+		return nil
+	}
+
+	entry, err := p.append(data)
+	if err != nil {
+		return err
+	}
+
+	return p.index.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(packEntriesBucket).Put([]byte(oid), entry.encode())
+	})
+}
+
+// get returns a reader for the packed object, starting at fromByte. It returns
+// errPackEntryNotFound when the object is not packed.
+func (p *packStore) get(oid string, fromByte int64) (io.ReadCloser, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	entry, err := p.lookup(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p.packPath(entry.Pack))
+	if err != nil {
+		return nil, err
+	}
+
+	if fromByte < 0 {
+		fromByte = 0
+	}
+	if fromByte > entry.Length {
+		fromByte = entry.Length
+	}
+
+	return &packReader{
+		SectionReader: io.NewSectionReader(f, entry.Offset+fromByte, entry.Length-fromByte),
+		f:             f,
+	}, nil
+}
+
+func (p *packStore) exists(oid string) bool {
+	_, err := p.lookup(oid)
+	return err == nil
+}
+
+// walk calls fn with the oid and length of every packed object.
+func (p *packStore) walk(fn func(oid string, size int64) error) error {
+	return p.index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(packEntriesBucket).ForEach(func(k, v []byte) error {
+			entry, err := decodePackEntry(v)
+			if err != nil {
+				return err
+			}
+			return fn(string(k), entry.Length)
+		})
+	})
+}
+
+// delete removes oid from the index. It returns false if it was not packed.
+func (p *packStore) delete(oid string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	found := false
+	err := p.index.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(packEntriesBucket)
+		if bucket.Get([]byte(oid)) == nil {
+			return nil
+		}
+		found = true
+		return bucket.Delete([]byte(oid))
+	})
+	return found, err
+}
+
+// compact rewrites packs whose live content has dropped below
+// packCompactRatio, copying the live entries into the current pack and
+// removing the old file. It returns the number of bytes reclaimed.
+func (p *packStore) compact() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	live := make(map[uint32]int64)
+	err := p.index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(packEntriesBucket).ForEach(func(k, v []byte) error {
+			entry, err := decodePackEntry(v)
+			if err != nil {
+				return err
+			}
+			live[entry.Pack] += entry.Length
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := p.packIds()
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, id := range ids {
+		if id == p.currentId {
+			continue
+		}
+
+		st, err := os.Stat(p.packPath(id))
+		if err != nil {
+			return reclaimed, err
+		}
+		if st.Size() > 0 && float64(live[id])/float64(st.Size()) >= packCompactRatio {
+			continue
+		}
+
+		if err := p.rewritePack(id); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += st.Size() - live[id]
+	}
+
+	return reclaimed, nil
+}
+
+// rewritePack moves the live entries of pack id into the current pack and
+// removes it. Callers must hold mu.
+func (p *packStore) rewritePack(id uint32) error {
+	src, err := os.Open(p.packPath(id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	moved := make(map[string]packEntry)
+	err = p.index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(packEntriesBucket).ForEach(func(k, v []byte) error {
+			entry, err := decodePackEntry(v)
+			if err != nil {
+				return err
+			}
+			if entry.Pack == id {
+				moved[string(k)] = entry
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for oid, entry := range moved {
+		data := make([]byte, entry.Length)
+		if _, err := src.ReadAt(data, entry.Offset); err != nil {
+			return err
+		}
+
+		newEntry, err := p.append(data)
+		if err != nil {
+			return err
+		}
+		moved[oid] = newEntry
+	}
+
+	err = p.index.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(packEntriesBucket)
+		for oid, entry := range moved {
+			if err := bucket.Put([]byte(oid), entry.encode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p.packPath(id))
+}
+
+func (p *packStore) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current != nil {
+		p.current.Close()
+		p.current = nil
+	}
+	return p.index.Close()
+}
+
+// packReader reads a single object out of a pack file.
+type packReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *packReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const packTestPath = "pack-store-test"
+
+func TestPackedContentStorePut(t *testing.T) {
+	store := setupPacked(t)
+	defer teardownPacked(store)
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := store.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	path := packTestPath + "/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("expected small content to not be stored as a loose file")
+	}
+
+	if !store.Exists(m) {
+		t.Fatalf("expected content to exist after putting")
+	}
+
+	r, err := store.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestPackedContentStorePutHashMismatch(t *testing.T) {
+	store := setupPacked(t)
+	defer teardownPacked(store)
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := store.Put(m, bytes.NewBuffer([]byte("bogus conten"))); err != errHashMismatch {
+		t.Fatalf("expected hash mismatch, got: %v", err)
+	}
+
+	if store.Exists(m) {
+		t.Fatalf("expected content to not exist after putting bogus content")
+	}
+}
+
+func TestPackedContentStoreLargeObjectIsLoose(t *testing.T) {
+	store := setupPacked(t)
+	defer teardownPacked(store)
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	store.packs.threshold = contentSize
+
+	if err := store.Put(m, bytes.NewBuffer([]byte(content))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if store.packs.exists(m.Oid) {
+		t.Fatalf("expected large content to not be packed")
+	}
+
+	path := packTestPath + "/f9/7e/1b2936a56511b3b6efc99011758e4700d60fb1674d31445d1ee40b663f24"
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected large content to be stored as a loose file: %s", err)
+	}
+}
+
+func TestPackedContentStoreDeleteAndCompact(t *testing.T) {
+	store := setupPacked(t)
+	defer teardownPacked(store)
+
+	kept := &MetaObject{Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72", Size: 12}
+	deleted := &MetaObject{Oid: contentOid, Size: contentSize}
+
+	if err := store.Put(kept, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if err := store.Put(deleted, bytes.NewBuffer([]byte(content))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if err := store.Delete(deleted); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	if store.Exists(deleted) {
+		t.Fatalf("expected deleted content to not exist")
+	}
+
+	// Start a new pack so the first one is eligible for compaction.
+	store.packs.mu.Lock()
+	store.packs.roll()
+	store.packs.mu.Unlock()
+
+	reclaimed, err := store.Compact()
+	if err != nil {
+		t.Fatalf("expected compact to succeed, got: %s", err)
+	}
+	if reclaimed != contentSize {
+		t.Fatalf("expected %d bytes reclaimed, got: %d", contentSize, reclaimed)
+	}
+
+	if _, err := os.Stat(store.packs.packPath(1)); !os.IsNotExist(err) {
+		t.Fatalf("expected compacted pack to be removed")
+	}
+
+	r, err := store.Get(kept, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed after compaction, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestPackedContentStoreReopen(t *testing.T) {
+	store := setupPacked(t)
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := store.Put(m, bytes.NewBuffer([]byte(content))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	store.Close()
+
+	store, err := NewPackedContentStore(packTestPath, 1024)
+	if err != nil {
+		t.Fatalf("expected reopen to succeed, got: %s", err)
+	}
+	defer teardownPacked(store)
+
+	if !store.Exists(m) {
+		t.Fatalf("expected content to exist after reopening")
+	}
+}
+
+func TestPackedContentStoreReopenUnpacked(t *testing.T) {
+	store := setupPacked(t)
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := store.Put(m, bytes.NewBuffer([]byte(content))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	store.Close()
+
+	store, err := NewContentStore(packTestPath)
+	if err != nil {
+		t.Fatalf("expected reopen to succeed, got: %s", err)
+	}
+	defer teardownPacked(store)
+
+	if !store.Exists(m) {
+		t.Fatalf("expected packed content to exist with packing disabled")
+	}
+
+	r, err := store.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != content {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func setupPacked(t *testing.T) *ContentStore {
+	store, err := NewPackedContentStore(packTestPath, 1024)
+	if err != nil {
+		t.Fatalf("error initializing packed content store: %s", err)
+	}
+	return store
+}
+
+func teardownPacked(store *ContentStore) {
+	store.Close()
+	os.RemoveAll(packTestPath)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	quotaRepo = "repo"
+	quotaUser = "user"
+)
+
+// reservationReleaseInterval is how often unconfirmed reservations that timed
+// out are released.
+const reservationReleaseInterval = 10 * time.Minute
+
+var (
+	errRepoQuotaExceeded = errors.New("Repository quota exceeded")
+	errUserQuotaExceeded = errors.New("User quota exceeded")
+)
+
+// Storage is charged in chargesBucket for each repository an object is pushed
+// to, so an object pushed to two repositories counts against both of them and
+// the users who pushed it to each:
+//
+//	{oid}/{repo} -> JSON objectCharge
+//
+// A charge is reserved when a batch request announces an upload, and confirmed
+// once the content is uploaded. Reservations that are never confirmed are
+// released after LFS_RESERVATIONTIMEOUT.
+
+// objectCharge records the storage of an object accounted to a repository and
+// the user who pushed it there.
+type objectCharge struct {
+	Oid  string `json:"oid"`
+	Repo string `json:"repo"`
+	User string `json:"user"`
+	Size int64  `json:"size"`
+	// Confirmed is set once the content is uploaded to the repository.
+	Confirmed  bool      `json:"confirmed,omitempty"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+func chargeKey(oid, repo string) []byte {
+	return []byte(oid + "/" + repo)
+}
+
+// chargePrefix is the prefix of the keys of the charges for oid.
+func chargePrefix(oid string) []byte {
+	return []byte(oid + "/")
+}
+
+// Usage reports the objects and bytes stored for a repository or user against
+// its quota. A Quota of zero means unlimited.
+type Usage struct {
+	Name    string `json:"name"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+	Quota   int64  `json:"quota"`
+}
+
+// Percent returns the share of the quota in use, or zero when unlimited.
+func (u *Usage) Percent() int {
+	if u.Quota <= 0 {
+		return 0
+	}
+	return int(u.Bytes * 100 / u.Quota)
+}
+
+func usageKey(kind, name string) []byte {
+	return []byte(kind + ":" + name)
+}
+
+// objectCountKey is the usage key of the number of objects charged to name.
+func objectCountKey(kind, name string) []byte {
+	return []byte("objects:" + kind + ":" + name)
+}
+
+func getInt64(bucket *bolt.Bucket, key []byte) int64 {
+	value := bucket.Get(key)
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func putInt64(bucket *bolt.Bucket, key []byte, n int64) error {
+	if n == 0 {
+		return bucket.Delete(key)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return bucket.Put(key, b)
+}
+
+// defaultQuota returns the configured quota for kind.
+func defaultQuota(kind string) int64 {
+	if kind == quotaRepo {
+		return Config.RepoQuotaSize()
+	}
+	return Config.UserQuotaSize()
+}
+
+// quotaFor returns the quota override for name, or the configured default.
+func quotaFor(tx *bolt.Tx, kind, name string) int64 {
+	value := tx.Bucket(quotasBucket).Get(usageKey(kind, name))
+	if value == nil {
+		return defaultQuota(kind)
+	}
+	n, _ := strconv.ParseInt(string(value), 10, 64)
+	return n
+}
+
+// Reserve reserves size bytes of storage for oid in repo, charged to repo and
+// user, failing with errRepoQuotaExceeded or errUserQuotaExceeded if either
+// would go over quota. A repository that is already charged for the object is
+// not charged again.
+func (s *MetaStore) Reserve(oid, repo, user string, size int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return reserve(tx, &objectCharge{Oid: oid, Repo: repo, User: user, Size: size, ReservedAt: time.Now().UTC()})
+	})
+}
+
+// ChargeStored charges repo and user for oid, whose content is already
+// stored, and confirms the charge right away since no upload is needed.
+func (s *MetaStore) ChargeStored(oid, repo, user string, size int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := reserve(tx, &objectCharge{Oid: oid, Repo: repo, User: user, Size: size, ReservedAt: time.Now().UTC()}); err != nil {
+			return err
+		}
+		return confirmCharge(tx, oid, repo)
+	})
+}
+
+// reserve records the charge c within tx, unless its repository is already
+// charged for the object.
+func reserve(tx *bolt.Tx, c *objectCharge) error {
+	charges := tx.Bucket(chargesBucket)
+	if charges == nil {
+		return errNoBucket
+	}
+	if charges.Get(chargeKey(c.Oid, c.Repo)) != nil {
+		return nil
+	}
+
+	usage := tx.Bucket(usageBucket)
+	repoUsed := getInt64(usage, usageKey(quotaRepo, c.Repo))
+	userUsed := getInt64(usage, usageKey(quotaUser, c.User))
+
+	if q := quotaFor(tx, quotaRepo, c.Repo); q > 0 && repoUsed+c.Size > q {
+		return errRepoQuotaExceeded
+	}
+	if q := quotaFor(tx, quotaUser, c.User); q > 0 && userUsed+c.Size > q {
+		return errUserQuotaExceeded
+	}
+	return addCharge(tx, c)
+}
+
+// addCharge records the charge c within tx and adds it to the usage of its
+// repository and user, regardless of their quotas.
+func addCharge(tx *bolt.Tx, c *objectCharge) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(chargesBucket).Put(chargeKey(c.Oid, c.Repo), data); err != nil {
+		return err
+	}
+
+	usage := tx.Bucket(usageBucket)
+	repoKey, userKey := usageKey(quotaRepo, c.Repo), usageKey(quotaUser, c.User)
+	if err := putInt64(usage, repoKey, getInt64(usage, repoKey)+c.Size); err != nil {
+		return err
+	}
+	if err := putInt64(usage, userKey, getInt64(usage, userKey)+c.Size); err != nil {
+		return err
+	}
+	return countCharge(usage, c, 1)
+}
+
+// confirmCharge confirms the charge of repo for oid within tx, if it has one.
+func confirmCharge(tx *bolt.Tx, oid, repo string) error {
+	charges := tx.Bucket(chargesBucket)
+	data := charges.Get(chargeKey(oid, repo))
+	if data == nil {
+		return nil
+	}
+
+	var c objectCharge
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if c.Confirmed {
+		return nil
+	}
+	c.Confirmed = true
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	return charges.Put(chargeKey(oid, repo), data)
+}
+
+// chargesOf returns the charges for oid within tx.
+func chargesOf(tx *bolt.Tx, oid string) ([]*objectCharge, error) {
+	var charges []*objectCharge
+	prefix := chargePrefix(oid)
+	c := tx.Bucket(chargesBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var charge objectCharge
+		if err := json.Unmarshal(v, &charge); err != nil {
+			return nil, err
+		}
+		charges = append(charges, &charge)
+	}
+	return charges, nil
+}
+
+// releaseCharge deletes the charge c within tx and gives its storage back to
+// its repository and user.
+func releaseCharge(tx *bolt.Tx, c *objectCharge) error {
+	usage := tx.Bucket(usageBucket)
+	repoKey, userKey := usageKey(quotaRepo, c.Repo), usageKey(quotaUser, c.User)
+	if err := putInt64(usage, repoKey, getInt64(usage, repoKey)-c.Size); err != nil {
+		return err
+	}
+	if err := putInt64(usage, userKey, getInt64(usage, userKey)-c.Size); err != nil {
+		return err
+	}
+	if err := countCharge(usage, c, -1); err != nil {
+		return err
+	}
+
+	return tx.Bucket(chargesBucket).Delete(chargeKey(c.Oid, c.Repo))
+}
+
+// refund releases every charge for oid within tx.
+func refund(tx *bolt.Tx, oid string) error {
+	charges, err := chargesOf(tx, oid)
+	if err != nil {
+		return err
+	}
+	for _, c := range charges {
+		if err := releaseCharge(tx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countCharge adds delta to the object counts of the repository and user c is
+// charged to.
+func countCharge(usage *bolt.Bucket, c *objectCharge, delta int64) error {
+	repoKey, userKey := objectCountKey(quotaRepo, c.Repo), objectCountKey(quotaUser, c.User)
+	if err := putInt64(usage, repoKey, getInt64(usage, repoKey)+delta); err != nil {
+		return err
+	}
+	return putInt64(usage, userKey, getInt64(usage, userKey)+delta)
+}
+
+// ChargesOf returns the charges for oid, sorted by repository.
+func (s *MetaStore) ChargesOf(oid string) ([]*objectCharge, error) {
+	var charges []*objectCharge
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		charges, err = chargesOf(tx, oid)
+		return err
+	})
+	return charges, err
+}
+
+// ReleaseReservations releases the reservations made before cutoff that were
+// never confirmed, and returns them.
+func (s *MetaStore) ReleaseReservations(cutoff time.Time) ([]*objectCharge, error) {
+	var released []*objectCharge
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(chargesBucket).ForEach(func(k, v []byte) error {
+			var c objectCharge
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if !c.Confirmed && c.ReservedAt.Before(cutoff) {
+				released = append(released, &c)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, c := range released {
+			if err := releaseCharge(tx, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return released, err
+}
+
+// releaseReservationsLoop releases reservations left unconfirmed for longer
+// than LFS_RESERVATIONTIMEOUT, such as those of abandoned uploads.
+func (a *App) releaseReservationsLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		released, err := a.metaStore.ReleaseReservations(time.Now().Add(-Config.ReservationTimeoutDuration()))
+		if err != nil {
+			logger.Log(kv{"fn": "releaseReservations", "err": err.Error()})
+			continue
+		}
+		if len(released) > 0 {
+			logger.Log(kv{"fn": "releaseReservations", "msg": "released unconfirmed reservations", "count": len(released)})
+		}
+	}
+}
+
+// migrateUploadCharges charges the objects that aren't charged to any
+// repository, such as those uploaded with tus, to the repository and user that
+// uploaded them. Objects stored before uploads were recorded stay uncharged
+// and follow the default visibility.
+func migrateUploadCharges(tx *bolt.Tx) error {
+	var uncharged []*objectCharge
+	err := tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+		meta, err := decodeObject(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		if meta.Repo == "" {
+			return nil
+		}
+		prefix := chargePrefix(meta.Oid)
+		if k, _ := tx.Bucket(chargesBucket).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		uncharged = append(uncharged, &objectCharge{Oid: meta.Oid, Repo: meta.Repo, User: meta.Uploader, Size: meta.Size, Confirmed: true, ReservedAt: meta.UploadedAt})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range uncharged {
+		if err := addCharge(tx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateChargeKeys keys the charges that were kept per object by object and
+// repository. They are confirmed, since nothing recorded whether their
+// uploads finished.
+func migrateChargeKeys(tx *bolt.Tx) error {
+	charges := tx.Bucket(chargesBucket)
+	old := make(map[string]*objectCharge)
+	err := charges.ForEach(func(k, v []byte) error {
+		if bytes.IndexByte(k, '/') >= 0 {
+			return nil
+		}
+		var c objectCharge
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		c.Oid, c.Confirmed = string(k), true
+		old[string(k)] = &c
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, c := range old {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := charges.Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := charges.Put(chargeKey(c.Oid, c.Repo), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns the current usage and quota of a repository or user.
+func (s *MetaStore) Usage(kind, name string) (*Usage, error) {
+	u := &Usage{Name: name}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		u.Objects = getInt64(tx.Bucket(usageBucket), objectCountKey(kind, name))
+		u.Bytes = getInt64(tx.Bucket(usageBucket), usageKey(kind, name))
+		u.Quota = quotaFor(tx, kind, name)
+		return nil
+	})
+	return u, err
+}
+
+// Usages returns the usage of every repository or user that has stored data
+// or a quota override, sorted by name.
+func (s *MetaStore) Usages(kind string) ([]*Usage, error) {
+	byName := make(map[string]*Usage)
+	prefix := kind + ":"
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		collect := func(bucket []byte) error {
+			return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				if !strings.HasPrefix(string(k), prefix) {
+					return nil
+				}
+				name := strings.TrimPrefix(string(k), prefix)
+				if _, ok := byName[name]; !ok {
+					byName[name] = &Usage{
+						Name:    name,
+						Objects: getInt64(tx.Bucket(usageBucket), objectCountKey(kind, name)),
+						Bytes:   getInt64(tx.Bucket(usageBucket), usageKey(kind, name)),
+						Quota:   quotaFor(tx, kind, name),
+					}
+				}
+				return nil
+			})
+		}
+
+		if err := collect(usageBucket); err != nil {
+			return err
+		}
+		return collect(quotasBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make([]*Usage, 0, len(byName))
+	for _, u := range byName {
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Name < usages[j].Name })
+	return usages, nil
+}
+
+// SetQuota overrides the quota of a repository or user. A negative limit
+// removes the override so the configured default applies again; zero means
+// unlimited.
+func (s *MetaStore) SetQuota(kind, name string, limit int64) error {
+	if kind != quotaRepo && kind != quotaUser {
+		return fmt.Errorf("Invalid quota kind: %s", kind)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(quotasBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if limit < 0 {
+			return bucket.Delete(usageKey(kind, name))
+		}
+		return bucket.Put(usageKey(kind, name), []byte(strconv.FormatInt(limit, 10)))
+	})
+}
+
+// checkUpload reserves storage for an object about to be uploaded, returning
+// an ObjectError if the object is too large or would exceed a quota.
+func (a *App) checkUpload(rv *RequestVars, user string) *ObjectError {
+	if max := Config.MaxObjectSizeBytes(); max > 0 && rv.Size > max {
+		return &ObjectError{
+			Code:    413,
+			Message: fmt.Sprintf("Object size %d exceeds the maximum of %d bytes", rv.Size, max),
+		}
+	}
+
+	return chargeError(a.metaStore.Reserve(rv.Oid, rv.Repo, user, rv.Size))
+}
+
+// chargeStored charges the repository of rv for meta, an object pushed to it
+// whose content is already stored, returning an ObjectError if that would
+// exceed a quota.
+func (a *App) chargeStored(rv *RequestVars, meta *MetaObject, user string) *ObjectError {
+	return chargeError(a.metaStore.ChargeStored(meta.Oid, rv.Repo, user, meta.Size))
+}
+
+// chargeError returns the ObjectError for an error charging storage.
+func chargeError(err error) *ObjectError {
+	switch err {
+	case nil:
+		return nil
+	case errRepoQuotaExceeded, errUserQuotaExceeded:
+		return &ObjectError{Code: 507, Message: err.Error()}
+	default:
+		return &ObjectError{Code: 500, Message: err.Error()}
+	}
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Repositories are registered in reposBucket, keyed by the {repo} segment of
+// their URLs, which also keys their locks, lock policy and quota:
+//
+//	{name} -> JSON Repository
+//
+// The {user} segment of their URLs must be their owner, so that one name
+// can't be reached through several owners. Unless LFS_AUTOCREATEREPOS is off,
+// a repository is registered, owned by the {user} segment, the first time
+// something is uploaded to or locked in it; otherwise requests for unknown
+// repositories get a 404.
+
+// Repository visibilities.
+const (
+	// visibilityPrivate repositories are only readable by users granted
+	// access.
+	visibilityPrivate = "private"
+	// visibilityInternal repositories are readable by any authenticated
+	// user.
+	visibilityInternal = "internal"
+	// visibilityPublic repositories are readable by anyone.
+	visibilityPublic = "public"
+)
+
+var visibilities = []string{visibilityPrivate, visibilityInternal, visibilityPublic}
+
+// Access to a repository, as checked by requireAuth. Visibility only decides
+// who may read a repository; writing to it takes being its owner or being
+// granted accessWrite. Users may also be granted accessRead to private
+// repositories.
+const (
+	// accessDownload is downloading objects, which anonymous users may do
+	// from public repositories.
+	accessDownload = "download"
+	// accessRead is anything else that doesn't change the repository, such
+	// as listing locks.
+	accessRead = "read"
+	// accessWrite is uploading objects and taking or releasing locks.
+	accessWrite = "write"
+	// accessBatch is accessDownload or accessWrite, depending on the
+	// operation of a batch request.
+	accessBatch = "batch"
+)
+
+var grantAccesses = []string{accessRead, accessWrite}
+
+// transferAdapters are the transfer adapters the server implements.
+var transferAdapters = []string{"basic", "tus"}
+
+// maxRepoNameLength is the longest repository name.
+const maxRepoNameLength = 100
+
+var (
+	errRepoNotFound    = errors.New("Repository not found")
+	errRepoExists      = errors.New("Repository already exists")
+	errRepoArchived    = errors.New("Repository is archived")
+	errRepoNotEmpty    = errors.New("Repository still stores objects")
+	errTransferRefused = errors.New("None of the transfer adapters offered is allowed in this repository")
+)
+
+// Repository is a registered repository and its settings. Its quota and lock
+// policy are kept with the other quotas and lock policies.
+type Repository struct {
+	Name string `json:"name"`
+	// Owner is the {user} segment of the repository's URLs. Repositories
+	// registered before owners were recorded have none and accept any.
+	Owner      string `json:"owner,omitempty"`
+	Visibility string `json:"visibility"`
+	// Transfers are the transfer adapters uploads may use. If empty, any
+	// adapter the server supports may be used.
+	Transfers []string `json:"transfers,omitempty"`
+	// Archived repositories are read only.
+	Archived  bool      `json:"archived,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// CreatedBy is the administrator who created the repository, or the
+	// user whose upload or lock did.
+	CreatedBy string `json:"created_by,omitempty"`
+	// Grants maps the users granted access to the repository to accessRead
+	// or accessWrite.
+	Grants map[string]string `json:"grants,omitempty"`
+}
+
+// AllowsTransfer reports whether uploads to the repository may use the
+// transfer adapter t.
+func (r *Repository) AllowsTransfer(t string) bool {
+	if len(r.Transfers) == 0 {
+		return true
+	}
+	for _, allowed := range r.Transfers {
+		if allowed == t {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultVisibility is the visibility of repositories that aren't registered
+// yet and of new ones not given one: public if LFS_PUBLIC is set, otherwise
+// internal.
+func defaultVisibility() string {
+	if Config.IsPublic() {
+		return visibilityPublic
+	}
+	return visibilityInternal
+}
+
+// repoAllows reports whether user, or an anonymous user if empty, has access
+// to repo. A nil repo stands for no repository in particular: it has the
+// default visibility and any user may write to it.
+func repoAllows(repo *Repository, user, access string) bool {
+	visibility := defaultVisibility()
+	if repo != nil {
+		visibility = repo.Visibility
+	}
+
+	switch {
+	case user == "":
+		return visibility == visibilityPublic && access == accessDownload
+	case repo == nil:
+		return true
+	case user == repo.Owner || repo.Grants[user] == accessWrite:
+		return true
+	case access == accessWrite:
+		return false
+	case visibility != visibilityPrivate:
+		return true
+	}
+	return repo.Grants[user] == accessRead
+}
+
+// validRepoName checks that name can be the {repo} segment of a URL.
+func validRepoName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > maxRepoNameLength ||
+		strings.ContainsAny(name, "/?#%") || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("Invalid repository name: %q", name)
+	}
+	return nil
+}
+
+func (r *Repository) validate() error {
+	if err := validRepoName(r.Name); err != nil {
+		return err
+	}
+	if r.Owner != "" && validRepoName(r.Owner) != nil {
+		return fmt.Errorf("Invalid owner: %q", r.Owner)
+	}
+	if !contains(visibilities, r.Visibility) {
+		return fmt.Errorf("Invalid visibility: %q", r.Visibility)
+	}
+	for _, t := range r.Transfers {
+		if !contains(transferAdapters, t) {
+			return fmt.Errorf("Invalid transfer adapter: %q", t)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func repository(tx *bolt.Tx, name string) (*Repository, error) {
+	bucket := tx.Bucket(reposBucket)
+	if bucket == nil {
+		return nil, errNoBucket
+	}
+
+	data := bucket.Get([]byte(name))
+	if data == nil {
+		return nil, errRepoNotFound
+	}
+	repo := &Repository{}
+	return repo, json.Unmarshal(data, repo)
+}
+
+func putRepository(tx *bolt.Tx, repo *Repository) error {
+	data, err := json.Marshal(repo)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(reposBucket).Put([]byte(repo.Name), data)
+}
+
+// Repository returns the repository name, or errRepoNotFound.
+func (s *MetaStore) Repository(name string) (*Repository, error) {
+	var repo *Repository
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		repo, err = repository(tx, name)
+		return err
+	})
+	return repo, err
+}
+
+// Repositories returns every registered repository, sorted by name.
+func (s *MetaStore) Repositories() ([]*Repository, error) {
+	var repos []*Repository
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reposBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var r Repository
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			repos = append(repos, &r)
+			return nil
+		})
+	})
+	return repos, err
+}
+
+// CreateRepository registers repo, defaulting its visibility to
+// defaultVisibility.
+func (s *MetaStore) CreateRepository(repo *Repository) error {
+	if repo.Visibility == "" {
+		repo.Visibility = defaultVisibility()
+	}
+	if err := repo.validate(); err != nil {
+		return err
+	}
+	repo.CreatedAt = time.Now().UTC()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := repository(tx, repo.Name); err != errRepoNotFound {
+			if err == nil {
+				return errRepoExists
+			}
+			return err
+		}
+		return putRepository(tx, repo)
+	})
+}
+
+// UpdateRepository sets the visibility and transfer adapters of the
+// repository name, and returns it.
+func (s *MetaStore) UpdateRepository(name, visibility string, transfers []string) (*Repository, error) {
+	var repo *Repository
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if repo, err = repository(tx, name); err != nil {
+			return err
+		}
+
+		repo.Visibility, repo.Transfers = visibility, transfers
+		if err := repo.validate(); err != nil {
+			return err
+		}
+		return putRepository(tx, repo)
+	})
+	return repo, err
+}
+
+// ArchiveRepository archives or restores the repository name, and returns it.
+func (s *MetaStore) ArchiveRepository(name string, archived bool) (*Repository, error) {
+	var repo *Repository
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if repo, err = repository(tx, name); err != nil {
+			return err
+		}
+
+		repo.Archived = archived
+		return putRepository(tx, repo)
+	})
+	return repo, err
+}
+
+// GrantRepository grants user access to the repository name, or revokes
+// their access if access is empty, and returns the repository.
+func (s *MetaStore) GrantRepository(name, user, access string) (*Repository, error) {
+	if access != "" && !contains(grantAccesses, access) {
+		return nil, fmt.Errorf("Invalid access: %q", access)
+	}
+
+	var repo *Repository
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if repo, err = repository(tx, name); err != nil {
+			return err
+		}
+
+		if access == "" {
+			delete(repo.Grants, user)
+		} else {
+			if tx.Bucket(usersBucket).Get([]byte(user)) == nil {
+				return errUserNotFound
+			}
+			if repo.Grants == nil {
+				repo.Grants = make(map[string]string)
+			}
+			repo.Grants[user] = access
+		}
+		return putRepository(tx, repo)
+	})
+	return repo, err
+}
+
+// deleteGrants revokes every access granted to user.
+func deleteGrants(tx *bolt.Tx, user string) error {
+	return updateRecords(tx.Bucket(reposBucket), func(v []byte) ([]byte, error) {
+		var repo Repository
+		if err := json.Unmarshal(v, &repo); err != nil {
+			return nil, err
+		}
+		if _, ok := repo.Grants[user]; !ok {
+			return nil, nil
+		}
+		delete(repo.Grants, user)
+		return json.Marshal(&repo)
+	})
+}
+
+// RenameRepository renames the repository name to newName, moving its locks,
+// lock history, lock policy, quota, storage accounting, objects and webhooks.
+// Traffic already recorded stays under the old name.
+func (s *MetaStore) RenameRepository(name, newName string) (*Repository, error) {
+	if err := validRepoName(newName); err != nil {
+		return nil, err
+	}
+
+	var repo *Repository
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if repo, err = repository(tx, name); err != nil {
+			return err
+		}
+		if _, err := repository(tx, newName); err != errRepoNotFound {
+			if err == nil {
+				return errRepoExists
+			}
+			return err
+		}
+
+		repo.Name = newName
+		if err := putRepository(tx, repo); err != nil {
+			return err
+		}
+		if err := tx.Bucket(reposBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return renameRepoData(tx, name, newName)
+	})
+	return repo, err
+}
+
+// renameRepoData moves the data of repository name to newName.
+func renameRepoData(tx *bolt.Tx, name, newName string) error {
+	for _, b := range [][]byte{locksBucket, lockHistoryBucket} {
+		if err := moveBucket(tx.Bucket(b), []byte(name), []byte(newName)); err != nil {
+			return err
+		}
+	}
+
+	policy, err := lockPolicy(tx, name)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		policy.Repo = newName
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(lockPoliciesBucket).Put([]byte(newName), data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(lockPoliciesBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	if quota := tx.Bucket(quotasBucket).Get(usageKey(quotaRepo, name)); quota != nil {
+		if err := tx.Bucket(quotasBucket).Put(usageKey(quotaRepo, newName), append([]byte(nil), quota...)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(quotasBucket).Delete(usageKey(quotaRepo, name)); err != nil {
+			return err
+		}
+	}
+
+	usage := tx.Bucket(usageBucket)
+	for _, key := range []func(string, string) []byte{usageKey, objectCountKey} {
+		n := getInt64(usage, key(quotaRepo, name))
+		if err := putInt64(usage, key(quotaRepo, newName), n); err != nil {
+			return err
+		}
+		if err := putInt64(usage, key(quotaRepo, name), 0); err != nil {
+			return err
+		}
+	}
+
+	if err := rekeyCharges(tx.Bucket(chargesBucket), name, newName); err != nil {
+		return err
+	}
+
+	if err := updateRecords(tx.Bucket(objectsBucket), func(data []byte) ([]byte, error) {
+		meta, err := decodeObject(data)
+		if err != nil || meta.Repo != name {
+			return nil, err
+		}
+		meta.Repo = newName
+		return encodeObject(meta)
+	}); err != nil {
+		return err
+	}
+
+	return updateRecords(tx.Bucket(webhooksBucket), func(data []byte) ([]byte, error) {
+		var h Webhook
+		if err := json.Unmarshal(data, &h); err != nil || h.Repo != name {
+			return nil, err
+		}
+		h.Repo = newName
+		return json.Marshal(&h)
+	})
+}
+
+// updateRecords replaces each value of bucket with what update returns for
+// it, leaving the value alone if update returns nil.
+func updateRecords(bucket *bolt.Bucket, update func([]byte) ([]byte, error)) error {
+	updated := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		data, err := update(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		if data != nil {
+			updated[string(k)] = data
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, data := range updated {
+		if err := bucket.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyCharges moves the charges of the repository name to newName.
+func rekeyCharges(charges *bolt.Bucket, name, newName string) error {
+	moved := make(map[string]*objectCharge)
+	err := charges.ForEach(func(k, v []byte) error {
+		var c objectCharge
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		if c.Repo == name {
+			moved[string(k)] = &c
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, c := range moved {
+		if err := charges.Delete([]byte(k)); err != nil {
+			return err
+		}
+		c.Repo = newName
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := charges.Put(chargeKey(c.Oid, c.Repo), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveBucket renames the bucket name inside parent to newName, with
+// everything in it.
+func moveBucket(parent *bolt.Bucket, name, newName []byte) error {
+	src := parent.Bucket(name)
+	if src == nil {
+		return nil
+	}
+
+	dst, err := parent.CreateBucket(newName)
+	if err != nil {
+		return err
+	}
+	if err := copyBucket(dst, src); err != nil {
+		return err
+	}
+	return parent.DeleteBucket(name)
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src to dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			child, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(child, src.Bucket(k))
+		}
+		return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	})
+}
+
+// DeleteRepository unregisters the repository name and deletes its locks,
+// lock history, lock policy and quota. A repository still storing objects
+// can't be deleted.
+func (s *MetaStore) DeleteRepository(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := repository(tx, name); err != nil {
+			return err
+		}
+		if getInt64(tx.Bucket(usageBucket), objectCountKey(quotaRepo, name)) > 0 {
+			return errRepoNotEmpty
+		}
+
+		for _, b := range [][]byte{locksBucket, lockHistoryBucket} {
+			if tx.Bucket(b).Bucket([]byte(name)) == nil {
+				continue
+			}
+			if err := tx.Bucket(b).DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(lockPoliciesBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(quotasBucket).Delete(usageKey(quotaRepo, name)); err != nil {
+			return err
+		}
+		return tx.Bucket(reposBucket).Delete([]byte(name))
+	})
+}
+
+// repoForWrite returns the repository name before something is uploaded to
+// or locked in it, registering it for user if it is unknown and repositories
+// are created automatically. It returns errRepoArchived if the repository is
+// read only. Requests outside a repository have an empty name and a nil
+// repository.
+func (a *App) repoForWrite(owner, name, user string) (*Repository, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	repo, err := a.metaStore.Repository(name)
+	if err == errRepoNotFound && Config.IsAutoCreatingRepos() {
+		repo = &Repository{Name: name, Owner: owner, CreatedBy: user}
+		err = a.metaStore.CreateRepository(repo)
+		if err == errRepoExists {
+			repo, err = a.metaStore.Repository(name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repo.Archived {
+		return repo, errRepoArchived
+	}
+	return repo, nil
+}
+
+// repoStatus returns the HTTP status for an error of repoForWrite or
+// uploadTransfer.
+func repoStatus(err error) int {
+	switch err {
+	case errRepoNotFound:
+		return 404
+	case errRepoArchived:
+		return 403
+	case errTransferRefused:
+		return 422
+	}
+	return 500
+}
+
+// refuseRepo answers an LFS API request that its repository doesn't allow.
+func refuseRepo(w http.ResponseWriter, r *http.Request, err error) {
+	status := repoStatus(err)
+	w.Header().Set("Content-Type", metaMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+	logRequest(r, status)
+}
+
+// uploadTransfer picks the transfer adapter of a batch upload to repo: the
+// first one offered that the server supports and the repository allows, or
+// else basic if the repository allows it.
+func uploadTransfer(offered []string, repo *Repository) (string, error) {
+	for _, t := range offered {
+		if !contains(transferAdapters, t) || (t == "tus" && !Config.IsUsingTus()) {
+			continue
+		}
+		if repo == nil || repo.AllowsTransfer(t) {
+			return t, nil
+		}
+	}
+	if repo == nil || repo.AllowsTransfer("basic") {
+		return "basic", nil
+	}
+	return "", errTransferRefused
+}
+
+// checkBasicUpload returns an error if r may not upload to its repository
+// with the basic transfer adapter.
+func (a *App) checkBasicUpload(r *http.Request) error {
+	vars := mux.Vars(r)
+	repo, err := a.repoForWrite(vars["user"], vars["repo"], requestUser(r))
+	if err == nil && repo != nil && !repo.AllowsTransfer("basic") {
+		err = errTransferRefused
+	}
+	return err
+}
+
+// requestRepo returns the repository of r. It returns a nil repository for
+// requests outside a repository. Unknown repositories are returned as they
+// would be created, owned by the {user} segment with the default visibility,
+// when they are created automatically; otherwise they, and repositories
+// requested through another owner, give errRepoNotFound.
+func (a *App) requestRepo(r *http.Request) (*Repository, error) {
+	vars := mux.Vars(r)
+	if vars["repo"] == "" {
+		return nil, nil
+	}
+
+	repo, err := a.metaStore.Repository(vars["repo"])
+	if err == errRepoNotFound && Config.IsAutoCreatingRepos() {
+		return &Repository{Name: vars["repo"], Owner: vars["user"], Visibility: defaultVisibility()}, nil
+	}
+	if err == nil && repo.Owner != "" && repo.Owner != vars["user"] {
+		return nil, errRepoNotFound
+	}
+	return repo, err
+}
+
+// batchAccess returns the access the batch request r needs, reading its
+// operation without consuming the body.
+func batchAccess(r *http.Request) string {
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var bv BatchVars
+	if err == nil && json.Unmarshal(body, &bv) == nil && bv.Operation == "download" {
+		return accessDownload
+	}
+	return accessWrite
+}
+
+// canDownload reports whether the user of r may download meta through the
+// repository of r. Objects are shared by every repository, so one is only
+// served through the repositories it was pushed to, or to users who may
+// download it from one of them. Objects that no repository is known to hold,
+// such as those stored before repositories were tracked, follow the default
+// visibility.
+func (a *App) canDownload(r *http.Request, meta *MetaObject) bool {
+	charges, err := a.metaStore.ChargesOf(meta.Oid)
+	if err != nil {
+		logger.Log(kv{"fn": "canDownload", "err": err.Error()})
+		return false
+	}
+
+	name, user := mux.Vars(r)["repo"], requestUser(r)
+	held := false
+	for _, c := range charges {
+		if !c.Confirmed {
+			continue
+		}
+		held = true
+		if c.Repo == name {
+			return true
+		}
+
+		repo, err := a.metaStore.Repository(c.Repo)
+		if err == errRepoNotFound {
+			repo, err = nil, nil
+		}
+		if err != nil {
+			logger.Log(kv{"fn": "canDownload", "err": err.Error()})
+			continue
+		}
+		if repoAllows(repo, user, accessDownload) {
+			return true
+		}
+	}
+	return !held && repoAllows(nil, user, accessDownload)
+}
+
+// migrateRepositories registers the repositories that existing locks, lock
+// history, lock policies, quotas, storage accounting and objects refer to.
+func migrateRepositories(tx *bolt.Tx) error {
+	names := make(map[string]bool)
+	collectKeys := func(bucket []byte, prefix string) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(string(k), prefix) {
+				names[strings.TrimPrefix(string(k), prefix)] = true
+			}
+			return nil
+		})
+	}
+	for _, b := range [][]byte{locksBucket, lockHistoryBucket, lockPoliciesBucket} {
+		if err := collectKeys(b, ""); err != nil {
+			return err
+		}
+	}
+	for _, b := range [][]byte{quotasBucket, usageBucket} {
+		if err := collectKeys(b, quotaRepo+":"); err != nil {
+			return err
+		}
+	}
+
+	err := tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+		meta, err := decodeObject(v)
+		if err != nil {
+			return err
+		}
+		names[meta.Repo] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for name := range names {
+		if name == "" || tx.Bucket(reposBucket).Get([]byte(name)) != nil {
+			continue
+		}
+		if err := putRepository(tx, &Repository{Name: name, Visibility: defaultVisibility(), CreatedAt: now}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRepositories(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.CreateRepository(&Repository{Name: "game"}); err != nil {
+		t.Fatalf("expected CreateRepository to succeed, got: %s", err)
+	}
+	if err := metaStoreTest.CreateRepository(&Repository{Name: "game"}); err != errRepoExists {
+		t.Errorf("expected errRepoExists, got %v", err)
+	}
+	for _, r := range []*Repository{{Name: "a/b"}, {Name: ".."}, {Name: "art", Visibility: "secret"}, {Name: "art", Transfers: []string{"ftp"}}} {
+		if err := metaStoreTest.CreateRepository(r); err == nil {
+			t.Errorf("expected %+v to be invalid", r)
+		}
+	}
+
+	repo, err := metaStoreTest.Repository("game")
+	if err != nil || repo.Visibility != visibilityInternal || repo.CreatedAt.IsZero() {
+		t.Fatalf("expected an internal repository, got %+v, %v", repo, err)
+	}
+	if _, err := metaStoreTest.UpdateRepository("game", visibilityPublic, []string{"tus"}); err != nil {
+		t.Fatalf("expected UpdateRepository to succeed, got: %s", err)
+	}
+
+	if err := metaStoreTest.AddLocks("game", Lock{Id: "game-lock", Path: "hero.psd", Owner: User{Name: testUser}, LockedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.SetLockPolicy(&LockPolicy{Repo: "game", MaxLocksPerUser: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.SetQuota(quotaRepo, "game", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: "gameoid", Size: 10, Repo: "game"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.Reserve("gameoid", "game", testUser, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.RecordUpload("gameoid", "game", testUser, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := metaStoreTest.RenameRepository("game", "game2"); err != nil {
+		t.Fatalf("expected RenameRepository to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.Repository("game"); err != errRepoNotFound {
+		t.Errorf("expected the old name to be gone, got %v", err)
+	}
+	repo, _ = metaStoreTest.Repository("game2")
+	if repo == nil || repo.Visibility != visibilityPublic || !repo.AllowsTransfer("tus") || repo.AllowsTransfer("basic") {
+		t.Errorf("expected the settings to be kept, got %+v", repo)
+	}
+	if locks, _ := metaStoreTest.SelectLocks(LockSelection{Repo: "game2"}); len(locks) != 1 || locks[0].Lock.Id != "game-lock" {
+		t.Errorf("expected the lock to move, got %v", locks)
+	}
+	if policy, _ := metaStoreTest.LockPolicy("game2"); policy == nil || policy.Repo != "game2" || policy.MaxLocksPerUser != 3 {
+		t.Errorf("expected the lock policy to move, got %+v", policy)
+	}
+	if usage, _ := metaStoreTest.Usage(quotaRepo, "game2"); usage.Objects != 1 || usage.Bytes != 10 || usage.Quota != 1000 {
+		t.Errorf("expected the usage and quota to move, got %+v", usage)
+	}
+	if charges, _ := metaStoreTest.ChargesOf("gameoid"); len(charges) != 1 || charges[0].Repo != "game2" || !charges[0].Confirmed {
+		t.Errorf("expected the charge to move, got %+v", charges)
+	}
+	if meta, _ := metaStoreTest.UnsafeGet(&RequestVars{Oid: "gameoid"}); meta == nil || meta.Repo != "game2" {
+		t.Errorf("expected the object to move, got %+v", meta)
+	}
+
+	if err := metaStoreTest.DeleteRepository("game2"); err != errRepoNotEmpty {
+		t.Errorf("expected errRepoNotEmpty, got %v", err)
+	}
+	metaStoreTest.db.Update(func(tx *bolt.Tx) error { return refund(tx, "gameoid") })
+	if err := metaStoreTest.DeleteRepository("game2"); err != nil {
+		t.Fatalf("expected DeleteRepository to succeed, got: %s", err)
+	}
+	if locks, _ := metaStoreTest.SelectLocks(LockSelection{Repo: "game2"}); len(locks) != 0 {
+		t.Errorf("expected the locks to be deleted, got %v", locks)
+	}
+
+	metaStoreTest.CreateRepository(&Repository{Name: "secret", Visibility: visibilityPrivate})
+	if _, err := metaStoreTest.GrantRepository("secret", "nobody", accessRead); err != errUserNotFound {
+		t.Errorf("expected errUserNotFound, got %v", err)
+	}
+	metaStoreTest.AddUser(testUser, testPass)
+	if _, err := metaStoreTest.GrantRepository("secret", testUser, "admin"); err == nil {
+		t.Errorf("expected an invalid access to be refused")
+	}
+	if _, err := metaStoreTest.GrantRepository("secret", testUser, accessRead); err != nil {
+		t.Fatalf("expected GrantRepository to succeed, got: %s", err)
+	}
+	if err := metaStoreTest.DeleteUser(testUser); err != nil {
+		t.Fatal(err)
+	}
+	if repo, _ := metaStoreTest.Repository("secret"); len(repo.Grants) != 0 {
+		t.Errorf("expected deleting the user to revoke their access, got %v", repo.Grants)
+	}
+
+	if err := metaStoreTest.AddLocks("legacy", Lock{Id: "legacy-lock", Path: "a.psd", Owner: User{Name: testUser}, LockedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStoreTest.db.Update(migrateRepositories); err != nil {
+		t.Fatalf("expected migrateRepositories to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.Repository("legacy"); err != nil {
+		t.Errorf("expected the migration to register the repository, got %v", err)
+	}
+}
+
+func TestAdminAPIRepos(t *testing.T) {
+	if status := adminAPI(t, "GET", "/repos/apirepo", "", nil); status != 404 {
+		t.Fatalf("expected status 404 for an unknown repository, got %d", status)
+	}
+	if status := adminAPI(t, "POST", "/repos", `{"name":"apirepo","visibility":"everyone"}`, nil); status != 422 {
+		t.Errorf("expected status 422 for an invalid visibility, got %d", status)
+	}
+	if status := adminAPI(t, "POST", "/repos", `{"name":"apirepo","owner":"a/b"}`, nil); status != 422 {
+		t.Errorf("expected status 422 for an invalid owner, got %d", status)
+	}
+
+	var repo AdminRepo
+	if status := adminAPI(t, "POST", "/repos", `{"name":"apirepo","owner":"bilbo","visibility":"private"}`, &repo); status != 201 {
+		t.Fatalf("expected status 201, got %d", status)
+	}
+	if repo.Repository == nil || repo.Name != "apirepo" || repo.Owner != testUser || repo.Visibility != visibilityPrivate || repo.CreatedBy != testAdminUser {
+		t.Errorf("expected the new repository, got %+v", repo.Repository)
+	}
+	if status := adminAPI(t, "POST", "/repos", `{"name":"apirepo"}`, nil); status != 409 {
+		t.Errorf("expected status 409 for an existing repository, got %d", status)
+	}
+
+	if status := adminAPI(t, "PUT", "/repos/apirepo", `{"visibility":"internal","transfers":["tus"]}`, &repo); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	res, err := api("POST", "/bilbo/apirepo/objects/batch", metaMediaType, testUser, testPass, bytes.NewBufferString(`{"operation":"upload","objects":[{"oid":"apirepooid","size":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 422 {
+		t.Errorf("expected status 422 for a refused transfer adapter, got %d", res.StatusCode)
+	}
+
+	if status := adminAPI(t, "PUT", "/repos/apirepo/lockpolicy", `{"max_locks_per_user":2}`, &repo); status != 200 || repo.LockPolicy == nil {
+		t.Fatalf("expected the lock policy to be set, got %d", status)
+	}
+	if status := adminAPI(t, "PUT", "/repos/apirepo/archived", `{"archived":true}`, &repo); status != 200 || !repo.Archived {
+		t.Fatalf("expected the repository to be archived, got %d", status)
+	}
+	if _, err := createRefLock("/bilbo/apirepo/locks", "a.psd", ""); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected locking in an archived repository to be refused, got %v", err)
+	}
+	adminAPI(t, "PUT", "/repos/apirepo/archived", `{"archived":false}`, nil)
+
+	if status := adminAPI(t, "POST", "/repos/apirepo/rename", `{"name":"apirepo2"}`, &repo); status != 200 || repo.Name != "apirepo2" || repo.LockPolicy == nil {
+		t.Fatalf("expected the repository to be renamed with its lock policy, got %d", status)
+	}
+	if status := adminAPI(t, "DELETE", "/repos/apirepo2", "", nil); status != 204 {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+
+	entries, _, err := testMetaStore.AuditLog(AuditFilter{Repo: "apirepo"}, auditPageSize)
+	if err != nil || len(entries) < 5 {
+		t.Errorf("expected the changes to be audited, got %d: %v", len(entries), err)
+	}
+}
+
+func TestRepoAllows(t *testing.T) {
+	private := &Repository{Visibility: visibilityPrivate, Grants: map[string]string{"reader": accessRead, "writer": accessWrite}}
+	public := &Repository{Visibility: visibilityPublic, Owner: "owner", Grants: map[string]string{"writer": accessWrite}}
+	tests := []struct {
+		repo   *Repository
+		user   string
+		access string
+		want   bool
+	}{
+		{public, "", accessDownload, true},
+		{public, "", accessRead, false},
+		{public, "", accessWrite, false},
+		{public, "anyone", accessRead, true},
+		{public, "anyone", accessWrite, false},
+		{public, "owner", accessWrite, true},
+		{public, "writer", accessWrite, true},
+		{&Repository{Visibility: visibilityInternal}, "anyone", accessWrite, false},
+		{&Repository{Visibility: visibilityPrivate, Owner: "owner"}, "owner", accessWrite, true},
+		{nil, "", accessDownload, false},
+		{nil, "anyone", accessWrite, true},
+		{&Repository{Visibility: visibilityInternal}, "anyone", accessDownload, true},
+		{private, "anyone", accessDownload, false},
+		{private, "reader", accessRead, true},
+		{private, "reader", accessWrite, false},
+		{private, "writer", accessWrite, true},
+		{private, "", accessDownload, false},
+	}
+	for _, test := range tests {
+		if got := repoAllows(test.repo, test.user, test.access); got != test.want {
+			t.Errorf("expected %q %s access to %+v to be %v", test.user, test.access, test.repo, test.want)
+		}
+	}
+}
+
+func TestRepoVisibility(t *testing.T) {
+	status := func(method, path, accept, user, pass, body string) int {
+		res, err := api(method, path, accept, user, pass, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	download := `{"operation":"download","objects":[{"oid":"` + contentOid + `","size":1}]}`
+	uploadOid := strings.Repeat("ab", 32)
+	upload := `{"operation":"upload","objects":[{"oid":"` + uploadOid + `","size":1}]}`
+
+	adminAPI(t, "POST", "/repos", `{"name":"pubrepo","owner":"bilbo","visibility":"public"}`, nil)
+	adminAPI(t, "POST", "/repos", `{"name":"privrepo","visibility":"private"}`, nil)
+	defer adminAPI(t, "DELETE", "/repos/privrepo", "", nil)
+	defer testMetaStore.Delete(&RequestVars{Oid: uploadOid})
+
+	// Push the seeded object to the public repository.
+	if _, err := batchUpload("/bilbo/pubrepo/objects/batch", contentOid, contentSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// Visibility only opens reading: other users need a write grant to upload.
+	if s := status("POST", "/bilbo/pubrepo/objects/batch", metaMediaType, testUser1, testPass1, upload); s != 403 {
+		t.Errorf("expected uploads by users other than the owner to be refused, got %d", s)
+	}
+	adminAPI(t, "PUT", "/repos/pubrepo/grants/"+testUser1, `{"access":"write"}`, nil)
+	if s := status("POST", "/bilbo/pubrepo/objects/batch", metaMediaType, testUser1, testPass1, upload); s != 200 {
+		t.Errorf("expected a write grant to allow uploads, got %d", s)
+	}
+
+	if s := status("GET", "/bilbo/pubrepo/objects/"+contentOid, contentMediaType, "", "", ""); s != 200 {
+		t.Errorf("expected anonymous downloads from a public repository, got %d", s)
+	}
+	if s := status("POST", "/bilbo/pubrepo/objects/batch", metaMediaType, "", "", download); s != 200 {
+		t.Errorf("expected anonymous batch downloads from a public repository, got %d", s)
+	}
+	for _, req := range [][]string{{"POST", "/bilbo/pubrepo/objects/batch", upload}, {"GET", "/bilbo/pubrepo/locks", ""}, {"POST", "/bilbo/pubrepo/locks", `{"path":"a.psd"}`}, {"GET", "/bilbo/repo/objects/" + contentOid, ""}} {
+		if s := status(req[0], req[1], metaMediaType, "", "", req[2]); s != 401 {
+			t.Errorf("expected anonymous %s %s to need credentials, got %d", req[0], req[1], s)
+		}
+	}
+
+	if s := status("GET", "/bilbo/privrepo/objects/"+contentOid, contentMediaType, testUser, testPass, ""); s != 404 {
+		t.Errorf("expected a private repository to be hidden, got %d", s)
+	}
+	if s := adminAPI(t, "PUT", "/repos/privrepo/grants/"+testUser, `{"access":"read"}`, nil); s != 200 {
+		t.Fatalf("expected granting access to succeed, got %d", s)
+	}
+	if s := status("GET", "/bilbo/privrepo/objects/"+contentOid, contentMediaType, testUser, testPass, ""); s != 200 {
+		t.Errorf("expected a read grant to allow downloads, got %d", s)
+	}
+	if s := status("GET", "/bilbo/privrepo/locks", metaMediaType, testUser, testPass, ""); s != 200 {
+		t.Errorf("expected a read grant to allow listing locks, got %d", s)
+	}
+	if s := status("POST", "/bilbo/privrepo/objects/batch", metaMediaType, testUser, testPass, upload); s != 403 {
+		t.Errorf("expected a read grant to refuse uploads, got %d", s)
+	}
+	var repo AdminRepo
+	if s := adminAPI(t, "PUT", "/repos/privrepo/grants/"+testUser, `{"access":"write"}`, &repo); s != 200 || repo.Grants[testUser] != accessWrite {
+		t.Fatalf("expected the grant to be updated, got %d", s)
+	}
+	if s := status("POST", "/bilbo/privrepo/objects/batch", metaMediaType, testUser, testPass, upload); s != 200 {
+		t.Errorf("expected a write grant to allow uploads, got %d", s)
+	}
+	if s := status("GET", "/bilbo/privrepo/locks", metaMediaType, testUser1, testPass1, ""); s != 404 {
+		t.Errorf("expected users without a grant not to see the repository, got %d", s)
+	}
+
+	// An object only pushed to the private repository can't be read
+	// through another one by users who can't read it there.
+	data := "private content"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	meta, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testContentStore.Put(meta, bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+	defer testMetaStore.Delete(&RequestVars{Oid: oid})
+	if err := testMetaStore.ChargeStored(oid, "privrepo", testUser, meta.Size); err != nil {
+		t.Fatal(err)
+	}
+	if s := status("GET", "/bilbo/pubrepo/objects/"+oid, contentMediaType, "", "", ""); s != 404 {
+		t.Errorf("expected a private object to be hidden from anonymous users, got %d", s)
+	}
+	if s := status("GET", "/bilbo/repo/objects/"+oid, metaMediaType, testUser1, testPass1, ""); s != 404 {
+		t.Errorf("expected a private object to be hidden from users without a grant, got %d", s)
+	}
+	if s := status("GET", "/bilbo/repo/objects/"+oid, contentMediaType, testUser, testPass, ""); s != 200 {
+		t.Errorf("expected a private object to be readable by users with a grant, got %d", s)
+	}
+
+	var revoked AdminRepo
+	if s := adminAPI(t, "DELETE", "/repos/privrepo/grants/"+testUser, "", &revoked); s != 200 || len(revoked.Grants) != 0 {
+		t.Errorf("expected revoking access to succeed, got %d", s)
+	}
+}
+
+func TestRepoSharedObject(t *testing.T) {
+	status := func(method, path, accept, user, pass, body string) int {
+		res, err := api(method, path, accept, user, pass, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	put := func(data string) *MetaObject {
+		sum := sha256.Sum256([]byte(data))
+		meta, err := testMetaStore.Put(&RequestVars{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testContentStore.Put(meta, bytes.NewBufferString(data)); err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	adminAPI(t, "POST", "/repos", `{"name":"shared-a","visibility":"private"}`, nil)
+	adminAPI(t, "POST", "/repos", `{"name":"shared-b","visibility":"private"}`, nil)
+	defer adminAPI(t, "DELETE", "/repos/shared-a", "", nil)
+	defer adminAPI(t, "DELETE", "/repos/shared-b", "", nil)
+	adminAPI(t, "PUT", "/repos/shared-a/grants/"+testUser, `{"access":"write"}`, nil)
+	adminAPI(t, "PUT", "/repos/shared-b/grants/"+testUser1, `{"access":"write"}`, nil)
+	if err := testMetaStore.AddUser("bilbo2", "baggins2"); err != nil {
+		t.Fatal(err)
+	}
+	defer testMetaStore.DeleteUser("bilbo2")
+
+	// The object is pushed to shared-a first; pushing it to shared-b
+	// afterwards is deduplicated but still records the reference.
+	meta := put("shared content")
+	defer testMetaStore.Delete(&RequestVars{Oid: meta.Oid})
+	if err := testMetaStore.ChargeStored(meta.Oid, "shared-a", testUser, meta.Size); err != nil {
+		t.Fatal(err)
+	}
+	upload := fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d}]}`, meta.Oid, meta.Size)
+	if s := status("POST", "/bilbo/shared-b/objects/batch", metaMediaType, testUser1, testPass1, upload); s != 200 {
+		t.Fatalf("expected a deduplicated upload to succeed, got %d", s)
+	}
+	if charges, err := testMetaStore.ChargesOf(meta.Oid); err != nil || len(charges) != 2 {
+		t.Fatalf("expected the object to be charged to both repositories, got %d charges (%v)", len(charges), err)
+	}
+
+	tests := []struct {
+		user, pass, repo string
+		want             int
+	}{
+		{testUser, testPass, "shared-a", 200},
+		{testUser, testPass, "shared-b", 404},
+		{testUser, testPass, "repo", 200},
+		{testUser1, testPass1, "shared-b", 200},
+		{testUser1, testPass1, "shared-a", 404},
+		{testUser1, testPass1, "repo", 200},
+		{"bilbo2", "baggins2", "repo", 404},
+	}
+	for _, test := range tests {
+		if s := status("GET", "/bilbo/"+test.repo+"/objects/"+meta.Oid, contentMediaType, test.user, test.pass, ""); s != test.want {
+			t.Errorf("expected %s downloading through %s to get %d, got %d", test.user, test.repo, test.want, s)
+		}
+	}
+
+	// Objects with no known repository follow the default visibility.
+	orphan := put("orphaned content")
+	defer testMetaStore.Delete(&RequestVars{Oid: orphan.Oid})
+	for _, path := range []string{"/objects/" + orphan.Oid, "/bilbo/repo/objects/" + orphan.Oid} {
+		if s := status("GET", path, contentMediaType, "bilbo2", "baggins2", ""); s != 200 {
+			t.Errorf("expected %s to be served to authenticated users, got %d", path, s)
+		}
+	}
+}
+
+func TestRepoPublicDefault(t *testing.T) {
+	defer func(public string) { Config.Public = public }(Config.Public)
+	Config.Public = "true"
+
+	status := func(method, path, accept, body string) int {
+		res, err := api(method, path, accept, "", "", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if err := testMetaStore.ChargeStored(contentOid, "publicdefault", testUser, contentSize); err != nil {
+		t.Fatal(err)
+	}
+	if s := status("GET", "/bilbo/publicdefault/objects/"+contentOid, contentMediaType, ""); s != 200 {
+		t.Errorf("expected anonymous downloads from an unregistered repository, got %d", s)
+	}
+	if s := status("PUT", "/bilbo/publicdefault/objects/"+contentOid, contentMediaType, content); s != 401 {
+		t.Errorf("expected anonymous uploads to need credentials, got %d", s)
+	}
+	if s := status("POST", "/bilbo/publicdefault/locks", metaMediaType, `{"path":"a.psd"}`); s != 401 {
+		t.Errorf("expected anonymous locks to need credentials, got %d", s)
+	}
+	if s := status("POST", "/bilbo/"+testRepo+"/locks/"+lockId+"/unlock", metaMediaType, `{}`); s != 401 {
+		t.Errorf("expected anonymous unlocks to need credentials, got %d", s)
+	}
+
+	if _, err := createRefLock("/bilbo/publicdefault/locks", "a.psd", ""); err != nil {
+		t.Fatal(err)
+	}
+	if repo, err := testMetaStore.Repository("publicdefault"); err != nil || repo.Visibility != visibilityPublic {
+		t.Errorf("expected the repository to be created public, got %+v, %v", repo, err)
+	}
+}
+
+func TestRepoAutoCreate(t *testing.T) {
+	if _, err := createRefLock("/bilbo/autorepo/locks", "a.psd", ""); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := testMetaStore.Repository("autorepo")
+	if err != nil || repo.CreatedBy != testUser || repo.Owner != testUser {
+		t.Fatalf("expected locking to create the repository, got %+v, %v", repo, err)
+	}
+	if _, err := listLocks("/other/autorepo/locks"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the repository to be hidden under another owner, got %v", err)
+	}
+
+	defer func(auto string) { Config.AutoCreateRepos = auto }(Config.AutoCreateRepos)
+	Config.AutoCreateRepos = "false"
+
+	if _, err := listLocks("/bilbo/autorepo/locks"); err != nil {
+		t.Errorf("expected a known repository to be served, got %v", err)
+	}
+	res, err := api("GET", "/bilbo/norepo/locks", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected status 404 for an unknown repository, got %d", res.StatusCode)
+	}
+	if _, err := testMetaStore.Repository("norepo"); err != errRepoNotFound {
+		t.Errorf("expected the repository not to be created, got %v", err)
+	}
+}
+
+func TestMgmtRepos(t *testing.T) {
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos", url.Values{"name": {"mgmtrepo"}, "visibility": {"public"}}); status != 302 {
+		t.Fatalf("expected a redirect after creating, got %d", status)
+	}
+	status, body := mgmtRequest(t, "GET", "/mgmt/repos", nil)
+	if status != 200 || !strings.Contains(body, `href="/mgmt/repos/mgmtrepo"`) {
+		t.Fatalf("expected the repository to be listed, got %d", status)
+	}
+
+	form := url.Values{"repo": {"mgmtrepo"}, "visibility": {"private"}, "transfers": {"basic"}, "quota": {"1G"}}
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/update", form); status != 302 {
+		t.Fatalf("expected a redirect after updating, got %d", status)
+	}
+	status, body = mgmtRequest(t, "GET", "/mgmt/repos/mgmtrepo", nil)
+	if status != 200 || !strings.Contains(body, "1.0 GiB") || !strings.Contains(body, `value="private" selected`) {
+		t.Fatalf("expected the settings to be shown, got %d", status)
+	}
+
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/grant", url.Values{"repo": {"mgmtrepo"}, "user": {testUser}, "access": {"write"}}); status != 302 {
+		t.Fatalf("expected a redirect after granting access, got %d", status)
+	}
+	status, body = mgmtRequest(t, "GET", "/mgmt/repos/mgmtrepo", nil)
+	if status != 200 || !strings.Contains(body, testUser+" (write)") {
+		t.Fatalf("expected the grant to be shown, got %d", status)
+	}
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/revoke", url.Values{"repo": {"mgmtrepo"}, "user": {testUser}}); status != 302 {
+		t.Fatalf("expected a redirect after revoking access, got %d", status)
+	}
+
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/rename", url.Values{"repo": {"mgmtrepo"}, "name": {"mgmtrepo2"}}); status != 302 {
+		t.Fatalf("expected a redirect after renaming, got %d", status)
+	}
+	if usage, _ := testMetaStore.Usage(quotaRepo, "mgmtrepo2"); usage.Quota != 1<<30 {
+		t.Errorf("expected the quota to move, got %d", usage.Quota)
+	}
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/del", url.Values{"repo": {"mgmtrepo2"}, "confirm": {"mgmtrepo"}}); status != 200 {
+		t.Errorf("expected an unconfirmed deletion to be refused, got %d", status)
+	}
+	if status, _ := mgmtRequest(t, "POST", "/mgmt/repos/del", url.Values{"repo": {"mgmtrepo2"}, "confirm": {"mgmtrepo2"}}); status != 302 {
+		t.Fatalf("expected a redirect after deleting, got %d", status)
+	}
+	if status, _ := mgmtRequest(t, "GET", "/mgmt/repos/mgmtrepo2", nil); status != 404 {
+		t.Errorf("expected status 404 for a deleted repository, got %d", status)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errLegalHold  = errors.New("Object is under legal hold")
+	errNotExpired = errors.New("Object is no longer expired")
+	errNoCharges  = errors.New("Object is not charged to any repository")
+)
+
+// RetentionRule expires objects stored in repositories whose name matches
+// Pattern. An object is expired when any of the enabled conditions holds.
+type RetentionRule struct {
+	Pattern    string `json:"pattern"`
+	UnusedDays int    `json:"unused_days,omitempty"`
+	MaxAgeDays int    `json:"max_age_days,omitempty"`
+	ExpireAll  bool   `json:"expire_all,omitempty"`
+}
+
+// Describe returns a short human readable summary of the rule.
+func (r *RetentionRule) Describe() string {
+	if r.ExpireAll {
+		return "expire everything"
+	}
+
+	s := ""
+	if r.UnusedDays > 0 {
+		s = fmt.Sprintf("not downloaded for %d days", r.UnusedDays)
+	}
+	if r.MaxAgeDays > 0 {
+		if s != "" {
+			s += " or "
+		}
+		s += fmt.Sprintf("older than %d days", r.MaxAgeDays)
+	}
+	return s
+}
+
+// expires reports whether meta, stored in repo, is expired by the rule at now,
+// and why.
+func (r *RetentionRule) expires(repo string, meta *MetaObject, now time.Time) (string, bool) {
+	if ok, _ := path.Match(r.Pattern, repo); !ok {
+		return "", false
+	}
+
+	if r.ExpireAll {
+		return fmt.Sprintf("repository matches %q", r.Pattern), true
+	}
+
+	if meta.CreatedAt.IsZero() {
+		// Objects stored before timestamps were recorded have an unknown age.
+		return "", false
+	}
+
+	if r.MaxAgeDays > 0 && now.Sub(meta.CreatedAt) > days(r.MaxAgeDays) {
+		return fmt.Sprintf("older than %d days", r.MaxAgeDays), true
+	}
+
+	if r.UnusedDays > 0 {
+		last := meta.LastDownload
+		if last.IsZero() {
+			last = meta.CreatedAt
+		}
+		if now.Sub(last) > days(r.UnusedDays) {
+			return fmt.Sprintf("not downloaded for %d days", r.UnusedDays), true
+		}
+	}
+
+	return "", false
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// Pin exempts an object from retention. Objects under legal hold also cannot
+// be deleted by other means.
+type Pin struct {
+	Oid       string    `json:"oid"`
+	LegalHold bool      `json:"legal_hold"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RetentionCandidate is an object selected for expiry, with the repositories
+// referencing it and why each of them expires it.
+type RetentionCandidate struct {
+	Oid     string
+	Size    int64
+	Repos   []string
+	Reasons []string
+}
+
+// RetentionReport describes a retention run. Uncharged lists the objects that
+// no repository is known to reference, which retention can't decide on.
+type RetentionReport struct {
+	Started    time.Time
+	DryRun     bool
+	Candidates []*RetentionCandidate
+	Uncharged  []string
+	Deleted    int
+	Bytes      int64
+	Errors     []string
+}
+
+// RetentionRules returns all retention rules sorted by pattern.
+func (s *MetaStore) RetentionRules() ([]*RetentionRule, error) {
+	var rules []*RetentionRule
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(retentionBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var rule RetentionRule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, &rule)
+			return nil
+		})
+	})
+	return rules, err
+}
+
+// SetRetentionRule adds or replaces the rule for rule.Pattern.
+func (s *MetaStore) SetRetentionRule(rule *RetentionRule) error {
+	if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+		return fmt.Errorf("Invalid repository pattern: %q", rule.Pattern)
+	}
+	if !rule.ExpireAll && rule.UnusedDays <= 0 && rule.MaxAgeDays <= 0 {
+		return errors.New("Retention rule has no expiry condition")
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(retentionBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put([]byte(rule.Pattern), data)
+	})
+}
+
+// DeleteRetentionRule removes the rule for pattern.
+func (s *MetaStore) DeleteRetentionRule(pattern string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(retentionBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Delete([]byte(pattern))
+	})
+}
+
+// Pins returns all pinned objects.
+func (s *MetaStore) Pins() ([]*Pin, error) {
+	var pins []*Pin
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pinsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var pin Pin
+			if err := json.Unmarshal(v, &pin); err != nil {
+				return err
+			}
+			pins = append(pins, &pin)
+			return nil
+		})
+	})
+	return pins, err
+}
+
+// Pin exempts an object from retention.
+func (s *MetaStore) Pin(pin *Pin) error {
+	if pin.CreatedAt.IsZero() {
+		pin.CreatedAt = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pinsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put([]byte(pin.Oid), data)
+	})
+}
+
+// Unpin removes the pin for oid.
+func (s *MetaStore) Unpin(oid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pinsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Delete([]byte(oid))
+	})
+}
+
+// PinOf returns the pin for oid, or nil if the object is not pinned.
+func (s *MetaStore) PinOf(oid string) (*Pin, error) {
+	var pin *Pin
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pinsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		data := bucket.Get([]byte(oid))
+		if data == nil {
+			return nil
+		}
+		pin = &Pin{}
+		return json.Unmarshal(data, pin)
+	})
+	return pin, err
+}
+
+// ExpiryCandidates returns the objects that the retention rules expire at now,
+// along with the unpinned objects that aren't charged to any repository.
+// Pinned objects are never selected, and an object referenced by several
+// repositories is only selected if the rules expire it from all of them.
+func (s *MetaStore) ExpiryCandidates(now time.Time) ([]*RetentionCandidate, []string, error) {
+	rules, err := s.RetentionRules()
+	if err != nil || len(rules) == 0 {
+		return nil, nil, err
+	}
+
+	var candidates []*RetentionCandidate
+	var uncharged []string
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+			meta, err := decodeObject(v)
+			if err != nil {
+				return err
+			}
+
+			c, err := expiryOf(tx, rules, meta, now)
+			if err == errNoCharges {
+				uncharged = append(uncharged, meta.Oid)
+				return nil
+			}
+			if err != nil || c == nil {
+				return err
+			}
+			candidates = append(candidates, c)
+			return nil
+		})
+	})
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Oid < candidates[j].Oid })
+	sort.Strings(uncharged)
+	return candidates, uncharged, err
+}
+
+// expiryOf returns the candidate for meta if rules expire it at now from every
+// repository it is charged to, or nil. Pinned objects are never expired, and
+// objects charged to no repository return errNoCharges.
+func expiryOf(tx *bolt.Tx, rules []*RetentionRule, meta *MetaObject, now time.Time) (*RetentionCandidate, error) {
+	if tx.Bucket(pinsBucket).Get([]byte(meta.Oid)) != nil {
+		return nil, nil
+	}
+
+	charges, err := chargesOf(tx, meta.Oid)
+	if err != nil {
+		return nil, err
+	}
+	if len(charges) == 0 {
+		return nil, errNoCharges
+	}
+
+	c := &RetentionCandidate{Oid: meta.Oid, Size: meta.Size}
+	for _, charge := range charges {
+		reason, ok := "", false
+		for _, rule := range rules {
+			if reason, ok = rule.expires(charge.Repo, meta, now); ok {
+				break
+			}
+		}
+		if !ok {
+			return nil, nil
+		}
+		c.Repos = append(c.Repos, charge.Repo)
+		c.Reasons = append(c.Reasons, reason)
+	}
+	return c, nil
+}
+
+// Expire removes the metadata of oid if rules still expire it at now from
+// every repository it is charged to, and returns errNotExpired otherwise.
+func (s *MetaStore) Expire(oid string, rules []*RetentionRule, now time.Time) (*MetaObject, error) {
+	var meta *MetaObject
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		value := tx.Bucket(objectsBucket).Get([]byte(oid))
+		if value == nil {
+			return errObjectNotFound
+		}
+
+		var err error
+		if meta, err = decodeObject(value); err != nil {
+			return err
+		}
+		c, err := expiryOf(tx, rules, meta, now)
+		if err == errNoCharges || (err == nil && c == nil) {
+			return errNotExpired
+		}
+		if err != nil {
+			return err
+		}
+		return removeObject(tx, oid)
+	})
+	return meta, err
+}
+
+// deleteObject removes an object's metadata and content. Objects under legal
+// hold are refused with errLegalHold.
+func (a *App) deleteObject(oid string) (*MetaObject, error) {
+	pin, err := a.metaStore.PinOf(oid)
+	if err != nil {
+		return nil, err
+	}
+	if pin != nil && pin.LegalHold {
+		return nil, errLegalHold
+	}
+
+	meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.metaStore.Delete(&RequestVars{Oid: oid}); err != nil {
+		return nil, err
+	}
+
+	return meta, a.contentStore.Delete(meta)
+}
+
+// RunRetention expires the objects selected by the retention rules. With
+// dryRun set, nothing is deleted and the report only lists the candidates.
+func (a *App) RunRetention(dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{Started: time.Now().UTC(), DryRun: dryRun}
+
+	candidates, uncharged, err := a.metaStore.ExpiryCandidates(report.Started)
+	if err != nil {
+		return nil, err
+	}
+	report.Candidates, report.Uncharged = candidates, uncharged
+
+	if !dryRun {
+		rules, err := a.metaStore.RetentionRules()
+		if err != nil {
+			return nil, err
+		}
+
+		// Candidates are checked again as they are deleted, since they may
+		// have been pushed to another repository in the meantime.
+		for _, c := range candidates {
+			meta, err := a.metaStore.Expire(c.Oid, rules, report.Started)
+			if err == nil {
+				err = a.contentStore.Delete(meta)
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", c.Oid, err))
+				continue
+			}
+			report.Deleted++
+			report.Bytes += c.Size
+		}
+
+		a.retentionMu.Lock()
+		a.lastRetention = report
+		a.retentionMu.Unlock()
+	}
+
+	return report, nil
+}
+
+// LastRetention returns the report of the most recent retention run that
+// deleted objects, or nil.
+func (a *App) LastRetention() *RetentionReport {
+	a.retentionMu.Lock()
+	defer a.retentionMu.Unlock()
+	return a.lastRetention
+}
+
+// retentionLoop runs retention every interval.
+func (a *App) retentionLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := a.RunRetention(false)
+		if err != nil {
+			logger.Log(kv{"fn": "retention", "err": err.Error()})
+			continue
+		}
+		logger.Log(kv{"fn": "retention", "msg": "expired objects", "deleted": report.Deleted, "bytes": report.Bytes, "uncharged": len(report.Uncharged), "errors": len(report.Errors)})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionRuleExpires(t *testing.T) {
+	now := time.Now()
+	meta := &MetaObject{
+		Oid:          contentOid,
+		CreatedAt:    now.Add(-10 * 24 * time.Hour),
+		LastDownload: now.Add(-2 * 24 * time.Hour),
+	}
+
+	rule := &RetentionRule{Pattern: "ci-*", UnusedDays: 5}
+	if _, ok := rule.expires("ci-1", meta, now); ok {
+		t.Errorf("expected recently downloaded object to be kept")
+	}
+
+	rule.MaxAgeDays = 7
+	if _, ok := rule.expires("ci-1", meta, now); !ok {
+		t.Errorf("expected old object to expire")
+	}
+
+	if _, ok := rule.expires("release", meta, now); ok {
+		t.Errorf("expected rule to only apply to matching repositories")
+	}
+}
+
+func TestRunRetention(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+	setup()
+	defer teardown()
+
+	app := &App{metaStore: metaStoreTest, contentStore: contentStore}
+
+	expired := &MetaObject{Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72", Size: 12}
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: expired.Oid, Size: expired.Size}); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if err := contentStore.Put(expired, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	// The seeded content object lives in the same repo but is pinned.
+	for _, oid := range []string{expired.Oid, contentOid} {
+		if err := metaStoreTest.Reserve(oid, "ci-1", testUser, 12); err != nil {
+			t.Fatalf("expected Reserve to succeed, got: %s", err)
+		}
+	}
+	if err := metaStoreTest.Pin(&Pin{Oid: contentOid}); err != nil {
+		t.Fatalf("expected Pin to succeed, got: %s", err)
+	}
+
+	if err := metaStoreTest.SetRetentionRule(&RetentionRule{Pattern: "ci-*", ExpireAll: true}); err != nil {
+		t.Fatalf("expected SetRetentionRule to succeed, got: %s", err)
+	}
+
+	report, err := app.RunRetention(true)
+	if err != nil {
+		t.Fatalf("expected dry run to succeed, got: %s", err)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].Oid != expired.Oid {
+		t.Fatalf("expected only the unpinned object to be selected, got: %+v", report.Candidates)
+	}
+	if !contentStore.Exists(expired) {
+		t.Fatalf("expected dry run to not delete content")
+	}
+
+	report, err = app.RunRetention(false)
+	if err != nil {
+		t.Fatalf("expected run to succeed, got: %s", err)
+	}
+	if report.Deleted != 1 {
+		t.Fatalf("expected 1 object deleted, got: %d", report.Deleted)
+	}
+	if contentStore.Exists(expired) {
+		t.Errorf("expected content to be deleted")
+	}
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: expired.Oid}); err == nil {
+		t.Errorf("expected meta to be deleted")
+	}
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: contentOid}); err != nil {
+		t.Errorf("expected pinned object to be kept, got: %s", err)
+	}
+}
+
+func TestRetentionSharedObjects(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	app := &App{metaStore: metaStoreTest, contentStore: contentStore}
+
+	shared := strings.Repeat("1", 64)
+	uncharged := strings.Repeat("2", 64)
+	for _, oid := range []string{shared, uncharged} {
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: oid, Size: 12}); err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+	}
+	if err := metaStoreTest.ChargeStored(shared, "ci-1", testUser, 12); err != nil {
+		t.Fatalf("expected ChargeStored to succeed, got: %s", err)
+	}
+	if err := metaStoreTest.SetRetentionRule(&RetentionRule{Pattern: "ci-*", ExpireAll: true}); err != nil {
+		t.Fatalf("expected SetRetentionRule to succeed, got: %s", err)
+	}
+
+	report, err := app.RunRetention(true)
+	if err != nil {
+		t.Fatalf("expected dry run to succeed, got: %s", err)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].Oid != shared {
+		t.Fatalf("expected the object only charged to ci-1 to be selected, got: %+v", report.Candidates)
+	}
+	if i := sort.SearchStrings(report.Uncharged, uncharged); i == len(report.Uncharged) || report.Uncharged[i] != uncharged {
+		t.Errorf("expected the uncharged object to be reported, got: %v", report.Uncharged)
+	}
+
+	// Pushing the object to a repository the rules don't expire keeps it,
+	// even once it has been selected.
+	if err := metaStoreTest.ChargeStored(shared, "release", testUser, 12); err != nil {
+		t.Fatalf("expected ChargeStored to succeed, got: %s", err)
+	}
+	rules, err := metaStoreTest.RetentionRules()
+	if err != nil {
+		t.Fatalf("expected RetentionRules to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.Expire(shared, rules, time.Now()); err != errNotExpired {
+		t.Errorf("expected a shared object not to be expired, got: %v", err)
+	}
+
+	report, err = app.RunRetention(false)
+	if err != nil {
+		t.Fatalf("expected run to succeed, got: %s", err)
+	}
+	if len(report.Candidates) != 0 || report.Deleted != 0 {
+		t.Errorf("expected nothing to be deleted, got: %+v", report)
+	}
+	for _, oid := range []string{shared, uncharged} {
+		if _, err := metaStoreTest.UnsafeGet(&RequestVars{Oid: oid}); err != nil {
+			t.Errorf("expected %s to be kept, got: %s", oid, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -10,9 +11,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 )
 
@@ -35,9 +36,15 @@ type BatchVars struct {
 
 // MetaObject is object metadata as seen by the object and metadata stores.
 type MetaObject struct {
-	Oid      string `json:"oid"`
-	Size     int64  `json:"size"`
-	Existing bool
+	Oid          string    `json:"oid"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+	Repo         string    `json:"repo"`
+	Uploader     string    `json:"uploader"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+	LastDownload time.Time `json:"last_download"`
+	Downloads    int64     `json:"downloads"`
+	Existing     bool      `json:"-"`
 }
 
 type BatchResponse struct {
@@ -62,15 +69,37 @@ type User struct {
 	Name string `json:"name"`
 }
 
+// Ref is the server ref a lock belongs to, e.g. "refs/heads/main".
+type Ref struct {
+	Name string `json:"name"`
+}
+
 type Lock struct {
-	Id       string    `json:"id"`
-	Path     string    `json:"path"`
-	Owner    User      `json:"owner"`
-	LockedAt time.Time `json:"locked_at"`
+	Id        string     `json:"id"`
+	Path      string     `json:"path"`
+	Owner     User       `json:"owner"`
+	LockedAt  time.Time  `json:"locked_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Ref       *Ref       `json:"ref,omitempty"`
+}
+
+// RefName returns the name of the ref the lock is bound to, or "" if the lock
+// applies to every ref.
+func (l *Lock) RefName() string {
+	if l.Ref == nil {
+		return ""
+	}
+	return l.Ref.Name
+}
+
+// Expired reports whether the lock has expired at now.
+func (l *Lock) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
 }
 
 type LockRequest struct {
 	Path string `json:"path"`
+	Ref  *Ref   `json:"ref,omitempty"`
 }
 
 type LockResponse struct {
@@ -82,6 +111,13 @@ type UnlockRequest struct {
 	Force bool `json:"force"`
 }
 
+// TransferLockRequest hands a lock to Owner. Force allows transferring
+// another user's lock.
+type TransferLockRequest struct {
+	Owner User `json:"owner"`
+	Force bool `json:"force"`
+}
+
 type UnlockResponse struct {
 	Lock    *Lock  `json:"lock"`
 	Message string `json:"message,omitempty"`
@@ -94,10 +130,23 @@ type LockList struct {
 }
 
 type VerifiableLockRequest struct {
+	Ref    *Ref   `json:"ref,omitempty"`
 	Cursor string `json:"cursor,omitempty"`
 	Limit  int    `json:"limit,omitempty"`
 }
 
+// LockCheckRequest lists the paths changed by a push to Ref by User.
+type LockCheckRequest struct {
+	Ref   *Ref     `json:"ref,omitempty"`
+	User  string   `json:"user,omitempty"`
+	Paths []string `json:"paths"`
+}
+
+type LockCheckResponse struct {
+	Conflicts []LockConflict `json:"conflicts"`
+	Message   string         `json:"message,omitempty"`
+}
+
 type VerifiableLockList struct {
 	Ours       []Lock `json:"ours"`
 	Theirs     []Lock `json:"theirs"`
@@ -142,10 +191,10 @@ func (v *RequestVars) tusLink() string {
 	return link
 }
 
+// VerifyLink builds a URL to verify a tus upload of the object, in the
+// repository it is uploaded to.
 func (v *RequestVars) VerifyLink() string {
-	path := fmt.Sprintf("/verify/%s", v.Oid)
-
-	return fmt.Sprintf("%s%s", Config.ExtOrigin, path)
+	return v.internalLink("verify")
 }
 
 // link provides a structure used to build a hypermedia representation of an HTTP link.
@@ -160,40 +209,65 @@ type App struct {
 	router       *mux.Router
 	contentStore *ContentStore
 	metaStore    *MetaStore
+
+	downloads *downloadRecorder
+	traffic   *trafficRecorder
+	webhooks  *webhookDispatcher
+	events    *eventHub
+
+	retentionMu   sync.Mutex
+	lastRetention *RetentionReport
+
+	sessionMu  sync.Mutex
+	sessionKey []byte
+	mgmt       *sessionArea
+	account    *sessionArea
 }
 
 // NewApp creates a new App using the ContentStore and MetaStore provided
 func NewApp(content *ContentStore, meta *MetaStore) *App {
 	app := &App{contentStore: content, metaStore: meta}
+	app.downloads = newDownloadRecorder(meta, downloadFlushInterval)
+	app.traffic = newTrafficRecorder(meta, trafficFlushInterval)
+	app.webhooks = newWebhookDispatcher(meta, webhookPollInterval)
+	app.events = newEventHub()
+	app.mgmt = newMgmtArea(app)
+	app.account = newAccountArea(app)
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/{user}/{repo}/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects/batch", app.requireAuth(accessBatch, app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
 	route := "/{user}/{repo}/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.requireAuth(accessDownload, app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.requireAuth(accessDownload, app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
+	r.HandleFunc(route, app.requireAuth(accessWrite, app.auditAPI("object.upload", app.PutHandler))).Methods("PUT").MatcherFunc(ContentMatcher)
 
-	r.HandleFunc("/{user}/{repo}/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects", app.requireAuth(accessWrite, app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.LocksHandler)).Methods("GET").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/verify", app.requireAuth(app.LocksVerifyHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.CreateLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.requireAuth(app.DeleteLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(accessRead, app.LocksHandler)).Methods("GET").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/verify", app.requireAuth(accessRead, app.LocksVerifyHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/check", app.requireAuth(accessRead, app.LocksCheckHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(accessWrite, app.auditAPI("lock.create", app.CreateLockHandler))).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.requireAuth(accessWrite, app.auditAPI("lock.unlock", app.DeleteLockHandler))).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/{id}/renew", app.requireAuth(accessWrite, app.auditAPI("lock.renew", app.RenewLockHandler))).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/{id}/transfer", app.requireAuth(accessWrite, app.auditAPI("lock.transfer", app.TransferLockHandler))).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/objects/batch", app.requireAuth(accessBatch, app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
 	route = "/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.requireAuth(accessDownload, app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.requireAuth(accessDownload, app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
+	r.HandleFunc(route, app.requireAuth(accessWrite, app.auditAPI("object.upload", app.PutHandler))).Methods("PUT").MatcherFunc(ContentMatcher)
 
-	r.HandleFunc("/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/objects", app.requireAuth(accessWrite, app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/verify/{oid}", app.VerifyHandler).Methods("POST")
+	r.HandleFunc("/{user}/{repo}/verify/{oid}", app.requireAuth(accessWrite, app.auditAPI("object.upload", app.VerifyHandler))).Methods("POST")
+	r.HandleFunc("/verify/{oid}", app.requireAuth(accessWrite, app.auditAPI("object.upload", app.VerifyHandler))).Methods("POST")
 
 	app.addMgmt(r)
+	app.addAccount(r)
+	app.addAdminAPI(r)
 
 	app.router = r
 
@@ -204,12 +278,21 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err == nil {
-		context.Set(r, "RequestID", fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+		id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
 	}
 
 	a.router.ServeHTTP(w, r)
 }
 
+type requestIDKey struct{}
+
+// requestID returns the id ServeHTTP assigned to r.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
 // Serve calls http.Serve with the provided Listener and the app's router
 func (a *App) Serve(l net.Listener) error {
 	return http.Serve(l, a)
@@ -219,7 +302,7 @@ func (a *App) Serve(l net.Listener) error {
 func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
-	if err != nil {
+	if err != nil || !a.canDownload(r, meta) {
 		writeStatus(w, r, 404)
 		return
 	}
@@ -244,16 +327,30 @@ func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer content.Close()
 
+	if r.Method == "GET" {
+		a.downloads.Record(meta.Oid, time.Now())
+	}
+
+	start := time.Now()
+	object := &EventObject{Oid: meta.Oid, Size: meta.Size}
+	if r.Method == "GET" {
+		a.publish(&Event{Type: eventTransferStarted, Operation: "download", Repo: rv.Repo, User: requestUser(r), Object: object, Bytes: meta.Size - fromByte, RemoteAddr: r.RemoteAddr})
+	}
+
 	w.WriteHeader(statusCode)
-	io.Copy(w, content)
+	n, _ := io.Copy(w, content)
 	logRequest(r, statusCode)
+
+	if r.Method == "GET" {
+		a.publish(&Event{Type: eventTransferFinished, Operation: "download", Repo: rv.Repo, User: requestUser(r), Object: object, Bytes: n, DurationMs: time.Since(start).Milliseconds(), Status: statusCode, RemoteAddr: r.RemoteAddr})
+	}
 }
 
 // GetMetaHandler retrieves metadata about the object
 func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
-	if err != nil {
+	if err != nil || !a.canDownload(r, meta) {
 		writeStatus(w, r, 404)
 		return
 	}
@@ -270,7 +367,26 @@ func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 
 // PostHandler instructs the client how to upload data
 func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.checkBasicUpload(r); err != nil {
+		refuseRepo(w, r, err)
+		return
+	}
+
 	rv := unpack(r)
+	var objErr *ObjectError
+	if stored, err := a.metaStore.Get(rv); err == nil && a.contentStore.Exists(stored) {
+		objErr = a.chargeStored(rv, stored, requestUser(r))
+	} else {
+		objErr = a.checkUpload(rv, requestUser(r))
+	}
+	if objErr != nil {
+		w.Header().Set("Content-Type", metaMediaType)
+		w.WriteHeader(objErr.Code)
+		json.NewEncoder(w).Encode(objErr)
+		logRequest(r, objErr.Code)
+		return
+	}
+
 	meta, err := a.metaStore.Put(rv)
 	if err != nil {
 		writeStatus(w, r, 404)
@@ -297,25 +413,55 @@ func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
 	var responseObjects []*Representation
 
 	var useTus bool
-	if bv.Operation == "upload" && Config.IsUsingTus() {
-		for _, t := range bv.Transfers {
-			if t == "tus" {
-				useTus = true
-				break
-			}
+	if bv.Operation == "upload" {
+		vars := mux.Vars(r)
+		repo, err := a.repoForWrite(vars["user"], vars["repo"], requestUser(r))
+		if err != nil {
+			refuseRepo(w, r, err)
+			return
+		}
+		transfer, err := uploadTransfer(bv.Transfers, repo)
+		if err != nil {
+			refuseRepo(w, r, err)
+			return
 		}
+		useTus = transfer == "tus"
 	}
 
 	// Create a response object
 	for _, object := range bv.Objects {
 		meta, err := a.metaStore.Get(object)
 		if err == nil && a.contentStore.Exists(meta) { // Object is found and exists
-			responseObjects = append(responseObjects, a.Represent(object, meta, true, false, false))
-			continue
+			// Pushing an object that is already stored charges the
+			// repository for it without an upload.
+			if bv.Operation == "upload" {
+				if objErr := a.chargeStored(object, meta, requestUser(r)); objErr != nil {
+					responseObjects = append(responseObjects, &Representation{Oid: object.Oid, Size: object.Size, Error: objErr})
+					continue
+				}
+			}
+
+			// An object the user may not download through this repository
+			// is not found, unless they are uploading it.
+			readable := a.canDownload(r, meta)
+			if readable || bv.Operation == "upload" {
+				responseObjects = append(responseObjects, a.Represent(object, meta, readable, false, false))
+				continue
+			}
 		}
 
 		// Object is not found
 		if bv.Operation == "upload" {
+			if objErr := a.checkUpload(object, requestUser(r)); objErr != nil {
+				rep := &Representation{
+					Oid:   object.Oid,
+					Size:  object.Size,
+					Error: objErr,
+				}
+				responseObjects = append(responseObjects, rep)
+				continue
+			}
+
 			meta, err = a.metaStore.Put(object)
 			if err == nil {
 				responseObjects = append(responseObjects, a.Represent(object, meta, false, true, useTus))
@@ -344,10 +490,17 @@ func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
 	enc := json.NewEncoder(w)
 	enc.Encode(respobj)
 	logRequest(r, 200)
+
+	a.publish(&Event{Type: eventBatch, Operation: bv.Operation, Repo: mux.Vars(r)["repo"], User: requestUser(r), Count: len(bv.Objects), Status: 200, RemoteAddr: r.RemoteAddr})
 }
 
 // PutHandler receives data from the client and puts it into the content store
 func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.checkBasicUpload(r); err != nil {
+		refuseRepo(w, r, err)
+		return
+	}
+
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
 	if err != nil {
@@ -355,13 +508,31 @@ func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
+	object := &EventObject{Oid: meta.Oid, Size: meta.Size}
+	a.publish(&Event{Type: eventTransferStarted, Operation: "upload", Repo: rv.Repo, User: requestUser(r), Object: object, Bytes: meta.Size, RemoteAddr: r.RemoteAddr})
+
 	if err := a.contentStore.Put(meta, r.Body); err != nil {
 		a.metaStore.Delete(rv)
 		w.WriteHeader(500)
 		fmt.Fprintf(w, `{"message":"%s"}`, err)
+		a.publish(&Event{Type: eventTransferFinished, Operation: "upload", Repo: rv.Repo, User: requestUser(r), Object: object, DurationMs: time.Since(start).Milliseconds(), Status: 500, RemoteAddr: r.RemoteAddr})
 		return
 	}
 
+	a.publish(&Event{Type: eventTransferFinished, Operation: "upload", Repo: rv.Repo, User: requestUser(r), Object: object, Bytes: meta.Size, DurationMs: time.Since(start).Milliseconds(), Status: 200, RemoteAddr: r.RemoteAddr})
+
+	if err := a.metaStore.RecordUpload(meta.Oid, rv.Repo, requestUser(r), time.Now()); err != nil {
+		logger.Log(kv{"fn": "PutHandler", "err": err.Error()})
+	}
+
+	a.publish(&Event{
+		Type:   eventObjectUploaded,
+		Repo:   rv.Repo,
+		User:   requestUser(r),
+		Object: &EventObject{Oid: meta.Oid, Size: meta.Size},
+	})
+
 	logRequest(r, 200)
 }
 
@@ -374,6 +545,20 @@ func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Fatal(kv{"fn": "VerifyHandler", "err": fmt.Sprintf("Failed to verify %s: %v", oid, err)})
 	}
 
+	repo, user := vars["repo"], requestUser(r)
+	if err := a.metaStore.RecordUpload(oid, repo, user, time.Now()); err != nil {
+		logger.Log(kv{"fn": "VerifyHandler", "err": err.Error()})
+	}
+
+	if meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: oid}); err == nil {
+		a.publish(&Event{
+			Type:   eventObjectUploaded,
+			Repo:   repo,
+			User:   user,
+			Object: &EventObject{Oid: meta.Oid, Size: meta.Size},
+		})
+	}
+
 	logRequest(r, 200)
 }
 
@@ -386,10 +571,12 @@ func (a *App) LocksHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", metaMediaType)
 
-	locks, nextCursor, err := a.metaStore.FilteredLocks(repo,
-		r.FormValue("path"),
-		r.FormValue("cursor"),
-		r.FormValue("limit"))
+	locks, nextCursor, err := a.metaStore.FilteredLocks(repo, LockFilter{
+		Id:     r.FormValue("id"),
+		Path:   r.FormValue("path"),
+		Ref:    r.FormValue("refspec"),
+		Cursor: r.FormValue("cursor"),
+	}, r.FormValue("limit"))
 
 	if err != nil {
 		ll.Message = err.Error()
@@ -406,7 +593,7 @@ func (a *App) LocksHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["repo"]
-	user := context.Get(r, "USER")
+	user := requestUser(r)
 
 	dec := json.NewDecoder(r.Body)
 	enc := json.NewEncoder(w)
@@ -426,10 +613,13 @@ func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
 		limit = 100
 	}
 
+	f := LockFilter{Cursor: reqBody.Cursor}
+	if reqBody.Ref != nil {
+		f.Ref = reqBody.Ref.Name
+	}
+
 	ll := &VerifiableLockList{}
-	locks, nextCursor, err := a.metaStore.FilteredLocks(repo, "",
-		reqBody.Cursor,
-		strconv.Itoa(limit))
+	locks, nextCursor, err := a.metaStore.FilteredLocks(repo, f, strconv.Itoa(limit))
 	if err != nil {
 		ll.Message = err.Error()
 	} else {
@@ -449,10 +639,66 @@ func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
 	logRequest(r, 200)
 }
 
+// LocksCheckHandler reports which of the paths changed by a push are locked by
+// someone other than the pusher. It is meant to be called from a pre-receive
+// hook; the pusher defaults to the authenticated user, and checking for
+// another user needs write access to the repository.
+func (a *App) LocksCheckHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+
+	dec := json.NewDecoder(r.Body)
+	enc := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", metaMediaType)
+
+	var checkRequest LockCheckRequest
+	if err := dec.Decode(&checkRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&LockCheckResponse{Message: err.Error()})
+		return
+	}
+
+	pusher := requestUser(r)
+	if checkRequest.User != "" && checkRequest.User != pusher {
+		rp, err := a.requestRepo(r)
+		if err != nil && err != errRepoNotFound {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(&LockCheckResponse{Message: err.Error()})
+			return
+		}
+		if err != nil || !repoAllows(rp, pusher, accessWrite) {
+			w.WriteHeader(http.StatusForbidden)
+			enc.Encode(&LockCheckResponse{Message: "Checking the locks of another user needs write access"})
+			return
+		}
+		pusher = checkRequest.User
+	}
+	ref := ""
+	if checkRequest.Ref != nil {
+		ref = checkRequest.Ref.Name
+	}
+
+	conflicts, err := a.metaStore.CheckLocks(repo, ref, pusher, checkRequest.Paths)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&LockCheckResponse{Message: err.Error()})
+		return
+	}
+
+	enc.Encode(&LockCheckResponse{Conflicts: conflicts})
+
+	logRequest(r, 200)
+}
+
 func (a *App) CreateLockHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["repo"]
-	user := context.Get(r, "USER").(string)
+	user := requestUser(r)
+	if user == "" {
+		writeStatus(w, r, 401)
+		return
+	}
 
 	dec := json.NewDecoder(r.Body)
 	enc := json.NewEncoder(w)
@@ -466,31 +712,59 @@ func (a *App) CreateLockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	locks, _, err := a.metaStore.FilteredLocks(repo, lockRequest.Path, "", "1")
+	auditEntry(r).Path = lockRequest.Path
+	if _, err := a.repoForWrite(vars["user"], repo, user); err != nil {
+		w.WriteHeader(repoStatus(err))
+		enc.Encode(&LockResponse{Message: err.Error()})
+		return
+	}
+
+	lockPath, err := normalizeLockPath(lockRequest.Path)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		enc.Encode(&LockResponse{Message: err.Error()})
 		return
 	}
-	if len(locks) > 0 {
-		w.WriteHeader(http.StatusConflict)
-		enc.Encode(&LockResponse{Message: "lock already created"})
+
+	now := time.Now()
+	expires, err := a.lockExpiry(repo, now)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&LockResponse{Message: err.Error()})
 		return
 	}
 
 	lock := &Lock{
-		Id:       randomLockId(),
-		Path:     lockRequest.Path,
-		Owner:    User{Name: user},
-		LockedAt: time.Now(),
+		Id:        randomLockId(),
+		Path:      lockPath,
+		Owner:     User{Name: user},
+		LockedAt:  now,
+		ExpiresAt: expires,
+	}
+	if lockRequest.Ref != nil && lockRequest.Ref.Name != "" {
+		lock.Ref = &Ref{Name: lockRequest.Ref.Name}
 	}
 
-	if err := a.metaStore.AddLocks(repo, *lock); err != nil {
+	existing, err := a.metaStore.CreateLock(repo, *lock)
+	if err == errLockExists {
+		w.WriteHeader(http.StatusConflict)
+		enc.Encode(&LockResponse{Lock: existing, Message: "lock already created"})
+		return
+	}
+	if status, msg, ok := a.lockPolicyError(repo, user, lock.Path, err); ok {
+		w.WriteHeader(status)
+		enc.Encode(&LockResponse{Message: msg})
+		return
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(&LockResponse{Message: err.Error()})
 		return
 	}
 
+	auditEntry(r).LockId = lock.Id
+	a.publish(&Event{Type: eventLockCreated, Repo: repo, User: user, Lock: lock})
+
 	w.WriteHeader(http.StatusCreated)
 	enc.Encode(&LockResponse{
 		Lock: lock,
@@ -503,7 +777,11 @@ func (a *App) DeleteLockHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["repo"]
 	lockId := vars["id"]
-	user := context.Get(r, "USER").(string)
+	user := requestUser(r)
+	if user == "" {
+		writeStatus(w, r, 401)
+		return
+	}
 
 	dec := json.NewDecoder(r.Body)
 	enc := json.NewEncoder(w)
@@ -525,6 +803,11 @@ func (a *App) DeleteLockHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	l, err := a.metaStore.DeleteLock(repo, user, lockId, unlockRequest.Force)
+	if status, msg, ok := a.lockPolicyError(repo, user, "", err); ok {
+		w.WriteHeader(status)
+		enc.Encode(&UnlockResponse{Message: msg})
+		return
+	}
 	if err != nil {
 		if err == errNotOwner {
 			w.WriteHeader(http.StatusForbidden)
@@ -540,11 +823,167 @@ func (a *App) DeleteLockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit := auditEntry(r)
+	audit.Path = l.Path
+	if l.Owner.Name != user {
+		audit.Action = "lock.force_unlock"
+		audit.Target = l.Owner.Name
+	}
+
+	a.publish(&Event{Type: eventLockReleased, Repo: repo, User: user, Lock: l, Force: unlockRequest.Force})
+
 	enc.Encode(&UnlockResponse{Lock: l})
 
 	logRequest(r, 200)
 }
 
+// adminUnlock releases any lock of repo on behalf of the administrator user,
+// bypassing ownership and lock policy, and publishes the release as
+// DeleteLockHandler does. It returns errLockNotFound if there is no such lock.
+func (a *App) adminUnlock(repo, user, id string) (*Lock, error) {
+	l, err := a.metaStore.AdminDeleteLock(repo, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, errLockNotFound
+	}
+
+	a.publish(&Event{Type: eventLockReleased, Repo: repo, User: user, Lock: l, Force: true})
+	return l, nil
+}
+
+// releaseLocks releases the locks matching f with adminUnlock, recording each
+// release in the audit log as part of the request r. Locks released meanwhile
+// are skipped. It returns the released locks, up to the first failure.
+func (a *App) releaseLocks(r *http.Request, user string, f LockSelection) ([]RepoLock, error) {
+	locks, err := a.metaStore.SelectLocks(f)
+	if err != nil {
+		return nil, err
+	}
+
+	released := make([]RepoLock, 0, len(locks))
+	for _, rl := range locks {
+		l, err := a.adminUnlock(rl.Repo, user, rl.Lock.Id)
+		if err == errLockNotFound {
+			continue
+		}
+		a.auditOperation(r, &AuditEntry{
+			Action: "lock.force_unlock",
+			Repo:   rl.Repo,
+			LockId: rl.Lock.Id,
+			Path:   rl.Lock.Path,
+			Target: rl.Lock.Owner.Name,
+		}, err)
+		if err != nil {
+			return released, err
+		}
+		released = append(released, RepoLock{Repo: rl.Repo, Lock: *l})
+	}
+	return released, nil
+}
+
+// RenewLockHandler extends the expiry of a lock by the repository's lock TTL.
+// Only the owner of a lock may renew it.
+func (a *App) RenewLockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	lockId := vars["id"]
+	user := requestUser(r)
+	if user == "" {
+		writeStatus(w, r, 401)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", metaMediaType)
+
+	expires, err := a.lockExpiry(repo, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&LockResponse{Message: err.Error()})
+		return
+	}
+
+	l, err := a.metaStore.RenewLock(repo, user, lockId, expires)
+	if err != nil {
+		if err == errRenewNotOwner {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		enc.Encode(&LockResponse{Message: err.Error()})
+		return
+	}
+	if l == nil {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(&LockResponse{Message: "unable to find lock"})
+		return
+	}
+
+	enc.Encode(&LockResponse{Lock: l})
+
+	logRequest(r, 200)
+}
+
+// TransferLockHandler makes another user the owner of a lock.
+func (a *App) TransferLockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	lockId := vars["id"]
+	user := requestUser(r)
+	if user == "" {
+		writeStatus(w, r, 401)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	enc := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", metaMediaType)
+
+	var transferRequest TransferLockRequest
+	if err := dec.Decode(&transferRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&LockResponse{Message: err.Error()})
+		return
+	}
+
+	auditEntry(r).Target = transferRequest.Owner.Name
+	l, err := a.metaStore.TransferLock(repo, user, lockId, transferRequest.Owner.Name, transferRequest.Force)
+	subject := user
+	if err == errTooManyLocks {
+		subject = transferRequest.Owner.Name
+	}
+	if status, msg, ok := a.lockPolicyError(repo, subject, "", err); ok {
+		w.WriteHeader(status)
+		enc.Encode(&LockResponse{Message: msg})
+		return
+	}
+	if err != nil {
+		switch err {
+		case errTransferNotOwner:
+			w.WriteHeader(http.StatusForbidden)
+		case errNoNewOwner:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		enc.Encode(&LockResponse{Message: err.Error()})
+		return
+	}
+	if l == nil {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(&LockResponse{Message: "unable to find lock"})
+		return
+	}
+
+	enc.Encode(&LockResponse{Lock: l})
+
+	logRequest(r, 200)
+}
+
 // Represent takes a RequestVars and Meta and turns it into a Representation suitable
 // for json encoding
 func (a *App) Represent(rv *RequestVars, meta *MetaObject, download, upload, useTus bool) *Representation {
@@ -577,19 +1016,49 @@ func (a *App) Represent(rv *RequestVars, meta *MetaObject, download, upload, use
 	return rep
 }
 
-func (a *App) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+// requireAuth authenticates r and checks that its user has access to its
+// repository before calling h. Anonymous users may download from public
+// repositories; everything else needs credentials. Users without any access
+// to a private repository get a 404, as if it didn't exist.
+func (a *App) requireAuth(access string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !Config.IsPublic() {
-			user, password, _ := r.BasicAuth()
-			if user, ret := a.metaStore.Authenticate(user, password); !ret {
-				w.Header().Set("WWW-Authenticate", "Basic realm=git-lfs-server")
-				writeStatus(w, r, 401)
-				return
-			} else {
-				context.Set(r, "USER", user)
+		repo, repoErr := a.requestRepo(r)
+		if repoErr != nil && repoErr != errRepoNotFound {
+			logger.Log(kv{"fn": "requireAuth", "err": repoErr.Error()})
+			writeStatus(w, r, 500)
+			return
+		}
+		need := access
+		if need == accessBatch {
+			need = batchAccess(r)
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok && repoErr == nil && repoAllows(repo, "", need) {
+			h(w, r)
+			return
+		}
+		if user, ret := a.metaStore.Authenticate(user, password); !ret {
+			// A request without credentials is only the challenge that makes
+			// the client send them.
+			if ok {
+				a.publish(&Event{Type: eventAuthFailed, Repo: mux.Vars(r)["repo"], User: user, Status: 401, RemoteAddr: r.RemoteAddr})
 			}
+			w.Header().Set("WWW-Authenticate", "Basic realm=git-lfs-server")
+			writeStatus(w, r, 401)
+			return
+		} else {
+			r = withUser(r, user)
+		}
+
+		switch {
+		case repoErr == nil && repoAllows(repo, requestUser(r), need):
+			h(w, r)
+		case repoErr == nil && repoAllows(repo, requestUser(r), accessRead):
+			writeStatus(w, r, 403)
+		default:
+			writeStatus(w, r, 404)
 		}
-		h(w, r)
 	}
 }
 
@@ -609,6 +1078,20 @@ func MetaMatcher(r *http.Request, m *mux.RouteMatch) bool {
 	return mt == metaMediaType
 }
 
+// requestUser returns the name of the authenticated user, or an empty string
+// if the request was not authenticated.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+type userKey struct{}
+
+// withUser returns a copy of r made by the authenticated user.
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
 func randomLockId() string {
 	var id [20]byte
 	rand.Read(id[:])
@@ -675,5 +1158,5 @@ func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
 }
 
 func logRequest(r *http.Request, status int) {
-	logger.Log(kv{"method": r.Method, "url": r.URL, "status": status, "request_id": context.Get(r, "RequestID")})
+	logger.Log(kv{"method": r.Method, "url": r.URL, "status": status, "request_id": requestID(r)})
 }
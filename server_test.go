@@ -2,17 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -32,7 +37,7 @@ func TestGetAuthed(t *testing.T) {
 }
 
 func TestGetAuthedWithRange(t *testing.T) {
-	req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	req, err := http.NewRequest("GET", lfsServer.URL+"/bilbo/repo/objects/"+contentOid, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -68,8 +73,37 @@ func TestGetAuthedWithRange(t *testing.T) {
 	}
 }
 
+func TestGetRecordsDownload(t *testing.T) {
+	lfsApp.downloads.Flush()
+	before, err := testMetaStore.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("error retrieving meta: %s", err)
+	}
+
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	ioutil.ReadAll(res.Body)
+
+	if err := lfsApp.downloads.Flush(); err != nil {
+		t.Fatalf("error flushing download statistics: %s", err)
+	}
+
+	after, err := testMetaStore.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("error retrieving meta: %s", err)
+	}
+	if after.Downloads != before.Downloads+1 {
+		t.Errorf("expected download count to increase by 1, got %d -> %d", before.Downloads, after.Downloads)
+	}
+	if after.LastDownload.IsZero() {
+		t.Errorf("expected last download time to be recorded")
+	}
+}
+
 func TestGetUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, contentMediaType, "", "", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -80,7 +114,7 @@ func TestGetUnAuthed(t *testing.T) {
 }
 
 func TestGetBadAuth(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -119,7 +153,7 @@ func TestGetMetaAuthed(t *testing.T) {
 }
 
 func TestGetMetaUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, metaMediaType, "", "", nil)
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, "", "", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -216,7 +250,7 @@ func TestPostUnAuthed(t *testing.T) {
 }
 
 func TestPut(t *testing.T) {
-	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/bilbo/repo/objects/"+contentOid, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -249,10 +283,92 @@ func TestPut(t *testing.T) {
 	}
 }
 
+func TestBatchUploadTooLarge(t *testing.T) {
+	defer func(max string) { Config.MaxObjectSize = max }(Config.MaxObjectSize)
+	Config.MaxObjectSize = "1K"
+
+	objects, err := batchUpload("/bilbo/repo/objects/batch", nonExistingOid, 4096)
+	if err != nil {
+		t.Fatalf("batch error: %s", err)
+	}
+
+	if objects[0].Error == nil || objects[0].Error.Code != 413 {
+		t.Fatalf("expected object error 413, got %+v", objects[0].Error)
+	}
+}
+
+func TestConfigValidateSizes(t *testing.T) {
+	c := &Configuration{RepoQuota: "10G", UserQuota: "512", MaxObjectSize: "1K"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected sizes to be valid, got: %s", err)
+	}
+
+	c.UserQuota = "10GB"
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("expected an invalid quota to be rejected")
+	}
+	if !strings.Contains(err.Error(), "LFS_USERQUOTA") {
+		t.Fatalf("expected the error to name the setting, got: %s", err)
+	}
+}
+
+func TestBatchUploadRepoQuota(t *testing.T) {
+	if err := testMetaStore.SetQuota(quotaRepo, "quota-repo", 100); err != nil {
+		t.Fatalf("error setting quota: %s", err)
+	}
+	defer testMetaStore.SetQuota(quotaRepo, "quota-repo", -1)
+
+	objects, err := batchUpload("/bilbo/quota-repo/objects/batch", "1111111111111111111111111111111111111111111111111111111111111111", 60)
+	if err != nil {
+		t.Fatalf("batch error: %s", err)
+	}
+	if objects[0].Error != nil {
+		t.Fatalf("expected first object to be accepted, got %+v", objects[0].Error)
+	}
+
+	objects, err = batchUpload("/bilbo/quota-repo/objects/batch", "2222222222222222222222222222222222222222222222222222222222222222", 60)
+	if err != nil {
+		t.Fatalf("batch error: %s", err)
+	}
+	if objects[0].Error == nil || objects[0].Error.Code != 507 {
+		t.Fatalf("expected object error 507, got %+v", objects[0].Error)
+	}
+
+	usage, err := testMetaStore.Usage(quotaRepo, "quota-repo")
+	if err != nil {
+		t.Fatalf("error retrieving usage: %s", err)
+	}
+	if usage.Bytes != 60 {
+		t.Fatalf("expected 60 bytes used, got %d", usage.Bytes)
+	}
+}
+
+func TestBatchUploadStoredObjectCharges(t *testing.T) {
+	objects, err := batchUpload("/bilbo/stored-repo/objects/batch", contentOid, contentSize)
+	if err != nil {
+		t.Fatalf("batch error: %s", err)
+	}
+	if objects[0].Error != nil || objects[0].Actions["upload"] != nil {
+		t.Fatalf("expected the stored object to need no upload, got %+v", objects[0])
+	}
+
+	usage, err := testMetaStore.Usage(quotaRepo, "stored-repo")
+	if err != nil || usage.Objects != 1 || usage.Bytes != contentSize {
+		t.Fatalf("expected the repository to be charged for the object, got %+v, %v", usage, err)
+	}
+	charges, _ := testMetaStore.ChargesOf(contentOid)
+	for _, c := range charges {
+		if c.Repo == "stored-repo" && !c.Confirmed {
+			t.Errorf("expected the charge to be confirmed, got %+v", c)
+		}
+	}
+}
+
 func TestMediaTypesRequired(t *testing.T) {
 	m := []string{"GET", "PUT", "POST", "HEAD"}
 	for _, method := range m {
-		res, err := api(method, "/user/repo/objects/"+contentOid, "", testUser, testPass, nil)
+		res, err := api(method, "/bilbo/repo/objects/"+contentOid, "", testUser, testPass, nil)
 		if err != nil {
 			t.Fatalf("request error: %s", err)
 		}
@@ -264,7 +380,7 @@ func TestMediaTypesRequired(t *testing.T) {
 
 func TestMediaTypesParsed(t *testing.T) {
 	accept := contentMediaType + "; charset=utf-8"
-	res, err := api("GET", "/user/repo/objects/"+contentOid, accept, testUser, testPass, nil)
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, accept, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -274,7 +390,7 @@ func TestMediaTypesParsed(t *testing.T) {
 }
 
 func TestLocksList(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, testUser, testPass, nil)
+	res, err := api("GET", "/bilbo/repo/locks", metaMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -301,7 +417,7 @@ func TestLocksList(t *testing.T) {
 }
 
 func TestLocksListUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, "", "", nil)
+	res, err := api("GET", "/bilbo/repo/locks", metaMediaType, "", "", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -313,7 +429,7 @@ func TestLocksListUnAuthed(t *testing.T) {
 
 func TestLocksVerify(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
-	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, testUser, testPass, buf)
+	res, err := api("POST", "/bilbo/repo/locks/verify", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -335,7 +451,7 @@ func TestLocksVerify(t *testing.T) {
 
 func TestLocksVerifyUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
-	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, "", "", buf)
+	res, err := api("POST", "/bilbo/repo/locks/verify", metaMediaType, "", "", buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -352,7 +468,7 @@ func TestLock(t *testing.T) {
 		t.Fatalf("create lock error: %s", err)
 	}
 	if lock == nil {
-		t.Errorf("expected lock to be created, got: %s", lock)
+		t.Errorf("expected lock to be created, got: %v", lock)
 	}
 	if lock.Owner.Name != testUser {
 		t.Errorf("expected lock owner to be match, got: %s", lock.Owner.Name)
@@ -369,7 +485,7 @@ func TestLockExists(t *testing.T) {
 	}
 
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, l.Path))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, testUser, testPass, buf)
+	res, err := api("POST", "/bilbo/repo/locks", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -377,11 +493,204 @@ func TestLockExists(t *testing.T) {
 	if res.StatusCode != 409 {
 		t.Fatalf("expected status 409, got %d", res.StatusCode)
 	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock == nil || lockResponse.Lock.Id != l.Id {
+		t.Errorf("expected conflicting lock to be returned, got: %v", lockResponse.Lock)
+	}
+}
+
+func TestLockRefs(t *testing.T) {
+	main, err := createRefLock("/bilbo/refs-repo/locks", "TestLockRefs", "refs/heads/main")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+	if main.RefName() != "refs/heads/main" {
+		t.Errorf("expected lock ref to match, got: %q", main.RefName())
+	}
+
+	if _, err := createRefLock("/bilbo/refs-repo/locks", "TestLockRefs", "refs/heads/feature"); err != nil {
+		t.Errorf("expected lock on another ref to succeed, got: %s", err)
+	}
+	if _, err := createRefLock("/bilbo/refs-repo/locks", "TestLockRefs", "refs/heads/main"); err == nil {
+		t.Errorf("expected lock on the same ref to conflict")
+	}
+	if _, err := createRefLock("/bilbo/refs-repo/locks", "TestLockRefs", ""); err == nil {
+		t.Errorf("expected lock without a ref to conflict")
+	}
+
+	list, err := listLocks("/bilbo/refs-repo/locks?refspec=refs/heads/main")
+	if err != nil {
+		t.Fatalf("list locks error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Id != main.Id {
+		t.Errorf("expected only the main lock, got: %v", list.Locks)
+	}
+
+	list, err = listLocks("/bilbo/refs-repo/locks?id=" + main.Id)
+	if err != nil {
+		t.Fatalf("list locks error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Id != main.Id {
+		t.Errorf("expected the lock with the id, got: %v", list.Locks)
+	}
+
+	buf := bytes.NewBufferString(`{"ref":{"name":"refs/heads/feature"}}`)
+	res, err := api("POST", "/bilbo/refs-repo/locks/verify", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var verify VerifiableLockList
+	if err := json.NewDecoder(res.Body).Decode(&verify); err != nil {
+		t.Fatalf("expected response body to be VerifiableLockList, got error: %s", err)
+	}
+	if len(verify.Ours) != 1 || verify.Ours[0].RefName() != "refs/heads/feature" {
+		t.Errorf("expected only the feature lock, got: %v", verify.Ours)
+	}
+}
+
+func TestLockInvalidPath(t *testing.T) {
+	buf := bytes.NewBufferString(`{"path":"../outside"}`)
+	res, err := api("POST", "/bilbo/repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
+	}
+}
+
+func TestLockPolicyErrors(t *testing.T) {
+	if err := testMetaStore.SetLockPolicy(&LockPolicy{Repo: "policy-repo", AllowedPaths: []string{"*.psd"}, ForceUnlockers: []string{testUser}}); err != nil {
+		t.Fatalf("error setting lock policy: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"path":"README.md"}`)
+	res, err := api("POST", "/bilbo/policy-repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if !strings.Contains(lockResponse.Message, "*.psd") {
+		t.Errorf("expected message to list lockable paths, got: %s", lockResponse.Message)
+	}
+
+	l, err := createRefLock("/bilbo/policy-repo/locks", "hero.psd", "")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf = bytes.NewBufferString(`{"force": true}`)
+	res, err = api("POST", "/bilbo/policy-repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksCheck(t *testing.T) {
+	for _, path := range []string{"check/hero.psd", "check/levels/"} {
+		if _, err := createRefLock("/bilbo/check-repo/locks", path, ""); err != nil {
+			t.Fatalf("create lock error: %s", err)
+		}
+	}
+
+	check := func(user string) []LockConflict {
+		req := LockCheckRequest{
+			Ref:   &Ref{Name: "refs/heads/main"},
+			User:  user,
+			Paths: []string{"check/hero.psd", "check/levels/one.map", "check/other.psd"},
+		}
+		data, _ := json.Marshal(&req)
+		res, err := api("POST", "/bilbo/check-repo/locks/check", metaMediaType, testUser, testPass, bytes.NewBuffer(data))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		var checkResponse LockCheckResponse
+		if err := json.NewDecoder(res.Body).Decode(&checkResponse); err != nil {
+			t.Fatalf("expected response body to be LockCheckResponse, got error: %s", err)
+		}
+		return checkResponse.Conflicts
+	}
+
+	if conflicts := check(testUser); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts for the lock owner, got: %v", conflicts)
+	}
+
+	conflicts := check(testUser1)
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts for another user, got: %v", conflicts)
+	}
+	if conflicts[0].Path != "check/hero.psd" || conflicts[1].Lock.Path != "check/levels/" {
+		t.Errorf("expected conflicts for the locked paths, got: %v", conflicts)
+	}
+
+	if _, err := testMetaStore.GrantRepository("check-repo", testUser1, accessRead); err != nil {
+		t.Fatalf("error granting access: %s", err)
+	}
+	data, _ := json.Marshal(&LockCheckRequest{User: testUser, Paths: []string{"check/hero.psd"}})
+	res, err := api("POST", "/bilbo/check-repo/locks/check", metaMediaType, testUser1, testPass1, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Errorf("expected a reader not to check as another user, got %d", res.StatusCode)
+	}
+}
+
+func TestTransferLockHandler(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestTransferLockHandler")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"owner":{"name":"%s"}}`, testUser1))
+	res, err := api("POST", "/bilbo/repo/locks/"+l.Id+"/transfer", metaMediaType, testUser1, testPass1, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403 for another user, got %d", res.StatusCode)
+	}
+
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"owner":{"name":"%s"}}`, testUser1))
+	res, err = api("POST", "/bilbo/repo/locks/"+l.Id+"/transfer", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock == nil || lockResponse.Lock.Owner.Name != testUser1 {
+		t.Errorf("expected lock to be transferred, got: %v", lockResponse.Lock)
+	}
 }
 
 func TestLockUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, "TestLockUnAuthed"))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, "", "", buf)
+	res, err := api("POST", "/bilbo/repo/locks", metaMediaType, "", "", buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -398,7 +707,7 @@ func TestUnlock(t *testing.T) {
 	}
 
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser, testPass, buf)
+	res, err := api("POST", "/bilbo/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -417,7 +726,7 @@ func TestUnlock(t *testing.T) {
 	}
 	lock := unlockResponse.Lock
 	if lock == nil || lock.Id != l.Id {
-		t.Errorf("expected deleted lock to be returned, got: %s", lock)
+		t.Errorf("expected deleted lock to be returned, got: %v", lock)
 	}
 }
 
@@ -428,7 +737,7 @@ func TestUnLockUnAuthed(t *testing.T) {
 	}
 
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, "", "", buf)
+	res, err := api("POST", "/bilbo/repo/locks/"+l.Id+"/unlock", metaMediaType, "", "", buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -445,7 +754,7 @@ func TestUnlockNotOwner(t *testing.T) {
 	}
 
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
+	res, err := api("POST", "/bilbo/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -461,7 +770,7 @@ func TestUnlockNotOwnerForce(t *testing.T) {
 	}
 
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, true))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
+	res, err := api("POST", "/bilbo/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -472,7 +781,7 @@ func TestUnlockNotOwnerForce(t *testing.T) {
 
 func createLock(username, password, path string) (*Lock, error) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, path))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, username, password, buf)
+	res, err := api("POST", "/bilbo/repo/locks", metaMediaType, username, password, buf)
 	if err != nil {
 		return nil, fmt.Errorf("request error: %s", err)
 	}
@@ -493,6 +802,106 @@ func createLock(username, password, path string) (*Lock, error) {
 	return lockResponse.Lock, nil
 }
 
+func TestRenewLockHandler(t *testing.T) {
+	if err := testMetaStore.SetLockPolicy(&LockPolicy{Repo: "ttl-repo", TTL: "1h"}); err != nil {
+		t.Fatalf("error setting lock policy: %s", err)
+	}
+
+	l, err := createRefLock("/bilbo/ttl-repo/locks", "TestRenewLock", "")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+	if l.ExpiresAt == nil || time.Until(*l.ExpiresAt) > time.Hour {
+		t.Fatalf("expected lock to expire within the policy TTL, got: %v", l.ExpiresAt)
+	}
+
+	res, err := api("POST", "/bilbo/ttl-repo/locks/"+l.Id+"/renew", metaMediaType, testUser1, testPass1, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Errorf("expected status 403 for another user, got %d", res.StatusCode)
+	}
+
+	res, err = api("POST", "/bilbo/ttl-repo/locks/"+l.Id+"/renew", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock == nil || lockResponse.Lock.ExpiresAt == nil || lockResponse.Lock.ExpiresAt.Before(*l.ExpiresAt) {
+		t.Errorf("expected lock expiry to be extended, got: %v", lockResponse.Lock)
+	}
+}
+
+func createRefLock(path, lockPath, ref string) (*Lock, error) {
+	req := LockRequest{Path: lockPath}
+	if ref != "" {
+		req.Ref = &Ref{Name: ref}
+	}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := api("POST", path, metaMediaType, testUser, testPass, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		return nil, fmt.Errorf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		return nil, fmt.Errorf("expected response body to be LockResponse, got error: %s", err)
+	}
+	return lockResponse.Lock, nil
+}
+
+func listLocks(path string) (*LockList, error) {
+	res, err := api("GET", path, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("expected response body to be LockList, got error: %s", err)
+	}
+	return &list, nil
+}
+
+func batchUpload(path, oid string, size int64) ([]*Representation, error) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d}]}`, oid, size))
+	res, err := api("POST", path, metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("expected response body to be BatchResponse, got error: %s", err)
+	}
+	if len(batch.Objects) != 1 {
+		return nil, fmt.Errorf("expected 1 object, got %d", len(batch.Objects))
+	}
+	return batch.Objects, nil
+}
+
 // simple http client for making api request
 func api(method, path, accept, username, password string, body *bytes.Buffer) (*http.Response, error) {
 	req, err := http.NewRequest(method, lfsServer.URL+path, nil)
@@ -513,6 +922,7 @@ func api(method, path, accept, username, password string, body *bytes.Buffer) (*
 }
 
 var (
+	lfsApp           *App
 	lfsServer        *httptest.Server
 	testMetaStore    *MetaStore
 	testContentStore *ContentStore
@@ -559,8 +969,8 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	app := NewApp(testContentStore, testMetaStore)
-	lfsServer = httptest.NewServer(app)
+	lfsApp = NewApp(testContentStore, testMetaStore)
+	lfsServer = httptest.NewServer(lfsApp)
 
 	logger = NewKVLogger(ioutil.Discard)
 
@@ -582,6 +992,11 @@ func seedMetaStore() error {
 		return err
 	}
 
+	repo := &Repository{Name: testRepo, Owner: testUser, Grants: map[string]string{testUser1: accessWrite}}
+	if err := testMetaStore.CreateRepository(repo); err != nil {
+		return err
+	}
+
 	rv := &RequestVars{Oid: contentOid, Size: contentSize}
 	if _, err := testMetaStore.Put(rv); err != nil {
 		return err
@@ -604,3 +1019,50 @@ func seedContentStore() error {
 
 	return nil
 }
+
+func TestVerifyRecordsUploader(t *testing.T) {
+	data := "tus content"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	defer testMetaStore.Delete(&RequestVars{Oid: oid})
+
+	// Stage the upload as tusd would have stored it.
+	dataPath, urls := tusServer.dataPath, tusServer.oidToTusUrl
+	defer func() { tusServer.dataPath, tusServer.oidToTusUrl = dataPath, urls }()
+	tusServer.dataPath = t.TempDir()
+	tusServer.oidToTusUrl = map[string]string{oid: "http://localhost:1080/files/upload1"}
+	if err := os.WriteFile(filepath.Join(tusServer.dataPath, "upload1.bin"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := lfsApp.events.Subscribe("tusrepo", []string{eventObjectUploaded})
+	defer lfsApp.events.Unsubscribe(sub)
+
+	if res, err := api("POST", "/bilbo/tusrepo/verify/"+oid, metaMediaType, "", "", nil); err != nil || res.StatusCode != 401 {
+		t.Fatalf("expected verifying without credentials to be refused, got %v, %v", res, err)
+	}
+	res, err := api("POST", "/bilbo/tusrepo/verify/"+oid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	meta, err := testMetaStore.Get(&RequestVars{Oid: oid})
+	if err != nil || meta.Repo != "tusrepo" || meta.Uploader != testUser {
+		t.Errorf("expected the upload to be recorded for the repository and user, got %+v, %v", meta, err)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Repo != "tusrepo" || e.User != testUser {
+			t.Errorf("expected the event to carry the repository and user, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an object.uploaded event")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Sessions are kept in a signed cookie holding the JSON encoded session and
+// its HMAC-SHA256, both base64 encoded and separated by a dot. The key and
+// the time each user last logged out of each area are kept in sessionsBucket:
+//
+//	secret:               HMAC key
+//	ended:{area}:{user}:  time (RFC 3339), before which the user's sessions
+//	                      in the area are invalid
+const (
+	// csrfField is the name of the form field holding a session's CSRF token.
+	csrfField = "csrf_token"
+	// sessionMaxAge is how long a session lasts, even when active.
+	sessionMaxAge = 12 * time.Hour
+	// sessionRefresh is how often an active session's cookie is renewed.
+	sessionRefresh = time.Minute
+)
+
+var sessionSecretKey = []byte("secret")
+
+// session is a logged in user of an area.
+type session struct {
+	Area string `json:"area"`
+	User string `json:"user"`
+	// Role is the user's current role in the area, looked up on every
+	// request so that changes apply to open sessions.
+	Role string `json:"-"`
+	// CSRF is the token the session's forms must post back.
+	CSRF    string    `json:"csrf"`
+	Created time.Time `json:"created"`
+	Seen    time.Time `json:"seen"`
+}
+
+func newSession(area, user string) *session {
+	var token [20]byte
+	rand.Read(token[:])
+	now := time.Now().UTC()
+	return &session{Area: area, User: user, CSRF: hex.EncodeToString(token[:]), Created: now, Seen: now}
+}
+
+// SessionSecret returns the key sessions are signed with, creating it the
+// first time.
+func (s *MetaStore) SessionSecret() ([]byte, error) {
+	var secret []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if stored := bucket.Get(sessionSecretKey); stored != nil {
+			secret = append(secret, stored...)
+			return nil
+		}
+
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return bucket.Put(sessionSecretKey, secret)
+	})
+	return secret, err
+}
+
+func sessionsEndedKey(area, user string) []byte {
+	return []byte("ended:" + area + ":" + user + ":")
+}
+
+// EndSessions invalidates the sessions of user in area created before at.
+func (s *MetaStore) EndSessions(area, user string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(sessionsEndedKey(area, user), []byte(at.UTC().Format(time.RFC3339Nano)))
+	})
+}
+
+// SessionsEnded returns when the sessions of user in area were last ended, or
+// the zero time.
+func (s *MetaStore) SessionsEnded(area, user string) (time.Time, error) {
+	var ended time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get(sessionsEndedKey(area, user))
+		if value == nil {
+			return nil
+		}
+		var err error
+		ended, err = time.Parse(time.RFC3339Nano, string(value))
+		return err
+	})
+	return ended, err
+}
+
+// sessionSecret returns the key sessions are signed with, loading it from the
+// meta store the first time.
+func (a *App) sessionSecret() ([]byte, error) {
+	a.sessionMu.Lock()
+	defer a.sessionMu.Unlock()
+
+	if a.sessionKey == nil {
+		key, err := a.metaStore.SessionSecret()
+		if err != nil {
+			return nil, err
+		}
+		a.sessionKey = key
+	}
+	return a.sessionKey, nil
+}
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionArea is a part of the server that users log in to with a form, and
+// that is served under "/" + name: the mgmt interface for administrators, and
+// the account pages for LFS users.
+type sessionArea struct {
+	app    *App
+	name   string
+	cookie string
+	// enabled reports whether anyone can log in.
+	enabled func() bool
+	// authenticate checks the credentials posted to the login form and
+	// returns the user's role in the area, or an empty string if they are
+	// not valid.
+	authenticate func(user, pass string) (string, error)
+	// role returns the role of user in the area, or an empty string if they
+	// can no longer use it.
+	role func(user string) (string, error)
+	// basicAuth, if set, guards GET requests that use basic auth instead of
+	// a session.
+	basicAuth func(role string, h http.HandlerFunc) http.HandlerFunc
+}
+
+func (s *sessionArea) path() string {
+	return "/" + s.name
+}
+
+// set sends the cookie holding sess.
+func (s *sessionArea) set(w http.ResponseWriter, sess *session) error {
+	key, err := s.app.sessionSecret()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	http.SetCookie(w, s.cookieFor(payload+"."+sign(key, payload), 0))
+	return nil
+}
+
+// clear tells the browser to drop the session cookie.
+func (s *sessionArea) clear(w http.ResponseWriter) {
+	http.SetCookie(w, s.cookieFor("", -1))
+}
+
+// cookieFor returns the session cookie with value. Browsers only send it to
+// the area, never along with requests from other sites, and only over HTTPS
+// when the server uses it.
+func (s *sessionArea) cookieFor(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.cookie,
+		Value:    value,
+		Path:     s.path(),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   Config.IsHTTPS(),
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// session returns the valid session of r, or nil if it has none: the cookie
+// must be signed with the server's key for the area, and the session must not
+// be idle for longer than LFS_SESSIONTIMEOUT, older than sessionMaxAge, ended
+// by logging out, or held by someone who can no longer use the area.
+func (s *sessionArea) session(r *http.Request) (*session, error) {
+	cookie, err := r.Cookie(s.cookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	key, err := s.app.sessionSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(key, payload))) {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil
+	}
+	var sess session
+	if err := json.Unmarshal(data, &sess); err != nil || sess.Area != s.name {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if now.Sub(sess.Seen) > Config.SessionTimeoutDuration() || now.Sub(sess.Created) > sessionMaxAge {
+		return nil, nil
+	}
+	if sess.Role, err = s.role(sess.User); err != nil || sess.Role == "" {
+		return nil, err
+	}
+
+	ended, err := s.app.metaStore.SessionsEnded(s.name, sess.User)
+	if err != nil {
+		return nil, err
+	}
+	if !sess.Created.After(ended) {
+		return nil, nil
+	}
+	return &sess, nil
+}
+
+// requestSession returns the session of a request let through by a session
+// area, or nil if it used basic auth.
+func requestSession(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionKey{}).(*session)
+	return s
+}
+
+type sessionKey struct{}
+
+// validCSRF reports whether r posted the CSRF token of s.
+func validCSRF(s *session, r *http.Request) bool {
+	token := r.PostFormValue(csrfField)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
+
+// require guards a page of the area. Requests need the session cookie set by
+// the login form, and POST requests also need the session's CSRF token;
+// browsers without a session are sent to the login form. The user must have a
+// role granting what role does, unless role is empty.
+func (s *sessionArea) require(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.enabled() {
+			writeStatus(w, r, 404)
+			return
+		}
+
+		sess, err := s.session(r)
+		if err != nil {
+			logger.Log(kv{"fn": "requireSession", "area": s.name, "err": err.Error()})
+			writeStatus(w, r, 500)
+			return
+		}
+
+		if sess == nil {
+			readOnly := r.Method == "GET" || r.Method == "HEAD"
+			if _, _, ok := r.BasicAuth(); ok && readOnly && s.basicAuth != nil {
+				s.basicAuth(role, h)(w, r)
+				return
+			}
+
+			if readOnly {
+				http.Redirect(w, r, s.path()+"/login?next="+url.QueryEscape(r.URL.RequestURI()), 302)
+				return
+			}
+			writeStatus(w, r, 403)
+			return
+		}
+
+		if r.Method == "POST" && !validCSRF(sess, r) {
+			writeStatus(w, r, 403)
+			return
+		}
+		if role != "" && !roleAllows(sess.Role, role) {
+			writeStatus(w, r, 403)
+			return
+		}
+
+		if time.Since(sess.Seen) > sessionRefresh {
+			sess.Seen = time.Now().UTC()
+			if err := s.set(w, sess); err != nil {
+				logger.Log(kv{"fn": "requireSession", "area": s.name, "err": err.Error()})
+			}
+		}
+
+		r = withRole(withUser(r, sess.User), sess.Role)
+		r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, sess))
+		h(w, r)
+		logRequest(r, 200)
+	}
+}
+
+// next returns where to go after logging in: the page of the area the user
+// was sent to the login form from, or the area's first page.
+func (s *sessionArea) next(next string) string {
+	if next == s.path() || (strings.HasPrefix(next, s.path()+"/") && !strings.HasPrefix(next, s.path()+"/login")) {
+		return next
+	}
+	return s.path()
+}
+
+// loginForm shows the login form.
+func (s *sessionArea) loginForm(w http.ResponseWriter, r *http.Request) {
+	if !s.enabled() {
+		writeStatus(w, r, 404)
+		return
+	}
+
+	if err := render(w, r, "login.tmpl", pageData{Name: "login", Area: s.name, Path: s.next(r.FormValue("next"))}); err != nil {
+		writeStatus(w, r, 404)
+	}
+}
+
+// login starts a session for the user and redirects to the page the login
+// form was shown for.
+func (s *sessionArea) login(w http.ResponseWriter, r *http.Request) {
+	if !s.enabled() {
+		writeStatus(w, r, 404)
+		return
+	}
+
+	user, pass := r.PostFormValue("user"), r.PostFormValue("password")
+	next := s.next(r.PostFormValue("next"))
+	auditEntry(r).Target = user
+
+	role, err := s.authenticate(user, pass)
+	if err != nil {
+		mgmtError(w, r, "Error checking credentials: %s", err)
+		return
+	}
+	if role == "" {
+		s.app.publish(&Event{Type: eventAuthFailed, User: user, Status: 401, RemoteAddr: r.RemoteAddr})
+		w.WriteHeader(http.StatusUnauthorized)
+		if err := render(w, r, "login.tmpl", pageData{Name: "login", Area: s.name, Path: next, Error: "Invalid user name or password"}); err != nil {
+			logger.Log(kv{"fn": "login", "area": s.name, "err": err.Error()})
+		}
+		return
+	}
+
+	if err := s.set(w, newSession(s.name, user)); err != nil {
+		mgmtError(w, r, "Error starting session: %s", err)
+		return
+	}
+	auditEntry(r).Actor = user
+
+	http.Redirect(w, r, next, 302)
+}
+
+// logout ends every session of the user in the area and returns to the login
+// form.
+func (s *sessionArea) logout(w http.ResponseWriter, r *http.Request) {
+	if err := s.app.metaStore.EndSessions(s.name, requestUser(r), time.Now()); err != nil {
+		mgmtError(w, r, "Error ending session: %s", err)
+		return
+	}
+	s.clear(w)
+
+	http.Redirect(w, r, s.path()+"/login", 302)
+}
+
+// newMgmtArea returns the mgmt interface, used by administrators. GET requests
+// may also authenticate with basic auth, for scripts.
+func newMgmtArea(a *App) *sessionArea {
+	return &sessionArea{
+		app:          a,
+		name:         "mgmt",
+		cookie:       "lfs_mgmt_session",
+		enabled:      a.adminEnabled,
+		authenticate: a.authenticateAdmin,
+		role:         a.adminRole,
+		basicAuth:    a.adminAuth,
+	}
+}
+
+// requireSession guards a page of the mgmt interface, which the administrator
+// must have a role granting what role does to use.
+func (a *App) requireSession(role string, h http.HandlerFunc) http.HandlerFunc {
+	return a.mgmt.require(role, h)
+}
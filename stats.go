@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// statsBucket holds running totals of the objects in the meta store, kept up
+// to date by Put and Delete so they don't need a scan of the objects:
+//
+//	objects: number of objects (int64 BE)
+//	bytes:   sum of their sizes (int64 BE)
+//
+// The number of objects charged to each repository and user is kept next to
+// their bytes in usageBucket, under objectCountKey.
+var (
+	statsObjectsKey = []byte("objects")
+	statsBytesKey   = []byte("bytes")
+)
+
+// StoreStats are the totals of the objects in the meta store.
+type StoreStats struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// countObject adds delta objects of size bytes each to the totals.
+func countObject(tx *bolt.Tx, size, delta int64) error {
+	bucket := tx.Bucket(statsBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	if err := putInt64(bucket, statsObjectsKey, getInt64(bucket, statsObjectsKey)+delta); err != nil {
+		return err
+	}
+	return putInt64(bucket, statsBytesKey, getInt64(bucket, statsBytesKey)+size*delta)
+}
+
+// StoreStats returns the number of objects in the meta store and their size.
+func (s *MetaStore) StoreStats() (*StoreStats, error) {
+	stats := &StoreStats{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		stats.Objects = getInt64(bucket, statsObjectsKey)
+		stats.Bytes = getInt64(bucket, statsBytesKey)
+		return nil
+	})
+	return stats, err
+}
+
+// migrateObjectCounts computes the object totals, and the object counts of
+// repositories and users from the storage charged to them.
+func migrateObjectCounts(tx *bolt.Tx) error {
+	stats := tx.Bucket(statsBucket)
+	for _, key := range [][]byte{statsObjectsKey, statsBytesKey} {
+		if err := stats.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	err := tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+		meta, err := decodeObject(v)
+		if err != nil {
+			return err
+		}
+		return countObject(tx, meta.Size, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	usage := tx.Bucket(usageBucket)
+	var counts [][]byte
+	prefix := []byte("objects:")
+	c := usage.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		counts = append(counts, k)
+	}
+	for _, k := range counts {
+		if err := usage.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(chargesBucket).ForEach(func(k, v []byte) error {
+		var c objectCharge
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		return countCharge(usage, &c, 1)
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Access tokens are passwords users create for their LFS clients, so that
+// their account password doesn't need to be stored on every machine, and each
+// machine can be revoked on its own. They are kept in a bucket per user in
+// tokensBucket:
+//
+//	{user} -> {id} -> JSON AccessToken
+//
+// Only the SHA-256 of a token is stored; the token itself is shown once, when
+// it is created.
+const (
+	// tokenPrefix starts every token, so that they are told apart from
+	// passwords without looking them up.
+	tokenPrefix = "lfs_"
+	// tokenUsedInterval is how often the last use of a token is recorded.
+	tokenUsedInterval = time.Hour
+	// maxTokens is how many tokens a user may have.
+	maxTokens = 50
+)
+
+var (
+	errTokenNotFound = errors.New("Token not found")
+	errTooManyTokens = errors.New("Too many tokens")
+)
+
+// AccessToken describes an access token.
+type AccessToken struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken creates an access token for user, and returns it along with the
+// token itself.
+func (s *MetaStore) CreateToken(user, name string) (*AccessToken, string, error) {
+	var secret [20]byte
+	var id [4]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(secret[:])
+	t := &AccessToken{Id: hex.EncodeToString(id[:]), Name: name, Hash: hashToken(token), Created: time.Now().UTC()}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if tx.Bucket(usersBucket).Get([]byte(user)) == nil {
+			return errUserNotFound
+		}
+		if len(userTokens(bucket, user)) >= maxTokens {
+			return errTooManyTokens
+		}
+
+		tokens, err := bucket.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return tokens.Put([]byte(t.Id), data)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return t, token, nil
+}
+
+// userTokens returns the tokens of user, skipping any that can't be decoded.
+func userTokens(bucket *bolt.Bucket, user string) []*AccessToken {
+	var tokens []*AccessToken
+	if b := bucket.Bucket([]byte(user)); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			var t AccessToken
+			if err := json.Unmarshal(v, &t); err == nil {
+				tokens = append(tokens, &t)
+			}
+			return nil
+		})
+	}
+	return tokens
+}
+
+// Tokens returns the access tokens of user, newest first.
+func (s *MetaStore) Tokens(user string) ([]*AccessToken, error) {
+	var tokens []*AccessToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		tokens = userTokens(bucket, user)
+		return nil
+	})
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, err
+}
+
+// RevokeToken deletes the access token of user with id.
+func (s *MetaStore) RevokeToken(user, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		tokens := bucket.Bucket([]byte(user))
+		if tokens == nil || tokens.Get([]byte(id)) == nil {
+			return errTokenNotFound
+		}
+		return tokens.Delete([]byte(id))
+	})
+}
+
+// RevokeTokens deletes every access token of user.
+func (s *MetaStore) RevokeTokens(user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteTokens(tx, user)
+	})
+}
+
+// deleteTokens deletes every access token of user.
+func deleteTokens(tx *bolt.Tx, user string) error {
+	bucket := tx.Bucket(tokensBucket)
+	if bucket.Bucket([]byte(user)) == nil {
+		return nil
+	}
+	return bucket.DeleteBucket([]byte(user))
+}
+
+// checkToken reports whether token is an access token of user, and records
+// its use.
+func (s *MetaStore) checkToken(user, token string) bool {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return false
+	}
+
+	hash := []byte(hashToken(token))
+	var found *AccessToken
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		for _, t := range userTokens(bucket, user) {
+			if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 {
+				found = t
+			}
+		}
+		return nil
+	})
+	if found == nil {
+		return false
+	}
+
+	if now := time.Now().UTC(); now.Sub(found.LastUsed) > tokenUsedInterval {
+		found.LastUsed = now
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			tokens := tx.Bucket(tokensBucket).Bucket([]byte(user))
+			if tokens == nil || tokens.Get([]byte(found.Id)) == nil {
+				return nil
+			}
+			data, err := json.Marshal(found)
+			if err != nil {
+				return err
+			}
+			return tokens.Put([]byte(found.Id), data)
+		})
+		if err != nil {
+			logger.Log(kv{"fn": "checkToken", "err": err.Error()})
+		}
+	}
+	return true
+}
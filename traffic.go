@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Traffic is kept in trafficBucket as hourly counts per repository and user:
+//
+//	hour (unix hours, uint64 BE) kind ":" name -> JSON TrafficCounts
+//
+// where kind is quotaRepo or quotaUser. Every transfer is counted once for
+// its repository and once for its user, so the repository counts of an hour
+// add up to its total.
+const (
+	// trafficFlushInterval is how often buffered traffic is written to the
+	// meta store.
+	trafficFlushInterval = 5 * time.Second
+	// trafficRetention is how long hourly traffic is kept.
+	trafficRetention = 31 * 24 * time.Hour
+)
+
+// TrafficCounts are the uploads and downloads of a repository or user.
+type TrafficCounts struct {
+	Name          string `json:"name,omitempty"`
+	Uploads       int64  `json:"uploads"`
+	UploadBytes   int64  `json:"upload_bytes"`
+	Downloads     int64  `json:"downloads"`
+	DownloadBytes int64  `json:"download_bytes"`
+}
+
+// Bytes returns the bytes uploaded and downloaded.
+func (c *TrafficCounts) Bytes() int64 {
+	return c.UploadBytes + c.DownloadBytes
+}
+
+func (c *TrafficCounts) add(o *TrafficCounts) {
+	c.Uploads += o.Uploads
+	c.UploadBytes += o.UploadBytes
+	c.Downloads += o.Downloads
+	c.DownloadBytes += o.DownloadBytes
+}
+
+func trafficHour(t time.Time) uint64 {
+	return uint64(t.Unix() / 3600)
+}
+
+// trafficHourKey is the prefix of the traffic keys of hour.
+func trafficHourKey(hour uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, hour)
+	return key
+}
+
+func trafficKey(hour uint64, kind, name string) []byte {
+	return append(trafficHourKey(hour), usageKey(kind, name)...)
+}
+
+// trafficRecorder buffers the traffic of published events in memory and
+// writes it to the meta store periodically, like downloadRecorder.
+type trafficRecorder struct {
+	store *MetaStore
+
+	mu      sync.Mutex
+	pending map[string]*TrafficCounts
+}
+
+// newTrafficRecorder creates a trafficRecorder that flushes to store every
+// interval, and drops traffic older than trafficRetention every hour.
+func newTrafficRecorder(store *MetaStore, interval time.Duration) *trafficRecorder {
+	r := &trafficRecorder{store: store, pending: make(map[string]*TrafficCounts)}
+	go r.loop(interval)
+	return r
+}
+
+// Record counts the transfer of e, if it is an uploaded object or a finished
+// download.
+func (r *trafficRecorder) Record(e *Event) {
+	var counts TrafficCounts
+	switch {
+	case e.Type == eventObjectUploaded && e.Object != nil:
+		counts.Uploads, counts.UploadBytes = 1, e.Object.Size
+	case e.Type == eventTransferFinished && e.Operation == "download" && e.Status < 400:
+		counts.Downloads, counts.DownloadBytes = 1, e.Bytes
+	default:
+		return
+	}
+
+	hour := trafficHour(e.Time)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range [][]byte{trafficKey(hour, quotaRepo, e.Repo), trafficKey(hour, quotaUser, e.User)} {
+		r.merge(string(key), &counts)
+	}
+}
+
+// merge adds counts to the pending traffic under key. The caller holds r.mu.
+func (r *trafficRecorder) merge(key string, counts *TrafficCounts) {
+	c, ok := r.pending[key]
+	if !ok {
+		c = &TrafficCounts{}
+		r.pending[key] = c
+	}
+	c.add(counts)
+}
+
+// Flush writes the buffered traffic to the meta store.
+func (r *trafficRecorder) Flush() error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*TrafficCounts)
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	err := r.store.RecordTraffic(pending)
+	if err != nil {
+		// Keep the traffic for the next flush.
+		r.mu.Lock()
+		for key, counts := range pending {
+			r.merge(key, counts)
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *trafficRecorder) loop(interval time.Duration) {
+	var pruned uint64
+	for now := range time.Tick(interval) {
+		if err := r.Flush(); err != nil {
+			logger.Log(kv{"fn": "trafficRecorder", "err": err.Error()})
+		}
+
+		if hour := trafficHour(now); hour != pruned {
+			if err := r.store.PruneTraffic(now.Add(-trafficRetention)); err != nil {
+				logger.Log(kv{"fn": "trafficRecorder", "err": err.Error()})
+			}
+			pruned = hour
+		}
+	}
+}
+
+// RecordTraffic adds the counts in pending, keyed by trafficKey, to the stored
+// traffic in a single transaction.
+func (s *MetaStore) RecordTraffic(pending map[string]*TrafficCounts) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(trafficBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		for key, counts := range pending {
+			var stored TrafficCounts
+			if value := bucket.Get([]byte(key)); value != nil {
+				if err := json.Unmarshal(value, &stored); err != nil {
+					return err
+				}
+			}
+			stored.add(counts)
+
+			data, err := json.Marshal(&stored)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PruneTraffic drops the traffic of the hours before cutoff.
+func (s *MetaStore) PruneTraffic(cutoff time.Time) error {
+	limit := trafficHourKey(trafficHour(cutoff))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(trafficBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var old [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+			old = append(old, k)
+		}
+		for _, k := range old {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TrafficReport sums the traffic from the start of the hour of Since until
+// Until.
+type TrafficReport struct {
+	Since time.Time        `json:"since"`
+	Until time.Time        `json:"until"`
+	Total TrafficCounts    `json:"total"`
+	Repos []*TrafficCounts `json:"repos"`
+	Users []*TrafficCounts `json:"users"`
+}
+
+// UploadRate returns the average bytes uploaded per second.
+func (r *TrafficReport) UploadRate() int64 {
+	return r.rate(r.Total.UploadBytes)
+}
+
+// DownloadRate returns the average bytes downloaded per second.
+func (r *TrafficReport) DownloadRate() int64 {
+	return r.rate(r.Total.DownloadBytes)
+}
+
+func (r *TrafficReport) rate(n int64) int64 {
+	seconds := int64(r.Until.Sub(r.Since) / time.Second)
+	if seconds <= 0 {
+		return 0
+	}
+	return n / seconds
+}
+
+// Traffic returns the traffic of the hours since since, with the repositories
+// and users sorted by the bytes they transferred.
+func (s *MetaStore) Traffic(since time.Time) (*TrafficReport, error) {
+	hour := trafficHour(since)
+	report := &TrafficReport{Since: time.Unix(int64(hour)*3600, 0).UTC(), Until: time.Now().UTC()}
+	repos := make(map[string]*TrafficCounts)
+	users := make(map[string]*TrafficCounts)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(trafficBucket).Cursor()
+		for k, v := c.Seek(trafficHourKey(hour)); k != nil; k, v = c.Next() {
+			var counts TrafficCounts
+			if err := json.Unmarshal(v, &counts); err != nil {
+				return err
+			}
+
+			byName := users
+			kind, name, _ := strings.Cut(string(k[8:]), ":")
+			if kind == quotaRepo {
+				byName = repos
+				report.Total.add(&counts)
+			}
+			if byName[name] == nil {
+				byName[name] = &TrafficCounts{Name: name}
+			}
+			byName[name].add(&counts)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Repos = sortTraffic(repos)
+	report.Users = sortTraffic(users)
+	return report, nil
+}
+
+// sortTraffic returns the counts sorted by bytes transferred, then by name.
+func sortTraffic(byName map[string]*TrafficCounts) []*TrafficCounts {
+	sorted := make([]*TrafficCounts, 0, len(byName))
+	for _, c := range byName {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Bytes() != sorted[j].Bytes() {
+			return sorted[i].Bytes() > sorted[j].Bytes()
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraffic(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	now := time.Now()
+	recorder := &trafficRecorder{store: metaStoreTest, pending: make(map[string]*TrafficCounts)}
+	for _, e := range []*Event{
+		{Type: eventObjectUploaded, Repo: "art", User: testUser, Time: now, Object: &EventObject{Oid: contentOid, Size: 300}},
+		{Type: eventTransferFinished, Operation: "download", Repo: "art", User: testUser1, Time: now, Bytes: 300, Status: 200},
+		{Type: eventTransferFinished, Operation: "download", Repo: "docs", User: testUser1, Time: now, Bytes: 20, Status: 206},
+		{Type: eventTransferFinished, Operation: "download", Repo: "docs", User: testUser1, Time: now, Status: 404},
+		{Type: eventTransferFinished, Operation: "upload", Repo: "docs", User: testUser1, Time: now, Bytes: 20, Status: 200},
+		{Type: eventObjectUploaded, Repo: "old", User: testUser, Time: now.Add(-40 * 24 * time.Hour), Object: &EventObject{Oid: contentOid, Size: 5}},
+	} {
+		recorder.Record(e)
+	}
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("expected Flush to succeed, got: %s", err)
+	}
+
+	report, err := metaStoreTest.Traffic(now.Add(-23 * time.Hour))
+	if err != nil {
+		t.Fatalf("expected Traffic to succeed, got: %s", err)
+	}
+	want := TrafficCounts{Uploads: 1, UploadBytes: 300, Downloads: 2, DownloadBytes: 320}
+	if report.Total != want {
+		t.Errorf("expected total traffic %+v, got %+v", want, report.Total)
+	}
+	if len(report.Repos) != 2 || report.Repos[0].Name != "art" || report.Repos[1].Name != "docs" {
+		t.Errorf("expected the repositories by bytes transferred, got %+v", report.Repos)
+	}
+	if len(report.Users) != 2 || report.Users[0].Name != testUser1 || report.Users[0].Downloads != 2 {
+		t.Errorf("expected the users by bytes transferred, got %+v", report.Users)
+	}
+
+	if err := metaStoreTest.PruneTraffic(now.Add(-trafficRetention)); err != nil {
+		t.Fatalf("expected PruneTraffic to succeed, got: %s", err)
+	}
+	report, err = metaStoreTest.Traffic(now.Add(-60 * 24 * time.Hour))
+	if err != nil || report.Total.Uploads != 1 {
+		t.Errorf("expected the old traffic to be pruned, got %+v: %v", report.Total, err)
+	}
+}
+
+func TestTrafficRecorderKeepsFailedFlush(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	r := &trafficRecorder{store: metaStoreTest, pending: make(map[string]*TrafficCounts)}
+	e := &Event{Type: eventObjectUploaded, Repo: "art", User: testUser, Time: time.Now(), Object: &EventObject{Oid: contentOid, Size: 300}}
+	r.Record(e)
+
+	metaStoreTest.db.Close()
+	if err := r.Flush(); err == nil {
+		t.Fatal("expected Flush to fail with the meta store closed")
+	}
+	r.Record(e)
+
+	c := r.pending[string(trafficKey(trafficHour(e.Time), quotaRepo, "art"))]
+	if c == nil || c.Uploads != 2 || c.UploadBytes != 600 {
+		t.Errorf("expected the failed flush to be kept with the new upload, got %+v", c)
+	}
+}
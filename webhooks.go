@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// webhookPollInterval is how often due deliveries are looked for when
+	// no new event wakes the dispatcher.
+	webhookPollInterval = 5 * time.Second
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is how many times a delivery is tried before it
+	// is marked as failed.
+	webhookMaxAttempts = 8
+	// webhookRetryBase is the delay before the first retry. It doubles with
+	// every attempt, up to webhookRetryMax.
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+	// webhookDeliveryLogSize is how many finished deliveries are kept.
+	webhookDeliveryLogSize = 1000
+	// webhookDeliveryPageSize is the number of deliveries shown in mgmt.
+	webhookDeliveryPageSize = 100
+	// webhookQueueSize is how many events may wait to be queued for the
+	// webhooks before publishing them queues them on the caller's goroutine.
+	webhookQueueSize = 1024
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+var errWebhookNotFound = errors.New("Webhook not found")
+
+// Webhook posts events to URL. A webhook without a Repo receives the events
+// of every repository, and one without Events receives every event type.
+type Webhook struct {
+	Id        string    `json:"id"`
+	Repo      string    `json:"repo,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (h *Webhook) wants(e *Event) bool {
+	if h.Repo != "" && h.Repo != e.Repo {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature of payload sent in the X-LFS-Signature header:
+// the hex HMAC-SHA256 of the payload keyed with the webhook's secret.
+func (h *Webhook) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivery is an event queued for, or sent to, a webhook.
+type Delivery struct {
+	Id           uint64          `json:"id"`
+	WebhookId    string          `json:"webhook_id"`
+	URL          string          `json:"url"`
+	Event        string          `json:"event"`
+	Repo         string          `json:"repo,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+	ResponseCode int             `json:"response_code,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	DeliveredAt  time.Time       `json:"delivered_at,omitempty"`
+}
+
+// Webhooks returns all webhooks.
+func (s *MetaStore) Webhooks() ([]*Webhook, error) {
+	var hooks []*Webhook
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhooksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var h Webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			hooks = append(hooks, &h)
+			return nil
+		})
+	})
+	return hooks, err
+}
+
+// AddWebhook stores a new webhook and assigns its id.
+func (s *MetaStore) AddWebhook(h *Webhook) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook URL: %q", h.URL)
+	}
+
+	h.Id = randomEventId()
+	h.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhooksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put([]byte(h.Id), data)
+	})
+}
+
+// DeleteWebhook removes the webhook with id. Its pending deliveries fail.
+func (s *MetaStore) DeleteWebhook(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhooksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func webhook(tx *bolt.Tx, id string) (*Webhook, error) {
+	data := tx.Bucket(webhooksBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	var h Webhook
+	return &h, json.Unmarshal(data, &h)
+}
+
+// EnqueueDeliveries queues e, encoded as payload, for every webhook that wants
+// it and returns the number of deliveries queued. The oldest finished
+// deliveries beyond webhookDeliveryLogSize are dropped.
+func (s *MetaStore) EnqueueDeliveries(e *Event, payload []byte) (int, error) {
+	// Most events have no webhook, so look for one before taking the write
+	// lock.
+	var hooks []*Webhook
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			var h Webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			if h.wants(e) {
+				hooks = append(hooks, &h)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(hooks) == 0 {
+		return 0, err
+	}
+
+	n := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(deliveriesBucket)
+		var seq uint64
+		var err error
+		for _, h := range hooks {
+			if seq, err = deliveries.NextSequence(); err != nil {
+				return err
+			}
+
+			d := &Delivery{
+				Id:          seq,
+				WebhookId:   h.Id,
+				URL:         h.URL,
+				Event:       e.Type,
+				Repo:        e.Repo,
+				Payload:     payload,
+				Status:      deliveryPending,
+				NextAttempt: e.Time,
+				CreatedAt:   e.Time,
+			}
+			if err := putDelivery(tx, d); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return pruneDeliveries(tx, seq)
+	})
+	return n, err
+}
+
+// putDelivery stores d and keeps the pending index in step with its status.
+func putDelivery(tx *bolt.Tx, d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(deliveriesBucket).Put(seqKey(d.Id), data); err != nil {
+		return err
+	}
+	if d.Status == deliveryPending {
+		return tx.Bucket(pendingDeliveriesBucket).Put(seqKey(d.Id), nil)
+	}
+	return tx.Bucket(pendingDeliveriesBucket).Delete(seqKey(d.Id))
+}
+
+// pruneDeliveries drops finished deliveries older than the newest
+// webhookDeliveryLogSize, given the id of the newest delivery.
+func pruneDeliveries(tx *bolt.Tx, newest uint64) error {
+	if newest <= webhookDeliveryLogSize {
+		return nil
+	}
+	limit := seqKey(newest - webhookDeliveryLogSize)
+
+	pending := tx.Bucket(pendingDeliveriesBucket)
+	var old [][]byte
+	c := tx.Bucket(deliveriesBucket).Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, limit) <= 0; k, _ = c.Next() {
+		if pending.Get(k) == nil {
+			old = append(old, k)
+		}
+	}
+
+	for _, k := range old {
+		if err := tx.Bucket(deliveriesBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliveries returns up to limit of the most recent deliveries, newest first.
+func (s *MetaStore) Deliveries(limit int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deliveriesBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(deliveries) < limit; k, v = c.Prev() {
+			var d Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, &d)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// dueDeliveries returns the pending deliveries whose next attempt is due at
+// now, with their webhooks. The webhook is nil if it has been deleted.
+func (s *MetaStore) dueDeliveries(now time.Time) ([]*Delivery, []*Webhook, error) {
+	var deliveries []*Delivery
+	var hooks []*Webhook
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		return tx.Bucket(pendingDeliveriesBucket).ForEach(func(k, v []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(bucket.Get(k), &d); err != nil {
+				return err
+			}
+			if d.NextAttempt.After(now) {
+				return nil
+			}
+
+			h, err := webhook(tx, d.WebhookId)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, &d)
+			hooks = append(hooks, h)
+			return nil
+		})
+	})
+	return deliveries, hooks, err
+}
+
+// SaveDelivery stores the outcome of a delivery attempt.
+func (s *MetaStore) SaveDelivery(d *Delivery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putDelivery(tx, d)
+	})
+}
+
+// Redeliver queues the delivery with id to be sent again right away.
+func (s *MetaStore) Redeliver(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(deliveriesBucket).Get(seqKey(id))
+		if data == nil {
+			return fmt.Errorf("Delivery %d not found", id)
+		}
+
+		var d Delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+
+		h, err := webhook(tx, d.WebhookId)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			return errWebhookNotFound
+		}
+
+		d.Status = deliveryPending
+		d.Attempts = 0
+		d.NextAttempt = time.Now().UTC()
+		d.Error = ""
+		return putDelivery(tx, &d)
+	})
+}
+
+// webhookDispatcher sends queued deliveries to their webhooks, retrying
+// failures with exponential backoff.
+type webhookDispatcher struct {
+	store  *MetaStore
+	client *http.Client
+	wake   chan struct{}
+	queue  chan *Event
+
+	mu sync.Mutex
+}
+
+// newWebhookDispatcher creates a webhookDispatcher that looks for due
+// deliveries every interval and whenever an event is queued.
+func newWebhookDispatcher(store *MetaStore, interval time.Duration) *webhookDispatcher {
+	d := &webhookDispatcher{
+		store:  store,
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+		queue:  make(chan *Event, webhookQueueSize),
+	}
+	go d.loop(interval)
+	go d.queueLoop()
+	return d
+}
+
+// Publish hands e to the webhooks without waiting for it to be queued,
+// unless webhookQueueSize events are already waiting.
+func (d *webhookDispatcher) Publish(e *Event) {
+	select {
+	case d.queue <- e:
+	default:
+		if err := d.Enqueue(e); err != nil {
+			logger.Log(kv{"fn": "webhooks", "event": e.Type, "err": err.Error()})
+		}
+	}
+}
+
+func (d *webhookDispatcher) queueLoop() {
+	for e := range d.queue {
+		if err := d.Enqueue(e); err != nil {
+			logger.Log(kv{"fn": "webhooks", "event": e.Type, "err": err.Error()})
+		}
+	}
+}
+
+// Enqueue queues e for the webhooks that want it.
+func (d *webhookDispatcher) Enqueue(e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	n, err := d.store.EnqueueDeliveries(e, payload)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Redeliver queues a delivery to be sent again right away.
+func (d *webhookDispatcher) Redeliver(id uint64) error {
+	if err := d.store.Redeliver(id); err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// DeliverDue attempts every delivery that is due.
+func (d *webhookDispatcher) DeliverDue() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	deliveries, hooks, err := d.store.dueDeliveries(now)
+	if err != nil {
+		return err
+	}
+
+	for i, del := range deliveries {
+		d.attempt(del, hooks[i], now)
+		if err := d.store.SaveDelivery(del); err != nil {
+			return err
+		}
+		if del.Status != deliveryPending {
+			logger.Log(kv{"fn": "webhooks", "delivery": del.Id, "url": del.URL, "event": del.Event, "status": del.Status, "attempts": del.Attempts})
+		}
+	}
+	return nil
+}
+
+// attempt posts the delivery to the webhook and records the outcome in del.
+func (d *webhookDispatcher) attempt(del *Delivery, h *Webhook, now time.Time) {
+	if h == nil {
+		del.Status = deliveryFailed
+		del.Error = errWebhookNotFound.Error()
+		return
+	}
+
+	del.Attempts++
+	del.ResponseCode = 0
+	del.Error = ""
+
+	err := d.post(del, h)
+	if err == nil {
+		del.Status = deliveryDelivered
+		del.DeliveredAt = now
+		return
+	}
+
+	del.Error = err.Error()
+	if del.Attempts >= webhookMaxAttempts {
+		del.Status = deliveryFailed
+		return
+	}
+
+	delay := webhookRetryBase << uint(del.Attempts-1)
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	del.NextAttempt = now.Add(delay)
+}
+
+func (d *webhookDispatcher) post(del *Delivery, h *Webhook) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lfs-test-server/"+version)
+	req.Header.Set("X-LFS-Event", del.Event)
+	req.Header.Set("X-LFS-Delivery", fmt.Sprintf("%d", del.Id))
+	if h.Secret != "" {
+		req.Header.Set("X-LFS-Signature", h.sign(del.Payload))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	del.ResponseCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		}
+
+		if err := d.DeliverDue(); err != nil {
+			logger.Log(kv{"fn": "webhooks", "err": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookWants(t *testing.T) {
+	e := &Event{Type: eventLockCreated, Repo: "repo"}
+
+	cases := []struct {
+		hook Webhook
+		want bool
+	}{
+		{Webhook{}, true},
+		{Webhook{Repo: "repo"}, true},
+		{Webhook{Repo: "other"}, false},
+		{Webhook{Events: []string{eventLockCreated, eventLockReleased}}, true},
+		{Webhook{Repo: "repo", Events: []string{eventObjectUploaded}}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.hook.wants(e); got != c.want {
+			t.Errorf("expected %+v wants %s in %s to be %v", c.hook, e.Type, e.Repo, c.want)
+		}
+	}
+}
+
+func TestEnqueueDeliveriesWithoutWebhooks(t *testing.T) {
+	e := &Event{Type: eventLockCreated, Repo: "nohooks", Time: time.Now().UTC()}
+	if n, err := testMetaStore.EnqueueDeliveries(e, []byte(`{}`)); err != nil || n != 0 {
+		t.Fatalf("expected nothing to be queued, got %d: %v", n, err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	hook := &Webhook{Repo: "hookrepo", URL: receiver.URL, Secret: "s3cret", Events: []string{eventLockCreated}}
+	if err := testMetaStore.AddWebhook(hook); err != nil {
+		t.Fatalf("expected webhook to be added, got: %s", err)
+	}
+	defer testMetaStore.DeleteWebhook(hook.Id)
+
+	lock, err := createRefLock("/bilbo/hookrepo/locks", "textures/hero.png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDelivery(t, hook.Id, queued)
+	if err := lfsApp.webhooks.DeliverDue(); err != nil {
+		t.Fatalf("expected deliveries to be sent, got: %s", err)
+	}
+
+	var r *http.Request
+	var body []byte
+	select {
+	case r = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the webhook to be called")
+	}
+
+	if sig := r.Header.Get("X-LFS-Signature"); sig != hook.sign(body) {
+		t.Errorf("expected signature %s, got %s", hook.sign(body), sig)
+	}
+	if ev := r.Header.Get("X-LFS-Event"); ev != eventLockCreated {
+		t.Errorf("expected event header %s, got %s", eventLockCreated, ev)
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("expected payload to be an Event, got error: %s", err)
+	}
+	if e.Repo != "hookrepo" || e.User != testUser || e.Lock == nil || e.Lock.Id != lock.Id {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	d := waitDelivery(t, hook.Id, attempted)
+	if d.Status != deliveryDelivered || d.Attempts != 1 || d.ResponseCode != 200 {
+		t.Errorf("expected delivery to be delivered on the first attempt, got %+v", d)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		w.WriteHeader(500)
+	}))
+	defer receiver.Close()
+
+	hook := &Webhook{Repo: "retryrepo", URL: receiver.URL}
+	if err := testMetaStore.AddWebhook(hook); err != nil {
+		t.Fatalf("expected webhook to be added, got: %s", err)
+	}
+	defer testMetaStore.DeleteWebhook(hook.Id)
+
+	if _, err := createRefLock("/bilbo/retryrepo/locks", "retry.psd", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitDelivery(t, hook.Id, queued)
+	if err := lfsApp.webhooks.DeliverDue(); err != nil {
+		t.Fatalf("expected deliveries to be sent, got: %s", err)
+	}
+
+	d := waitDelivery(t, hook.Id, attempted)
+	if d.Status != deliveryPending || d.Attempts != 1 || d.ResponseCode != 500 {
+		t.Fatalf("expected delivery to be pending after a failed attempt, got %+v", d)
+	}
+	if !d.NextAttempt.After(time.Now()) {
+		t.Errorf("expected the retry to be delayed, next attempt at %s", d.NextAttempt)
+	}
+
+	// Not due yet.
+	if err := lfsApp.webhooks.DeliverDue(); err != nil {
+		t.Fatalf("expected deliveries to be sent, got: %s", err)
+	}
+	if n := len(calls); n != 1 {
+		t.Errorf("expected 1 call to the webhook, got %d", n)
+	}
+
+	if err := lfsApp.webhooks.Redeliver(d.Id); err != nil {
+		t.Fatalf("expected delivery to be redelivered, got: %s", err)
+	}
+	if err := lfsApp.webhooks.DeliverDue(); err != nil {
+		t.Fatalf("expected deliveries to be sent, got: %s", err)
+	}
+	waitDelivery(t, hook.Id, attempted)
+	if n := len(calls); n != 2 {
+		t.Errorf("expected 2 calls to the webhook, got %d", n)
+	}
+}
+
+// waitDelivery waits for the delivery to webhookId to satisfy done, since
+// events are queued for the webhooks and delivered in the background.
+func waitDelivery(t *testing.T, webhookId string, done func(*Delivery) bool) *Delivery {
+	t.Helper()
+
+	var last *Delivery
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		deliveries, err := testMetaStore.Deliveries(webhookDeliveryPageSize)
+		if err != nil {
+			t.Fatalf("expected deliveries, got error: %s", err)
+		}
+		for _, d := range deliveries {
+			if d.WebhookId == webhookId {
+				if last = d; done(d) {
+					return d
+				}
+			}
+		}
+	}
+	if last == nil {
+		t.Fatalf("expected a delivery to webhook %s", webhookId)
+	}
+	t.Fatalf("unexpected delivery to webhook %s: %+v", webhookId, last)
+	return nil
+}
+
+func queued(d *Delivery) bool { return true }
+
+func attempted(d *Delivery) bool { return d.Attempts > 0 }